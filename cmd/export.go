@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/ankorstore/mq-lease-service/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	exportCmd.Flags().String("data", "./data", "Persistent state directory")
+	exportCmd.Flags().String("storage-key-prefix", "", "Prefix of the storage keys (only the states of this namespace are exported)")
+
+	rootCmd.AddCommand(exportCmd)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Dumps the stored provider states as NDJSON (one JSON state per line), for backups",
+	RunE: func(cmd *cobra.Command, _ []string) (err error) {
+		persistentStateDir, _ := cmd.Flags().GetString("data")
+		storageKeyPrefix, _ := cmd.Flags().GetString("storage-key-prefix")
+		if err := storage.ValidateKeyPrefix(storageKeyPrefix); err != nil {
+			return err
+		}
+
+		// read-only, so a running server isn't disturbed
+		st := storage.NewReadOnly[*lease.ProviderState](cmd.Context(), persistentStateDir, storage.WithKeyPrefix(storageKeyPrefix))
+		if err := st.Init(); err != nil {
+			return fmt.Errorf("failed to open the storage: %w", err)
+		}
+		defer func() {
+			err = errors.Join(err, st.Close())
+		}()
+		iterator, ok := st.(storage.Iterator)
+		if !ok {
+			return errors.New("the storage can't be iterated")
+		}
+
+		out := cmd.OutOrStdout()
+		return iterator.Iterate(func(key string, value []byte) error {
+			// the states are re-encoded to JSON, whatever their storage encoding is
+			state := lease.NewProviderState(lease.NewProviderStateOpts{ID: key})
+			if err := state.Unmarshal(value); err != nil {
+				return fmt.Errorf("failed to read the state %s: %w", key, err)
+			}
+			line, err := state.ExportJSON()
+			if err != nil {
+				return fmt.Errorf("failed to export the state %s: %w", key, err)
+			}
+			_, err = out.Write(append(line, '\n'))
+			return err
+		})
+	},
+}
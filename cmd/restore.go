@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ankorstore/mq-lease-service/internal/storage"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	restoreCmd.Flags().String("data", "./data", "Persistent state directory to restore the backup into")
+	restoreCmd.Flags().String("from", "", "Backup file to restore (written on shutdown, see the server --storage-backup-dir flag)")
+	restoreCmd.Flags().Bool("force", false, "Overwrite the storage if it's not empty (all its states are dropped first)")
+	_ = restoreCmd.MarkFlagRequired("from")
+
+	rootCmd.AddCommand(restoreCmd)
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Rebuilds the storage from a backup written on shutdown, for disaster recovery (the server must be stopped)",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		persistentStateDir, _ := cmd.Flags().GetString("data")
+		from, _ := cmd.Flags().GetString("from")
+		force, _ := cmd.Flags().GetBool("force")
+
+		backup, err := os.Open(from)
+		if err != nil {
+			return fmt.Errorf("failed to open the backup: %w", err)
+		}
+		defer backup.Close()
+
+		err = storage.Restore(cmd.Context(), persistentStateDir, backup, force)
+		if errors.Is(err, storage.ErrNotEmpty) {
+			return fmt.Errorf("the storage %s is not empty, use --force to overwrite it", persistentStateDir)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(cmd.OutOrStdout(), "Restored %s into %s\n", from, persistentStateDir)
+		return err
+	},
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/ankorstore/mq-lease-service/internal/server"
 	"github.com/ankorstore/mq-lease-service/internal/version"
 	"github.com/ankorstore/mq-lease-service/pkg/util/logger"
@@ -15,10 +18,30 @@ import (
 
 func init() {
 	serverCmd.Flags().Uint("port", 8080, "server listening port")
-	serverCmd.Flags().String("config", "./config.yaml", "Configuration path")
+	serverCmd.Flags().String("config", "./config.yaml", "Configuration path (file, or directory of *.yaml files)")
 	serverCmd.Flags().String("data", "./data", "Persistent state directory")
 	serverCmd.Flags().Bool("log-debug", false, "Enable debug logging")
 	serverCmd.Flags().Bool("log-json", true, "Enable JSON format logging")
+	serverCmd.Flags().Uint32("log-debug-sample-burst", 0, "Max number of debug logs written per --log-debug-sample-period, the next ones being dropped (0 to disable the sampling)")
+	serverCmd.Flags().Duration("log-debug-sample-period", time.Second, "Period of the debug logs sampling (see --log-debug-sample-burst)")
+	serverCmd.Flags().Int("max-body-size", 1024*1024, "Max request body size (in bytes)")
+	serverCmd.Flags().Bool("compression", false, "Enable compression of the API responses (when supported by the client)")
+	serverCmd.Flags().String("mode", string(server.ModeWriter), "Server mode: writer, or follower (read-only, mutating requests are redirected to the writer)")
+	serverCmd.Flags().String("writer-url", "", "Base URL of the writer instance (follower mode only)")
+	serverCmd.Flags().String("storage-encoding", string(lease.StorageEncodingJSON), "Encoding of the states in the storage: json, or msgpack (more compact). States written with any of them can be read.")
+	serverCmd.Flags().Bool("allow-event-time", false, "Allow the acquire/release requests to carry an event_time, used instead of the current time (to replay historical events, not meant for production)")
+	serverCmd.Flags().Bool("allow-metrics-reset", false, "Expose the POST /_admin/metrics/reset route, resetting the application metrics (to isolate the test cases asserting on them, not meant for production)")
+	serverCmd.Flags().Duration("storage-gc-interval", 10*time.Minute, "Interval between 2 storage value log GC runs, reclaiming the disk space (0 to disable)")
+	serverCmd.Flags().Int("storage-open-retries", 5, "Number of retries to open the storage on startup (e.g. while its volume is being mounted)")
+	serverCmd.Flags().Duration("storage-open-retry-interval", 500*time.Millisecond, "Delay before the first retry to open the storage, doubled for each of the next ones (up to 30s)")
+	serverCmd.Flags().Bool("in-memory-storage", false, "Keep the states in memory only (--data is ignored), they are lost on shutdown (for the tests and the ephemeral runs)")
+	serverCmd.Flags().String("storage-backup-dir", "", "Directory a backup of the storage is written to on shutdown (one timestamped file per shutdown, disabled if empty)")
+	serverCmd.Flags().String("storage-key-prefix", "", "Prefix of the storage keys, to share the storage between several instances")
+	serverCmd.Flags().Bool("log-bodies", false, "Log (at debug level) the provider routes request bodies and response statuses, with the auth-related fields redacted")
+	serverCmd.Flags().Duration("follower-refresh-interval", 5*time.Second, "Interval between 2 state re-hydrations from the storage (follower mode only)")
+	serverCmd.Flags().Duration("request-timeout", 30*time.Second, "Max time spent handling a request, the handlers giving up are answered with a 503 once exceeded (0 to disable)")
+	serverCmd.Flags().String("tls-cert", "", "Path of the TLS certificate, to serve HTTPS (requires --tls-key)")
+	serverCmd.Flags().String("tls-key", "", "Path of the TLS private key, to serve HTTPS (requires --tls-cert)")
 
 	rootCmd.AddCommand(serverCmd)
 }
@@ -31,21 +54,68 @@ var serverCmd = &cobra.Command{
 		configPath, _ := cmd.Flags().GetString("config")
 		logDebug, _ := cmd.Flags().GetBool("log-debug")
 		logJSON, _ := cmd.Flags().GetBool("log-json")
+		logDebugSampleBurst, _ := cmd.Flags().GetUint32("log-debug-sample-burst")
+		logDebugSamplePeriod, _ := cmd.Flags().GetDuration("log-debug-sample-period")
+		if logDebugSampleBurst > 0 && logDebugSamplePeriod <= 0 {
+			return errors.New("--log-debug-sample-period must be positive when --log-debug-sample-burst is set")
+		}
 		persistentStateDir, _ := cmd.Flags().GetString("data")
+		compression, _ := cmd.Flags().GetBool("compression")
+		maxBodySize, _ := cmd.Flags().GetInt("max-body-size")
+		mode, _ := cmd.Flags().GetString("mode")
+		writerURL, _ := cmd.Flags().GetString("writer-url")
+		followerRefreshInterval, _ := cmd.Flags().GetDuration("follower-refresh-interval")
+		allowEventTime, _ := cmd.Flags().GetBool("allow-event-time")
+		logBodies, _ := cmd.Flags().GetBool("log-bodies")
+		allowMetricsReset, _ := cmd.Flags().GetBool("allow-metrics-reset")
+		storageGCInterval, _ := cmd.Flags().GetDuration("storage-gc-interval")
+		storageOpenRetries, _ := cmd.Flags().GetInt("storage-open-retries")
+		storageOpenRetryInterval, _ := cmd.Flags().GetDuration("storage-open-retry-interval")
+		storageKeyPrefix, _ := cmd.Flags().GetString("storage-key-prefix")
+		storageBackupDir, _ := cmd.Flags().GetString("storage-backup-dir")
+		inMemoryStorage, _ := cmd.Flags().GetBool("in-memory-storage")
+		requestTimeout, _ := cmd.Flags().GetDuration("request-timeout")
+		tlsCertFile, _ := cmd.Flags().GetString("tls-cert")
+		tlsKeyFile, _ := cmd.Flags().GetString("tls-key")
+		storageEncodingFlag, _ := cmd.Flags().GetString("storage-encoding")
+		storageEncoding, err := lease.ParseStorageEncoding(storageEncodingFlag)
+		if err != nil {
+			return err
+		}
 
 		// Logger
 		log := logger.New(logger.NewOpts{
-			AppInfo: version.Version{},
-			Debug:   logDebug,
-			JSON:    logJSON,
+			AppInfo:           version.Version{},
+			Debug:             logDebug,
+			JSON:              logJSON,
+			DebugSampleBurst:  logDebugSampleBurst,
+			DebugSamplePeriod: logDebugSamplePeriod,
 		})
 		ctx := log.WithContext(cmd.Context())
 
 		// Main server
 		srv := server.New(server.NewOpts{
-			Port:               int(serverPort),
-			ConfigPath:         configPath,
-			PersistentStateDir: persistentStateDir,
+			Port:                     int(serverPort),
+			ConfigPath:               configPath,
+			PersistentStateDir:       persistentStateDir,
+			Compression:              compression,
+			BodyLimit:                maxBodySize,
+			Mode:                     server.Mode(mode),
+			WriterURL:                writerURL,
+			FollowerRefreshInterval:  followerRefreshInterval,
+			StorageEncoding:          storageEncoding,
+			AllowEventTime:           allowEventTime,
+			LogBodies:                logBodies,
+			StorageGCInterval:        storageGCInterval,
+			StorageOpenRetries:       storageOpenRetries,
+			StorageOpenRetryInterval: storageOpenRetryInterval,
+			StorageKeyPrefix:         storageKeyPrefix,
+			StorageBackupDir:         storageBackupDir,
+			InMemoryStorage:          inMemoryStorage,
+			TLSCertFile:              tlsCertFile,
+			TLSKeyFile:               tlsKeyFile,
+			RequestTimeout:           requestTimeout,
+			AllowMetricsReset:        allowMetricsReset,
 		})
 
 		grp, runCtx := errgroup.WithContext(ctx)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/ankorstore/mq-lease-service/pkg/sim"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	simulateCmd.Flags().String("events", "./events.json", "Path of the JSON file holding the list of events to replay")
+	simulateCmd.Flags().Duration("stabilize-duration", 5*time.Minute, "Stabilize duration of the simulated provider")
+	simulateCmd.Flags().Duration("ttl", 30*time.Second, "TTL of the simulated provider requests")
+	simulateCmd.Flags().Int("expected-request-count", 4, "Expected request count of the simulated provider")
+	simulateCmd.Flags().Int("delay-assignment-count", 0, "Number of polls the lease assignment is delayed by")
+	simulateCmd.Flags().String("winner-selection", string(lease.WinnerSelectionHighest), "Winner selection mode (highest|lowest)")
+
+	rootCmd.AddCommand(simulateCmd)
+}
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Replays recorded acquire/release events against a lease provider and reports the granted leases",
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		eventsPath, _ := cmd.Flags().GetString("events")
+		stabilizeDuration, _ := cmd.Flags().GetDuration("stabilize-duration")
+		ttl, _ := cmd.Flags().GetDuration("ttl")
+		expectedRequestCount, _ := cmd.Flags().GetInt("expected-request-count")
+		delayAssignmentCount, _ := cmd.Flags().GetInt("delay-assignment-count")
+		winnerSelection, _ := cmd.Flags().GetString("winner-selection")
+		if err := lease.WinnerSelection(winnerSelection).Validate(); err != nil {
+			return err
+		}
+
+		raw, err := os.ReadFile(eventsPath)
+		if err != nil {
+			return fmt.Errorf("failed to read events: %w", err)
+		}
+		var events []sim.Event
+		if err := json.Unmarshal(raw, &events); err != nil {
+			return fmt.Errorf("failed to parse events: %w", err)
+		}
+
+		report, err := sim.Run(cmd.Context(), lease.ProviderOpts{
+			StabilizeDuration:    stabilizeDuration,
+			TTL:                  ttl,
+			ExpectedRequestCount: expectedRequestCount,
+			DelayAssignmentCount: delayAssignmentCount,
+			WinnerSelection:      lease.WinnerSelection(winnerSelection),
+			ID:                   "simulation",
+		}, events)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	},
+}
@@ -1,6 +1,7 @@
 package e2e_test
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -15,8 +16,10 @@ import (
 	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
 	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
 	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/ankorstore/mq-lease-service/internal/server"
+	"github.com/ankorstore/mq-lease-service/internal/server/middlewares"
 	. "github.com/onsi/ginkgo/v2" //nolint
 	. "github.com/onsi/gomega" //nolint
 	"golang.org/x/sync/errgroup"
@@ -31,6 +34,8 @@ var _ = Describe("API", Ordered, func() {
 	var now time.Time
 	var srv server.Server
 	var storageDir string
+	var serverOpts []serverHelper.Option
+	var configOpts []configHelper.HelperOption
 
 	var owner string
 	var repo string
@@ -52,11 +57,14 @@ var _ = Describe("API", Ordered, func() {
 	BeforeEach(func() {
 		// created a temporary storage dir (so that each test is working in isolation)
 		storageDir = storage.NewStorageDir()
+		// nested test cases can append server/config options in their own BeforeEach
+		serverOpts = nil
+		configOpts = nil
 	})
 
 	JustBeforeEach(func() {
 		// use the default configuration used in the config helper
-		_, configPath := config.LoadDefaultConfig()
+		_, configPath := config.LoadDefaultConfig(configOpts...)
 		owner = configHelper.DefaultConfigRepoOwner
 		repo = configHelper.DefaultConfigRepoName
 		baseRef = configHelper.DefaultConfigRepoBaseRef
@@ -64,7 +72,7 @@ var _ = Describe("API", Ordered, func() {
 		ctx, cancel := context.WithCancel(context.Background())
 		grp := errgroup.Group{}
 		// bootstrap a new server (will run the usual bootstrapping sequence, like starting the storage etc...)
-		srv = serverHelper.New(configPath, storageDir, clk)
+		srv = serverHelper.New(configPath, storageDir, clk, serverOpts...)
 		grp.Go(func() error {
 			return srv.RunTest(ctx)
 		})
@@ -155,6 +163,519 @@ var _ = Describe("API", Ordered, func() {
 		})
 	})
 
+	Describe("Version endpoint", func() {
+		It("should return the build information", func() {
+			resp, body := apiCall(srv, versionReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			payload := map[string]any{}
+			Expect(json.Unmarshal([]byte(body), &payload)).To(Succeed())
+			Expect(payload).To(HaveKey("app"))
+			Expect(payload).To(HaveKey("commit"))
+			Expect(payload).To(HaveKey("tag"))
+			Expect(payload).To(HaveKey("build_date"))
+		})
+	})
+
+	Describe("OpenAPI endpoint", func() {
+		It("should return the OpenAPI spec", func() {
+			resp, body := apiCall(srv, openAPIReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			spec := struct {
+				OpenAPI string                    `json:"openapi"`
+				Paths   map[string]map[string]any `json:"paths"`
+			}{}
+			Expect(json.Unmarshal([]byte(body), &spec)).To(Succeed())
+			Expect(spec.OpenAPI).To(HavePrefix("3."))
+			Expect(spec.Paths).To(HaveKeyWithValue("/", HaveKey("get")))
+			Expect(spec.Paths).To(HaveKeyWithValue("/{owner}/{repo}/{baseRef}", And(HaveKey("get"), HaveKey("delete"))))
+			Expect(spec.Paths).To(HaveKeyWithValue("/{owner}/{repo}/{baseRef}/acquire", HaveKey("post")))
+			Expect(spec.Paths).To(HaveKeyWithValue("/{owner}/{repo}/{baseRef}/release", HaveKey("post")))
+		})
+	})
+
+	Describe("Authentication", func() {
+		authConfig := func(protect ...string) string {
+			cfg := "auth:\n  basic:\n    users:\n      user: pass\n"
+			if len(protect) > 0 {
+				cfg += "  protect: [" + strings.Join(protect, ", ") + "]\n"
+			}
+			return cfg
+		}
+		withCredentials := func(req *http.Request) *http.Request {
+			req.SetBasicAuth("user", "pass")
+			return req
+		}
+
+		Context("with the default protected route groups", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig()))
+			})
+
+			It("should not protect the k8s probes, metrics and meta routes", func() {
+				for _, path := range []string{"/k8s/liveness", "/k8s/readiness", "/metrics", "/_meta/version"} {
+					resp, _ := apiCall(srv, httptest.NewRequest("GET", path, nil))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK), path)
+				}
+			})
+
+			It("should not protect the read-only routes", func() {
+				resp, _ := apiCall(srv, providerListReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, _ = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("should protect the mutating routes", func() {
+				resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				resp, _ = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-1", 1, "success"))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				resp, _ = apiCall(srv, providerClearReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+				resp, _ = apiCall(srv, withCredentials(acquireReq(owner, repo, baseRef, "xxx-1", 1)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("with API keys", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig("auth:\n  api_keys: [token-1, token-2]\n"))
+			})
+			withToken := func(req *http.Request, token string) *http.Request {
+				req.Header.Set("Authorization", "Bearer "+token)
+				return req
+			}
+
+			It("should accept any of the configured tokens", func() {
+				resp, _ := apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-1", 1), "token-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, _ = apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-2", 2), "token-2"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("should reject unknown tokens", func() {
+				resp, _ := apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-1", 1), "unknown"))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			})
+		})
+
+		Context("with both basic auth and API keys", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig()+"  api_keys: [token-1]\n"))
+			})
+
+			It("should accept both kinds of credentials", func() {
+				resp, _ := apiCall(srv, withCredentials(acquireReq(owner, repo, baseRef, "xxx-1", 1)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				req := acquireReq(owner, repo, baseRef, "xxx-2", 2)
+				req.Header.Set("Authorization", "Bearer token-1")
+				resp, _ = apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("with scoped credentials", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig(fmt.Sprintf(
+					"auth:\n  basic:\n    users:\n      user-a: pass-a\n      user-b: pass-b\n      admin: pass-admin\n  api_keys: [token-a]\n  scopes:\n    user-a: [%[1]s/%[2]s]\n    user-b: [other/repo]\n    token-a: [other/repo, %[1]s/%[2]s]\n",
+					configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName,
+				)))
+				serverOpts = append(serverOpts, serverHelper.WithAllowMetricsReset())
+			})
+
+			It("should allow the callers scoped to the repository", func() {
+				req := acquireReq(owner, repo, baseRef, "xxx-1", 1)
+				req.SetBasicAuth("user-a", "pass-a")
+				resp, _ := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				req = acquireReq(owner, repo, baseRef, "xxx-2", 2)
+				req.Header.Set("Authorization", "Bearer token-a")
+				resp, _ = apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("should forbid the callers not scoped to the repository", func() {
+				req := acquireReq(owner, repo, baseRef, "xxx-1", 1)
+				req.SetBasicAuth("user-b", "pass-b")
+				resp, body := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+				Expect(body).To(MatchJSON(`{"error": "not authorized to access this repository", "request_id": "e2e-request-id"}`))
+			})
+
+			It("should forbid the scoped callers on the administration routes", func() {
+				adminReqs := func() []*http.Request {
+					return []*http.Request{
+						drainReq(true),
+						drainReq(false),
+						acquiredLeasesReq(),
+						hydrationReq(),
+						exportReq(),
+						importReq("", true),
+						clearAllReq(true),
+						metricsResetReq(),
+					}
+				}
+				for _, req := range adminReqs() {
+					req.Header.Set("Authorization", "Bearer token-a")
+					resp, body := apiCall(srv, req)
+					Expect(resp.StatusCode).To(Equal(http.StatusForbidden), req.Method+" "+req.URL.Path)
+					Expect(body).To(MatchJSON(`{"error": "not authorized to access this route", "request_id": "e2e-request-id"}`))
+				}
+				for _, req := range adminReqs() {
+					req.SetBasicAuth("admin", "pass-admin")
+					resp, _ := apiCall(srv, req)
+					Expect(resp.StatusCode).NotTo(Equal(http.StatusForbidden), req.Method+" "+req.URL.Path)
+				}
+			})
+		})
+
+		Context("when the read-only routes are protected too", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig("read", "write")))
+			})
+
+			It("should protect the read-only routes", func() {
+				resp, _ := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				resp, _ = apiCall(srv, withCredentials(providerDetailsReq(owner, repo, baseRef)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("with the metrics auth", func() {
+			metricsReq := func() *http.Request {
+				return httptest.NewRequest("GET", "/metrics", nil)
+			}
+
+			Context("set to none", func() {
+				BeforeEach(func() {
+					configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig("read", "write")+"  metrics_auth: none\n"))
+				})
+
+				It("should not protect the metrics endpoint, even if the API is protected", func() {
+					resp, _ := apiCall(srv, metricsReq())
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					resp, _ = apiCall(srv, providerListReq())
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				})
+			})
+
+			Context("set to basic", func() {
+				BeforeEach(func() {
+					configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig()+"  api_keys: [token-1]\n  metrics_auth: basic\n"))
+				})
+
+				It("should only accept the basic auth credentials on the metrics endpoint", func() {
+					resp, _ := apiCall(srv, metricsReq())
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+					req := metricsReq()
+					req.Header.Set("Authorization", "Bearer token-1")
+					resp, _ = apiCall(srv, req)
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+					resp, _ = apiCall(srv, withCredentials(metricsReq()))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				})
+
+				It("should not change the protection of the API routes", func() {
+					resp, _ := apiCall(srv, providerListReq())
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				})
+			})
+
+			Context("set to token", func() {
+				BeforeEach(func() {
+					configOpts = append(configOpts, configHelper.WithExtraConfig(authConfig()+"  api_keys: [token-1]\n  metrics_auth: token\n"))
+				})
+
+				It("should only accept the API keys on the metrics endpoint", func() {
+					resp, _ := apiCall(srv, metricsReq())
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+					resp, _ = apiCall(srv, withCredentials(metricsReq()))
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+					req := metricsReq()
+					req.Header.Set("Authorization", "Bearer token-1")
+					resp, _ = apiCall(srv, req)
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				})
+			})
+		})
+	})
+
+	Describe("CORS", func() {
+		const origin = "https://dashboard.example.com"
+		withOrigin := func(req *http.Request) *http.Request {
+			req.Header.Set("Origin", origin)
+			return req
+		}
+
+		Context("when it's not configured", func() {
+			It("should not send any CORS header", func() {
+				resp, _ := apiCall(srv, withOrigin(providerDetailsReq(owner, repo, baseRef)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			})
+		})
+
+		Context("when it's configured", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig("cors:\n  allowed_origins: ["+origin+"]\n  allowed_methods: [GET]\n"))
+			})
+
+			It("should send the CORS headers on the API routes", func() {
+				resp, _ := apiCall(srv, withOrigin(providerDetailsReq(owner, repo, baseRef)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal(origin))
+				Expect(resp.Header.Get("Access-Control-Expose-Headers")).To(ContainSubstring("X-Lease-Acquired-SHA"))
+				Expect(resp.Header.Get("Access-Control-Expose-Headers")).To(ContainSubstring("X-Request-ID"))
+			})
+
+			It("should answer the preflight requests with the allowed methods", func() {
+				req := withOrigin(httptest.NewRequest("OPTIONS", fmt.Sprintf("/%s/%s/%s/stats", owner, repo, baseRef), nil))
+				req.Header.Set("Access-Control-Request-Method", "GET")
+				resp, _ := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal(origin))
+				Expect(resp.Header.Get("Access-Control-Allow-Methods")).To(Equal("GET"))
+			})
+
+			It("should not allow the other origins", func() {
+				req := providerDetailsReq(owner, repo, baseRef)
+				req.Header.Set("Origin", "https://unknown.example.com")
+				resp, _ := apiCall(srv, req)
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			})
+
+			It("should not send the CORS headers on the internal routes", func() {
+				resp, _ := apiCall(srv, withOrigin(httptest.NewRequest("GET", "/_meta/version", nil)))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Dynamic providers", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithExtraConfig("allow_dynamic_providers:\n  allow: [dynamic-*]\n  defaults:\n    stabilize_duration_seconds: 60\n    ttl_seconds: 300\n    expected_request_count: 1\n"))
+		})
+
+		It("should create the provider of an allowlisted repository on acquire", func() {
+			// only the acquire requests are creating providers
+			resp, _ := apiCall(srv, providerDetailsReq("dynamic-owner", "repo", "main"))
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+			resp, body := apiCall(srv, acquireReq("dynamic-owner", "repo", "main", "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"acquired"`))
+
+			resp, body = apiCall(srv, providerDetailsReq("dynamic-owner", "repo", "main"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			details := &lease.ProviderStateView{}
+			Expect(json.Unmarshal([]byte(body), details)).To(Succeed())
+			Expect(details.Config.StabilizeDuration).To(Equal(60))
+			Expect(details.Config.TTL).To(Equal(300))
+			Expect(details.Config.ExpectedRequestCount).To(Equal(1))
+
+			_, body = apiCall(srv, providerListReq())
+			Expect(body).To(ContainSubstring(`"dynamic-owner:repo:main"`))
+		})
+
+		It("should return a 404 outside of the allowlist", func() {
+			resp, body := apiCall(srv, acquireReq("other-owner", "repo", "main", "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			Expect(body).To(MatchJSON(`{"error": "unknown provider", "request_id": "e2e-request-id"}`))
+
+			_, body = apiCall(srv, providerListReq())
+			Expect(body).NotTo(ContainSubstring(`"other-owner:repo:main"`))
+		})
+
+		It("should not create the provider on an invalid request", func() {
+			req := httptest.NewRequest("POST", "/dynamic-owner/repo/main/acquire", strings.NewReader(`{"head_ref": "gh-readonly-queue/main/pr-1-abc", "priority": 1}`))
+			req.Header.Set("Content-Type", "application/json")
+			resp, _ := apiCall(srv, req)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			_, body := apiCall(srv, providerListReq())
+			Expect(body).NotTo(ContainSubstring(`"dynamic-owner:repo:main"`))
+		})
+
+		It("should not create the provider on an invalid head ref or priority", func() {
+			_, before := apiCall(srv, providerListReq())
+			for _, input := range []string{
+				`{"head_sha": "xxx-1", "head_ref": "feature/foo", "priority": 1}`,
+				`{"head_sha": "xxx-1", "head_ref": "gh-readonly-queue/main/pr-1-abc"}`,
+			} {
+				req := httptest.NewRequest("POST", "/dynamic-owner/repo/main/acquire", strings.NewReader(input))
+				req.Header.Set("Content-Type", "application/json")
+				resp, _ := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest), input)
+			}
+
+			_, after := apiCall(srv, providerListReq())
+			Expect(after).To(Equal(before))
+		})
+	})
+
+	Describe("Rate limit", func() {
+		withToken := func(req *http.Request, token string) *http.Request {
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when limited per IP", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig("rate_limit:\n  max: 3\n  window_seconds: 60\n"))
+			})
+
+			It("should reject the mutating requests over the limit with a 429", func() {
+				resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, _ = apiCall(srv, heartbeatReq(owner, repo, baseRef, "xxx-2"))
+				Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+
+				// all the mutating routes are sharing the limit
+				for _, req := range []*http.Request{acquireReq(owner, repo, baseRef, "xxx-1", 1), releaseReq(owner, repo, baseRef, "xxx-1", 1, lease.StatusSuccess)} {
+					resp, body := apiCall(srv, req)
+					Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+					Expect(resp.Header.Get("Retry-After")).NotTo(BeEmpty())
+					Expect(body).To(MatchJSON(fmt.Sprintf(`{
+						"error": "Too many requests",
+						"error_context": "retry after %ss",
+						"request_id": "e2e-request-id"
+					}`, resp.Header.Get("Retry-After"))))
+				}
+			})
+
+			It("should not limit the read-only and probe routes", func() {
+				for i := 0; i < 5; i++ {
+					resp, _ := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					resp, _ = apiCall(srv, providerStatsReq(owner, repo, baseRef))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					resp, _ = apiCall(srv, httptest.NewRequest("GET", "/k8s/readiness", nil))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				}
+			})
+		})
+
+		Context("when limited per credential", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig("auth:\n  api_keys: [token-1, token-2]\nrate_limit:\n  max: 2\n  key: credential\n"))
+			})
+
+			It("should apply the limit to each caller separately", func() {
+				for i := 1; i <= 2; i++ {
+					resp, _ := apiCall(srv, withToken(acquireReq(owner, repo, baseRef, fmt.Sprintf("xxx-%d", i), i), "token-1"))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				}
+				resp, _ := apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-1", 1), "token-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+				// the other caller has its own limit (from the same IP)
+				resp, _ = apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-3", 3), "token-2"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("should not count the rejected unauthenticated requests", func() {
+				for i := 0; i < 3; i++ {
+					resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+					Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+				}
+				resp, _ := apiCall(srv, withToken(acquireReq(owner, repo, baseRef, "xxx-1", 1), "token-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("Response compression", func() {
+		var req *http.Request
+		var providerStateOpts *lease.NewProviderStateOpts
+
+		BeforeEach(func() {
+			// prefill the state, so the payload is big enough to be worth compressing
+			var providerState *lease.ProviderState
+			providerState, providerStateOpts = generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusPending,
+				3: lease.StatusPending,
+				4: lease.StatusAcquired,
+			}, pointer.Int(4))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		JustBeforeEach(func() {
+			req = providerDetailsReq(owner, repo, baseRef)
+			req.Header.Set("Accept-Encoding", "gzip")
+		})
+
+		Context("when compression is disabled", func() {
+			It("should return a plain body", func() {
+				resp, body := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Content-Encoding")).To(BeEmpty())
+				Expect(json.Valid([]byte(body))).To(BeTrue())
+			})
+		})
+
+		Context("when compression is enabled", func() {
+			BeforeEach(func() {
+				serverOpts = append(serverOpts, serverHelper.WithCompression())
+			})
+
+			It("should return a gzip encoded body", func() {
+				resp, body := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Content-Encoding")).To(Equal("gzip"))
+
+				reader, err := gzip.NewReader(strings.NewReader(body))
+				Expect(err).To(BeNil())
+				decoded, err := io.ReadAll(reader)
+				Expect(err).To(BeNil())
+
+				leaseRequestsPayloadsJSON := buildExpectedRequestsContextPayloads(providerStateOpts.Known, map[string][]int{
+					"xxx-1": {},
+					"xxx-2": {},
+					"xxx-3": {},
+					"xxx-4": rangeInt(4),
+				})
+				acquiredLeaseRequestPayloadJSON := buildExpectedRequestContextPayload(providerStateOpts.Acquired, rangeInt(4))
+				expectedPayload := fmt.Sprintf(`{
+					"last_updated_at": "%s",
+					"acquired": %s,
+					"known": %s,
+					"config": {
+						"stabilize_duration": %d,
+						"ttl": %d,
+						"expected_request_count": %d,
+						"delay_assignment_count": %d
+					}
+				}`, providerStateOpts.LastUpdatedAt.Format(time.RFC3339), acquiredLeaseRequestPayloadJSON, leaseRequestsPayloadsJSON, configHelper.DefaultConfigRepoStabilizeDurationSeconds, configHelper.DefaultConfigRepoTTLSeconds, configHelper.DefaultConfigRepoExpectedRequestCount, configHelper.DefaultConfigRepoDelayAssignmentCount)
+				Expect(string(decoded)).To(MatchJSON(expectedPayload))
+			})
+
+			It("should not compress the body if the client does not support it", func() {
+				req.Header.Del("Accept-Encoding")
+				resp, body := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("Content-Encoding")).To(BeEmpty())
+				Expect(json.Valid([]byte(body))).To(BeTrue())
+			})
+		})
+	})
+
 	Describe("Provider details endpoint", func() {
 		var providerDetailsResp *http.Response
 		var providerDetailsRespBody string
@@ -231,6 +752,114 @@ var _ = Describe("API", Ordered, func() {
 
 					Expect(providerDetailsRespBody).To(MatchJSON(expectedPayload))
 				})
+
+				It("should be decodable as a typed provider view", func() {
+					view := &lease.ProviderStateView{}
+					Expect(json.Unmarshal([]byte(providerDetailsRespBody), view)).To(Succeed())
+
+					Expect(view.LastUpdatedAt).To(BeTemporally("==", providerStateOpts.LastUpdatedAt))
+					Expect(view.Frozen).To(BeFalse())
+					Expect(view.Config).To(Equal(lease.ProviderConfigView{
+						StabilizeDuration:    configHelper.DefaultConfigRepoStabilizeDurationSeconds,
+						TTL:                  configHelper.DefaultConfigRepoTTLSeconds,
+						ExpectedRequestCount: configHelper.DefaultConfigRepoExpectedRequestCount,
+						DelayAssignmentCount: configHelper.DefaultConfigRepoDelayAssignmentCount,
+					}))
+					Expect(view.Acquired).NotTo(BeNil())
+					Expect(view.Acquired.Request.HeadSHA).To(Equal("xxx-4"))
+					Expect(*view.Acquired.Request.Status).To(Equal(lease.StatusAcquired))
+					Expect(view.Acquired.StackedPullRequests).To(HaveLen(4))
+					Expect(view.Known).To(HaveLen(4))
+					for i, known := range view.Known {
+						Expect(known.Request.HeadSHA).To(Equal(fmt.Sprintf("xxx-%d", i+1)))
+						Expect(known.Request.Priority).To(Equal(i + 1))
+					}
+				})
+			})
+
+			Context("when the request is conditional", func() {
+				conditionalDetailsReq := func(etag string) *http.Request {
+					req := providerDetailsReq(owner, repo, baseRef)
+					req.Header.Set("If-None-Match", etag)
+					return req
+				}
+
+				It("should return a 304 response while the details are unchanged, and a 200 with a new ETag afterwards", func() {
+					etag := providerDetailsResp.Header.Get("ETag")
+					Expect(etag).NotTo(BeEmpty())
+
+					resp, body := apiCall(srv, conditionalDetailsReq(etag))
+					Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+					Expect(body).To(BeEmpty())
+					Expect(resp.Header.Get("ETag")).To(Equal(etag))
+
+					// a new lease request changes the details
+					resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+					resp, body = apiCall(srv, conditionalDetailsReq(etag))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					Expect(body).To(ContainSubstring(`"head_sha":"xxx-1"`))
+					newEtag := resp.Header.Get("ETag")
+					Expect(newEtag).NotTo(BeEmpty())
+					Expect(newEtag).NotTo(Equal(etag))
+
+					resp, _ = apiCall(srv, conditionalDetailsReq(newEtag))
+					Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+				})
+			})
+		})
+	})
+
+	Describe("Provider stats endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the provider is unknown", func() {
+			It("should return a 404 response", func() {
+				resp, _ := apiCall(srv, providerStatsReq("unknown", "unknown", "unknown"))
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("when the provider has no known lease requests", func() {
+			It("should return empty stats", func() {
+				resp, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"known_count": 0,
+					"pending_count": 0,
+					"acquired": false,
+					"stabilize_remaining_seconds": %d,
+					"oldest_request_age_seconds": 0
+				}`, configHelper.DefaultConfigRepoStabilizeDurationSeconds)))
+			})
+		})
+
+		Context("when the provider has some known lease requests", func() {
+			BeforeEach(func() {
+				providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+					1: lease.StatusPending,
+					2: lease.StatusPending,
+					3: lease.StatusPending,
+					4: lease.StatusAcquired,
+				}, pointer.Int(4))
+				storage.PrefillStorage(storageDir, providerState)
+				// requests were last seen every 2 seconds after "now", and the provider updated with the last one
+				clk.SetTime(opts.LastUpdatedAt.Add(10 * time.Second))
+			})
+
+			It("should return stats computed from the state", func() {
+				resp, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"known_count": 4,
+					"pending_count": 3,
+					"acquired": true,
+					"stabilize_remaining_seconds": %d,
+					"oldest_request_age_seconds": 16
+				}`, configHelper.DefaultConfigRepoStabilizeDurationSeconds-10)))
 			})
 		})
 	})
@@ -292,7 +921,7 @@ var _ = Describe("API", Ordered, func() {
 					checkStateAndExpectEmptyPayload(providerDetailsResp, providerDetailsRespBody)
 				})
 				It("should empty the persisted (storage) state", func() {
-					provider, err := srv.GetOrchestrator().Get(owner, repo, baseRef)
+					provider, err := srv.GetOrchestrator().Get(owner, repo, baseRef, "")
 					Expect(err).To(BeNil())
 					// fore hydration again
 					err = provider.HydrateFromState(context.Background())
@@ -302,6 +931,66 @@ var _ = Describe("API", Ordered, func() {
 					checkStateAndExpectEmptyPayload(providerDetailsResp, providerDetailsRespBody)
 				})
 			})
+
+			Context("when the safe clear is requested", func() {
+				Context("when a lease is held", func() {
+					BeforeEach(func() {
+						providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+							1: lease.StatusPending,
+							2: lease.StatusAcquired,
+						}, pointer.Int(2))
+						storage.PrefillStorage(storageDir, providerState)
+						clk.SetTime(opts.LastUpdatedAt.Add(time.Second))
+					})
+
+					It("should reject the clear with a 409 response, exposing the lease holder", func() {
+						resp, body := apiCall(srv, providerSafeClearReq(owner, repo, baseRef))
+						Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+						Expect(body).To(MatchJSON(fmt.Sprintf(`{
+							"error": "Couldn't clear the provider",
+							"request_id": "e2e-request-id",
+							"error_context": {
+								"reason": "lease already acquired",
+								"acquired": {
+									"request": {
+										"head_sha": "xxx-2",
+										"head_ref": "%s",
+										"priority": 2,
+										"status": "acquired"
+									},
+									"stacked_pull_requests": [{"number": 1}, {"number": 2}]
+								}
+							}
+						}`, ref(2))))
+					})
+
+					It("should keep the state", func() {
+						_, _ = apiCall(srv, providerSafeClearReq(owner, repo, baseRef))
+						provider, err := srv.GetOrchestrator().Get(owner, repo, baseRef, "")
+						Expect(err).To(BeNil())
+						Expect(provider.AcquiredSHA()).To(Equal("xxx-2"))
+					})
+				})
+
+				Context("when no lease is held", func() {
+					BeforeEach(func() {
+						providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+							1: lease.StatusPending,
+							2: lease.StatusPending,
+						}, nil)
+						storage.PrefillStorage(storageDir, providerState)
+						clk.SetTime(opts.LastUpdatedAt.Add(time.Second))
+					})
+
+					It("should clear the state", func() {
+						resp, _ := apiCall(srv, providerSafeClearReq(owner, repo, baseRef))
+						Expect(resp.StatusCode).To(Equal(http.StatusOK))
+						provider, err := srv.GetOrchestrator().Get(owner, repo, baseRef, "")
+						Expect(err).To(BeNil())
+						Expect(provider.Stats().KnownCount).To(Equal(0))
+					})
+				})
+			})
 		})
 	})
 
@@ -340,141 +1029,1590 @@ var _ = Describe("API", Ordered, func() {
 						storage.PrefillStorage(storageDir, providerState)
 						clk.SetTime(opts.LastUpdatedAt)
 
-						headSha = fmt.Sprintf("xxx-%d", toGenerate+1)
-						headRef = ref(toGenerate + 1)
-						priority = toGenerate + 1
-					})
-					It("the request status should be pending", func() {
-						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
-						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
-							HeadSHA:  headSha,
-							HeadRef:  headRef,
-							Priority: priority,
-							Status:   pointer.String(lease.StatusPending),
-						}, []int{})
-						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
-					})
-				})
+						headSha = fmt.Sprintf("xxx-%d", toGenerate+1)
+						headRef = ref(toGenerate + 1)
+						priority = toGenerate + 1
+					})
+					It("the request status should be pending", func() {
+						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
+						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+							HeadSHA:  headSha,
+							HeadRef:  headRef,
+							Priority: priority,
+							Status:   pointer.String(lease.StatusPending),
+						}, []int{})
+						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+					})
+				})
+
+				Context("if the number of expected request is reached", func() {
+					BeforeEach(func() {
+						statuses := map[int]lease.Status{}
+						toGenerate := configHelper.DefaultConfigRepoExpectedRequestCount - 1
+						for i := 1; i <= toGenerate; i++ {
+							statuses[i] = lease.StatusPending
+						}
+						providerState, opts := generateProviderState(now, owner, repo, baseRef, statuses, nil)
+						storage.PrefillStorage(storageDir, providerState)
+						clk.SetTime(opts.LastUpdatedAt)
+
+						headSha = fmt.Sprintf("xxx-%d", toGenerate+1)
+						headRef = ref(toGenerate + 1)
+						priority = toGenerate + 1
+					})
+					It("the request status should be acquired", func() {
+						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
+						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+							HeadSHA:  headSha,
+							HeadRef:  headRef,
+							Priority: priority,
+							Status:   pointer.String(lease.StatusAcquired),
+						}, rangeInt(configHelper.DefaultConfigRepoExpectedRequestCount))
+						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+					})
+				})
+
+				Context("if the stabilize duration has been consumed", func() {
+					BeforeEach(func() {
+						providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+							1: lease.StatusPending,
+						}, nil)
+						storage.PrefillStorage(storageDir, providerState)
+						currentTime := opts.LastUpdatedAt
+						currentTime = currentTime.Add(time.Second * (configHelper.DefaultConfigRepoStabilizeDurationSeconds + 1))
+						clk.SetTime(currentTime)
+
+						headSha = "xxx-1" //nolint:goconst
+						headRef = ref(1)
+						priority = 1
+					})
+					It("the request status should be acquired", func() {
+						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
+						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+							HeadSHA:  headSha,
+							HeadRef:  headRef,
+							Priority: priority,
+							Status:   pointer.String(lease.StatusAcquired),
+						}, rangeInt(1))
+						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+					})
+				})
+			})
+
+			Context("when the lease has already been acquired", func() {
+				BeforeEach(func() {
+					providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+						1: lease.StatusPending,
+						2: lease.StatusAcquired,
+					}, pointer.Int(2))
+					storage.PrefillStorage(storageDir, providerState)
+					currentTime := opts.LastUpdatedAt
+					currentTime = currentTime.Add(time.Second)
+					clk.SetTime(currentTime)
+				})
+				Context("when the incoming lease request is new", func() {
+					BeforeEach(func() {
+						headSha = "xxx-3"
+						headRef = ref(3)
+						priority = 3
+					})
+					It("the request should be rejected", func() {
+						Expect(acquireResp.StatusCode).To(Equal(http.StatusConflict))
+					})
+					It("the response should embed the lease holder", func() {
+						expectedPayload := fmt.Sprintf(`{
+							"error": "Couldn't acquire the lock",
+							"request_id": "e2e-request-id",
+							"error_context": {
+								"reason": "lease already acquired",
+								"acquired": %s
+							}
+						}`, buildExpectedRequestContextPayload(&lease.Request{
+							HeadSHA:  "xxx-2",
+							HeadRef:  ref(2),
+							Priority: 2,
+							Status:   pointer.String(lease.StatusAcquired),
+						}, rangeInt(2)))
+						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+					})
+				})
+
+				Context("when the incoming lease request is already known", func() {
+					BeforeEach(func() {
+						headSha = "xxx-1"
+						headRef = ref(1)
+						priority = 1
+					})
+
+					Context("if the lease owner has completed", func() {
+						BeforeEach(func() {
+							providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+								1: lease.StatusPending,
+								2: lease.StatusCompleted,
+							}, pointer.Int(2))
+							storage.PrefillStorage(storageDir, providerState)
+							currentTime := opts.LastUpdatedAt
+							currentTime = currentTime.Add(time.Second)
+							clk.SetTime(currentTime)
+						})
+						It("the request status should be completed", func() {
+							Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
+							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+								HeadSHA:  headSha,
+								HeadRef:  headRef,
+								Priority: priority,
+								Status:   pointer.String(lease.StatusCompleted),
+							}, []int{})
+							Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+						})
+					})
+
+					Context("if the lease owner has not failed nor succeed yet", func() {
+						It("the request status should continue to be pending", func() {
+							Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
+							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+								HeadSHA:  headSha,
+								HeadRef:  headRef,
+								Priority: priority,
+								Status:   pointer.String(lease.StatusPending),
+							}, []int{})
+							Expect(acquireRespBody).To(MatchJSON(expectedPayload))
+						})
+					})
+				})
+			})
+		})
+	})
+
+	Describe("Acquire endpoint input validation", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the head ref is not a merge queue temporary branch", func() {
+			It("should return the expected pattern and the offending value", func() {
+				req := httptest.NewRequest(
+					"POST",
+					fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+					strings.NewReader(`{"head_sha": "xxx-1", "head_ref": "feature/my-branch", "priority": 1}`),
+				)
+				req.Header.Set("Content-Type", "application/json")
+
+				resp, body := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"error": "Invalid request",
+					"request_id": "e2e-request-id",
+					"error_context": [{
+						"failed_field": "acquireRequest.HeadRef",
+						"tag": "ghTempBranchRef",
+						"value": "",
+						"expected": %q,
+						"actual": "feature/my-branch"
+					}]
+				}`, lease.GHTempRefPattern)))
+			})
+		})
+
+		Context("when the PR number of the head ref can't be a priority", func() {
+			It("should reject the request", func() {
+				for _, headRef := range []string{"gh-readonly-queue/main/pr-0-abc", "gh-readonly-queue/main/pr-99999999999999999999999-abc"} {
+					req := httptest.NewRequest(
+						"POST",
+						fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+						strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": %q, "priority": 1}`, headRef)),
+					)
+					req.Header.Set("Content-Type", "application/json")
+
+					resp, body := apiCall(srv, req)
+					Expect(resp.StatusCode).To(Equal(http.StatusBadRequest), headRef)
+					Expect(body).To(ContainSubstring(`"tag":"ghTempBranchRef"`))
+				}
+			})
+		})
+	})
+
+	Describe("Request metadata", func() {
+		acquireWithMetadataReq := func(metadata string) *http.Request {
+			req := httptest.NewRequest(
+				"POST",
+				fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+				strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": "%s", "priority": 1, "metadata": %s}`, ref(1), metadata)),
+			)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		It("should echo the metadata in the request contexts", func() {
+			resp, body := apiCall(srv, acquireWithMetadataReq(`{"actor": "octocat"}`))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"metadata":{"actor":"octocat"}`))
+
+			resp, body = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"metadata":{"actor":"octocat"}`))
+		})
+
+		It("should reject the oversized metadata", func() {
+			resp, body := apiCall(srv, acquireWithMetadataReq(fmt.Sprintf(`{"actor": "%s"}`, strings.Repeat("x", 257))))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{
+				"error": "Invalid request",
+				"request_id": "e2e-request-id",
+				"error_context": [{"failed_field": "acquireRequest.Metadata[actor]", "tag": "max", "value": "256"}]
+			}`))
+		})
+	})
+
+	Describe("API versioning", func() {
+		acquireWithAcceptReq := func(accept string) *http.Request {
+			req := acquireReq(owner, repo, baseRef, "xxx-1", 1)
+			req.Header.Set("Accept", accept)
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when no version is selected", func() {
+			It("should serve the current version, in its default shape", func() {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get(middlewares.APIVersionHeaderName)).To(Equal("1"))
+				Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"request": {"head_sha": "xxx-1", "head_ref": "%s", "priority": 1, "status": "pending"}
+				}`, ref(1))))
+			})
+		})
+
+		Context("when the current version is selected", func() {
+			It("should envelope the response with the version", func() {
+				resp, body := apiCall(srv, acquireWithAcceptReq("application/vnd.mqlease.v1+json"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get(middlewares.APIVersionHeaderName)).To(Equal("1"))
+				Expect(resp.Header.Get("Content-Type")).To(Equal("application/vnd.mqlease.v1+json"))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"api_version": 1,
+					"request": {"head_sha": "xxx-1", "head_ref": "%s", "priority": 1, "status": "pending"}
+				}`, ref(1))))
+			})
+		})
+
+		Context("when an unsupported version is selected", func() {
+			It("should return a 406", func() {
+				resp, body := apiCall(srv, acquireWithAcceptReq("application/vnd.mqlease.v2+json"))
+				Expect(resp.StatusCode).To(Equal(http.StatusNotAcceptable))
+				Expect(body).To(MatchJSON(`{
+					"error": "Unsupported API version",
+					"error_context": {"requested": "application/vnd.mqlease.v2+json", "supported_versions": [1]},
+					"request_id": "e2e-request-id"
+				}`))
+
+				// the request hasn't been processed
+				resp, body = apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"known_count":0`))
+			})
+		})
+	})
+
+	Describe("Generic mode", func() {
+		// generic mode requests are not tied to the merge queue, their refs are arbitrary
+		genericReq := func(endpoint string, headSha string, headRef string, priority int, status string) *http.Request {
+			payload := fmt.Sprintf(`{"head_sha": "%s", "head_ref": "%s", "priority": %d`, headSha, headRef, priority)
+			if status != "" {
+				payload += fmt.Sprintf(`, "status": "%s"`, status)
+			}
+			req := httptest.NewRequest("POST", fmt.Sprintf("/%s/%s/%s/%s", owner, repo, baseRef, endpoint), strings.NewReader(payload+"}"))
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithGenericMode(true))
+		})
+
+		It("should accept arbitrary head refs, without computing stacked pull requests", func() {
+			resp, body := apiCall(srv, genericReq("acquire", "xxx-1", "nightly-deploy", 1, ""))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"request": {"head_sha": "xxx-1", "head_ref": "nightly-deploy", "priority": 1, "status": "pending"}}`))
+
+			clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+			resp, body = apiCall(srv, genericReq("acquire", "xxx-1", "nightly-deploy", 1, ""))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"request": {"head_sha": "xxx-1", "head_ref": "nightly-deploy", "priority": 1, "status": "acquired"}}`))
+
+			resp, body = apiCall(srv, genericReq("release", "xxx-1", "nightly-deploy", 1, "success"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"completed"`))
+		})
+
+		It("should still require a head ref", func() {
+			resp, _ := apiCall(srv, genericReq("acquire", "xxx-1", "", 1, ""))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Default priority", func() {
+		noPriorityReq := func(headSha string) *http.Request {
+			req := httptest.NewRequest(
+				"POST",
+				fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+				strings.NewReader(fmt.Sprintf(`{"head_sha": "%s", "head_ref": "%s"}`, headSha, ref(1))),
+			)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when a default priority is configured", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithDefaultPriority(5))
+			})
+
+			It("should apply the default priority to the requests without any, and persist it", func() {
+				resp, body := apiCall(srv, noPriorityReq("xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{"request": {"head_sha": "xxx-1", "head_ref": "%s", "priority": 5, "status": "pending"}}`, ref(1))))
+
+				// re-hydrated from the storage
+				provider, err := srv.GetOrchestrator().Get(owner, repo, baseRef, "")
+				Expect(err).To(BeNil())
+				Expect(provider.HydrateFromState(context.Background())).To(Succeed())
+				resp, body = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"priority":5`))
+			})
+
+			It("should make the default priority compete with the explicit ones", func() {
+				resp, _ := apiCall(srv, noPriorityReq("xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+				resp, body := apiCall(srv, noPriorityReq("xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+			})
+		})
+
+		Context("when no default priority is configured", func() {
+			It("should require the priority", func() {
+				resp, body := apiCall(srv, noPriorityReq("xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(body).To(ContainSubstring(`"failed_field":"acquireRequest.Priority"`))
+			})
+		})
+	})
+
+	Describe("Pending accepted", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when it's disabled", func() {
+			It("should answer the pending requests with a 200", func() {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+			})
+		})
+
+		Context("when it's enabled", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithPendingAccepted(true))
+			})
+
+			It("should answer the pending requests with a 202, and the acquired ones with a 200", func() {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+				Expect(resp.Header.Get("Poll-Interval-Ms")).NotTo(BeEmpty())
+
+				clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+				resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+			})
+		})
+	})
+
+	Describe("Release hand-off", func() {
+		handoffReq := func(nextHeadSha string) *http.Request {
+			req := httptest.NewRequest(
+				"POST",
+				fmt.Sprintf("/%s/%s/%s/release", owner, repo, baseRef),
+				strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-3", "head_ref": "%s", "priority": 3, "status": "failure", "next_head_sha": "%s"}`, ref(3), nextHeadSha)),
+			)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			providerState, _ := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusPending,
+				3: lease.StatusAcquired,
+			}, pointer.Int(3))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		It("should hand the lease off to a pending target", func() {
+			resp, body := apiCall(srv, handoffReq("xxx-1"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"failure"`))
+
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"acquired"`))
+		})
+
+		It("should reject the release with an unknown target", func() {
+			resp, body := apiCall(srv, handoffReq("unknown"))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{"error": "Couldn't release the lock", "error_context": "unknown hand-off target unknown", "request_id": "e2e-request-id"}`))
+		})
+	})
+
+	Describe("Max priority", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithMaxPriority(10))
+		})
+
+		It("should reject the lease requests above the max priority", func() {
+			resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-11", 11))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{
+				"error": "Invalid request",
+				"request_id": "e2e-request-id",
+				"error_context": [{
+					"failed_field": "acquireRequest.Priority",
+					"tag": "maxPriority",
+					"value": "",
+					"expected": "<= 10",
+					"actual": "11"
+				}]
+			}`))
+
+			resp, body = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-11", 11, "success"))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(ContainSubstring(`"tag":"maxPriority"`))
+		})
+
+		It("should accept the lease requests up to the max priority", func() {
+			resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-10", 10))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+		})
+	})
+
+	Describe("Priority from ref", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithPriorityFromRef("ascending"), configHelper.WithMaxPriority(10))
+		})
+
+		It("should accept the requests without any priority, or an out of bounds one", func() {
+			req := httptest.NewRequest("POST", fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef), strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": "%s"}`, ref(42))))
+			req.Header.Set("Content-Type", "application/json")
+			resp, body := apiCall(srv, req)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"priority":42`))
+
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-11", 11))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"priority":11`))
+		})
+	})
+
+	Describe("Acquire endpoint idempotency", func() {
+		var keyedAcquireReq func(priority int) *http.Request
+		var lastUpdatedAt func() string
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			keyedAcquireReq = func(priority int) *http.Request {
+				req := acquireReq(owner, repo, baseRef, "xxx-1", priority)
+				req.Header.Set("Idempotency-Key", "some-key")
+				return req
+			}
+			lastUpdatedAt = func() string {
+				_, body := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				details := map[string]any{}
+				Expect(json.Unmarshal([]byte(body), &details)).To(Succeed())
+				return details["last_updated_at"].(string)
+			}
+		})
+
+		Context("when the same request is retried with the same idempotency key", func() {
+			It("should replay the response without updating the provider", func() {
+				firstResp, firstBody := apiCall(srv, keyedAcquireReq(1))
+				Expect(firstResp.StatusCode).To(Equal(http.StatusOK))
+				Expect(lastUpdatedAt()).To(Equal(now.Format(time.RFC3339)))
+
+				clk.SetTime(now.Add(10 * time.Second))
+				retryResp, retryBody := apiCall(srv, keyedAcquireReq(1))
+				Expect(retryResp.StatusCode).To(Equal(firstResp.StatusCode))
+				Expect(retryBody).To(MatchJSON(firstBody))
+				Expect(lastUpdatedAt()).To(Equal(now.Format(time.RFC3339)))
+			})
+		})
+
+		Context("when a different request is sent with the same idempotency key", func() {
+			It("should process the request", func() {
+				resp, _ := apiCall(srv, keyedAcquireReq(1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				updatedAt := now.Add(10 * time.Second)
+				clk.SetTime(updatedAt)
+				resp, body := apiCall(srv, keyedAcquireReq(2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"priority":2`))
+				Expect(lastUpdatedAt()).To(Equal(updatedAt.Format(time.RFC3339)))
+			})
+		})
+	})
+
+	Describe("Acquired SHA header", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the lease is not acquired", func() {
+			It("should return an empty header", func() {
+				resp, _ := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(BeEmpty())
+			})
+		})
+
+		Context("when the lease is acquired", func() {
+			BeforeEach(func() {
+				providerState, _ := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+					1: lease.StatusPending,
+					2: lease.StatusAcquired,
+				}, pointer.Int(2))
+				storage.PrefillStorage(storageDir, providerState)
+			})
+
+			It("should return the acquired SHA on all the provider responses", func() {
+				resp, _ := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-2"))
+				resp, _ = apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-2"))
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-2"))
+			})
+
+			It("should reflect the state after the release", func() {
+				resp, _ := apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-2", 2, "failure"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(BeEmpty())
+
+				// the remaining request now acquires the lease
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-1"))
+			})
+		})
+	})
+
+	Describe("Queues", func() {
+		// the provider routes of a queue are nested under its base ref
+		queueBaseRef := func(queue string) string {
+			return baseRef + "/queues/" + queue
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithExtraQueues("shard-1", "shard-2"))
+		})
+
+		It("should list the queues providers along with the one without queue", func() {
+			_, body := apiCall(srv, providerListReq())
+			payload := map[string]any{}
+			Expect(json.Unmarshal([]byte(body), &payload)).To(Succeed())
+			Expect(payload).To(HaveLen(3))
+			Expect(payload).To(HaveKey(fmt.Sprintf("%s:%s:%s", owner, repo, baseRef)))
+			Expect(payload).To(HaveKey(fmt.Sprintf("%s:%s:%s:shard-1", owner, repo, baseRef)))
+			Expect(payload).To(HaveKey(fmt.Sprintf("%s:%s:%s:shard-2", owner, repo, baseRef)))
+		})
+
+		It("should return a 404 response for an unknown queue", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, queueBaseRef("unknown"), "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+
+		It("should operate the queues independently", func() {
+			// the same commit is queued on both shards
+			for _, queue := range []string{"shard-1", "shard-2"} {
+				resp, body := apiCall(srv, acquireReq(owner, repo, queueBaseRef(queue), "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+			}
+			_, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+			Expect(body).To(ContainSubstring(`"known_count":0`))
+
+			// both of them acquire their own lease
+			clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+			for _, queue := range []string{"shard-1", "shard-2"} {
+				resp, body := apiCall(srv, acquireReq(owner, repo, queueBaseRef(queue), "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+				Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-1"))
+			}
+
+			// releasing the shard-1 lease doesn't affect shard-2
+			resp, _ := apiCall(srv, releaseReq(owner, repo, queueBaseRef("shard-1"), "xxx-1", 1, "failure"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(BeEmpty())
+			resp, body = apiCall(srv, providerStatsReq(owner, repo, queueBaseRef("shard-2")))
+			Expect(body).To(ContainSubstring(`"acquired":true`))
+			Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-1"))
+		})
+	})
+
+	Describe("Poll interval header", func() {
+		const minSeconds, maxSeconds = 2, 10
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithPollIntervalSeconds(minSeconds, maxSeconds))
+		})
+
+		It("should suggest a poll interval within the configured bounds to the pending requests", func() {
+			for i := 1; i <= 5; i++ {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+				pollInterval, err := strconv.Atoi(resp.Header.Get("Poll-Interval-Ms"))
+				Expect(err).To(BeNil())
+				Expect(pollInterval).To(BeNumerically(">=", minSeconds*1000))
+				Expect(pollInterval).To(BeNumerically("<=", maxSeconds*1000))
+			}
+		})
+
+		It("should not suggest any poll interval once the lease is acquired", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			// once the stabilize duration is elapsed, the only request acquires the lease
+			clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+			resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"acquired"`))
+			Expect(resp.Header.Get("Poll-Interval-Ms")).To(BeEmpty())
+		})
+	})
+
+	Describe("Provider statuses endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the provider has no known lease requests", func() {
+			It("should return an empty list", func() {
+				resp, body := apiCall(srv, providerStatusesReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`[]`))
+			})
+		})
+
+		Context("when the provider has some known lease requests", func() {
+			BeforeEach(func() {
+				providerState, _ := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+					3: lease.StatusPending,
+					1: lease.StatusPending,
+					4: lease.StatusAcquired,
+					2: lease.StatusPending,
+				}, pointer.Int(4))
+				storage.PrefillStorage(storageDir, providerState)
+			})
+
+			It("should return their compact statuses, sorted by priority", func() {
+				resp, body := apiCall(srv, providerStatusesReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`[
+					{"head_sha": "xxx-1", "status": "pending", "priority": 1},
+					{"head_sha": "xxx-2", "status": "pending", "priority": 2},
+					{"head_sha": "xxx-3", "status": "pending", "priority": 3},
+					{"head_sha": "xxx-4", "status": "acquired", "priority": 4}
+				]`))
+			})
+		})
+	})
+
+	Describe("Provider history endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when no lease has been released", func() {
+			It("should return an empty history", func() {
+				resp, body := apiCall(srv, providerHistoryReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`[]`))
+			})
+		})
+
+		Context("when leases have been released", func() {
+			BeforeEach(func() {
+				providerState, opts := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+					1: lease.StatusPending,
+					2: lease.StatusPending,
+					3: lease.StatusAcquired,
+				}, pointer.Int(3))
+				storage.PrefillStorage(storageDir, providerState)
+				clk.SetTime(opts.LastUpdatedAt.Add(time.Second))
+			})
+
+			It("should return the released requests, newest first", func() {
+				resp, _ := apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-3", 3, "failure"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+				resp, _ = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				resp, body = apiCall(srv, providerHistoryReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				releasedAt := clk.Now().Format(time.RFC3339)
+				Expect(body).To(MatchJSON(fmt.Sprintf(`[
+					{
+						"head_sha": "xxx-2",
+						"head_ref": "%s",
+						"priority": 2,
+						"status": "success",
+						"released_at": "%s",
+						"stacked_pull_requests": [{"number": 1}, {"number": 2}]
+					},
+					{
+						"head_sha": "xxx-3",
+						"head_ref": "%s",
+						"priority": 3,
+						"status": "failure",
+						"released_at": "%s"
+					}
+				]`, ref(2), releasedAt, ref(3), releasedAt)))
+			})
+		})
+	})
+
+	Describe("Request timeline endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the request is unknown", func() {
+			It("should return a 404", func() {
+				resp, body := apiCall(srv, requestTimelineReq(owner, repo, baseRef, "xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+				Expect(body).To(MatchJSON(`{"error": "unknown lease request xxx-1", "request_id": "e2e-request-id"}`))
+			})
+		})
+
+		Context("when the request went through the whole lifecycle", func() {
+			It("should return its status transitions, oldest first", func() {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+				acquiredAt := now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second)
+				clk.SetTime(acquiredAt)
+				resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+
+				releasedAt := acquiredAt.Add(time.Minute)
+				clk.SetTime(releasedAt)
+				resp, _ = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-1", 1, "success"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				resp, body = apiCall(srv, requestTimelineReq(owner, repo, baseRef, "xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(fmt.Sprintf(`{
+					"head_sha": "xxx-1",
+					"timeline": [
+						{"status": "pending", "at": "%s"},
+						{"status": "acquired", "at": "%s"},
+						{"status": "success", "at": "%s"},
+						{"status": "completed", "at": "%s"}
+					]
+				}`,
+					now.Format(time.RFC3339Nano),
+					acquiredAt.Format(time.RFC3339Nano),
+					releasedAt.Format(time.RFC3339Nano),
+					releasedAt.Format(time.RFC3339Nano),
+				)))
+			})
+		})
+	})
+
+	Describe("Winner endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when no request is known", func() {
+			It("should return a null winner", func() {
+				resp, body := apiCall(srv, winnerReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`{"winner": null}`))
+			})
+		})
+
+		Context("when requests are queued", func() {
+			JustBeforeEach(func() {
+				for i := 1; i <= 2; i++ {
+					resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, fmt.Sprintf("xxx-%d", i), i))
+					Expect(resp.StatusCode).To(Equal(http.StatusOK))
+					Expect(body).To(ContainSubstring(`"status":"pending"`))
+				}
+			})
+
+			It("should return a null winner while the batch is stabilizing", func() {
+				resp, body := apiCall(srv, winnerReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`{"winner": null}`))
+			})
+
+			It("should return the request acquiring the lease next, without registering it", func() {
+				clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+				resp, body := apiCall(srv, winnerReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				winner := struct {
+					Winner *lease.RequestContext `json:"winner"`
+				}{}
+				Expect(json.Unmarshal([]byte(body), &winner)).To(Succeed())
+				Expect(winner.Winner).NotTo(BeNil())
+				Expect(winner.Winner.Request.HeadSHA).To(Equal("xxx-2"))
+				Expect(*winner.Winner.Request.Status).To(Equal(lease.StatusPending))
+
+				// the peeked winner is the one acquiring the lease
+				resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+				resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
+
+				// the lease is held: no winner anymore
+				resp, body = apiCall(srv, winnerReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(MatchJSON(`{"winner": null}`))
+			})
+		})
+	})
+
+	Describe("Event time", func() {
+		eventTime := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+		acquireWithEventTimeReq := func() *http.Request {
+			req := httptest.NewRequest(
+				"POST",
+				fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+				strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": "%s", "priority": 1, "event_time": "%s"}`, ref(1), eventTime.Format(time.RFC3339))),
+			)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when event times are not allowed", func() {
+			It("should reject the requests carrying an event time", func() {
+				resp, body := apiCall(srv, acquireWithEventTimeReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(body).To(MatchJSON(`{"error": "Invalid request", "error_context": "event_time is not allowed on this server", "request_id": "e2e-request-id"}`))
+			})
+		})
+
+		Context("when event times are allowed", func() {
+			BeforeEach(func() {
+				serverOpts = append(serverOpts, serverHelper.WithAllowEventTime())
+			})
+
+			It("should use the event time instead of the current time", func() {
+				resp, _ := apiCall(srv, acquireWithEventTimeReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				resp, body := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(fmt.Sprintf(`"last_updated_at":"%s"`, eventTime.Format(time.RFC3339))))
+			})
+		})
+	})
+
+	Describe("Follower mode", func() {
+		const writerURL = "http://writer.example.com"
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			providerState, _ := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			// the follower storage is read-only, it has to be filled before the server is started
+			storage.PrefillStorage(storageDir, providerState)
+			serverOpts = append(serverOpts, serverHelper.WithFollowerMode(writerURL))
+		})
+
+		It("should serve the read-only routes from the storage", func() {
+			resp, body := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"head_sha":"xxx-2"`))
+
+			resp, body = apiCall(srv, providerStatsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"known_count":2`))
+		})
+
+		It("should be ready", func() {
+			resp, _ := apiCall(srv, httptest.NewRequest("GET", "/k8s/readiness", nil))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should redirect the mutating routes to the writer", func() {
+			for _, req := range []*http.Request{
+				acquireReq(owner, repo, baseRef, "xxx-3", 3),
+				releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"),
+				providerClearReq(owner, repo, baseRef),
+			} {
+				resp, _ := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusTemporaryRedirect))
+				Expect(resp.Header.Get("Location")).To(Equal(writerURL + req.URL.RequestURI()))
+			}
+
+			// nothing changed locally
+			resp, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"known_count":2`))
+		})
+
+		It("should redirect the mutating admin routes to the writer", func() {
+			for _, req := range []*http.Request{
+				drainReq(true),
+				drainReq(false),
+				importReq("", true),
+				clearAllReq(true),
+			} {
+				resp, _ := apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusTemporaryRedirect), req.Method+" "+req.URL.Path)
+				Expect(resp.Header.Get("Location")).To(Equal(writerURL + req.URL.RequestURI()))
+			}
+
+			// nothing changed locally
+			resp, _ := apiCall(srv, httptest.NewRequest("GET", "/k8s/readiness", nil))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			resp, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"known_count":2`))
+		})
+
+		It("should serve the read-only admin routes", func() {
+			resp, body := apiCall(srv, acquiredLeasesReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"head_sha":"xxx-2"`))
+		})
+	})
+
+	Describe("Health endpoint", func() {
+		It("should be healthy when both the liveness and readiness probes pass", func() {
+			resp, body := apiCall(srv, healthReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{
+				"healthy": true,
+				"liveness": {"healthy": true},
+				"readiness": {"healthy": true}
+			}`))
+		})
+
+		It("should be unhealthy when the readiness probe fails", func() {
+			resp, _ := apiCall(srv, drainReq(true))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			resp, body := apiCall(srv, healthReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(MatchJSON(`{
+				"healthy": false,
+				"liveness": {"healthy": true},
+				"readiness": {"healthy": false, "reason": "draining"}
+			}`))
+		})
+	})
+
+	Describe("Drain mode", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+			providerState, _ := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		JustBeforeEach(func() {
+			resp, body := apiCall(srv, drainReq(true))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"draining": true}`))
+		})
+
+		It("should fail the readiness probe", func() {
+			resp, _ := apiCall(srv, httptest.NewRequest("GET", "/k8s/readiness", nil))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should reject the new lease requests", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-3", 3))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should still process the known lease requests", func() {
+			resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+			resp, body = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"completed"`))
+		})
+
+		It("should accept new lease requests again once the drain mode is off", func() {
+			resp, body := apiCall(srv, drainReq(false))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"draining": false}`))
+
+			resp, _ = apiCall(srv, httptest.NewRequest("GET", "/k8s/readiness", nil))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Freeze mode", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+			providerState, _ := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		JustBeforeEach(func() {
+			resp, body := apiCall(srv, freezeReq(owner, repo, baseRef, true))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"frozen": true}`))
+		})
+
+		It("should reject the lease requests", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-3", 3))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			// known ones included
+			resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+
+		It("should still process the releases and expose the provider details", func() {
+			resp, body := apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"completed"`))
+
+			resp, body = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"frozen":true`))
+		})
+
+		It("should accept the lease requests again once unfrozen", func() {
+			resp, body := apiCall(srv, freezeReq(owner, repo, baseRef, false))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"frozen": false}`))
+
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+			resp, body = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).NotTo(ContainSubstring(`"frozen"`))
+		})
+
+		It("should return a 404 response for an unknown provider", func() {
+			resp, _ := apiCall(srv, freezeReq("unknown", "unknown", "unknown", true))
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Provider config update endpoint", func() {
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		It("should apply the new stabilize duration to the lease assignment", func() {
+			resp, body := apiCall(srv, providerConfigUpdateReq(owner, repo, baseRef, `{"stabilize_duration": 5}`))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			view := &lease.ProviderStateView{}
+			Expect(json.Unmarshal([]byte(body), view)).To(Succeed())
+			Expect(view.Config).To(Equal(lease.ProviderConfigView{
+				StabilizeDuration:    5,
+				TTL:                  configHelper.DefaultConfigRepoTTLSeconds,
+				ExpectedRequestCount: configHelper.DefaultConfigRepoExpectedRequestCount,
+				DelayAssignmentCount: configHelper.DefaultConfigRepoDelayAssignmentCount,
+			}))
+
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+			// the configured stabilize duration would still be running
+			clk.SetTime(now.Add(5 * time.Second))
+			resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"acquired"`))
+
+			// the override is reflected in the details
+			resp, body = apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			view = &lease.ProviderStateView{}
+			Expect(json.Unmarshal([]byte(body), view)).To(Succeed())
+			Expect(view.Config.StabilizeDuration).To(Equal(5))
+			Expect(view.Acquired.Request.HeadSHA).To(Equal("xxx-1"))
+		})
+
+		It("should reject a stabilize duration over the limit", func() {
+			resp, body := apiCall(srv, providerConfigUpdateReq(owner, repo, baseRef, fmt.Sprintf(`{"stabilize_duration": %d}`, latest.DefaultMaxStabilizeDuration+1)))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{
+				"error": "Invalid request",
+				"error_context": "stabilize_duration is over the limit (see max_stabilize_duration_seconds)",
+				"request_id": "e2e-request-id"
+			}`))
+		})
+
+		It("should reject invalid values", func() {
+			resp, body := apiCall(srv, providerConfigUpdateReq(owner, repo, baseRef, `{"expected_request_count": 0}`))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(MatchJSON(`{
+				"error": "Invalid request",
+				"error_context": [{"failed_field": "configUpdateRequest.ExpectedRequestCount", "tag": "min", "value": "1"}],
+				"request_id": "e2e-request-id"
+			}`))
+		})
+	})
+
+	Describe("Export endpoint", func() {
+		const otherBaseRef = "release"
+		var providerState, otherProviderState *lease.ProviderState
+
+		BeforeEach(func() {
+			configOpts = append(configOpts, configHelper.WithExtraRepository(configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef))
+
+			// the owner/repo/base ref variables are only set once the server is started
+			providerState, _ = generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+			otherProviderState, _ = generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+			}, nil)
+			storage.PrefillStorage(storageDir, otherProviderState)
+		})
+
+		It("should export the states of all the providers as NDJSON", func() {
+			resp, body := apiCall(srv, exportReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+
+			lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+			// sorted by provider: the "main" base ref comes before the "release" one
+			Expect(lines).To(HaveLen(2))
+			for i, expectedState := range []*lease.ProviderState{providerState, otherProviderState} {
+				expected, err := expectedState.ExportJSON()
+				Expect(err).To(BeNil())
+				Expect(lines[i]).To(MatchJSON(expected))
+
+				// each line round-trips to an equivalent state
+				restored := lease.NewProviderState(lease.NewProviderStateOpts{})
+				Expect(restored.Unmarshal([]byte(lines[i]))).To(Succeed())
+				Expect(restored.GetIdentifier()).To(Equal(expectedState.GetIdentifier()))
+				reExported, err := restored.ExportJSON()
+				Expect(err).To(BeNil())
+				Expect(reExported).To(MatchJSON(expected))
+			}
+		})
+	})
+
+	Describe("Import endpoint", func() {
+		var exported string
+
+		BeforeEach(func() {
+			providerState, _ := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		JustBeforeEach(func() {
+			var resp *http.Response
+			resp, exported = apiCall(srv, exportReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		// startFreshInstance starts a new instance (same configuration, empty storage)
+		startFreshInstance := func() server.Server {
+			ctx, cancel := context.WithCancel(context.Background())
+			grp := errgroup.Group{}
+			fresh := serverHelper.New(config.GenerateDefaultConfig(), storage.NewStorageDir(), clk)
+			grp.Go(func() error {
+				return fresh.RunTest(ctx)
+			})
+			waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer waitCtxCancel()
+			Expect(fresh.WaitReady(waitCtx)).To(BeTrue())
+			DeferCleanup(func() {
+				cancel()
+				Expect(grp.Wait()).To(BeNil())
+			})
+			return fresh
+		}
+
+		It("should require a confirmation", func() {
+			resp, body := apiCall(srv, importReq(exported, false))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(ContainSubstring("confirm=true"))
+		})
+
+		It("should restore the exported states into a fresh instance", func() {
+			fresh := startFreshInstance()
+			_, body := apiCall(fresh, providerDetailsReq(owner, repo, baseRef))
+			Expect(body).To(ContainSubstring(`"known":[]`))
+
+			// the states of the unknown providers are skipped
+			unknownState, _ := generateProviderState(now, "unknown", "unknown", "main", map[int]lease.Status{1: lease.StatusPending}, nil)
+			unknownExported, err := unknownState.ExportJSON()
+			Expect(err).To(BeNil())
+
+			resp, body := apiCall(fresh, importReq(exported+string(unknownExported)+"\n", true))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(fmt.Sprintf(`{"imported": ["%s:%s:%s"], "skipped": ["unknown:unknown:main"]}`, owner, repo, baseRef)))
+
+			// the endpoints are reflecting the imported state
+			_, expectedDetails := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			resp, body = apiCall(fresh, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(expectedDetails))
+			_, body = apiCall(fresh, exportReq())
+			Expect(body).To(MatchJSON(exported))
+			resp, body = apiCall(fresh, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"status":"pending"`))
+			Expect(resp.Header.Get("X-Lease-Acquired-SHA")).To(Equal("xxx-2"))
+		})
+
+		It("should not import anything if a state is invalid", func() {
+			fresh := startFreshInstance()
+			resp, body := apiCall(fresh, importReq(exported+"{invalid\n", true))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(ContainSubstring(`"line":2`))
+
+			_, body = apiCall(fresh, providerDetailsReq(owner, repo, baseRef))
+			Expect(body).To(ContainSubstring(`"known":[]`))
+		})
+	})
+
+	Describe("Clear all endpoint", func() {
+		const otherBaseRef = "release"
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithExtraRepository(configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef))
+
+			// the owner/repo/base ref variables are only set once the server is started
+			providerState, _ := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+			otherProviderState, _ := generateProviderState(now, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+			}, nil)
+			storage.PrefillStorage(storageDir, otherProviderState)
+		})
+
+		It("should require a confirmation", func() {
+			resp, _ := apiCall(srv, clearAllReq(false))
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			resp, body := apiCall(srv, providerDetailsReq(owner, repo, baseRef))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(`"head_sha":"xxx-2"`))
+		})
+
+		It("should clear the states of all the providers, in memory and in the storage", func() {
+			resp, body := apiCall(srv, clearAllReq(true))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring(fmt.Sprintf(`"cleared":["%[1]s:%[2]s:%[3]s","%[1]s:%[2]s:%[4]s"]`, owner, repo, baseRef, otherBaseRef)))
+
+			for _, providerBaseRef := range []string{baseRef, otherBaseRef} {
+				provider, err := srv.GetOrchestrator().Get(owner, repo, providerBaseRef, "")
+				Expect(err).To(BeNil())
+				Expect(provider.AcquiredSHA()).To(BeEmpty())
+
+				// re-hydrated from the storage
+				Expect(provider.HydrateFromState(context.Background())).To(Succeed())
+				resp, body := apiCall(srv, providerDetailsReq(owner, repo, providerBaseRef))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"acquired":null`))
+				Expect(body).To(ContainSubstring(`"known":[]`))
+			}
+		})
+	})
+
+	Describe("Acquired leases endpoint", func() {
+		const otherBaseRef = "release"
+		var acquiredAt time.Time
+
+		BeforeEach(func() {
+			configOpts = append(configOpts, configHelper.WithExtraRepository(configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef))
+
+			providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			acquiredAt = opts.LastUpdatedAt.Add(-time.Minute).UTC()
+			opts.Acquired.UpdateAcquiredAt(acquiredAt)
+			storage.PrefillStorage(storageDir, providerState)
+			otherProviderState, _ := generateProviderState(now, owner, repo, otherBaseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+			}, nil)
+			storage.PrefillStorage(storageDir, otherProviderState)
+		})
+
+		It("should return the acquired lease of all the providers", func() {
+			resp, body := apiCall(srv, acquiredLeasesReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(fmt.Sprintf(`{
+				"%[1]s:%[2]s:%[3]s": {
+					"acquired": %[4]s,
+					"acquired_at": "%[5]s"
+				},
+				"%[1]s:%[2]s:%[6]s": {
+					"acquired": null,
+					"acquired_at": null
+				}
+			}`, owner, repo, baseRef, buildExpectedRequestContextPayload(&lease.Request{
+				HeadSHA:  "xxx-2",
+				HeadRef:  ref(2),
+				Priority: 2,
+				Status:   pointer.String(lease.StatusAcquired),
+			}, rangeInt(2)), acquiredAt.Format(time.RFC3339Nano), otherBaseRef)))
+		})
+
+		Context("when the mutating routes are protected", func() {
+			BeforeEach(func() {
+				configOpts = append(configOpts, configHelper.WithExtraConfig("auth:\n  api_keys: [token-1]\n"))
+			})
+
+			It("should be protected as well", func() {
+				resp, _ := apiCall(srv, acquiredLeasesReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+				req := acquiredLeasesReq()
+				req.Header.Set("Authorization", "Bearer token-1")
+				resp, _ = apiCall(srv, req)
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Describe("Hydration status endpoint", func() {
+		const otherBaseRef = "release"
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+			configOpts = append(configOpts, configHelper.WithExtraRepository(configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, otherBaseRef))
+
+			providerState, _ := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			storage.PrefillStorage(storageDir, providerState)
+		})
+
+		It("should report the hydration of all the providers at startup", func() {
+			resp, body := apiCall(srv, hydrationReq())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(fmt.Sprintf(`{
+				"%[1]s:%[2]s:%[3]s": {
+					"hydrated_at": "%[5]s",
+					"error": null,
+					"known_count": 2
+				},
+				"%[1]s:%[2]s:%[4]s": {
+					"hydrated_at": "%[5]s",
+					"error": null,
+					"known_count": 0
+				}
+			}`, owner, repo, baseRef, otherBaseRef, now.Format(time.RFC3339Nano))))
+		})
+	})
+
+	Describe("Metrics reset endpoint", func() {
+		outcomeMetric := `aks_mq_lease_service_lease_outcomes_total{endpoint="acquire",provider_id="%s:%s:%s",result="pending"} %d`
+		scrapeMetrics := func() string {
+			resp, body := apiCall(srv, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			return body
+		}
+
+		BeforeEach(func() {
+			clk.SetTime(now)
+		})
+
+		Context("when the metrics reset is not allowed", func() {
+			It("should not expose the route", func() {
+				// the path is then only matching the (GET/DELETE) provider routes
+				resp, _ := apiCall(srv, metricsResetReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+			})
+		})
+
+		Context("when the metrics reset is allowed", func() {
+			BeforeEach(func() {
+				serverOpts = append(serverOpts, serverHelper.WithAllowMetricsReset())
+			})
+
+			It("should reset the counters", func() {
+				resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(scrapeMetrics()).To(ContainSubstring(fmt.Sprintf(outcomeMetric, owner, repo, baseRef, 1)))
+
+				resp, _ = apiCall(srv, metricsResetReq())
+				Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+				Expect(scrapeMetrics()).NotTo(ContainSubstring("aks_mq_lease_service_lease_outcomes_total{"))
+
+				// the counters are starting from zero again
+				resp, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(scrapeMetrics()).To(ContainSubstring(fmt.Sprintf(outcomeMetric, owner, repo, baseRef, 1)))
+			})
+		})
+	})
+
+	Describe("Acquire endpoint decision", func() {
+		var lastUpdatedAt time.Time
+
+		BeforeEach(func() {
+			// all the expected requests but 2 are known, the lowest priority one is then polling
+			statuses := map[int]lease.Status{}
+			for i := 2; i < configHelper.DefaultConfigRepoExpectedRequestCount; i++ {
+				statuses[i] = lease.StatusPending
+			}
+			providerState, opts := generateProviderState(now, owner, repo, baseRef, statuses, nil)
+			storage.PrefillStorage(storageDir, providerState)
+			lastUpdatedAt = opts.LastUpdatedAt
+			clk.SetTime(lastUpdatedAt)
+		})
+
+		Context("when debug is not requested", func() {
+			It("should not expose the decision", func() {
+				resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).NotTo(ContainSubstring(`"decision"`))
+			})
+		})
 
-				Context("if the number of expected request is reached", func() {
-					BeforeEach(func() {
-						statuses := map[int]lease.Status{}
-						toGenerate := configHelper.DefaultConfigRepoExpectedRequestCount - 1
-						for i := 1; i <= toGenerate; i++ {
-							statuses[i] = lease.StatusPending
-						}
-						providerState, opts := generateProviderState(now, owner, repo, baseRef, statuses, nil)
-						storage.PrefillStorage(storageDir, providerState)
-						clk.SetTime(opts.LastUpdatedAt)
+		Context("when debug is requested", func() {
+			It("should expose the decision factors", func() {
+				resp, body := apiCall(srv, acquireDebugReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				var payload map[string]any
+				Expect(json.Unmarshal([]byte(body), &payload)).To(Succeed())
+				Expect(payload["decision"]).To(Equal(map[string]any{
+					"stabilize_passed":       false,
+					"expected_count_reached": false,
+					"known_count":            float64(configHelper.DefaultConfigRepoExpectedRequestCount - 1),
+					"max_priority":           float64(configHelper.DefaultConfigRepoExpectedRequestCount - 1),
+					"your_priority":          float64(1),
+				}))
+			})
 
-						headSha = fmt.Sprintf("xxx-%d", toGenerate+1)
-						headRef = ref(toGenerate + 1)
-						priority = toGenerate + 1
-					})
-					It("the request status should be acquired", func() {
-						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
-						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
-							HeadSHA:  headSha,
-							HeadRef:  headRef,
-							Priority: priority,
-							Status:   pointer.String(lease.StatusAcquired),
-						}, rangeInt(configHelper.DefaultConfigRepoExpectedRequestCount))
-						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
-					})
-				})
+			It("should tell when the stabilize duration has passed", func() {
+				// the new request resets the stabilize window
+				_, _ = apiCall(srv, acquireDebugReq(owner, repo, baseRef, "xxx-1", 1))
+				clk.SetTime(lastUpdatedAt.Add(configHelper.DefaultConfigRepoStabilizeDurationSeconds * time.Second))
+				_, body := apiCall(srv, acquireDebugReq(owner, repo, baseRef, "xxx-1", 1))
+				Expect(body).To(ContainSubstring(`"status":"pending"`))
+				Expect(body).To(ContainSubstring(`"stabilize_passed":true`))
+				Expect(body).To(ContainSubstring(`"expected_count_reached":false`))
+			})
+		})
+	})
 
-				Context("if the stabilize duration has been consumed", func() {
-					BeforeEach(func() {
-						providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
-							1: lease.StatusPending,
-						}, nil)
-						storage.PrefillStorage(storageDir, providerState)
-						currentTime := opts.LastUpdatedAt
-						currentTime = currentTime.Add(time.Second * (configHelper.DefaultConfigRepoStabilizeDurationSeconds + 1))
-						clk.SetTime(currentTime)
+	Describe("Heartbeat endpoint", func() {
+		var lastUpdatedAt time.Time
 
-						headSha = "xxx-1" //nolint:goconst
-						headRef = ref(1)
-						priority = 1
-					})
-					It("the request status should be acquired", func() {
-						Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
-						expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
-							HeadSHA:  headSha,
-							HeadRef:  headRef,
-							Priority: priority,
-							Status:   pointer.String(lease.StatusAcquired),
-						}, rangeInt(1))
-						Expect(acquireRespBody).To(MatchJSON(expectedPayload))
-					})
-				})
+		BeforeEach(func() {
+			providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
+				1: lease.StatusPending,
+				2: lease.StatusAcquired,
+			}, pointer.Int(2))
+			// the lease holder (not polling) was last seen 10 minutes before the pending request
+			lastUpdatedAt = opts.LastUpdatedAt
+			opts.Known["xxx-1"].UpdateLastSeenAt(lastUpdatedAt)
+			opts.Known["xxx-2"].UpdateLastSeenAt(lastUpdatedAt.Add(-10 * time.Minute))
+			storage.PrefillStorage(storageDir, providerState)
+			clk.SetTime(lastUpdatedAt.Add(time.Minute))
+		})
+
+		Context("when the provider is unknown", func() {
+			It("should return a 404 response", func() {
+				resp, _ := apiCall(srv, heartbeatReq("unknown", "unknown", "unknown", "xxx-2"))
+				Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
 			})
+		})
 
-			Context("when the lease has already been acquired", func() {
-				BeforeEach(func() {
-					providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
-						1: lease.StatusPending,
-						2: lease.StatusAcquired,
-					}, pointer.Int(2))
-					storage.PrefillStorage(storageDir, providerState)
-					currentTime := opts.LastUpdatedAt
-					currentTime = currentTime.Add(time.Second)
-					clk.SetTime(currentTime)
-				})
-				Context("when the incoming lease request is new", func() {
-					BeforeEach(func() {
-						headSha = "xxx-3"
-						headRef = ref(3)
-						priority = 3
-					})
-					It("the request should be rejected", func() {
-						Expect(acquireResp.StatusCode).To(Equal(http.StatusConflict))
-					})
-				})
+		Context("when the commit doesn't hold the lease", func() {
+			It("should return a 409 response", func() {
+				resp, body := apiCall(srv, heartbeatReq(owner, repo, baseRef, "xxx-1"))
+				Expect(resp.StatusCode).To(Equal(http.StatusConflict))
+				Expect(body).To(ContainSubstring("commit xxx-1 does not hold the lease"))
+			})
+		})
 
-				Context("when the incoming lease request is already known", func() {
-					BeforeEach(func() {
-						headSha = "xxx-1"
-						headRef = ref(1)
-						priority = 1
-					})
+		Context("when the commit holds the lease", func() {
+			It("should bump the lease holder last seen time", func() {
+				_, body := apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(body).To(ContainSubstring(`"oldest_request_age_seconds":660`))
 
-					Context("if the lease owner has completed", func() {
-						BeforeEach(func() {
-							providerState, opts := generateProviderState(now, owner, repo, baseRef, map[int]lease.Status{
-								1: lease.StatusPending,
-								2: lease.StatusCompleted,
-							}, pointer.Int(2))
-							storage.PrefillStorage(storageDir, providerState)
-							currentTime := opts.LastUpdatedAt
-							currentTime = currentTime.Add(time.Second)
-							clk.SetTime(currentTime)
-						})
-						It("the request status should be completed", func() {
-							Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
-							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
-								HeadSHA:  headSha,
-								HeadRef:  headRef,
-								Priority: priority,
-								Status:   pointer.String(lease.StatusCompleted),
-							}, []int{})
-							Expect(acquireRespBody).To(MatchJSON(expectedPayload))
-						})
-					})
+				resp, body := apiCall(srv, heartbeatReq(owner, repo, baseRef, "xxx-2"))
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring(`"status":"acquired"`))
 
-					Context("if the lease owner has not failed nor succeed yet", func() {
-						It("the request status should continue to be pending", func() {
-							Expect(acquireResp.StatusCode).To(Equal(http.StatusOK))
-							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
-								HeadSHA:  headSha,
-								HeadRef:  headRef,
-								Priority: priority,
-								Status:   pointer.String(lease.StatusPending),
-							}, []int{})
-							Expect(acquireRespBody).To(MatchJSON(expectedPayload))
-						})
-					})
-				})
+				// the pending request is now the least recently seen one
+				_, body = apiCall(srv, providerStatsReq(owner, repo, baseRef))
+				Expect(body).To(ContainSubstring(`"oldest_request_age_seconds":60`))
 			})
 		})
 	})
@@ -560,6 +2698,33 @@ var _ = Describe("API", Ordered, func() {
 							}, []int{})
 							Expect(releaseRespBody).To(MatchJSON(expectedPayload))
 						})
+
+						It("should accept the retried release as a no-op, even once the lease is cleaned up", func() {
+							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+								HeadSHA:  headSha,
+								HeadRef:  headRef,
+								Priority: priority,
+								Status:   pointer.String(lease.StatusCompleted),
+							}, []int{})
+
+							resp, body := apiCall(srv, releaseReq(owner, repo, baseRef, headSha, priority, status))
+							Expect(resp.StatusCode).To(Equal(http.StatusOK))
+							Expect(body).To(MatchJSON(expectedPayload))
+
+							// the remaining request of the batch completes, cleaning up the lease
+							resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+							Expect(resp.StatusCode).To(Equal(http.StatusOK))
+							Expect(body).To(ContainSubstring(`"status":"completed"`))
+
+							resp, body = apiCall(srv, releaseReq(owner, repo, baseRef, headSha, priority, status))
+							Expect(resp.StatusCode).To(Equal(http.StatusOK))
+							Expect(body).To(MatchJSON(expectedPayload))
+						})
+
+						It("should still reject a release with another status", func() {
+							resp, _ := apiCall(srv, releaseReq(owner, repo, baseRef, headSha, priority, lease.StatusFailure))
+							Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+						})
 					})
 
 					Context("and the reported status is a failure", func() {
@@ -577,6 +2742,35 @@ var _ = Describe("API", Ordered, func() {
 							Expect(releaseRespBody).To(MatchJSON(expectedPayload))
 						})
 					})
+
+					Context("and the reported status is a cancellation", func() {
+						BeforeEach(func() {
+							status = lease.StatusCancelled
+						})
+						It("should free the lease for the next request", func() {
+							Expect(releaseResp.StatusCode).To(Equal(http.StatusOK))
+							expectedPayload := buildExpectedRequestContextPayload(&lease.Request{
+								HeadSHA:  headSha,
+								HeadRef:  headRef,
+								Priority: priority,
+								Status:   pointer.String(lease.StatusCancelled),
+							}, []int{})
+							Expect(releaseRespBody).To(MatchJSON(expectedPayload))
+
+							resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+							Expect(resp.StatusCode).To(Equal(http.StatusOK))
+							Expect(body).To(ContainSubstring(`"status":"acquired"`))
+						})
+					})
+
+					Context("and the reported status is unknown", func() {
+						BeforeEach(func() {
+							status = "unknown"
+						})
+						It("should reject the release request", func() {
+							Expect(releaseResp.StatusCode).To(Equal(http.StatusBadRequest))
+						})
+					})
 				})
 			})
 		})
@@ -869,6 +3063,124 @@ func providerDetailsReq(owner string, repo string, baseRef string) *http.Request
 	)
 }
 
+// drainReq returns a pre-configured request for the "POST|DELETE /_admin/drain" endpoints
+func drainReq(draining bool) *http.Request {
+	method := "POST"
+	if !draining {
+		method = "DELETE"
+	}
+	return httptest.NewRequest(method, "/_admin/drain", nil)
+}
+
+// freezeReq returns a pre-configured request for the "POST /:owner/:repo/:baseRef/freeze|unfreeze" endpoints
+func freezeReq(owner string, repo string, baseRef string, frozen bool) *http.Request {
+	action := "freeze"
+	if !frozen {
+		action = "unfreeze"
+	}
+	return httptest.NewRequest("POST", fmt.Sprintf("/%s/%s/%s/%s", owner, repo, baseRef, action), nil)
+}
+
+// providerConfigUpdateReq returns a pre-configured request for the "PATCH /:owner/:repo/:baseRef/config" endpoint
+func providerConfigUpdateReq(owner string, repo string, baseRef string, update string) *http.Request {
+	req := httptest.NewRequest("PATCH", fmt.Sprintf("/%s/%s/%s/config", owner, repo, baseRef), strings.NewReader(update))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// clearAllReq returns a pre-configured request for the "DELETE /_admin/state" endpoint
+func clearAllReq(confirm bool) *http.Request {
+	return httptest.NewRequest("DELETE", fmt.Sprintf("/_admin/state?confirm=%t", confirm), nil)
+}
+
+// acquiredLeasesReq returns a pre-configured request for the "GET /_admin/acquired" endpoint
+func acquiredLeasesReq() *http.Request {
+	return httptest.NewRequest("GET", "/_admin/acquired", nil)
+}
+
+// hydrationReq returns a pre-configured request for the "GET /_admin/hydration" endpoint
+func hydrationReq() *http.Request {
+	return httptest.NewRequest("GET", "/_admin/hydration", nil)
+}
+
+// metricsResetReq returns a pre-configured request for the "POST /_admin/metrics/reset" endpoint
+func metricsResetReq() *http.Request {
+	return httptest.NewRequest("POST", "/_admin/metrics/reset", nil)
+}
+
+// exportReq returns a pre-configured request for the "GET /_admin/export" endpoint
+func exportReq() *http.Request {
+	return httptest.NewRequest("GET", "/_admin/export", nil)
+}
+
+// importReq returns a pre-configured request for the "POST /_admin/import" endpoint
+func importReq(states string, confirm bool) *http.Request {
+	req := httptest.NewRequest("POST", fmt.Sprintf("/_admin/import?confirm=%t", confirm), strings.NewReader(states))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return req
+}
+
+// healthReq returns a pre-configured request for the "GET /healthz" endpoint
+func healthReq() *http.Request {
+	return httptest.NewRequest("GET", "/healthz", nil)
+}
+
+// versionReq returns a pre-configured request for the "GET /_meta/version" endpoint
+func versionReq() *http.Request {
+	return httptest.NewRequest("GET", "/_meta/version", nil)
+}
+
+// openAPIReq returns a pre-configured request for the "GET /_meta/openapi.json" endpoint
+func openAPIReq() *http.Request {
+	return httptest.NewRequest("GET", "/_meta/openapi.json", nil)
+}
+
+// providerStatsReq returns a pre-configured request for the "GET /:owner/:repo/:baseRef/stats" endpoint
+func providerStatsReq(owner string, repo string, baseRef string) *http.Request {
+	return httptest.NewRequest(
+		"GET",
+		fmt.Sprintf("/%s/%s/%s/stats", owner, repo, baseRef),
+		nil,
+	)
+}
+
+// providerHistoryReq returns a pre-configured request for the "GET /:owner/:repo/:baseRef/history" endpoint
+func providerHistoryReq(owner string, repo string, baseRef string) *http.Request {
+	return httptest.NewRequest(
+		"GET",
+		fmt.Sprintf("/%s/%s/%s/history", owner, repo, baseRef),
+		nil,
+	)
+}
+
+// providerStatusesReq returns a pre-configured request for the "GET /:owner/:repo/:baseRef/statuses" endpoint
+func providerStatusesReq(owner string, repo string, baseRef string) *http.Request {
+	return httptest.NewRequest(
+		"GET",
+		fmt.Sprintf("/%s/%s/%s/statuses", owner, repo, baseRef),
+		nil,
+	)
+}
+
+// requestTimelineReq returns a pre-configured request for the "GET /:owner/:repo/:baseRef/requests/:headSha/timeline"
+// endpoint
+func requestTimelineReq(owner string, repo string, baseRef string, headSHA string) *http.Request {
+	return httptest.NewRequest(
+		"GET",
+		fmt.Sprintf("/%s/%s/%s/requests/%s/timeline", owner, repo, baseRef, headSHA),
+		nil,
+	)
+}
+
+// winnerReq returns a pre-configured request for the "GET /:owner/:repo/:baseRef/winner" endpoint
+func winnerReq(owner string, repo string, baseRef string) *http.Request {
+	return httptest.NewRequest(
+		"GET",
+		fmt.Sprintf("/%s/%s/%s/winner", owner, repo, baseRef),
+		nil,
+	)
+}
+
 // providerClearReq returns a pre-configured request for the "DELETE /:owner/:repo/:baseRef" endpoint
 func providerClearReq(owner string, repo string, baseRef string) *http.Request {
 	return httptest.NewRequest(
@@ -878,6 +3190,15 @@ func providerClearReq(owner string, repo string, baseRef string) *http.Request {
 	)
 }
 
+// providerSafeClearReq returns a pre-configured request for the "DELETE /:owner/:repo/:baseRef?safe=true" endpoint
+func providerSafeClearReq(owner string, repo string, baseRef string) *http.Request {
+	return httptest.NewRequest(
+		"DELETE",
+		fmt.Sprintf("/%s/%s/%s?safe=true", owner, repo, baseRef),
+		nil,
+	)
+}
+
 // acquireReq returns a pre-configured request for the "POST /:owner/:repo/:baseRef/acquire" endpoint
 func acquireReq(owner string, repo string, baseRef string, headSha string, priority int) *http.Request {
 	req := httptest.NewRequest(
@@ -889,6 +3210,17 @@ func acquireReq(owner string, repo string, baseRef string, headSha string, prior
 	return req
 }
 
+// acquireDebugReq returns a pre-configured request for the "POST /:owner/:repo/:baseRef/acquire?debug=true" endpoint
+func acquireDebugReq(owner string, repo string, baseRef string, headSha string, priority int) *http.Request {
+	req := httptest.NewRequest(
+		"POST",
+		fmt.Sprintf("/%s/%s/%s/acquire?debug=true", owner, repo, baseRef),
+		strings.NewReader(fmt.Sprintf(`{"head_sha": "%s", "head_ref": "%s", "priority": %d}`, headSha, ref(priority), priority)),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
 // releaseReq returns a pre-configured request for the "POST /:owner/:repo/:baseRef/release" endpoint
 func releaseReq(owner string, repo string, baseRef string, headSha string, priority int, status string) *http.Request {
 	req := httptest.NewRequest(
@@ -900,9 +3232,27 @@ func releaseReq(owner string, repo string, baseRef string, headSha string, prior
 	return req
 }
 
+// heartbeatReq returns a pre-configured request for the "POST /:owner/:repo/:baseRef/heartbeat" endpoint
+func heartbeatReq(owner string, repo string, baseRef string, headSha string) *http.Request {
+	req := httptest.NewRequest(
+		"POST",
+		fmt.Sprintf("/%s/%s/%s/heartbeat", owner, repo, baseRef),
+		strings.NewReader(fmt.Sprintf(`{"head_sha": "%s"}`, headSha)),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// testRequestID is the request ID sent by apiCall, when the request doesn't carry its own
+const testRequestID = "e2e-request-id"
+
 // apiCall is simulating an API call to the server (using the provided http request).
 // note that it is not calling a standalone server, but hooking into the fiber app directly, using their app.Test() method.
 func apiCall(srv server.Server, req *http.Request) (resp *http.Response, body string) {
+	// use a known request ID (unless the test case provides its own), so that the error payloads are predictable
+	if req.Header.Get(middlewares.RequestIDHeaderName) == "" {
+		req.Header.Set(middlewares.RequestIDHeaderName, testRequestID)
+	}
 	var err error
 	resp, err = srv.Test(req)
 	Expect(err).To(BeNil())
@@ -919,7 +3269,8 @@ func apiCall(srv server.Server, req *http.Request) (resp *http.Response, body st
 // generateProviderState ease the generation of a lease.ProviderState object, which can be then feed into the storage helper
 // to inject a know state in the storage before running the test case.
 func generateProviderState(now time.Time, owner string, repo string, baseRef string, releaseStatus map[int]lease.Status, acquired *int) (*lease.ProviderState, *lease.NewProviderStateOpts) {
-	currentTime := now
+	// requests are seen every 2 seconds, the last one being seen (and the provider being updated) at the given time
+	currentTime := now.Add(-time.Second * 2 * time.Duration(len(releaseStatus)))
 	known := map[string]*lease.Request{}
 	var acquiredLeaseRequest *lease.Request
 	for i, status := range releaseStatus {
@@ -0,0 +1,111 @@
+package e2e_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// Oversize bodies are rejected by the underlying HTTP server before reaching fiber handlers, in a way that app.Test()
+// can't observe. Those tests are then running against a real listening server.
+var _ = Describe("Body limit", Ordered, func() {
+	const bodyLimit = 1024
+
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var baseURL string
+
+	BeforeAll(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+		_, configPath := config.LoadDefaultConfig()
+
+		port := freePort()
+		baseURL = fmt.Sprintf("http://127.0.0.1:%d", port)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		grp := errgroup.Group{}
+		srv := serverHelper.New(
+			configPath,
+			storage.NewStorageDir(),
+			testing.NewFakePassiveClock(time.Now()),
+			serverHelper.WithPort(port),
+			serverHelper.WithBodyLimit(bodyLimit),
+		)
+		grp.Go(func() error {
+			return srv.Run(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+		// wait for the server to actually listen
+		Eventually(func() error {
+			resp, err := http.Get(baseURL + "/k8s/liveness")
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			return err
+		}, 5*time.Second, 50*time.Millisecond).Should(Succeed())
+
+		DeferCleanup(func() {
+			cancel()
+			_ = grp.Wait()
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	acquire := func(body string) (*http.Response, string) {
+		resp, err := http.Post(
+			fmt.Sprintf("%s/%s/%s/%s/acquire", baseURL, configHelper.DefaultConfigRepoOwner, configHelper.DefaultConfigRepoName, configHelper.DefaultConfigRepoBaseRef),
+			"application/json",
+			strings.NewReader(body),
+		)
+		Expect(err).To(BeNil())
+		defer func() { _ = resp.Body.Close() }()
+		data, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		return resp, string(data)
+	}
+
+	Context("when the body is under the limit", func() {
+		It("should process the request", func() {
+			resp, _ := acquire(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": "%s", "priority": 1}`, ref(1)))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when the body is over the limit", func() {
+		It("should reject the request with a 413 and a JSON error", func() {
+			padding := strings.Repeat("a", bodyLimit)
+			resp, body := acquire(fmt.Sprintf(`{"head_sha": "%s", "head_ref": "%s", "priority": 1}`, padding, ref(1)))
+			Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(body).To(MatchJSON(fmt.Sprintf(`{
+				"error": "Request body too large",
+				"error_context": {"max_body_size": %d}
+			}`, bodyLimit)))
+		})
+	})
+})
+
+// freePort asks the kernel for a free port to listen on
+func freePort() int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	defer func() { _ = l.Close() }()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -1,10 +1,16 @@
 package e2e_test
 
 import (
+	"context"
+	"time"
+
 	"github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
 	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
 	. "github.com/onsi/ginkgo/v2" //nolint
 	. "github.com/onsi/gomega" //nolint
+	"k8s.io/utils/clock/testing"
 )
 
 var _ = Describe("Config", Ordered, func() {
@@ -50,6 +56,143 @@ var _ = Describe("Config", Ordered, func() {
 		})
 	})
 
+	Describe("MaxProviders", func() {
+		Context("with more repositories than the max_providers limit", func() {
+			It("should fail the server setup", func() {
+				storage := storageHelper.NewHelper()
+				DeferCleanup(storage.Cleanup)
+				DeferCleanup(configHelper.CleanupEnv)
+
+				_, configPath := configHelper.LoadDefaultConfig(
+					config.WithExtraRepository("another-owner", "another-repo", "main"),
+					config.WithExtraConfig("max_providers: 1"),
+				)
+				srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+
+				err := srv.RunTest(context.Background())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("too many repositories configured: 2, the limit is 1"))
+			})
+		})
+	})
+
+	Describe("MaxStabilizeDuration", func() {
+		runServer := func(options ...config.HelperOption) error {
+			storage := storageHelper.NewHelper()
+			DeferCleanup(storage.Cleanup)
+			DeferCleanup(configHelper.CleanupEnv)
+
+			_, configPath := configHelper.LoadDefaultConfig(options...)
+			srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+			return srv.RunTest(context.Background())
+		}
+
+		Context("with a stabilize duration over the default limit", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithStabilizeDurationSeconds(30000000))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("stabilize duration of e2e/e2e-repo@main is too long: 30000000s, the limit is 86400s"))
+			})
+		})
+
+		Context("with a stabilize duration over the configured limit", func() {
+			It("should fail the server setup", func() {
+				err := runServer(
+					config.WithStabilizeDurationSeconds(120),
+					config.WithExtraConfig("max_stabilize_duration_seconds: 60"),
+				)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("stabilize duration of e2e/e2e-repo@main is too long: 120s, the limit is 60s"))
+			})
+		})
+	})
+
+	Describe("RateLimit", func() {
+		Context("with an invalid rate limit key", func() {
+			It("should fail the server setup", func() {
+				storage := storageHelper.NewHelper()
+				DeferCleanup(storage.Cleanup)
+				DeferCleanup(configHelper.CleanupEnv)
+
+				_, configPath := configHelper.LoadDefaultConfig(config.WithExtraConfig("rate_limit:\n  max: 10\n  key: user-agent\n"))
+				srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+
+				err := srv.RunTest(context.Background())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`invalid rate limit key "user-agent" (expected ip or credential)`))
+			})
+		})
+	})
+
+	Describe("DynamicProviders", func() {
+		Context("with an invalid allowlist pattern", func() {
+			It("should fail the server setup", func() {
+				storage := storageHelper.NewHelper()
+				DeferCleanup(storage.Cleanup)
+				DeferCleanup(configHelper.CleanupEnv)
+
+				_, configPath := configHelper.LoadDefaultConfig(config.WithExtraConfig("allow_dynamic_providers:\n  allow: [\"acme-[\"]\n"))
+				srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+
+				err := srv.RunTest(context.Background())
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`invalid dynamic providers allowlist pattern "acme-["`))
+			})
+		})
+	})
+
+	Describe("RepositorySettings", func() {
+		runServer := func(options ...config.HelperOption) error {
+			storage := storageHelper.NewHelper()
+			DeferCleanup(storage.Cleanup)
+			DeferCleanup(configHelper.CleanupEnv)
+
+			_, configPath := configHelper.LoadDefaultConfig(options...)
+			srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+			return srv.RunTest(context.Background())
+		}
+
+		Context("with a base ref holding the provider key separator", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithBaseRef("main:q1"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`e2e/e2e-repo@main:q1: invalid provider key part "main:q1" (":" isn't allowed)`))
+			})
+		})
+
+		Context("with an invalid winner selection", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithExtraConfig("allow_dynamic_providers:\n  allow: [acme]\n  defaults:\n    winner_selection: best\n"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`dynamic providers: invalid winner selection "best" (expected highest or lowest)`))
+			})
+		})
+
+		Context("with an invalid priority from ref", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithPriorityFromRef("desc"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`e2e/e2e-repo@main: invalid priority from ref "desc" (expected ascending or descending)`))
+			})
+		})
+
+		Context("with an invalid stabilize from", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithExtraConfig("allow_dynamic_providers:\n  allow: [acme]\n  defaults:\n    stabilize_from: first_poll\n"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`dynamic providers: invalid stabilize from "first_poll" (expected last_update or first_request)`))
+			})
+		})
+
+		Context("with an invalid completed response", func() {
+			It("should fail the server setup", func() {
+				err := runServer(config.WithExtraConfig("allow_dynamic_providers:\n  allow: [acme]\n  defaults:\n    completed_response: released\n"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`dynamic providers: invalid completed response "released" (expected completed or outcome)`))
+			})
+		})
+	})
+
 	AfterAll(func() {
 		configHelper.Cleanup()
 	})
@@ -0,0 +1,93 @@
+package e2e_test
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	goldenHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/golden"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	"github.com/ankorstore/mq-lease-service/internal/server"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "Update the golden files of the API responses (e2e/testdata/golden) instead of comparing them")
+
+// The API responses are compared with their golden files, to catch any (unintended) change of the API shape. The
+// server runs with a fake clock, so that the responses are deterministic.
+var _ = Describe("API responses goldens", func() {
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var golden *goldenHelper.Helper
+	var srv server.Server
+	var clk *testing.FakePassiveClock
+	var now time.Time
+
+	owner := configHelper.DefaultConfigRepoOwner
+	repo := configHelper.DefaultConfigRepoName
+	baseRef := configHelper.DefaultConfigRepoBaseRef
+
+	expectGolden := func(name string, req *http.Request, expectedStatus int) {
+		resp, body := apiCall(srv, req)
+		Expect(resp.StatusCode).To(Equal(expectedStatus))
+		Expect(golden.Compare(name, body)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+		golden = goldenHelper.NewHelper("testdata/golden", *updateGolden)
+		now, _ = time.Parse(time.RFC3339, "2023-01-01T10:00:00+01:00")
+		clk = testing.NewFakePassiveClock(now)
+		_, configPath := config.LoadDefaultConfig()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		grp := errgroup.Group{}
+		srv = serverHelper.New(configPath, storage.NewStorageDir(), clk)
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		DeferCleanup(func() {
+			cancel()
+			Expect(grp.Wait()).To(BeNil())
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	It("should match the goldens of the providers list", func() {
+		expectGolden("providers_list", providerListReq(), http.StatusOK)
+	})
+
+	It("should match the goldens along a complete flow", func() {
+		expectGolden("acquire_pending", acquireReq(owner, repo, baseRef, "xxx-1", 1), http.StatusOK)
+		_, _ = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+		expectGolden("details_pending", providerDetailsReq(owner, repo, baseRef), http.StatusOK)
+
+		clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds) * time.Second))
+		expectGolden("acquire_acquired", acquireReq(owner, repo, baseRef, "xxx-2", 2), http.StatusOK)
+		expectGolden("acquire_conflict", acquireReq(owner, repo, baseRef, "xxx-3", 3), http.StatusConflict)
+		expectGolden("details_acquired", providerDetailsReq(owner, repo, baseRef), http.StatusOK)
+
+		clk.SetTime(now.Add(time.Minute))
+		expectGolden("release_success", releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"), http.StatusOK)
+		expectGolden("acquire_completed", acquireReq(owner, repo, baseRef, "xxx-1", 1), http.StatusOK)
+		expectGolden("details_released", providerDetailsReq(owner, repo, baseRef), http.StatusOK)
+	})
+
+	It("should match the goldens of the release errors", func() {
+		expectGolden("release_not_acquired", releaseReq(owner, repo, baseRef, "xxx-1", 1, "success"), http.StatusBadRequest)
+	})
+})
@@ -0,0 +1,55 @@
+package e2e_test
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// The storage is closed when the server stops: the app is still answering (through app.Test()), which allows to check
+// the health of an instance whose storage is unusable.
+var _ = Describe("Health endpoint with an unhealthy storage", func() {
+	It("should be unhealthy", func() {
+		config := configHelper.NewHelper()
+		storage := storageHelper.NewHelper()
+		DeferCleanup(func() {
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+		_, configPath := config.LoadDefaultConfig()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		grp := errgroup.Group{}
+		srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		resp, _ := apiCall(srv, healthReq())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		// stopping the server closes the storage
+		cancel()
+		Expect(grp.Wait()).To(BeNil())
+
+		resp, body := apiCall(srv, healthReq())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(body).To(MatchJSON(`{
+			"healthy": false,
+			"liveness": {"healthy": true},
+			"readiness": {"healthy": false, "reason": "storage healthcheck failed"}
+		}`))
+	})
+})
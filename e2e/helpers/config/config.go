@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/ankorstore/mq-lease-service/internal/config"
 	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
@@ -17,6 +18,17 @@ const (
 	DefaultConfigRepoExpectedRequestCount     = 4
 	DefaultConfigRepoTTLSeconds               = 200
 	DefaultConfigRepoDelayAssignmentCount     = 0
+	// 0 means the server default bounds are used
+	DefaultConfigRepoPollIntervalMinSeconds = 0
+	DefaultConfigRepoPollIntervalMaxSeconds = 0
+	DefaultConfigRepoGenericMode            = false
+	// 0 means the priority is unbounded
+	DefaultConfigRepoMaxPriority = 0
+	// 0 means the priority is required
+	DefaultConfigRepoDefaultPriority = 0
+	DefaultConfigRepoPendingAccepted = false
+	// empty means the priority is sent by the clients
+	DefaultConfigRepoPriorityFromRef = ""
 )
 
 // baseConfigContent default YAML configuration used in GenerateDefaultConfig method
@@ -29,6 +41,15 @@ repositories:
     expected_request_count: ${E2E_CONFIG_REPO_EXPECTED_REQUEST_COUNT}
     ttl_seconds: ${E2E_CONFIG_REPO_TTL_SECONDS}
     delay_lease_assignment_by: ${E2E_CONFIG_REPO_DELAY_ASSIGNMENT_COUNT}
+    poll_interval_min_seconds: ${E2E_CONFIG_REPO_POLL_INTERVAL_MIN_SECONDS}
+    poll_interval_max_seconds: ${E2E_CONFIG_REPO_POLL_INTERVAL_MAX_SECONDS}
+    generic_mode: ${E2E_CONFIG_REPO_GENERIC_MODE}
+    max_priority: ${E2E_CONFIG_REPO_MAX_PRIORITY}
+    default_priority: ${E2E_CONFIG_REPO_DEFAULT_PRIORITY}
+    pending_accepted: ${E2E_CONFIG_REPO_PENDING_ACCEPTED}
+    priority_from_ref: ${E2E_CONFIG_REPO_PRIORITY_FROM_REF}
+${E2E_CONFIG_EXTRA_REPOSITORIES}
+${E2E_CONFIG_EXTRA}
 `
 
 type HelperOption func() map[string]string
@@ -96,6 +117,107 @@ func WithDelayAssignmentCount(count int) HelperOption {
 	}
 }
 
+// WithPollIntervalSeconds override the poll interval bounds used in base configuration YAML (i.e. don't use the default ones)
+func WithPollIntervalSeconds(minSeconds int, maxSeconds int) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_POLL_INTERVAL_MIN_SECONDS": strconv.Itoa(minSeconds),
+			"E2E_CONFIG_REPO_POLL_INTERVAL_MAX_SECONDS": strconv.Itoa(maxSeconds),
+		}
+	}
+}
+
+// WithGenericMode override the generic mode value used in base configuration YAML (i.e. don't use the default one)
+func WithGenericMode(enabled bool) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_GENERIC_MODE": strconv.FormatBool(enabled),
+		}
+	}
+}
+
+// WithMaxPriority override the max priority value used in base configuration YAML (i.e. don't use the default one)
+func WithMaxPriority(maxPriority int) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_MAX_PRIORITY": strconv.Itoa(maxPriority),
+		}
+	}
+}
+
+// WithDefaultPriority override the default priority value used in base configuration YAML (i.e. don't use the default
+// one)
+func WithDefaultPriority(priority int) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_DEFAULT_PRIORITY": strconv.Itoa(priority),
+		}
+	}
+}
+
+// WithPendingAccepted override the pending accepted value used in base configuration YAML (i.e. don't use the default
+// one)
+func WithPendingAccepted(enabled bool) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_PENDING_ACCEPTED": strconv.FormatBool(enabled),
+		}
+	}
+}
+
+// WithPriorityFromRef override the priority from ref value used in base configuration YAML (i.e. don't use the default
+// one)
+func WithPriorityFromRef(order string) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_REPO_PRIORITY_FROM_REF": order,
+		}
+	}
+}
+
+// WithExtraRepository adds a repository (using the default settings) to the base configuration YAML
+func WithExtraRepository(owner string, name string, baseRef string) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_EXTRA_REPOSITORIES": "  - owner: " + owner + "\n" +
+				"    name: " + name + "\n" +
+				"    base_ref: " + baseRef + "\n" +
+				"    stabilize_duration_seconds: " + strconv.Itoa(DefaultConfigRepoStabilizeDurationSeconds) + "\n" +
+				"    expected_request_count: " + strconv.Itoa(DefaultConfigRepoExpectedRequestCount) + "\n" +
+				"    ttl_seconds: " + strconv.Itoa(DefaultConfigRepoTTLSeconds) + "\n",
+		}
+	}
+}
+
+// WithExtraQueues adds a repository (using the default settings) per queue name, all of them on the default repository
+// and base ref
+func WithExtraQueues(queues ...string) HelperOption {
+	return func() map[string]string {
+		var repositories strings.Builder
+		for _, queue := range queues {
+			repositories.WriteString("  - owner: " + DefaultConfigRepoOwner + "\n" +
+				"    name: " + DefaultConfigRepoName + "\n" +
+				"    base_ref: " + DefaultConfigRepoBaseRef + "\n" +
+				"    queue: " + queue + "\n" +
+				"    stabilize_duration_seconds: " + strconv.Itoa(DefaultConfigRepoStabilizeDurationSeconds) + "\n" +
+				"    expected_request_count: " + strconv.Itoa(DefaultConfigRepoExpectedRequestCount) + "\n" +
+				"    ttl_seconds: " + strconv.Itoa(DefaultConfigRepoTTLSeconds) + "\n")
+		}
+		return map[string]string{
+			"E2E_CONFIG_EXTRA_REPOSITORIES": repositories.String(),
+		}
+	}
+}
+
+// WithExtraConfig appends the given YAML (top level keys, like `auth`) to the base configuration YAML
+func WithExtraConfig(yaml string) HelperOption {
+	return func() map[string]string {
+		return map[string]string{
+			"E2E_CONFIG_EXTRA": yaml,
+		}
+	}
+}
+
 type Helper struct {
 	baseDir      string
 	setupEnvVars map[string]struct{}
@@ -168,6 +290,15 @@ func (h *Helper) LoadDefaultConfig(options ...HelperOption) (*latest.ServerConfi
 			"E2E_CONFIG_REPO_EXPECTED_REQUEST_COUNT":     strconv.Itoa(DefaultConfigRepoExpectedRequestCount),
 			"E2E_CONFIG_REPO_TTL_SECONDS":                strconv.Itoa(DefaultConfigRepoTTLSeconds),
 			"E2E_CONFIG_REPO_DELAY_ASSIGNMENT_COUNT":     strconv.Itoa(DefaultConfigRepoDelayAssignmentCount),
+			"E2E_CONFIG_REPO_POLL_INTERVAL_MIN_SECONDS":  strconv.Itoa(DefaultConfigRepoPollIntervalMinSeconds),
+			"E2E_CONFIG_REPO_POLL_INTERVAL_MAX_SECONDS":  strconv.Itoa(DefaultConfigRepoPollIntervalMaxSeconds),
+			"E2E_CONFIG_REPO_GENERIC_MODE":               strconv.FormatBool(DefaultConfigRepoGenericMode),
+			"E2E_CONFIG_REPO_MAX_PRIORITY":               strconv.Itoa(DefaultConfigRepoMaxPriority),
+			"E2E_CONFIG_REPO_DEFAULT_PRIORITY":           strconv.Itoa(DefaultConfigRepoDefaultPriority),
+			"E2E_CONFIG_REPO_PENDING_ACCEPTED":           strconv.FormatBool(DefaultConfigRepoPendingAccepted),
+			"E2E_CONFIG_REPO_PRIORITY_FROM_REF":          DefaultConfigRepoPriorityFromRef,
+			"E2E_CONFIG_EXTRA_REPOSITORIES":              "",
+			"E2E_CONFIG_EXTRA":                           "",
 		}
 	}
 
@@ -0,0 +1,64 @@
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// Helper compares the API responses with their golden files (the canonical JSON responses, stored alongside the tests),
+// so that any change of the API shape is caught. In update mode, the golden files are (re)written instead.
+type Helper struct {
+	dir    string
+	update bool
+}
+
+// NewHelper creates a helper reading (or writing, in update mode) the golden files of the given directory
+func NewHelper(dir string, update bool) *Helper {
+	return &Helper{dir: dir, update: update}
+}
+
+// Compare returns an error if the JSON body doesn't match the golden file of the given name (the formatting and the
+// order of the keys are not significant). In update mode, the golden file is written with the body instead.
+func (h *Helper) Compare(name string, body string) error {
+	path := filepath.Join(h.dir, name+".json")
+	actual, err := indent(body)
+	if err != nil {
+		return fmt.Errorf("invalid JSON response for %s: %w", name, err)
+	}
+	if h.update {
+		if err := os.MkdirAll(h.dir, 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, actual, 0o644) //nolint:gosec // golden files are part of the sources
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed reading the golden file (run with -update-golden to create it): %w", err)
+	}
+	var expectedValue, actualValue any
+	if err := json.Unmarshal(expected, &expectedValue); err != nil {
+		return fmt.Errorf("invalid golden file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(actual, &actualValue); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(expectedValue, actualValue) {
+		return fmt.Errorf("response doesn't match the golden file %s (run with -update-golden to update it)\nexpected:\n%s\nactual:\n%s", path, expected, actual)
+	}
+	return nil
+}
+
+// indent returns the indented form of the JSON body (ending with a new line)
+func indent(body string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := json.Indent(buf, []byte(body), "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
@@ -7,15 +7,87 @@ import (
 	"k8s.io/utils/clock"
 )
 
+// Option allows to tweak the server options before the server instance is created
+type Option func(opts *server.NewOpts)
+
+// WithCompression enables the response compression on the server
+func WithCompression() Option {
+	return func(opts *server.NewOpts) {
+		opts.Compression = true
+	}
+}
+
+// WithPort sets the port the server is listening on (only relevant when the server is started with Run)
+func WithPort(port int) Option {
+	return func(opts *server.NewOpts) {
+		opts.Port = port
+	}
+}
+
+// WithBodyLimit sets the max request body size accepted by the server
+func WithBodyLimit(limit int) Option {
+	return func(opts *server.NewOpts) {
+		opts.BodyLimit = limit
+	}
+}
+
+// WithFollowerMode runs the server as a follower of the given writer instance
+func WithFollowerMode(writerURL string) Option {
+	return func(opts *server.NewOpts) {
+		opts.Mode = server.ModeFollower
+		opts.WriterURL = writerURL
+	}
+}
+
+// WithAllowEventTime allows the acquire/release requests to carry their own event time
+func WithAllowEventTime() Option {
+	return func(opts *server.NewOpts) {
+		opts.AllowEventTime = true
+	}
+}
+
+// WithAllowMetricsReset exposes the metrics reset administration route
+func WithAllowMetricsReset() Option {
+	return func(opts *server.NewOpts) {
+		opts.AllowMetricsReset = true
+	}
+}
+
+// WithLogBodies enables the logging of the provider routes request bodies
+func WithLogBodies() Option {
+	return func(opts *server.NewOpts) {
+		opts.LogBodies = true
+	}
+}
+
+// WithInMemoryStorage keeps the states in an in-memory storage (the persistent state directory is ignored)
+func WithInMemoryStorage() Option {
+	return func(opts *server.NewOpts) {
+		opts.InMemoryStorage = true
+	}
+}
+
+// WithTLS serves HTTPS with the given certificate and private key files
+func WithTLS(certFile string, keyFile string) Option {
+	return func(opts *server.NewOpts) {
+		opts.TLSCertFile = certFile
+		opts.TLSKeyFile = keyFile
+	}
+}
+
 // CreateAndInit creates a base API server (with a dummy logger) and with the provided dependencies
 // the user will probably want to use pre-configured mocked services (for example the clock), or a custom storage path
-func New(configPath string, persistentStateDir string, clock clock.PassiveClock) server.Server {
-	return server.New(server.NewOpts{
+func New(configPath string, persistentStateDir string, clock clock.PassiveClock, options ...Option) server.Server {
+	opts := server.NewOpts{
 		// the port isn't that important here, since we're not going to start it, but rather use fiber app.Test
 		// methods to directly tests the httpHandlers
 		Port:               rand.Intn(1000) + 10000, //nolint
 		ConfigPath:         configPath,
 		PersistentStateDir: persistentStateDir,
 		Clock:              clock,
-	})
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	return server.New(opts)
 }
@@ -0,0 +1,115 @@
+package e2e_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	"github.com/ankorstore/mq-lease-service/internal/server"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+var _ = Describe("In-memory storage", func() {
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var storageDir string
+	var srv server.Server
+	var clk *testing.FakePassiveClock
+
+	owner := configHelper.DefaultConfigRepoOwner
+	repo := configHelper.DefaultConfigRepoName
+	baseRef := configHelper.DefaultConfigRepoBaseRef
+	now := time.Now()
+
+	BeforeEach(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+		_, configPath := config.LoadDefaultConfig()
+		storageDir = storage.NewStorageDir()
+		clk = testing.NewFakePassiveClock(now)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		grp := errgroup.Group{}
+		srv = serverHelper.New(configPath, storageDir, clk, serverHelper.WithInMemoryStorage())
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		DeferCleanup(func() {
+			cancel()
+			Expect(grp.Wait()).To(BeNil())
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	It("should run the full acquire/release flow", func() {
+		resp, body := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"status":"pending"`))
+		resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"status":"pending"`))
+
+		clk.SetTime(now.Add(time.Duration(configHelper.DefaultConfigRepoStabilizeDurationSeconds+1) * time.Second))
+		resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-2", 2))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"status":"acquired"`))
+
+		resp, body = apiCall(srv, releaseReq(owner, repo, baseRef, "xxx-2", 2, "success"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"status":"completed"`))
+
+		resp, body = apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"status":"completed"`))
+	})
+
+	It("should store the states (serialized) in memory only", func() {
+		resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp, body := apiCall(srv, exportReq())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(ContainSubstring(`"head_sha":"xxx-1"`))
+
+		entries, err := os.ReadDir(storageDir)
+		Expect(err).To(BeNil())
+		Expect(entries).To(BeEmpty())
+	})
+})
+
+var _ = Describe("In-memory storage configuration", func() {
+	It("should fail to start in follower mode", func() {
+		config := configHelper.NewHelper()
+		storage := storageHelper.NewHelper()
+		DeferCleanup(func() {
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+		_, configPath := config.LoadDefaultConfig()
+
+		srv := serverHelper.New(
+			configPath,
+			storage.NewStorageDir(),
+			testing.NewFakePassiveClock(time.Now()),
+			serverHelper.WithInMemoryStorage(),
+			serverHelper.WithFollowerMode("http://writer.local"),
+		)
+		err := srv.RunTest(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("the in-memory storage can't be used in follower mode")))
+	})
+})
@@ -0,0 +1,129 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	"github.com/ankorstore/mq-lease-service/internal/server"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use (written by the server, read by the tests)
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// The request bodies are only visible in the server logs, those tests are then running the server with a captured
+// debug logger.
+var _ = Describe("Log bodies", Ordered, func() {
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var srv server.Server
+	var logs *syncBuffer
+	var serverOpts []serverHelper.Option
+
+	owner := configHelper.DefaultConfigRepoOwner
+	repo := configHelper.DefaultConfigRepoName
+	baseRef := configHelper.DefaultConfigRepoBaseRef
+
+	BeforeAll(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+
+		DeferCleanup(func() {
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	BeforeEach(func() {
+		serverOpts = nil
+	})
+
+	JustBeforeEach(func() {
+		_, configPath := config.LoadDefaultConfig()
+		logs = &syncBuffer{}
+		logger := zerolog.New(logs).Level(zerolog.DebugLevel)
+
+		ctx, cancel := context.WithCancel(logger.WithContext(context.Background()))
+		grp := errgroup.Group{}
+		srv = serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()), serverOpts...)
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		DeferCleanup(func() {
+			cancel()
+			config.CleanupEnv()
+			Expect(grp.Wait()).To(BeNil())
+		})
+	})
+
+	Context("when the bodies logging is disabled", func() {
+		It("should not log the request bodies", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(logs.String()).NotTo(ContainSubstring(`"req_body"`))
+			Expect(logs.String()).NotTo(ContainSubstring(`"message":"Request body"`))
+		})
+	})
+
+	Context("when the bodies logging is enabled", func() {
+		BeforeEach(func() {
+			serverOpts = append(serverOpts, serverHelper.WithLogBodies())
+		})
+
+		It("should log the request body and the response status", func() {
+			resp, _ := apiCall(srv, acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(logs.String()).To(ContainSubstring(`"req_status":200`))
+			Expect(logs.String()).To(ContainSubstring(`"req_body":{"head_ref":"` + ref(1) + `","head_sha":"xxx-1","priority":1}`))
+		})
+
+		It("should redact the auth-related fields", func() {
+			req := httptest.NewRequest(
+				"POST",
+				fmt.Sprintf("/%s/%s/%s/acquire", owner, repo, baseRef),
+				strings.NewReader(fmt.Sprintf(`{"head_sha": "xxx-1", "head_ref": "%s", "priority": 1, "auth_token": "secret-value"}`, ref(1))),
+			)
+			req.Header.Set("Content-Type", "application/json")
+			resp, _ := apiCall(srv, req)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(logs.String()).To(ContainSubstring(`"auth_token":"[REDACTED]"`))
+			Expect(logs.String()).NotTo(ContainSubstring("secret-value"))
+		})
+	})
+})
@@ -0,0 +1,100 @@
+package e2e_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	"github.com/ankorstore/mq-lease-service/internal/server"
+	"github.com/ankorstore/mq-lease-service/internal/server/middlewares"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// The request IDs have to be matched with the server logs, those tests are then running the server with a captured
+// logger.
+var _ = Describe("Request ID", Ordered, func() {
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var srv server.Server
+	var logs *syncBuffer
+
+	owner := configHelper.DefaultConfigRepoOwner
+	repo := configHelper.DefaultConfigRepoName
+	baseRef := configHelper.DefaultConfigRepoBaseRef
+
+	BeforeAll(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+
+		DeferCleanup(func() {
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	JustBeforeEach(func() {
+		_, configPath := config.LoadDefaultConfig()
+		logs = &syncBuffer{}
+		logger := zerolog.New(logs)
+
+		ctx, cancel := context.WithCancel(logger.WithContext(context.Background()))
+		grp := errgroup.Group{}
+		srv = serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		DeferCleanup(func() {
+			cancel()
+			config.CleanupEnv()
+			Expect(grp.Wait()).To(BeNil())
+		})
+	})
+
+	Context("when the request doesn't carry any ID", func() {
+		It("should generate one, echoed in the response and in the logs", func() {
+			resp, err := srv.Test(acquireReq(owner, repo, baseRef, "xxx-1", 1))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			requestID := resp.Header.Get(middlewares.RequestIDHeaderName)
+			Expect(requestID).NotTo(BeEmpty())
+			Expect(logs.String()).To(ContainSubstring(fmt.Sprintf(`"req_id":"%s"`, requestID)))
+		})
+
+		It("should generate a different one for each request", func() {
+			resp1, err := srv.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).To(BeNil())
+			resp2, err := srv.Test(httptest.NewRequest("GET", "/", nil))
+			Expect(err).To(BeNil())
+
+			Expect(resp1.Header.Get(middlewares.RequestIDHeaderName)).NotTo(Equal(resp2.Header.Get(middlewares.RequestIDHeaderName)))
+		})
+	})
+
+	Context("when the request carries its own ID", func() {
+		It("should honor it, in the response, the error payload and the logs", func() {
+			req := acquireReq(owner, repo, baseRef, "xxx-1", -1)
+			req.Header.Set(middlewares.RequestIDHeaderName, "support-ticket-42")
+			resp, body := apiCall(srv, req)
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			Expect(resp.Header.Get(middlewares.RequestIDHeaderName)).To(Equal("support-ticket-42"))
+			Expect(body).To(ContainSubstring(`"request_id":"support-ticket-42"`))
+			Expect(logs.String()).To(ContainSubstring(`"req_id":"support-ticket-42"`))
+		})
+	})
+})
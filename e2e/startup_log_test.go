@@ -0,0 +1,86 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// The startup summary is only visible in the server logs, this test is then running the server with a captured logger.
+var _ = Describe("Startup log summary", func() {
+	It("should list the loaded providers with their settings", func() {
+		config := configHelper.NewHelper()
+		storage := storageHelper.NewHelper()
+		DeferCleanup(func() {
+			config.Cleanup()
+			storage.Cleanup()
+		})
+		_, configPath := config.LoadDefaultConfig(configHelper.WithExtraRepository("e2e-other", "other-repo", "develop"))
+		logs := &syncBuffer{}
+
+		ctx, cancel := context.WithCancel(zerolog.New(logs).WithContext(context.Background()))
+		grp := errgroup.Group{}
+		srv := serverHelper.New(configPath, storage.NewStorageDir(), testing.NewFakePassiveClock(time.Now()))
+		grp.Go(func() error {
+			return srv.RunTest(ctx)
+		})
+		DeferCleanup(func() {
+			cancel()
+			config.CleanupEnv()
+			Expect(grp.Wait()).To(BeNil())
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		var summary string
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, `"message":"Lease providers loaded"`) {
+				summary = line
+			}
+		}
+		Expect(summary).NotTo(BeEmpty())
+
+		var entry struct {
+			Level         string                   `json:"level"`
+			ProviderCount int                      `json:"provider_count"`
+			Providers     []map[string]interface{} `json:"providers"`
+		}
+		Expect(json.Unmarshal([]byte(summary), &entry)).To(Succeed())
+		Expect(entry.Level).To(Equal("info"))
+		Expect(entry.ProviderCount).To(Equal(2))
+		Expect(entry.Providers).To(ConsistOf(
+			map[string]interface{}{
+				"gh_repo_owner":              configHelper.DefaultConfigRepoOwner,
+				"gh_repo_name":               configHelper.DefaultConfigRepoName,
+				"gh_base_ref":                configHelper.DefaultConfigRepoBaseRef,
+				"queue":                      "",
+				"stabilize_duration_seconds": float64(configHelper.DefaultConfigRepoStabilizeDurationSeconds),
+				"ttl_seconds":                float64(configHelper.DefaultConfigRepoTTLSeconds),
+				"expected_request_count":     float64(configHelper.DefaultConfigRepoExpectedRequestCount),
+				"delay_lease_assignment_by":  float64(configHelper.DefaultConfigRepoDelayAssignmentCount),
+			},
+			map[string]interface{}{
+				"gh_repo_owner":              "e2e-other",
+				"gh_repo_name":               "other-repo",
+				"gh_base_ref":                "develop",
+				"queue":                      "",
+				"stabilize_duration_seconds": float64(configHelper.DefaultConfigRepoStabilizeDurationSeconds),
+				"ttl_seconds":                float64(configHelper.DefaultConfigRepoTTLSeconds),
+				"expected_request_count":     float64(configHelper.DefaultConfigRepoExpectedRequestCount),
+				"delay_lease_assignment_by":  float64(0),
+			},
+		))
+	})
+})
@@ -0,0 +1,147 @@
+package e2e_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	configHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/config"
+	serverHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/server"
+	storageHelper "github.com/ankorstore/mq-lease-service/e2e/helpers/storage"
+	. "github.com/onsi/ginkgo/v2" //nolint
+	. "github.com/onsi/gomega" //nolint
+	"golang.org/x/sync/errgroup"
+	"k8s.io/utils/clock/testing"
+)
+
+// TLS is terminated by the listening server, which can't be observed through app.Test(): those tests are then running
+// against a real listening server.
+var _ = Describe("TLS", Ordered, func() {
+	var config *configHelper.Helper
+	var storage *storageHelper.Helper
+	var port int
+
+	BeforeAll(func() {
+		config = configHelper.NewHelper()
+		storage = storageHelper.NewHelper()
+		_, configPath := config.LoadDefaultConfig()
+		certFile, keyFile := selfSignedCertificate(GinkgoT().TempDir())
+
+		port = freePort()
+		ctx, cancel := context.WithCancel(context.Background())
+		grp := errgroup.Group{}
+		srv := serverHelper.New(
+			configPath,
+			storage.NewStorageDir(),
+			testing.NewFakePassiveClock(time.Now()),
+			serverHelper.WithPort(port),
+			serverHelper.WithTLS(certFile, keyFile),
+		)
+		grp.Go(func() error {
+			return srv.Run(ctx)
+		})
+
+		waitCtx, waitCtxCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer waitCtxCancel()
+		Expect(srv.WaitReady(waitCtx)).To(BeTrue())
+
+		DeferCleanup(func() {
+			cancel()
+			_ = grp.Wait()
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+	})
+
+	It("should serve HTTPS when a certificate and a key are configured", func() {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+			},
+		}
+		Eventually(func() error {
+			resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/k8s/liveness", port))
+			if err != nil {
+				return err
+			}
+			defer func() { _ = resp.Body.Close() }()
+			if resp.TLS == nil {
+				return fmt.Errorf("response not served over TLS")
+			}
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			}
+			return nil
+		}, 5*time.Second, 50*time.Millisecond).Should(Succeed())
+	})
+
+	It("should not serve plain HTTP", func() {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/k8s/liveness", port))
+		if err == nil {
+			defer func() { _ = resp.Body.Close() }()
+			// Go's TLS server answers plain HTTP requests with a 400 status code
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		}
+	})
+})
+
+var _ = Describe("TLS configuration", func() {
+	It("should fail to start when only one of the certificate and the key is provided", func() {
+		config := configHelper.NewHelper()
+		storage := storageHelper.NewHelper()
+		DeferCleanup(func() {
+			config.CleanupEnv()
+			config.Cleanup()
+			storage.Cleanup()
+		})
+		_, configPath := config.LoadDefaultConfig()
+
+		srv := serverHelper.New(
+			configPath,
+			storage.NewStorageDir(),
+			testing.NewFakePassiveClock(time.Now()),
+			serverHelper.WithPort(freePort()),
+			serverHelper.WithTLS("cert.pem", ""),
+		)
+		err := srv.Run(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("both a TLS certificate and a TLS key are required")))
+	})
+})
+
+// selfSignedCertificate writes a self-signed certificate (for 127.0.0.1) and its private key in the given directory
+func selfSignedCertificate(dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mq-lease-service"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)).To(Succeed())
+	return certFile, keyFile
+}
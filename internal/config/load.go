@@ -1,7 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 
 	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
 	"github.com/drone/envsubst/v2"
@@ -11,12 +15,88 @@ import (
 // LoadServerConfig opens the configuration file, performs environment substitution and parses it.
 // The environment substitution allows to e.g. include private information in form of
 // ${MY_GITHUB_PRIVATE_KEY} rather than hardcoding it on the configuration
+//
+// The path can also be a directory: all its `*.yaml` files are then loaded (see loadServerConfigDir).
 func LoadServerConfig(path string) (*latest.ServerConfig, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return &latest.ServerConfig{}, err
+	}
+	if info.IsDir() {
+		return loadServerConfigDir(path)
+	}
 	serverConfig := &latest.ServerConfig{}
-	err := load(path, serverConfig)
+	err = load(path, serverConfig)
 	return serverConfig, err
 }
 
+// loadServerConfigDir loads all the `*.yaml` files of the directory (in lexical order, the environment substitution
+// applying to each of them), and merges them: their repositories are concatenated (a repository can only be configured
+// once), while the other settings can only be defined in one of the files.
+func loadServerConfigDir(dir string) (*latest.ServerConfig, error) {
+	merged := &latest.ServerConfig{}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return merged, err
+	}
+	if len(paths) == 0 {
+		return merged, fmt.Errorf("no *.yaml configuration file found in %s", dir)
+	}
+
+	// file each repository key / setting has been defined in, to report the duplicates
+	repositoryFiles := map[string]string{}
+	settingFiles := map[string]string{}
+	for _, path := range paths {
+		part := &latest.ServerConfig{}
+		if err := load(path, part); err != nil {
+			return merged, fmt.Errorf("failed loading %s: %w", path, err)
+		}
+
+		for _, repository := range part.Repositories {
+			key := repositoryKey(repository)
+			if previous, ok := repositoryFiles[key]; ok {
+				return merged, fmt.Errorf("repository %s is configured in both %s and %s", key, previous, path)
+			}
+			repositoryFiles[key] = path
+			merged.Repositories = append(merged.Repositories, repository)
+		}
+
+		if err := mergeSettings(merged, part, path, settingFiles); err != nil {
+			return merged, err
+		}
+	}
+	return merged, nil
+}
+
+// mergeSettings copies the top level settings (but the repositories) defined in part to merged, failing if one of
+// them has already been defined by another file
+func mergeSettings(merged *latest.ServerConfig, part *latest.ServerConfig, path string, settingFiles map[string]string) error {
+	mergedValue := reflect.ValueOf(merged).Elem()
+	partValue := reflect.ValueOf(part).Elem()
+	for i := 0; i < partValue.NumField(); i++ {
+		field := partValue.Type().Field(i)
+		if field.Name == "Repositories" || partValue.Field(i).IsZero() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if previous, ok := settingFiles[name]; ok {
+			return fmt.Errorf("setting %s is defined in both %s and %s", name, previous, path)
+		}
+		settingFiles[name] = path
+		mergedValue.Field(i).Set(partValue.Field(i))
+	}
+	return nil
+}
+
+// repositoryKey identifies a repository (its lease provider)
+func repositoryKey(repository *latest.GithubRepositoryConfig) string {
+	key := fmt.Sprintf("%s:%s:%s", repository.Owner, repository.Name, repository.BaseRef)
+	if repository.Queue != "" {
+		key += ":" + repository.Queue
+	}
+	return key
+}
+
 func load(path string, config interface{}) error {
 	raw, err := os.ReadFile(path)
 	if err != nil {
@@ -2,6 +2,8 @@ package config_test
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ankorstore/mq-lease-service/internal/config"
@@ -63,6 +65,147 @@ func TestLoadServerConfig(t *testing.T) {
 	cleanup(yamlFileName)
 }
 
+func TestLoadServerConfig_Auth(t *testing.T) {
+	t.Setenv("TEST_API_KEY", "some-token")
+
+	yamlFileName := prepareYamlFile(`auth:
+  basic:
+    users:
+      user: pass
+  api_keys:
+    - ${TEST_API_KEY}
+    - another-token
+  protect: [read, write]
+  metrics_auth: token`)
+	defer cleanup(yamlFileName)
+
+	expected := &latest.ServerConfig{
+		AuthConfig: &latest.AuthConfig{
+			BasicAuth:   &latest.BasicAuthConfig{Users: map[string]string{"user": "pass"}},
+			APIKeys:     []string{"some-token", "another-token"},
+			Protect:     []string{latest.AuthProtectRead, latest.AuthProtectWrite},
+			MetricsAuth: latest.MetricsAuthToken,
+		},
+	}
+
+	got, err := config.LoadServerConfig(yamlFileName)
+	if err != nil {
+		t.Errorf("Could not load config, %v", err)
+	}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("%s", cmp.Diff(expected, got))
+	}
+}
+
+func TestLoadServerConfig_Directory(t *testing.T) {
+	t.Setenv("TEST_TEAM_B_TTL", "60")
+
+	dir := prepareConfigDir(t, map[string]string{
+		"team-a.yaml": `repositories:
+  - owner: test
+    name: repo0
+    base_ref: main
+    stabilize_duration_seconds: 300
+    expected_request_count: 4
+    ttl_seconds: 20
+max_providers: 10`,
+		"team-b.yaml": `repositories:
+  - owner: test
+    name: repo1
+    base_ref: develop
+    queue: shard-1
+    stabilize_duration_seconds: 100
+    expected_request_count: 5
+    ttl_seconds: ${TEST_TEAM_B_TTL}`,
+		"README.md": `not a configuration file`,
+	})
+
+	expected := &latest.ServerConfig{
+		Repositories: []*latest.GithubRepositoryConfig{
+			{
+				Owner:                "test",
+				Name:                 "repo0",
+				BaseRef:              "main",
+				StabilizeDuration:    300,
+				ExpectedRequestCount: 4,
+				TTL:                  20,
+			},
+			{
+				Owner:                "test",
+				Name:                 "repo1",
+				BaseRef:              "develop",
+				Queue:                "shard-1",
+				StabilizeDuration:    100,
+				ExpectedRequestCount: 5,
+				TTL:                  60,
+			},
+		},
+		MaxProviders: 10,
+	}
+
+	got, err := config.LoadServerConfig(dir)
+	if err != nil {
+		t.Errorf("Could not load config, %v", err)
+	}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("%s", cmp.Diff(expected, got))
+	}
+}
+
+func TestLoadServerConfig_DirectoryErrors(t *testing.T) {
+	repository := `
+  - owner: test
+    name: repo0
+    base_ref: main`
+
+	tests := []struct {
+		name          string
+		files         map[string]string
+		expectedError string
+	}{
+		{
+			name:          "no configuration file",
+			files:         map[string]string{"config.yml": "repositories: []"},
+			expectedError: "no *.yaml configuration file found",
+		},
+		{
+			name: "repository configured twice",
+			files: map[string]string{
+				"team-a.yaml": "repositories:" + repository,
+				"team-b.yaml": "repositories:" + repository,
+			},
+			expectedError: "repository test:repo0:main is configured in both",
+		},
+		{
+			name: "setting defined twice",
+			files: map[string]string{
+				"team-a.yaml": "max_providers: 10",
+				"team-b.yaml": "max_providers: 20",
+			},
+			expectedError: "setting max_providers is defined in both",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.LoadServerConfig(prepareConfigDir(t, tt.files))
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("expected an error containing %q, got %v", tt.expectedError, err)
+			}
+		})
+	}
+}
+
+// prepareConfigDir writes the given files (content by name) in a temporary directory
+func prepareConfigDir(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
 func prepareYamlFile(content string) string {
 	// Set up our test file
 	f, err := os.CreateTemp("/tmp", "gotest")
@@ -1,9 +1,156 @@
 package latest
 
-import "github.com/rs/zerolog"
+import (
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
 
 func (r GithubRepositoryConfig) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("gh_repo_owner", r.Owner).
 		Str("gh_repo_name", r.Name).
-		Str("gh_base_ref", r.BaseRef)
+		Str("gh_base_ref", r.BaseRef).
+		Str("queue", r.Queue)
+}
+
+// RepositoriesSummary logs the repositories along with their main lease settings (startup summary)
+type RepositoriesSummary []*GithubRepositoryConfig
+
+func (s RepositoriesSummary) MarshalZerologArray(a *zerolog.Array) {
+	for _, r := range s {
+		a.Dict(zerolog.Dict().
+			EmbedObject(r).
+			Int("stabilize_duration_seconds", r.StabilizeDuration).
+			Int("ttl_seconds", r.TTL).
+			Int("expected_request_count", r.ExpectedRequestCount).
+			Int("delay_lease_assignment_by", r.DelayLeaseAssignmentBy))
+	}
+}
+
+// IsProtected tells if the given route group requires authentication
+func (a *AuthConfig) IsProtected(group string) bool {
+	if a == nil {
+		return false
+	}
+	if len(a.Protect) == 0 {
+		return group == AuthProtectWrite
+	}
+	return slices.Contains(a.Protect, group)
+}
+
+// GetMetricsAuth returns the authentication mode of the metrics endpoint (defaults to MetricsAuthNone)
+func (a *AuthConfig) GetMetricsAuth() string {
+	if a == nil || a.MetricsAuth == "" {
+		return MetricsAuthNone
+	}
+	return a.MetricsAuth
+}
+
+// IsEnabled tells if the CORS headers should be sent
+func (c *CORSConfig) IsEnabled() bool {
+	return c != nil && len(c.AllowedOrigins) > 0
+}
+
+// GetAllowedMethods returns the HTTP methods allowed from the allowed origins (defaults to the read-only ones)
+func (c *CORSConfig) GetAllowedMethods() []string {
+	if c == nil || len(c.AllowedMethods) == 0 {
+		return []string{"GET", "HEAD"}
+	}
+	return c.AllowedMethods
+}
+
+// IsEnabled tells if the requests are rate limited
+func (c *RateLimitConfig) IsEnabled() bool {
+	return c != nil && c.Max > 0
+}
+
+// GetWindow returns the duration (in seconds) of the rate limit window (defaults to DefaultRateLimitWindow)
+func (c *RateLimitConfig) GetWindow() int {
+	if c == nil || c.Window <= 0 {
+		return DefaultRateLimitWindow
+	}
+	return c.Window
+}
+
+// GetKey returns how the clients are identified (defaults to RateLimitKeyIP)
+func (c *RateLimitConfig) GetKey() string {
+	if c == nil || c.Key == "" {
+		return RateLimitKeyIP
+	}
+	return c.Key
+}
+
+// GetMaxProviders returns the max number of repositories which can be configured (defaults to DefaultMaxProviders)
+func (c *ServerConfig) GetMaxProviders() int {
+	if c == nil || c.MaxProviders <= 0 {
+		return DefaultMaxProviders
+	}
+	return c.MaxProviders
+}
+
+// GetMaxStabilizeDuration returns the max stabilize duration (in seconds) of the repositories (defaults to
+// DefaultMaxStabilizeDuration)
+func (c *ServerConfig) GetMaxStabilizeDuration() int {
+	if c == nil || c.MaxStabilizeDuration <= 0 {
+		return DefaultMaxStabilizeDuration
+	}
+	return c.MaxStabilizeDuration
+}
+
+// IsEnabled tells if a cap applies to some owners
+func (c *OwnerLeasesConfig) IsEnabled() bool {
+	if c == nil {
+		return false
+	}
+	if c.MaxConcurrent > 0 {
+		return true
+	}
+	for _, limit := range c.Owners {
+		if limit > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEnabled tells if some repositories are allowed to get a dynamically created provider
+func (c *DynamicProvidersConfig) IsEnabled() bool {
+	return c != nil && len(c.Allow) > 0
+}
+
+// Allows tells if the provider of the given repository can be created dynamically (the malformed patterns never match)
+func (c *DynamicProvidersConfig) Allows(owner string, repo string) bool {
+	if !c.IsEnabled() {
+		return false
+	}
+	for _, pattern := range c.Allow {
+		name := owner
+		if strings.Contains(pattern, "/") {
+			name = owner + "/" + repo
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRepository returns the settings of the dynamically created provider of the given repository
+func (c *DynamicProvidersConfig) GetRepository(owner string, repo string, baseRef string) *GithubRepositoryConfig {
+	repository := &GithubRepositoryConfig{
+		StabilizeDuration:    DefaultDynamicProviderStabilizeDuration,
+		TTL:                  DefaultDynamicProviderTTL,
+		ExpectedRequestCount: DefaultDynamicProviderExpectedRequestCount,
+	}
+	if c != nil && c.Defaults != nil {
+		defaults := *c.Defaults
+		repository = &defaults
+	}
+	repository.Owner = owner
+	repository.Name = repo
+	repository.BaseRef = baseRef
+	repository.Queue = ""
+	return repository
 }
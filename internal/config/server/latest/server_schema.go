@@ -5,24 +5,193 @@ type BasicAuthConfig struct {
 	Users map[string]string `yaml:"users"`
 }
 
+// Route groups which can be protected by the authentication
+const (
+	// AuthProtectRead covers the read-only API routes (providers listing, details, stats...)
+	AuthProtectRead = "read"
+	// AuthProtectWrite covers the mutating API routes (acquire, release, clear)
+	AuthProtectWrite = "write"
+)
+
+// Authentication modes of the metrics endpoint
+const (
+	// MetricsAuthNone leaves the metrics endpoint unprotected (default)
+	MetricsAuthNone = "none"
+	// MetricsAuthBasic protects the metrics endpoint with the basic auth users
+	MetricsAuthBasic = "basic"
+	// MetricsAuthToken protects the metrics endpoint with the API keys (`Authorization: Bearer <token>`)
+	MetricsAuthToken = "token"
+)
+
 type AuthConfig struct {
 	BasicAuth *BasicAuthConfig `yaml:"basic,omitempty"`
+	// APIKeys is the list of tokens accepted as bearer tokens (`Authorization: Bearer <token>`)
+	APIKeys []string `yaml:"api_keys,omitempty"`
+	// Scopes restricts the repositories (`owner/repo`) a principal (basic auth username or API key) can access.
+	// Principals without scopes can access all the repositories.
+	Scopes map[string][]string `yaml:"scopes,omitempty"`
+	// Protect is the list of route groups requiring authentication (`read`, `write`). Defaults to `write` only.
+	// K8s probes and meta routes are never protected, the metrics endpoint has its own MetricsAuth setting.
+	Protect []string `yaml:"protect,omitempty"`
+	// MetricsAuth defines how the metrics endpoint is protected (`none|basic|token`), independently of the API routes.
+	// Defaults to `none`.
+	MetricsAuth string `yaml:"metrics_auth,omitempty"`
+}
+
+// CORSConfig represents the CORS configuration of the API routes (disabled if no origin is allowed).
+type CORSConfig struct {
+	// AllowedOrigins is the list of origins allowed to call the API from a browser (`*` allows any origin)
+	AllowedOrigins []string `yaml:"allowed_origins,omitempty"`
+	// AllowedMethods is the list of HTTP methods allowed from those origins. Defaults to `GET` and `HEAD` (read-only).
+	AllowedMethods []string `yaml:"allowed_methods,omitempty"`
 }
 
+// OwnerLeasesConfig caps the leases an owner can hold concurrently across all its repositories, for the deployments
+// sharing a worker capacity between the owners (disabled if no cap is set).
+type OwnerLeasesConfig struct {
+	// MaxConcurrent is the max number of leases each owner can hold at the same time. Unlimited if zero.
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	// Owners overrides MaxConcurrent for some owners (their weight in the shared capacity), zero meaning unlimited.
+	Owners map[string]int `yaml:"owners,omitempty"`
+}
+
+// Keys the rate limits can be applied per
+const (
+	// RateLimitKeyIP limits the requests per client IP
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyCredential limits the requests per authenticated caller (the anonymous ones are limited per IP)
+	RateLimitKeyCredential = "credential"
+)
+
+// DefaultRateLimitWindow is the default window (in seconds) of the rate limits
+const DefaultRateLimitWindow = 60
+
+// RateLimitConfig limits the requests each client can send to the mutating provider routes (disabled if no max is set).
+type RateLimitConfig struct {
+	// Max is the max number of requests per window of each client. Unlimited if zero.
+	Max int `yaml:"max,omitempty"`
+	// Window is the duration (in seconds) of the rate limit window. Defaults to DefaultRateLimitWindow.
+	Window int `yaml:"window_seconds,omitempty"`
+	// Key defines how the clients are identified (`ip|credential`). Defaults to `ip`.
+	Key string `yaml:"key,omitempty"`
+}
+
+// DynamicProvidersConfig allows the acquire requests to create the lease providers of the repositories which aren't
+// configured, as long as they are allowlisted (disabled if the allowlist is empty).
+type DynamicProvidersConfig struct {
+	// Allow is the allowlist of `owner` (any repository of the owner) or `owner/repo` patterns (see path.Match, e.g.
+	// `acme-*` or `acme/svc-*`)
+	Allow []string `yaml:"allow,omitempty"`
+	// Defaults are the settings of the dynamically created providers (the owner, name, base ref and queue are ignored).
+	// Defaults to a 300s stabilize duration, a 30s TTL and 4 expected requests.
+	Defaults *GithubRepositoryConfig `yaml:"defaults,omitempty"`
+}
+
+// Default settings of the dynamically created providers, when none are configured
+const (
+	DefaultDynamicProviderStabilizeDuration    = 300
+	DefaultDynamicProviderTTL                  = 30
+	DefaultDynamicProviderExpectedRequestCount = 4
+)
+
+// DefaultMaxProviders is the default max number of repositories (lease providers) which can be configured
+const DefaultMaxProviders = 1000
+
+// DefaultMaxStabilizeDuration is the default max stabilize duration (in seconds) of the repositories (1 day)
+const DefaultMaxStabilizeDuration = 24 * 60 * 60
+
 // ServerConfig represents the current server configuration file.
 type ServerConfig struct {
 	Repositories []*GithubRepositoryConfig `yaml:"repositories,omitempty"`
 	AuthConfig   *AuthConfig               `yaml:"auth,omitempty"`
+	CORSConfig   *CORSConfig               `yaml:"cors,omitempty"`
+	// MaxProviders is the max number of repositories (lease providers) which can be configured, a guardrail for the
+	// generated configs. Defaults to DefaultMaxProviders.
+	MaxProviders int `yaml:"max_providers,omitempty"`
+	// MaxStabilizeDuration is the max stabilize duration (in seconds) of the repositories, a guardrail against the typos
+	// blocking a queue (almost) forever. Defaults to DefaultMaxStabilizeDuration.
+	MaxStabilizeDuration int `yaml:"max_stabilize_duration_seconds,omitempty"`
+	// OwnerLeases caps the leases held concurrently by the repositories of a same owner. Disabled by default.
+	OwnerLeases *OwnerLeasesConfig `yaml:"owner_leases,omitempty"`
+	// RateLimitConfig limits the requests of each client to the mutating provider routes. Disabled by default.
+	RateLimitConfig *RateLimitConfig `yaml:"rate_limit,omitempty"`
+	// DynamicProviders allows the acquire requests to create the providers of the allowlisted repositories which
+	// aren't configured. Disabled by default.
+	DynamicProviders *DynamicProvidersConfig `yaml:"allow_dynamic_providers,omitempty"`
 }
 
 // GithubRepositoryConfig defines how a repository should be handled
 type GithubRepositoryConfig struct {
-	Owner                string `yaml:"owner"`
-	Name                 string `yaml:"name"`
-	BaseRef              string `yaml:"base_ref"`
+	Owner   string `yaml:"owner"`
+	Name    string `yaml:"name"`
+	BaseRef string `yaml:"base_ref"`
+	// Queue is the name of the queue, to run several independent merge queues on the same base ref (e.g. sharded CI).
+	// Optional, its provider is then served under `/:owner/:repo/:baseRef/queues/:queue`.
+	Queue                string `yaml:"queue,omitempty"`
 	StabilizeDuration    int    `yaml:"stabilize_duration_seconds"`
 	TTL                  int    `yaml:"ttl_seconds"`
 	ExpectedRequestCount int    `yaml:"expected_request_count"`
 	// DelayLeaseASsignmentBy is the number of times a lease can be delayed before it is assigned.
 	DelayLeaseAssignmentBy int `yaml:"delay_lease_assignment_by"`
+	// MinBatchSize is the min number of requests to wait for once the stabilize duration is elapsed (unless the expected
+	// request count is reached). Defaults to 1 (no extra wait).
+	MinBatchSize int `yaml:"min_batch_size,omitempty"`
+	// MinBatchMaxWait is the max extra time (after the stabilize duration) to wait for the min batch size to be reached.
+	// Defaults to the stabilize duration.
+	MinBatchMaxWait int `yaml:"min_batch_max_wait_seconds,omitempty"`
+	// WinnerSelection defines if the highest (default) or the lowest priority wins the lease (`highest|lowest`).
+	WinnerSelection string `yaml:"winner_selection,omitempty"`
+	// PollIntervalMin & PollIntervalMax are bounding the poll interval suggested to the pending requests (via the
+	// Poll-Interval-Ms header). Default to 1s and 30s.
+	PollIntervalMin int `yaml:"poll_interval_min_seconds,omitempty"`
+	PollIntervalMax int `yaml:"poll_interval_max_seconds,omitempty"`
+	// GenericMode allows to use the provider as a generic priority mutex: the head refs don't have to be GitHub merge
+	// queue refs (any non-empty string is accepted), and no stacked pull requests are computed.
+	GenericMode bool `yaml:"generic_mode,omitempty"`
+	// HistorySize is the number of released requests kept (in memory) in the provider history. Defaults to 20.
+	HistorySize int `yaml:"history_size,omitempty"`
+	// AutoCompleteOnSuccess completes all the remaining requests of the batch as soon as the lease holder reports a
+	// success, instead of waiting for each of them to poll in (faster teardown, the next batch can start right away).
+	AutoCompleteOnSuccess bool `yaml:"auto_complete_on_success,omitempty"`
+	// ExcludeFailedRequests excludes the requests released without success from the expected request count (they
+	// still count as part of the batch), so the rebuilt batch doesn't wait for the stabilize duration after a failure.
+	ExcludeFailedRequests bool `yaml:"exclude_failed_requests,omitempty"`
+	// FreezeWinner freezes the winner selection once the batch is eligible to the lease, so that the late priority
+	// changes don't change who acquires it.
+	FreezeWinner bool `yaml:"freeze_winner,omitempty"`
+	// StabilizeFrom defines what the stabilize duration is counted from (`last_update|first_request`): the last change
+	// of the state (default), or the first time the oldest pending request was seen (a steady trickle of new requests
+	// can't delay the lease assignment indefinitely).
+	StabilizeFrom string `yaml:"stabilize_from,omitempty"`
+	// MaxWait bounds the worst-case wait: once the oldest pending request has waited this long, the lease is granted to
+	// the winner even if neither the stabilize duration nor the expected request count conditions are met. Disabled
+	// if zero.
+	MaxWait int `yaml:"max_wait_seconds,omitempty"`
+	// LeaseTimeout releases (as failed) the lease whose holder hasn't polled nor sent a heartbeat for this long, so that
+	// a dead build can't block the queue forever. Disabled if zero.
+	LeaseTimeout int `yaml:"lease_timeout_seconds,omitempty"`
+	// DedupeByHeadRef uses the head ref as the request identity: a new head SHA for a known head ref (force-push)
+	// replaces the previous request, keeping the batch accurate.
+	DedupeByHeadRef bool `yaml:"dedupe_by_head_ref,omitempty"`
+	// PriorityFromRef derives the priority from the pull request number of the head ref (`ascending|descending`),
+	// ignoring the priority sent by the clients. Not applicable in generic mode.
+	PriorityFromRef string `yaml:"priority_from_ref,omitempty"`
+	// MaxPriority is the max priority the clients can send (the requests above it are rejected with a 400), so that
+	// none of them can dominate the queue forever. Unbounded if zero.
+	MaxPriority int `yaml:"max_priority,omitempty"`
+	// DefaultPriority is the priority of the acquire/release requests sent without any (e.g. by the generic mode
+	// clients). The priority is required if not set.
+	DefaultPriority int `yaml:"default_priority,omitempty"`
+	// TimeScale speeds up the elapsed time by the given factor (e.g. 10 makes the stabilize duration, TTL and wait
+	// windows pass 10 times faster), to run accelerated soak tests in staging without changing the other values.
+	// Disabled if zero.
+	TimeScale float64 `yaml:"time_scale,omitempty"`
+	// PendingAccepted makes the pending acquire responses use the 202 (Accepted) status code, so that the clients can't
+	// mistake them for an acquired lease. The acquired/completed ones are still using 200. Disabled by default, as the
+	// existing clients are expecting a 200 for all of them.
+	PendingAccepted bool `yaml:"pending_accepted,omitempty"`
+	// CompletedResponse defines what the requests of a batch are told once its lease holder is done
+	// (`completed|outcome`): completed on a success only (default, they stay pending on a failure), or the batch
+	// outcome (completed on a success, released on a failure).
+	CompletedResponse string `yaml:"completed_response,omitempty"`
 }
@@ -0,0 +1,46 @@
+package lease
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/shamaton/msgpack/v2"
+)
+
+// StorageEncoding is the format the provider states are encoded with in the storage
+type StorageEncoding string
+
+const (
+	// StorageEncodingJSON encodes the states in JSON (default)
+	StorageEncodingJSON StorageEncoding = "json"
+	// StorageEncodingMsgpack encodes the states in MessagePack, which is more compact & faster for big states
+	StorageEncodingMsgpack StorageEncoding = "msgpack"
+)
+
+// ParseStorageEncoding validates the given encoding name (empty defaults to JSON)
+func ParseStorageEncoding(encoding string) (StorageEncoding, error) {
+	switch StorageEncoding(encoding) {
+	case "", StorageEncodingJSON:
+		return StorageEncodingJSON, nil
+	case StorageEncodingMsgpack:
+		return StorageEncodingMsgpack, nil
+	default:
+		return "", fmt.Errorf("unknown storage encoding %q", encoding)
+	}
+}
+
+func encode(encoding StorageEncoding, v any) ([]byte, error) {
+	if encoding == StorageEncodingMsgpack {
+		return msgpack.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// decode sniffs the encoding of the given payload, so the states written with another encoding can still be read
+// (an encoded state is always a JSON object, starting with a `{`, which is never the case of a MessagePack map).
+func decode(b []byte, v any) error {
+	if len(b) > 0 && b[0] != '{' {
+		return msgpack.Unmarshal(b, v)
+	}
+	return json.Unmarshal(b, v)
+}
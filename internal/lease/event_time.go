@@ -0,0 +1,50 @@
+package lease
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+type eventTimeCtxKey struct{}
+
+// WithEventTime returns a context making the provider calls use the given time as the current time, instead of the
+// provider clock (used to replay historical events).
+func WithEventTime(ctx context.Context, eventTime time.Time) context.Context {
+	return context.WithValue(ctx, eventTimeCtxKey{}, eventTime)
+}
+
+func eventTimeFromContext(ctx context.Context) (time.Time, bool) {
+	eventTime, ok := ctx.Value(eventTimeCtxKey{}).(time.Time)
+	return eventTime, ok
+}
+
+// fixedClock is a passive clock frozen at a given time
+type fixedClock struct {
+	now time.Time
+}
+
+var _ clock.PassiveClock = fixedClock{}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func (c fixedClock) Since(t time.Time) time.Duration {
+	return c.now.Sub(t)
+}
+
+// useEventTime swaps the provider clock with one frozen at the event time carried by the context (if any), and returns
+// the function restoring the original clock. The caller must hold the write lock for the whole call.
+func (lp *leaseProviderImpl) useEventTime(ctx context.Context) func() {
+	eventTime, ok := eventTimeFromContext(ctx)
+	if !ok {
+		return func() {}
+	}
+	original := lp.clock
+	lp.clock = fixedClock{now: eventTime}
+	return func() {
+		lp.clock = original
+	}
+}
@@ -0,0 +1,54 @@
+package lease
+
+import "time"
+
+// defaultHistorySize is the number of released requests kept in the provider history, when none is configured
+const defaultHistorySize = 20
+
+// HistoryEntry is a released lease request, kept in the provider history
+type HistoryEntry struct {
+	HeadSHA  string `json:"head_sha"`
+	HeadRef  string `json:"head_ref"`
+	Priority int    `json:"priority"`
+	// Status is the status reported on release (success|failure|cancelled)
+	Status     string    `json:"status"`
+	ReleasedAt time.Time `json:"released_at"`
+	// StackedPullRequests are the pull requests merged alongside the released one (on success only)
+	StackedPullRequests []*StackedPullRequest `json:"stacked_pull_requests,omitempty"`
+	// timeline is the status timeline of the request as of its release (exposed by the timeline endpoint only)
+	timeline []StatusTransition
+}
+
+// historyBuffer is a fixed size ring buffer of history entries (in-memory only, not persisted)
+type historyBuffer struct {
+	entries []*HistoryEntry
+	// next is the index the next entry will be written at
+	next int
+	// count is the number of entries currently stored
+	count int
+}
+
+func newHistoryBuffer(size int) *historyBuffer {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	return &historyBuffer{entries: make([]*HistoryEntry, size)}
+}
+
+// add stores an entry, overwriting the oldest one if the buffer is full
+func (h *historyBuffer) add(entry *HistoryEntry) {
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.count < len(h.entries) {
+		h.count++
+	}
+}
+
+// list returns the stored entries, newest first
+func (h *historyBuffer) list() []*HistoryEntry {
+	res := make([]*HistoryEntry, 0, h.count)
+	for i := 1; i <= h.count; i++ {
+		res = append(res, h.entries[(h.next-i+len(h.entries))%len(h.entries)])
+	}
+	return res
+}
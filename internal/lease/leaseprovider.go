@@ -5,10 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ankorstore/mq-lease-service/internal/storage"
@@ -18,11 +23,132 @@ import (
 	"k8s.io/utils/pointer" //nolint
 )
 
+// clockSkewWarningThreshold is the max difference tolerated (without warning) between the current time and a future
+// last updated date found in a hydrated state (which has probably been written by a replica with a skewed clock)
+const clockSkewWarningThreshold = 5 * time.Second
+
+const (
+	// defaultPollIntervalMin is the lower bound of the suggested poll interval, when none is configured
+	defaultPollIntervalMin = time.Second
+	// defaultPollIntervalMax is the upper bound of the suggested poll interval, when none is configured
+	defaultPollIntervalMax = 30 * time.Second
+	// pollIntervalJitter is the max relative deviation applied to the suggested poll interval
+	pollIntervalJitter = 0.2
+)
+
+// ErrDraining is returned when a new request is trying to register in a draining provider
+var ErrDraining = errors.New("provider is draining, new lease requests are rejected")
+
+// ErrFrozen is returned when a request is trying to acquire the lease of a frozen provider
+var ErrFrozen = errors.New("provider is frozen, lease requests are rejected")
+
+// ErrLeaseAcquired is returned when a new request is trying to register while the lease is held
+var ErrLeaseAcquired = errors.New("lease already acquired")
+
+// ErrInvalidReleaseStatus is returned when a lease is released with another status than success, failure or cancelled
+var ErrInvalidReleaseStatus = errors.New("invalid release status")
+
+// AcquiredError is the ErrLeaseAcquired error, carrying the context of the request currently holding the lease
+type AcquiredError struct {
+	Acquired *RequestContext
+}
+
+func (e *AcquiredError) Error() string {
+	return ErrLeaseAcquired.Error()
+}
+
+func (e *AcquiredError) Unwrap() error {
+	return ErrLeaseAcquired
+}
+
+// GHTempRefPattern is the pattern the merge queue temporary branch refs are matching
+// ex: gh-readonly-queue/develop/pr-31132-d107b89c095dd85ba6c62b8a4503100ee33a04bb
+const GHTempRefPattern = `^gh-readonly-queue/([^/]+)/pr-(\d+)-([0-9a-fA-F]+)$`
+
 var refRegex *regexp.Regexp
 
 func init() {
-	// ex: gh-readonly-queue/develop/pr-31132-d107b89c095dd85ba6c62b8a4503100ee33a04bb
-	refRegex = regexp.MustCompile(`^gh-readonly-queue/([^/]+)/pr-(\d+)-([0-9a-fA-F]+)$`)
+	refRegex = regexp.MustCompile(GHTempRefPattern)
+}
+
+// WinnerSelection defines which end of the priority range wins the lease
+type WinnerSelection string
+
+const (
+	// WinnerSelectionHighest the request with the highest priority wins (default)
+	WinnerSelectionHighest WinnerSelection = "highest"
+	// WinnerSelectionLowest the request with the lowest priority wins
+	WinnerSelectionLowest WinnerSelection = "lowest"
+)
+
+// Validate checks the winner selection is a known one (empty meaning the default)
+func (w WinnerSelection) Validate() error {
+	switch w {
+	case "", WinnerSelectionHighest, WinnerSelectionLowest:
+		return nil
+	}
+	return fmt.Errorf("invalid winner selection %q (expected %s or %s)", w, WinnerSelectionHighest, WinnerSelectionLowest)
+}
+
+// StabilizeFrom defines what the stabilize duration is counted from
+type StabilizeFrom string
+
+const (
+	// StabilizeFromLastUpdate the stabilize duration starts over on every change of the state (default)
+	StabilizeFromLastUpdate StabilizeFrom = "last_update"
+	// StabilizeFromFirstRequest the stabilize duration starts when the oldest pending request was first seen, so a
+	// steady trickle of new requests can't delay the lease assignment indefinitely
+	StabilizeFromFirstRequest StabilizeFrom = "first_request"
+)
+
+// Validate checks the stabilize start is a known one (empty meaning the default)
+func (s StabilizeFrom) Validate() error {
+	switch s {
+	case "", StabilizeFromLastUpdate, StabilizeFromFirstRequest:
+		return nil
+	}
+	return fmt.Errorf("invalid stabilize from %q (expected %s or %s)", s, StabilizeFromLastUpdate, StabilizeFromFirstRequest)
+}
+
+// CompletedResponse defines what the requests of a batch are told once its lease holder is done
+type CompletedResponse string
+
+const (
+	// CompletedResponseCompleted the requests of the batch are completed on a success of the lease holder, and passed
+	// the lease on (staying pending) on a failure (default)
+	CompletedResponseCompleted CompletedResponse = "completed"
+	// CompletedResponseOutcome the requests of the batch learn its outcome: completed on a success of the lease holder,
+	// released (dropped from the queue) on a failure
+	CompletedResponseOutcome CompletedResponse = "outcome"
+)
+
+// Validate checks the completed response is a known one (empty meaning the default)
+func (c CompletedResponse) Validate() error {
+	switch c {
+	case "", CompletedResponseCompleted, CompletedResponseOutcome:
+		return nil
+	}
+	return fmt.Errorf("invalid completed response %q (expected %s or %s)", c, CompletedResponseCompleted, CompletedResponseOutcome)
+}
+
+// PriorityFromRef defines how the priority is derived from the pull request number of the head ref
+type PriorityFromRef string
+
+const (
+	// PriorityFromRefAscending the priority is the pull request number: the higher the number, the higher the priority
+	PriorityFromRefAscending PriorityFromRef = "ascending"
+	// PriorityFromRefDescending the priority is the negated pull request number: the lower the number, the higher the
+	// priority
+	PriorityFromRefDescending PriorityFromRef = "descending"
+)
+
+// Validate checks the priority order is a known one (empty meaning the priority isn't derived from the head ref)
+func (p PriorityFromRef) Validate() error {
+	switch p {
+	case "", PriorityFromRefAscending, PriorityFromRefDescending:
+		return nil
+	}
+	return fmt.Errorf("invalid priority from ref %q (expected %s or %s)", p, PriorityFromRefAscending, PriorityFromRefDescending)
 }
 
 type ProviderOpts struct {
@@ -30,10 +156,70 @@ type ProviderOpts struct {
 	TTL                  time.Duration
 	ExpectedRequestCount int
 	DelayAssignmentCount int
+	WinnerSelection      WinnerSelection
 	ID                   string
 	Clock                clock.PassiveClock
 	Storage              storage.Storage[*ProviderState]
 	Metrics              *providerMetrics
+	// MinBatchSize is the min number of requests to wait for once the stabilize duration is elapsed (unless the
+	// expected request count is reached), up to MinBatchMaxWait after the end of the stabilize duration
+	MinBatchSize int
+	// MinBatchMaxWait is the max extra time waited for the min batch size to be reached (defaults to the stabilize duration)
+	MinBatchMaxWait time.Duration
+	// PollIntervalMin & PollIntervalMax are bounding the poll interval suggested to the pending requests
+	// (default to 1s and 30s)
+	PollIntervalMin time.Duration
+	PollIntervalMax time.Duration
+	// GenericMode is used when the provider is a generic priority mutex (not tied to the GitHub merge queue): the head
+	// refs are then arbitrary, and no stacked pull requests are computed
+	GenericMode bool
+	// HistorySize is the number of released requests kept in the provider history (defaults to 20)
+	HistorySize int
+	// StorageEncoding is the format the state is written with in the storage (defaults to JSON)
+	StorageEncoding StorageEncoding
+	// AutoCompleteOnSuccess completes all the remaining known requests as soon as the lease holder reports a success,
+	// and clears the state right away (instead of waiting for each of them to poll in). Their late polls are still
+	// answered with the completed status.
+	AutoCompleteOnSuccess bool
+	// ExcludeFailedRequests counts the requests released without success (and dropped) as part of the batch when
+	// checking the expected request count, so the rebuilt batch doesn't wait for requests which will never come back.
+	// They are forgotten after the stabilize duration, or once a lease holder succeeds.
+	ExcludeFailedRequests bool
+	// FreezeWinner freezes the winner selection once the batch becomes eligible (stabilize duration elapsed, or expected
+	// request count reached): the late priority changes don't change who acquires the lease.
+	FreezeWinner bool
+	// StabilizeFrom defines what the stabilize duration is counted from (defaults to the last state update)
+	StabilizeFrom StabilizeFrom
+	// MaxWait is a safety valve: once the oldest pending request has waited this long, the lease is granted to the
+	// winner no matter the stabilize duration, the expected request count and the min batch size (disabled if zero)
+	MaxWait time.Duration
+	// LeaseTimeout releases (as failed) the lease whose holder hasn't been seen (polling or sending heartbeats) for this
+	// long, so that a dead build can't block the queue forever (disabled if zero)
+	LeaseTimeout time.Duration
+	// DedupeByHeadRef uses the head ref as the request identity: a new head SHA for a known head ref (force-push)
+	// replaces the previous request, instead of being added next to it
+	DedupeByHeadRef bool
+	// PriorityFromRef derives the priority from the pull request number of the head ref (`ascending|descending`),
+	// ignoring the priority sent by the client (disabled if empty, and in generic mode)
+	PriorityFromRef PriorityFromRef
+	// MaxPriority is the max priority the clients can send, so that none of them can dominate the queue forever
+	// (unbounded if zero)
+	MaxPriority int
+	// DefaultPriority is the priority of the requests sent without any (the priority is required if zero)
+	DefaultPriority int
+	// TimeScale speeds up the elapsed time by the given factor (e.g. 10 makes a 10 minutes stabilize duration pass in 1
+	// minute), for the accelerated staging tests. Disabled if zero.
+	TimeScale float64
+	// PendingAccepted makes the pending acquire responses use the 202 (Accepted) status code, the 200 one being kept for
+	// the acquired/completed requests
+	PendingAccepted bool
+	// CompletedResponse defines what the requests of a batch are told once its lease holder is done (defaults to
+	// completed on a success only)
+	CompletedResponse CompletedResponse
+	// Owner is the owner of the repository, its leases being accounted by OwnerLeases
+	Owner string
+	// OwnerLeases caps the leases held concurrently by the providers of the same owner (no cap if nil)
+	OwnerLeases *OwnerLeaseLimiter
 }
 
 type Status string
@@ -44,30 +230,122 @@ const (
 	StatusFailure   = "failure"
 	StatusSuccess   = "success"
 	StatusCompleted = "completed"
+	// StatusReleased is the terminal status of the requests of a batch whose lease holder failed (with the outcome
+	// completed response only): they are dropped from the queue
+	StatusReleased = "released"
+	// StatusCancelled is a neutral release outcome (cancelled build): the lease is passed on like on a failure, but
+	// it's not reported as one
+	StatusCancelled = "cancelled"
+)
+
+const (
+	outcomeEndpointAcquire = "acquire"
+	outcomeEndpointRelease = "release"
+	// outcomeRejected is the result of the acquire/release calls which failed
+	outcomeRejected = "rejected"
 )
 
+// hydration results, reported in the metrics
+const (
+	// hydrationResultRestored a state was found in the storage
+	hydrationResultRestored = "restored"
+	// hydrationResultEmpty no prior state in the storage
+	hydrationResultEmpty = "empty"
+	// hydrationResultError the state couldn't be read from the storage
+	hydrationResultError = "error"
+)
+
+// isReleasedWithoutSuccess tells if the status is a release outcome passing the lease on to the next request
+func isReleasedWithoutSuccess(status string) bool {
+	return status == StatusFailure || status == StatusCancelled
+}
+
+// isReleaseStatus tells if the status is a valid release outcome
+func isReleaseStatus(status string) bool {
+	return status == StatusSuccess || isReleasedWithoutSuccess(status)
+}
+
 type Request struct {
-	HeadSHA          string  `json:"head_sha"`
-	HeadRef          string  `json:"head_ref"`
-	Priority         int     `json:"priority"`
-	Status           *string `json:"status,omitempty"`
-	lastSeenAt       *time.Time
+	HeadSHA  string  `json:"head_sha"`
+	HeadRef  string  `json:"head_ref"`
+	Priority int     `json:"priority"`
+	Status   *string `json:"status,omitempty"`
+	// Metadata is arbitrary client data (e.g. build URL, actor), never interpreted by the provider, only echoed
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	lastSeenAt *time.Time
+	// firstSeenAt is the time the request was inserted
+	firstSeenAt      *time.Time
 	acquireCountdown *int
+	// acquiredAt is the time the request acquired the lease
+	acquiredAt *time.Time
+	// timeline is the append-only list of the status transitions of the request
+	timeline []StatusTransition
+	// NextHeadSHA is the pending request a failed (or cancelled) release hands the lease off to, instead of letting the
+	// provider pick the next winner. Only used on release, never stored.
+	NextHeadSHA string `json:"-"`
+}
+
+// StatusTransition is a status change of a lease request
+type StatusTransition struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
 }
 
 type StackedPullRequest struct {
 	Number int `json:"number"`
 }
 
+// RequestStatus is the compact view of a known request, for the clients only checking their own status
+type RequestStatus struct {
+	HeadSHA  string `json:"head_sha"`
+	Status   string `json:"status"`
+	Priority int    `json:"priority"`
+}
+
 type RequestContext struct {
 	Request             *Request              `json:"request"`
 	StackedPullRequests []*StackedPullRequest `json:"stacked_pull_requests,omitempty"`
+	// Decision is only set on demand, to debug the lease assignment
+	Decision *Decision `json:"decision,omitempty"`
+}
+
+// Decision exposes the factors the lease assignment is based on, as of now
+type Decision struct {
+	StabilizePassed      bool `json:"stabilize_passed"`
+	ExpectedCountReached bool `json:"expected_count_reached"`
+	KnownCount           int  `json:"known_count"`
+	// MaxPriority is the winning priority among the known requests (the lowest one with the `lowest` winner selection)
+	MaxPriority  int `json:"max_priority"`
+	YourPriority int `json:"your_priority"`
+}
+
+// setStatus changes the status of the request, recording the transition in its timeline. The timeline is clipped
+// first so that appending never writes to a backing array shared with a copy.
+func (lr *Request) setStatus(status string, at time.Time) {
+	lr.Status = pointer.String(status)
+	lr.timeline = append(slices.Clip(lr.timeline), StatusTransition{Status: status, At: at})
+}
+
+// Timeline returns a copy of the status transitions of the request, oldest first
+func (lr *Request) Timeline() []StatusTransition {
+	return slices.Clone(lr.timeline)
+}
+
+// copy returns a shallow copy of the request (the provider is never mutating the pointed values, only replacing them)
+func (lr *Request) copy() *Request {
+	c := *lr
+	return &c
 }
 
 func (lr *Request) UpdateLastSeenAt(t time.Time) {
 	lr.lastSeenAt = &t
 }
 
+// UpdateAcquiredAt sets the time the request acquired the lease
+func (lr *Request) UpdateAcquiredAt(t time.Time) {
+	lr.acquiredAt = &t
+}
+
 // MarshalZerologObject allows the .Embed log context.
 func (lr *Request) MarshalZerologObject(e *zerolog.Event) {
 	status := ""
@@ -88,6 +366,28 @@ type ProviderState struct {
 	lastUpdatedAt time.Time
 	acquired      *Request
 	known         map[string]*Request
+	// completed holds the requests auto-completed on a successful release (with their completion time), until they
+	// poll again or expire (TTL). Allocated on first use.
+	completed map[string]time.Time
+	// released holds the requests of a batch whose lease holder failed (with their release time), with the outcome
+	// completed response, until they poll again or expire (TTL). Allocated on first use.
+	released map[string]time.Time
+	// failed holds the requests released without success (with their release time), counted as part of the batch
+	// when ExcludeFailedRequests is set. Allocated on first use.
+	failed map[string]time.Time
+	// stabilizeElapsedLogged tells if the stabilize duration end has already been logged for the current batch
+	// (in-memory only, not persisted)
+	stabilizeElapsedLogged bool
+	// frozenWinner is the head SHA of the request selected to acquire the lease, when the winner selection is frozen
+	// (in-memory only, not persisted: the winner is selected again after a restart)
+	frozenWinner string
+	// handoffTarget is the head SHA of the request a failed release handed the lease off to, acquiring it on its next
+	// poll (in-memory only, not persisted: the winner is selected again after a restart)
+	handoffTarget string
+	// restored tells if the state has been read from the storage (in-memory only, not persisted)
+	restored bool
+	// encoding is the format used by Marshal (Unmarshal is able to read any of them)
+	encoding StorageEncoding
 }
 
 type NewProviderStateOpts struct {
@@ -95,6 +395,8 @@ type NewProviderStateOpts struct {
 	LastUpdatedAt time.Time
 	Acquired      *Request
 	Known         map[string]*Request
+	// Encoding defaults to JSON
+	Encoding StorageEncoding
 }
 
 func NewProviderState(opts NewProviderStateOpts) *ProviderState {
@@ -106,6 +408,7 @@ func NewProviderState(opts NewProviderStateOpts) *ProviderState {
 		lastUpdatedAt: opts.LastUpdatedAt,
 		acquired:      opts.Acquired,
 		known:         opts.Known,
+		encoding:      opts.Encoding,
 	}
 }
 
@@ -114,21 +417,72 @@ func (ps *ProviderState) GetIdentifier() string {
 }
 
 type providerStateRequestStorePayload struct {
-	HeadSHA    string     `json:"head_sha"`
-	HeadRef    string     `json:"head_ref"`
-	Priority   int        `json:"priority"`
-	Status     *string    `json:"status"`
-	LastSeenAt *time.Time `json:"last_seen_at"`
+	HeadSHA          string             `json:"head_sha"`
+	HeadRef          string             `json:"head_ref"`
+	Priority         int                `json:"priority"`
+	Status           *string            `json:"status"`
+	LastSeenAt       *time.Time         `json:"last_seen_at"`
+	FirstSeenAt      *time.Time         `json:"first_seen_at,omitempty"`
+	AcquireCountdown *int               `json:"acquire_countdown,omitempty"`
+	AcquiredAt       *time.Time         `json:"acquired_at,omitempty"`
+	Timeline         []StatusTransition `json:"timeline,omitempty"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
 }
 type providerStateStorePayload struct {
+	// SchemaVersion is the version of this payload schema (0 for the payloads written before it was introduced)
+	SchemaVersion int                                          `json:"schema_version"`
 	ID            string                                       `json:"id"`
 	LastUpdatedAt time.Time                                    `json:"last_updated_at"`
 	AcquiredSHA   *string                                      `json:"acquired_sha"`
 	Known         map[string]*providerStateRequestStorePayload `json:"known"`
+	Completed     map[string]time.Time                         `json:"completed,omitempty"`
+	Released      map[string]time.Time                         `json:"released,omitempty"`
+	Failed        map[string]time.Time                         `json:"failed,omitempty"`
+}
+
+// storePayloadSchemaVersion is the current version of the store payload schema
+const storePayloadSchemaVersion = 1
+
+// storePayloadMigrations upgrade a store payload from the version at their index to the next one
+var storePayloadMigrations = []func(p *providerStateStorePayload){
+	// 0 -> 1: the payloads weren't versioned, and the known requests weren't validated on read: drop the empty entries
+	// and a dangling acquired SHA
+	func(p *providerStateStorePayload) {
+		for k, v := range p.Known {
+			if v == nil {
+				delete(p.Known, k)
+			}
+		}
+		if p.AcquiredSHA != nil {
+			if _, ok := p.Known[*p.AcquiredSHA]; !ok {
+				p.AcquiredSHA = nil
+			}
+		}
+	},
+}
+
+// migrate upgrades the payload to the current schema version
+func (p *providerStateStorePayload) migrate() error {
+	if p.SchemaVersion > storePayloadSchemaVersion {
+		return fmt.Errorf("unsupported state schema version %d (max supported: %d)", p.SchemaVersion, storePayloadSchemaVersion)
+	}
+	for ; p.SchemaVersion < storePayloadSchemaVersion; p.SchemaVersion++ {
+		storePayloadMigrations[p.SchemaVersion](p)
+	}
+	return nil
 }
 
 // Marshal used to marshal the state before being stored
 func (ps *ProviderState) Marshal() ([]byte, error) {
+	return ps.marshal(ps.encoding)
+}
+
+// ExportJSON marshals the state to JSON, whatever its storage encoding is (for backups, restored with Unmarshal)
+func (ps *ProviderState) ExportJSON() ([]byte, error) {
+	return ps.marshal(StorageEncodingJSON)
+}
+
+func (ps *ProviderState) marshal(encoding StorageEncoding) ([]byte, error) {
 	var acquiredSHA *string
 	if ps.acquired != nil {
 		acquiredSHA = &ps.acquired.HeadSHA
@@ -136,18 +490,27 @@ func (ps *ProviderState) Marshal() ([]byte, error) {
 	known := map[string]*providerStateRequestStorePayload{}
 	for k, v := range ps.known {
 		known[k] = &providerStateRequestStorePayload{
-			HeadSHA:    v.HeadSHA,
-			HeadRef:    v.HeadRef,
-			Priority:   v.Priority,
-			Status:     v.Status,
-			LastSeenAt: v.lastSeenAt,
+			HeadSHA:          v.HeadSHA,
+			HeadRef:          v.HeadRef,
+			Priority:         v.Priority,
+			Status:           v.Status,
+			LastSeenAt:       v.lastSeenAt,
+			FirstSeenAt:      v.firstSeenAt,
+			AcquireCountdown: v.acquireCountdown,
+			AcquiredAt:       v.acquiredAt,
+			Timeline:         v.timeline,
+			Metadata:         v.Metadata,
 		}
 	}
-	res, err := json.Marshal(&providerStateStorePayload{
+	res, err := encode(encoding, &providerStateStorePayload{
+		SchemaVersion: storePayloadSchemaVersion,
 		ID:            ps.id,
 		LastUpdatedAt: ps.lastUpdatedAt,
 		AcquiredSHA:   acquiredSHA,
 		Known:         known,
+		Completed:     ps.completed,
+		Released:      ps.released,
+		Failed:        ps.failed,
 	})
 	if err != nil {
 		return nil, err
@@ -158,43 +521,169 @@ func (ps *ProviderState) Marshal() ([]byte, error) {
 // Unmarshal used to unmarshal the state from the store to its native type
 func (ps *ProviderState) Unmarshal(b []byte) error {
 	p := &providerStateStorePayload{}
-	err := json.Unmarshal(b, p)
+	err := decode(b, p)
 	if err != nil {
 		return err
 	}
+	if err := p.migrate(); err != nil {
+		return err
+	}
 	ps.id = p.ID
 	ps.lastUpdatedAt = p.LastUpdatedAt
 	known := map[string]*Request{}
 	for k, v := range p.Known {
 		known[k] = &Request{
-			HeadSHA:    v.HeadSHA,
-			HeadRef:    v.HeadRef,
-			Priority:   v.Priority,
-			Status:     v.Status,
-			lastSeenAt: v.LastSeenAt,
+			HeadSHA:          v.HeadSHA,
+			HeadRef:          v.HeadRef,
+			Priority:         v.Priority,
+			Status:           v.Status,
+			lastSeenAt:       v.LastSeenAt,
+			firstSeenAt:      v.FirstSeenAt,
+			acquireCountdown: v.AcquireCountdown,
+			acquiredAt:       v.AcquiredAt,
+			timeline:         v.Timeline,
+			Metadata:         v.Metadata,
 		}
 	}
 	ps.known = known
+	ps.completed = p.Completed
+	ps.released = p.Released
+	ps.failed = p.Failed
+	ps.acquired = nil
 	if p.AcquiredSHA != nil {
 		ps.acquired = ps.known[*p.AcquiredSHA]
 	}
+	ps.restored = true
 	return nil
 }
 
+// ConfigUpdate is a runtime override of the provider settings (the nil fields are left untouched)
+type ConfigUpdate struct {
+	StabilizeDuration    *time.Duration
+	TTL                  *time.Duration
+	ExpectedRequestCount *int
+	DelayAssignmentCount *int
+}
+
+// Stats is an aggregated view of the provider state
+type Stats struct {
+	KnownCount                int  `json:"known_count"`
+	PendingCount              int  `json:"pending_count"`
+	Acquired                  bool `json:"acquired"`
+	StabilizeRemainingSeconds int  `json:"stabilize_remaining_seconds"`
+	// OldestRequestAgeSeconds is the time elapsed since the least recently seen request polled the provider
+	OldestRequestAgeSeconds int `json:"oldest_request_age_seconds"`
+}
+
+// ProviderStateView is the JSON representation of a provider (details API responses), for the clients to decode them
+type ProviderStateView struct {
+	LastUpdatedAt time.Time         `json:"last_updated_at"`
+	Acquired      *RequestContext   `json:"acquired"`
+	Known         []*RequestContext `json:"known"`
+	Frozen        bool              `json:"frozen,omitempty"`
+	// Config is the current config of the provider (runtime overrides included)
+	Config ProviderConfigView `json:"config"`
+}
+
+// ProviderConfigView is the JSON representation of the config of a provider (durations in seconds)
+type ProviderConfigView struct {
+	StabilizeDuration     int     `json:"stabilize_duration"`
+	TTL                   int     `json:"ttl"`
+	ExpectedRequestCount  int     `json:"expected_request_count"`
+	DelayAssignmentCount  int     `json:"delay_assignment_count"`
+	GenericMode           bool    `json:"generic_mode,omitempty"`
+	AutoCompleteOnSuccess bool    `json:"auto_complete_on_success,omitempty"`
+	ExcludeFailedRequests bool    `json:"exclude_failed_requests,omitempty"`
+	FreezeWinner          bool    `json:"freeze_winner,omitempty"`
+	StabilizeFrom         string  `json:"stabilize_from,omitempty"`
+	MaxWait               int     `json:"max_wait,omitempty"`
+	LeaseTimeout          int     `json:"lease_timeout,omitempty"`
+	DedupeByHeadRef       bool    `json:"dedupe_by_head_ref,omitempty"`
+	PriorityFromRef       string  `json:"priority_from_ref,omitempty"`
+	MaxPriority           int     `json:"max_priority,omitempty"`
+	DefaultPriority       int     `json:"default_priority,omitempty"`
+	TimeScale             float64 `json:"time_scale,omitempty"`
+	PendingAccepted       bool    `json:"pending_accepted,omitempty"`
+	CompletedResponse     string  `json:"completed_response,omitempty"`
+}
+
+// AcquiredLease is the request holding the lease of a provider
+type AcquiredLease struct {
+	Acquired   *RequestContext `json:"acquired"`
+	AcquiredAt *time.Time      `json:"acquired_at"`
+}
+
 type Provider interface {
 	Acquire(ctx context.Context, leaseRequest *Request) (*Request, error)
 	Release(ctx context.Context, leaseRequest *Request) (*Request, error)
+	// Heartbeat records that the build holding the lease (identified by its head SHA) is still alive
+	Heartbeat(ctx context.Context, headSHA string) (*Request, error)
 	BuildRequestContext(ctx context.Context, leaseRequest *Request) (*RequestContext, error)
 	HydrateFromState(ctx context.Context) error
 	Clear(ctx context.Context)
+	// ClearIfNotAcquired clears the state, unless a request is holding the lease (AcquiredError)
+	ClearIfNotAcquired(ctx context.Context) error
+	Stats() *Stats
+	// AcquiredSHA returns the head SHA of the request currently holding the lease (empty if none)
+	AcquiredSHA() string
+	// DetailsETag returns the entity tag of the provider details, which changes along with them (last update, lease
+	// holder, known requests count, freeze and runtime config overrides)
+	DetailsETag() string
+	// AcquiredLease returns the request currently holding the lease, and since when (both empty if none)
+	AcquiredLease(ctx context.Context) (*AcquiredLease, error)
+	// SuggestedPollInterval returns the (jittered) time a pending request should wait before polling again
+	SuggestedPollInterval() time.Duration
+	// Decision returns the factors the lease assignment is based on, for the given request
+	Decision(leaseRequest *Request) *Decision
+	// History returns the last released requests, newest first
+	History() []*HistoryEntry
+	// Statuses returns the compact statuses of the known requests, sorted by priority like in the details (low priority
+	// first, then by head SHA)
+	Statuses() []*RequestStatus
+	// Timeline returns the status transitions of the given request (known, or recently released), oldest first. The
+	// boolean is false when the request is unknown.
+	Timeline(headSHA string) ([]StatusTransition, bool)
+	// PeekWinner returns the request which would win the lease if the batch resolved now (nil if the lease can't be
+	// granted yet), without registering anything nor changing the state
+	PeekWinner(ctx context.Context) (*RequestContext, error)
+	// ExportState returns the state marshalled to JSON (for backups)
+	ExportState() ([]byte, error)
+	// ImportState replaces the state with the given one (restored from a backup), and saves it
+	ImportState(ctx context.Context, state *ProviderState) error
+	// GenericMode tells if the provider is used as a generic priority mutex (head refs are not merge queue refs)
+	GenericMode() bool
+	// DerivesPriority tells if the priority is derived from the head ref (the one sent by the clients being ignored)
+	DerivesPriority() bool
+	// MaxPriority returns the max priority accepted from the clients (0 if unbounded)
+	MaxPriority() int
+	// DefaultPriority returns the priority of the requests sent without any (0 if the priority is required)
+	DefaultPriority() int
+	// PendingAccepted tells if the pending acquire responses use the 202 (Accepted) status code, instead of 200
+	PendingAccepted() bool
+	// SetDraining toggles the drain mode: while draining, new requests are rejected (known ones are still processed)
+	SetDraining(draining bool)
+	// SetFrozen toggles the freeze of the provider (maintenance window): while frozen, all the acquire requests are
+	// rejected (the releases are still processed)
+	SetFrozen(frozen bool)
+	// Frozen tells if the provider is frozen
+	Frozen() bool
+	// UpdateConfig overrides some of the provider settings at runtime (kept in memory, until restart)
+	UpdateConfig(ctx context.Context, update ConfigUpdate)
 }
 
 type leaseProviderImpl struct {
-	mutex   sync.Mutex
-	opts    ProviderOpts
-	clock   clock.PassiveClock
-	storage storage.Storage[*ProviderState]
-	metrics *providerMetrics
+	// mutex guards the state (and the history): the read-only paths only take the read lock
+	mutex    sync.RWMutex
+	opts     ProviderOpts
+	clock    clock.PassiveClock
+	storage  storage.Storage[*ProviderState]
+	metrics  *providerMetrics
+	draining atomic.Bool
+	frozen   atomic.Bool
+	history  *historyBuffer
+	// hydrated tells if the state has already been hydrated once: only the first hydration is reported in the metrics,
+	// not the follower refreshes
+	hydrated bool
 
 	state *ProviderState
 }
@@ -205,6 +694,7 @@ func NewLeaseProvider(opts ProviderOpts) Provider {
 	if cl == nil {
 		cl = clock.RealClock{}
 	}
+	cl = newScaledClock(cl, opts.TimeScale)
 	st := opts.Storage
 	// if no Storage service is provided, fallback to a Null storage
 	if st == nil {
@@ -216,27 +706,77 @@ func NewLeaseProvider(opts ProviderOpts) Provider {
 		clock:   cl,
 		storage: st,
 		metrics: opts.Metrics,
+		history: newHistoryBuffer(opts.HistorySize),
 		state: NewProviderState(NewProviderStateOpts{
 			ID:            opts.ID,
 			LastUpdatedAt: cl.Now(),
+			Encoding:      opts.StorageEncoding,
 		}),
 	}
 }
 
+// logger returns the context logger, with the provider ID bound so the logs of every provider can be told apart
+func (lp *leaseProviderImpl) logger(ctx context.Context) *zerolog.Logger {
+	logger := log.Ctx(ctx).With().Str("provider_id", lp.opts.ID).Logger()
+	return &logger
+}
+
 func (lp *leaseProviderImpl) HydrateFromState(ctx context.Context) error {
+	// the state can be re-hydrated while serving requests (follower mode)
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	lp.state.restored = false
 	if err := lp.storage.Hydrate(ctx, lp.state); err != nil {
+		lp.countHydration(hydrationResultError)
 		return err
 	}
+	if lp.state.restored {
+		lp.countHydration(hydrationResultRestored)
+	} else {
+		lp.countHydration(hydrationResultEmpty)
+	}
+
+	// A last updated date in the future would break the stabilize duration computation, clamp it to the current time
+	now := lp.clock.Now()
+	if skew := lp.state.lastUpdatedAt.Sub(now); skew > 0 {
+		if skew > clockSkewWarningThreshold {
+			lp.logger(ctx).
+				Warn().
+				Time("last_updated_at", lp.state.lastUpdatedAt).
+				Time("current_time", now).
+				Dur("clock_skew", skew).
+				Msg("Hydrated state last updated date is in the future, clamping it to the current time")
+		}
+		lp.state.lastUpdatedAt = now
+	}
+
 	lp.updateMetrics()
+	lp.syncOwnerLeases()
 	return nil
 }
 
 // MarshalJSON used to marshall the provider to its JSON form (used in API responses)
 func (lp *leaseProviderImpl) MarshalJSON() ([]byte, error) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	// build the request context for the acquired request
+	acquiredReqContext, err := lp.buildRequestContext(context.Background(), lp.state.acquired)
+	if err != nil {
+		return []byte{}, err
+	}
+
 	requestContexts := make([]*RequestContext, 0, len(lp.state.known))
 	// build lease request context (= request data + stacked Pulls data)
 	for _, r := range lp.state.known {
-		reqContext, err := lp.BuildRequestContext(context.Background(), r)
+		// the stacked pull requests of the acquired request are scanning all the known requests: they are only computed
+		// once, the (read-only) acquired request context being shared with its known entry
+		if r == lp.state.acquired {
+			requestContexts = append(requestContexts, acquiredReqContext)
+			continue
+		}
+		reqContext, err := lp.buildRequestContext(context.Background(), r)
 		if err != nil {
 			return []byte{}, err
 		}
@@ -248,33 +788,30 @@ func (lp *leaseProviderImpl) MarshalJSON() ([]byte, error) {
 		return requestContexts[i].Request.Priority < requestContexts[j].Request.Priority
 	})
 
-	// build the request context for the acquired request
-	acquiredReqContext, err := lp.BuildRequestContext(context.Background(), lp.state.acquired)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	type providerConfigJSON struct {
-		StabilizeDuration    int `json:"stabilize_duration"`
-		TTL                  int `json:"ttl"`
-		ExpectedRequestCount int `json:"expected_request_count"`
-		DelayAssignmentCount int `json:"delay_assignment_count"`
-	}
-
-	return json.Marshal(&struct {
-		LastUpdatedAt time.Time          `json:"last_updated_at"`
-		Acquired      *RequestContext    `json:"acquired"`
-		Known         []*RequestContext  `json:"known"`
-		Config        providerConfigJSON `json:"config"`
-	}{
+	return json.Marshal(&ProviderStateView{
 		LastUpdatedAt: lp.state.lastUpdatedAt,
+		Frozen:        lp.frozen.Load(),
 		Acquired:      acquiredReqContext,
 		Known:         requestContexts,
-		Config: providerConfigJSON{
-			StabilizeDuration:    int(lp.opts.StabilizeDuration.Seconds()),
-			TTL:                  int(lp.opts.TTL.Seconds()),
-			ExpectedRequestCount: lp.opts.ExpectedRequestCount,
-			DelayAssignmentCount: lp.opts.DelayAssignmentCount,
+		Config: ProviderConfigView{
+			StabilizeDuration:     int(lp.opts.StabilizeDuration.Seconds()),
+			TTL:                   int(lp.opts.TTL.Seconds()),
+			ExpectedRequestCount:  lp.opts.ExpectedRequestCount,
+			DelayAssignmentCount:  lp.opts.DelayAssignmentCount,
+			GenericMode:           lp.opts.GenericMode,
+			AutoCompleteOnSuccess: lp.opts.AutoCompleteOnSuccess,
+			ExcludeFailedRequests: lp.opts.ExcludeFailedRequests,
+			FreezeWinner:          lp.opts.FreezeWinner,
+			StabilizeFrom:         string(lp.opts.StabilizeFrom),
+			MaxWait:               int(lp.opts.MaxWait.Seconds()),
+			LeaseTimeout:          int(lp.opts.LeaseTimeout.Seconds()),
+			DedupeByHeadRef:       lp.opts.DedupeByHeadRef,
+			PriorityFromRef:       string(lp.opts.PriorityFromRef),
+			MaxPriority:           lp.opts.MaxPriority,
+			DefaultPriority:       lp.opts.DefaultPriority,
+			TimeScale:             lp.opts.TimeScale,
+			PendingAccepted:       lp.opts.PendingAccepted,
+			CompletedResponse:     string(lp.opts.CompletedResponse),
 		},
 	})
 }
@@ -283,9 +820,8 @@ func (lp *leaseProviderImpl) saveState(ctx context.Context) {
 	// Ignore upstream context, as this has to run no matter if the context is cancelled or not
 	err := lp.storage.Save(context.Background(), lp.state)
 	if err != nil {
-		log.Ctx(ctx).
+		lp.logger(ctx).
 			Error().
-			Str("lease_provider_id", lp.state.id).
 			Err(err).
 			Msg("Failed to save provider")
 	}
@@ -306,31 +842,146 @@ func (lp *leaseProviderImpl) evictTTL(ctx context.Context) {
 			continue
 		}
 		if lp.clock.Since(*v.lastSeenAt) > lp.opts.TTL {
-			log.Ctx(ctx).Debug().EmbedObject(v).Msg("Request evicted (TTL)")
+			lp.logger(ctx).Debug().EmbedObject(v).Msg("Request evicted (TTL)")
 			delete(lp.state.known, k)
+			lp.countEviction()
+		}
+	}
+	for k, completedAt := range lp.state.completed {
+		if lp.clock.Since(completedAt) > lp.opts.TTL {
+			delete(lp.state.completed, k)
+		}
+	}
+	for k, releasedAt := range lp.state.released {
+		if lp.clock.Since(releasedAt) > lp.opts.TTL {
+			delete(lp.state.released, k)
+		}
+	}
+	// past the stabilize duration, the batch isn't waiting for the expected request count anymore
+	for k, failedAt := range lp.state.failed {
+		if lp.clock.Since(failedAt) > lp.opts.StabilizeDuration {
+			delete(lp.state.failed, k)
 		}
 	}
 }
 
 // cleanup cleanups a successful release event, so the next processing can start!
 func (lp *leaseProviderImpl) cleanup(ctx context.Context) {
-	// When all commits reported their status, cleanup acquire lock for the next one.
 	if lp.state.acquired == nil {
 		return
 	}
 	if pointer.StringDeref(lp.state.acquired.Status, StatusAcquired) != StatusCompleted {
 		return
 	}
-	if len(lp.state.known) == 1 {
-		log.Ctx(ctx).Debug().EmbedObject(lp.state.acquired).Msg("Cleanup completed request")
-		delete(lp.state.known, lp.state.acquired.HeadSHA)
+	lp.logger(ctx).Debug().EmbedObject(lp.state.acquired).Msg("Cleanup completed request")
+	now := lp.clock.Now()
+	for sha, req := range lp.state.known {
+		if sha == lp.state.acquired.HeadSHA {
+			continue
+		}
+		// the requests outranked by the lease holder were part of its batch: they are completed as well (and told so
+		// when they poll in). The other ones registered afterwards, and are contenders for the next lease.
+		if !lp.outranks(req.Priority, lp.state.acquired.Priority) {
+			lp.markCompleted(sha, now)
+			delete(lp.state.known, sha)
+		}
+	}
+	delete(lp.state.known, lp.state.acquired.HeadSHA)
+	lp.state.acquired = nil
+	lp.state.failed = nil
+}
+
+// expireLease releases the lease as failed if its holder hasn't been seen for longer than the lease timeout (the lock
+// has to be held)
+func (lp *leaseProviderImpl) expireLease(ctx context.Context) {
+	acquired := lp.state.acquired
+	if lp.opts.LeaseTimeout <= 0 || acquired == nil || acquired.lastSeenAt == nil {
+		return
+	}
+	if pointer.StringDeref(acquired.Status, StatusPending) != StatusAcquired || lp.clock.Since(*acquired.lastSeenAt) <= lp.opts.LeaseTimeout {
+		return
+	}
+	lp.logger(ctx).
+		Warn().
+		EmbedObject(acquired).
+		Float64("config_lease_timeout_sec", lp.opts.LeaseTimeout.Seconds()).
+		Msg("Lease holder timed out, releasing the lease")
+
+	// released as a failure, without any hand-off (the next winner acquires the lease)
+	acquired.setStatus(StatusFailure, lp.clock.Now())
+	lp.recordHistory(acquired, StatusFailure, nil)
+	lp.countRelease(StatusFailure)
+	delete(lp.state.known, acquired.HeadSHA)
+	if lp.opts.ExcludeFailedRequests {
+		lp.markFailed(acquired.HeadSHA, lp.clock.Now())
+	}
+	if len(lp.state.known) == 0 {
 		lp.state.acquired = nil
 	}
 }
 
+// markCompleted remembers the given request as completed, until it polls in again (or expires)
+func (lp *leaseProviderImpl) markCompleted(sha string, completedAt time.Time) {
+	if lp.state.completed == nil {
+		lp.state.completed = make(map[string]time.Time)
+	}
+	lp.state.completed[sha] = completedAt
+}
+
+// markReleased remembers the given request as released by the failure of its batch, until it polls in again (or
+// expires)
+func (lp *leaseProviderImpl) markReleased(sha string, releasedAt time.Time) {
+	if lp.state.released == nil {
+		lp.state.released = make(map[string]time.Time)
+	}
+	lp.state.released[sha] = releasedAt
+}
+
+// markFailed remembers the given request as released without success, until the batch is over (or the stabilize
+// duration is elapsed)
+func (lp *leaseProviderImpl) markFailed(sha string, failedAt time.Time) {
+	if lp.state.failed == nil {
+		lp.state.failed = make(map[string]time.Time)
+	}
+	lp.state.failed[sha] = failedAt
+}
+
+// forgetHeadRef drops the known requests sharing the head ref of the given (new) request, so that a force-pushed
+// branch only counts once in the batch. The lease can't be held at this point (new requests are then rejected).
+func (lp *leaseProviderImpl) forgetHeadRef(ctx context.Context, leaseRequest *Request) {
+	for sha, known := range lp.state.known {
+		if known.HeadRef != leaseRequest.HeadRef {
+			continue
+		}
+		lp.logger(ctx).
+			Info().
+			EmbedObject(leaseRequest).
+			Str("replaced_head_sha", sha).
+			Msg("Lease request replaces the previous commit of the same head ref")
+		delete(lp.state.known, sha)
+	}
+}
+
+// derivePriority replaces the priority sent by the client with the one derived from the pull request number of the
+// head ref, when the provider is configured so
+func (lp *leaseProviderImpl) derivePriority(leaseRequest *Request) error {
+	if lp.opts.PriorityFromRef == "" || lp.opts.GenericMode {
+		return nil
+	}
+	prNumber, err := getPRNumberFromRef(leaseRequest.HeadRef)
+	if err != nil {
+		return err
+	}
+	if lp.opts.PriorityFromRef == PriorityFromRefDescending {
+		prNumber = -prNumber
+	}
+	leaseRequest.Priority = prNumber
+	return nil
+}
+
 // insert is trying to insert (or update) the request into the in-memory known requests list
 func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request) (*Request, error) {
-	log.Ctx(ctx).Debug().EmbedObject(leaseRequest).Msg("Inserting new lease request")
+	lp.logger(ctx).Debug().EmbedObject(leaseRequest).Msg("Inserting new lease request")
 
 	updated := false
 
@@ -342,23 +993,37 @@ func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request)
 
 	// If we don't have a lease request for this commit, add it
 	if existing, ok := lp.state.known[leaseRequest.HeadSHA]; !ok {
-		log.Ctx(ctx).Debug().EmbedObject(leaseRequest).Msg("Lease request is new")
+		lp.logger(ctx).Debug().EmbedObject(leaseRequest).Msg("Lease request is new")
+		if lp.draining.Load() {
+			return nil, ErrDraining
+		}
 		if lp.state.acquired != nil {
-			return nil, errors.New("lease already acquired")
+			acquired, err := lp.buildRequestContext(ctx, lp.state.acquired)
+			if err != nil {
+				// the stacked pull requests are only informative here, don't hide the conflict behind their failure
+				acquired = &RequestContext{Request: lp.state.acquired.copy()}
+			}
+			return nil, &AcquiredError{Acquired: acquired}
 		}
 
 		if leaseRequest.Status != nil && pointer.StringDeref(leaseRequest.Status, StatusPending) != StatusPending {
 			return nil, fmt.Errorf("invalid status %s for new LeaseRequest with HeadSHA %s", *leaseRequest.Status, leaseRequest.HeadSHA)
 		}
 
+		if lp.opts.DedupeByHeadRef {
+			lp.forgetHeadRef(ctx, leaseRequest)
+		}
 		lp.state.known[leaseRequest.HeadSHA] = leaseRequest
-		lp.state.known[leaseRequest.HeadSHA].Status = pointer.String(StatusPending)
+		lp.state.known[leaseRequest.HeadSHA].setStatus(StatusPending, lp.clock.Now())
+		lp.state.known[leaseRequest.HeadSHA].firstSeenAt = leaseRequest.lastSeenAt
+		// a failed request coming back (retried build) is part of the batch again
+		delete(lp.state.failed, leaseRequest.HeadSHA)
 		updated = true
 	} else {
-		log.Ctx(ctx).Debug().EmbedObject(leaseRequest).Msg("Lease request is already existing")
+		lp.logger(ctx).Debug().EmbedObject(leaseRequest).Msg("Lease request is already existing")
 		// Priority changed, update it
 		if existing.Priority != leaseRequest.Priority {
-			log.Ctx(ctx).
+			lp.logger(ctx).
 				Debug().
 				EmbedObject(leaseRequest).
 				Int("previous_priority", existing.Priority).
@@ -370,7 +1035,7 @@ func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request)
 
 		// Head ref changed, update it
 		if existing.HeadRef != leaseRequest.HeadRef {
-			log.Ctx(ctx).
+			lp.logger(ctx).
 				Debug().
 				EmbedObject(leaseRequest).
 				Str("previous_head_ref", existing.HeadRef).
@@ -380,21 +1045,28 @@ func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request)
 			updated = true
 		}
 
+		// Metadata changed, replace it (a request without metadata, e.g. a release, leaves it untouched)
+		if leaseRequest.Metadata != nil && !maps.Equal(existing.Metadata, leaseRequest.Metadata) {
+			lp.logger(ctx).Debug().EmbedObject(leaseRequest).Msg("Lease request metadata has changed")
+			existing.Metadata = leaseRequest.Metadata
+			updated = true
+		}
+
 		// Update the state when it's a whitelisted transition (ACQUIRED -> SUCCESS/FAILURE)
 		existingStatus := pointer.StringDeref(existing.Status, StatusPending)
 		// Check if it's a whitelisted transition
 		leaseRequestStatus := pointer.StringDeref(leaseRequest.Status, StatusPending)
 		statusMismatch := existingStatus != leaseRequestStatus
-		allowedTransition := existingStatus == StatusAcquired && (leaseRequestStatus == StatusSuccess || leaseRequestStatus == StatusFailure)
+		allowedTransition := existingStatus == StatusAcquired && (leaseRequestStatus == StatusSuccess || isReleasedWithoutSuccess(leaseRequestStatus))
 		// condition
 		if statusMismatch && allowedTransition {
-			log.Ctx(ctx).
+			lp.logger(ctx).
 				Debug().
 				EmbedObject(leaseRequest).
 				Str("previous_status", existingStatus).
 				Str("new_status", leaseRequestStatus).
 				Msg("Lease request status has changed")
-			existing.Status = &leaseRequestStatus
+			existing.setStatus(leaseRequestStatus, lp.clock.Now())
 			updated = true
 		} else if statusMismatch {
 			// status mismatch, we should not get this call
@@ -403,12 +1075,13 @@ func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request)
 
 		// Update existing request no matter if it changed or not (it's used for TTL eviction)
 		lp.updateRequestLastSeenAt(existing)
-		log.Ctx(ctx).Debug().EmbedObject(existing).Msg("Lease request updated")
+		lp.logger(ctx).Debug().EmbedObject(existing).Msg("Lease request updated")
 	}
 
 	if updated {
 		lp.state.lastUpdatedAt = lp.clock.Now()
-		log.Ctx(ctx).
+		lp.state.stabilizeElapsedLogged = false
+		lp.logger(ctx).
 			Debug().
 			Time("new_last_updated_at", lp.state.lastUpdatedAt).
 			Time("new_stabilize_ends_at", lp.state.lastUpdatedAt.Add(lp.opts.StabilizeDuration)).
@@ -423,79 +1096,131 @@ func (lp *leaseProviderImpl) insert(ctx context.Context, leaseRequest *Request)
 func (lp *leaseProviderImpl) evaluateRequest(ctx context.Context, req *Request) *Request {
 	// Prereq: we can expect the arg to be already part of the map!
 
-	log.Ctx(ctx).Debug().EmbedObject(req).Msg("Evaluating lease request")
+	lp.logger(ctx).Debug().EmbedObject(req).Msg("Evaluating lease request")
 
-	if lp.state.acquired != nil && !(pointer.StringDeref(lp.state.acquired.Status, StatusAcquired) == StatusFailure) {
+	if lp.state.acquired != nil && !isReleasedWithoutSuccess(pointer.StringDeref(lp.state.acquired.Status, StatusAcquired)) {
 		// Lock already acquired
-		log.Ctx(ctx).
+		lp.logger(ctx).
 			Debug().
 			EmbedObject(req).
 			Msgf("Lock already acquired (by sha %s, priority %d)", lp.state.acquired.HeadSHA, lp.state.acquired.Priority)
 		return req
 	}
-	// 1st: we reached the time limit -> lastUpdatedAt + StabilizeDuration > now
-	passedStabilizeDuration := lp.clock.Since(lp.state.lastUpdatedAt) >= lp.opts.StabilizeDuration
-	log.Ctx(ctx).
+	// 1st: we reached the time limit -> stabilizeStartedAt + StabilizeDuration > now
+	stabilizeStartedAt := lp.stabilizeStartedAt()
+	passedStabilizeDuration := lp.clock.Since(stabilizeStartedAt) >= lp.opts.StabilizeDuration
+	lp.logger(ctx).
 		Debug().
 		EmbedObject(req).
 		Float64("config_stabilize_duration_sec", lp.opts.StabilizeDuration.Seconds()).
 		Time("last_updated_at", lp.state.lastUpdatedAt).
-		Time("stabilize_ends_at", lp.state.lastUpdatedAt.Add(lp.opts.StabilizeDuration)).
+		Time("stabilize_ends_at", stabilizeStartedAt.Add(lp.opts.StabilizeDuration)).
 		Time("current_time", lp.clock.Now()).
 		Bool("stabilize_duration_passed", passedStabilizeDuration).
 		Msg("Stabilize duration check")
 
+	// log (only once per batch) the moment the stabilize duration is elapsed, to ease the debugging of slow acquisitions
+	if passedStabilizeDuration && !lp.state.stabilizeElapsedLogged {
+		lp.state.stabilizeElapsedLogged = true
+		lp.logger(ctx).
+			Info().
+			Int("known_count", len(lp.state.known)).
+			Int("winning_priority", lp.winningPriority()).
+			Time("last_updated_at", lp.state.lastUpdatedAt).
+			Msg("Stabilize duration elapsed")
+	}
+
 	// 2nd: we received all requests and can take a decision
-	reachedExpectedRequestCount := len(lp.state.known) >= lp.opts.ExpectedRequestCount
-	log.Ctx(ctx).
+	batchSize := lp.batchSize()
+	reachedExpectedRequestCount := batchSize >= lp.opts.ExpectedRequestCount
+	lp.logger(ctx).
 		Debug().
 		EmbedObject(req).
 		Int("config_expected_request_count", lp.opts.ExpectedRequestCount).
 		Int("actual_request_count", len(lp.state.known)).
+		Int("batch_size", batchSize).
 		Bool("expected_request_count_reached", reachedExpectedRequestCount).
 		Msg("Expected request count check")
 
+	// safety valve: once the oldest pending request waited for too long, the winner gets the lease no matter what
+	maxWaitReached := lp.maxWaitReached()
+	if maxWaitReached {
+		lp.logger(ctx).
+			Debug().
+			EmbedObject(req).
+			Float64("config_max_wait_sec", lp.opts.MaxWait.Seconds()).
+			Msg("Max wait reached, the stabilize duration and the expected request count are ignored")
+	}
+
 	// 3rd: there has been no previous failure
-	if lp.state.acquired == nil && (!passedStabilizeDuration && !reachedExpectedRequestCount) {
-		log.Ctx(ctx).
+	if lp.state.acquired == nil && !maxWaitReached && (!passedStabilizeDuration && !reachedExpectedRequestCount) {
+		lp.logger(ctx).
 			Debug().
 			EmbedObject(req).
 			Msg("Stabilize duration has not been met yet, or we're still waiting for more request to register")
 		return req
 	}
 
-	maxPriority := 0
-	// get max priority
-	for _, known := range lp.state.known {
-		if known.Priority > maxPriority {
-			maxPriority = known.Priority
+	// 4th: the stabilize duration is elapsed, but the batch is too small: wait for more requests (up to a hard cap, to
+	// avoid starving a lone request)
+	if lp.state.acquired == nil && !maxWaitReached && !reachedExpectedRequestCount && len(lp.state.known) < lp.opts.MinBatchSize {
+		minBatchMaxWait := lp.opts.MinBatchMaxWait
+		if minBatchMaxWait <= 0 {
+			minBatchMaxWait = lp.opts.StabilizeDuration
+		}
+		if lp.clock.Since(stabilizeStartedAt) < lp.opts.StabilizeDuration+minBatchMaxWait {
+			lp.logger(ctx).
+				Debug().
+				EmbedObject(req).
+				Int("config_min_batch_size", lp.opts.MinBatchSize).
+				Int("actual_request_count", len(lp.state.known)).
+				Time("min_batch_wait_ends_at", stabilizeStartedAt.Add(lp.opts.StabilizeDuration+minBatchMaxWait)).
+				Msg("Min batch size has not been reached yet, waiting for more requests to register")
+			return req
 		}
 	}
 
-	// Got the max priority, now check if we are the winner
-	if req.Priority == maxPriority {
+	// Got the winning priority, now check if we are the winner
+	if lp.isWinner(ctx, req) {
 
 		// In order to prevent race conditions, there's the option to delay the lock acquisition
 		// This is useful when the lock is acquired by a CI job that is canceled or restarted. There can be a short delay.
 		req.acquireCountdown = pointer.Int(pointer.IntDeref(req.acquireCountdown, lp.opts.DelayAssignmentCount+1) - 1)
 		if *req.acquireCountdown > 0 {
-			log.Ctx(ctx).
+			lp.logger(ctx).
 				Debug().
 				EmbedObject(req).
 				Msg("Delaying lock acquisition")
+			if lp.metrics != nil {
+				lp.metrics.assignmentsDelayed.WithLabelValues(lp.opts.ID).Inc()
+			}
+			return req
+		}
+
+		// the owner can't hold more leases (across all its repositories) than allowed: the winner waits for one of them
+		// to be released
+		if lp.opts.OwnerLeases != nil && !lp.opts.OwnerLeases.TryGrant(lp.opts.Owner, lp.opts.ID) {
+			lp.logger(ctx).
+				Debug().
+				EmbedObject(req).
+				Int("owner_max_concurrent_leases", lp.opts.OwnerLeases.Max(lp.opts.Owner)).
+				Msg("Owner concurrent leases cap reached, postponing the lease assignment")
 			return req
 		}
 
-		log.Ctx(ctx).
+		lp.logger(ctx).
 			Debug().
 			EmbedObject(req).
 			Msg("Current lease request has the higher priority. It then acquires the lock")
 
 		// Acquire lease
-		req.Status = pointer.String(StatusAcquired)
+		req.setStatus(StatusAcquired, lp.clock.Now())
+		req.UpdateAcquiredAt(lp.clock.Now())
 		lp.state.acquired = req
+		lp.state.frozenWinner = ""
+		lp.state.handoffTarget = ""
 
-		log.Ctx(ctx).
+		lp.logger(ctx).
 			Info().
 			EmbedObject(req).
 			Msg("Lock acquired")
@@ -504,37 +1229,166 @@ func (lp *leaseProviderImpl) evaluateRequest(ctx context.Context, req *Request)
 	return req
 }
 
+// computeStackedPullRequests returns the pull requests stacked by the given (winning) request: the other known
+// requests which aren't outranking it, followed by the winning request itself. The order is deterministic: the others
+// are sorted by priority (the most outranked first, according to the winner selection mode), then by pull request
+// number (ascending), and the winning request is always last.
 func (lp *leaseProviderImpl) computeStackedPullRequests(leaseRequest *Request) ([]*StackedPullRequest, error) {
-	if nil == leaseRequest {
+	// in generic mode, the head refs are not carrying any pull request number
+	if nil == leaseRequest || lp.opts.GenericMode {
 		return make([]*StackedPullRequest, 0), nil
 	}
 
-	// consider only the other requests which have lower priority (+ current one)
-	filteredRequestKeys := make([]string, 0, len(lp.state.known))
+	type stackedEntry struct {
+		priority int
+		number   int
+		sha      string
+	}
+
+	// consider only the other requests which are outranked by the current one (the current one is appended last)
+	entries := make([]stackedEntry, 0, len(lp.state.known))
 	for k, r := range lp.state.known {
-		if r.Priority > leaseRequest.Priority {
+		if k == leaseRequest.HeadSHA || lp.outranks(r.Priority, leaseRequest.Priority) {
 			continue
 		}
-		filteredRequestKeys = append(filteredRequestKeys, k)
+		prNumber, err := getPRNumberFromRef(r.HeadRef)
+		if err != nil {
+			return make([]*StackedPullRequest, 0), err
+		}
+		entries = append(entries, stackedEntry{priority: r.Priority, number: prNumber, sha: k})
 	}
-	// sort the filtered requests by priority
-	sort.SliceStable(filteredRequestKeys, func(i, j int) bool {
-		return lp.state.known[filteredRequestKeys[i]].Priority < lp.state.known[filteredRequestKeys[j]].Priority
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return lp.outranks(entries[j].priority, entries[i].priority)
+		}
+		if entries[i].number != entries[j].number {
+			return entries[i].number < entries[j].number
+		}
+		return entries[i].sha < entries[j].sha
 	})
 
-	stackedPullRequests := make([]*StackedPullRequest, 0, len(filteredRequestKeys))
-	// compute the stacked pr list (by looping over the filtered/sorted requests)
-	for _, k := range filteredRequestKeys {
-		prNumber, err := getPRNumberFromRef(lp.state.known[k].HeadRef)
-		if err != nil {
-			return stackedPullRequests, err
-		}
+	winnerNumber, err := getPRNumberFromRef(leaseRequest.HeadRef)
+	if err != nil {
+		return make([]*StackedPullRequest, 0), err
+	}
 
+	stackedPullRequests := make([]*StackedPullRequest, 0, len(entries)+1)
+	for _, entry := range entries {
 		stackedPullRequests = append(stackedPullRequests, &StackedPullRequest{
-			Number: prNumber,
+			Number: entry.number,
 		})
 	}
-	return stackedPullRequests, nil
+	return append(stackedPullRequests, &StackedPullRequest{Number: winnerNumber}), nil
+}
+
+// batchSize returns the number of requests of the current batch, compared to the expected request count: the known
+// requests, plus the failed ones (only tracked when they are excluded from the expected request count)
+func (lp *leaseProviderImpl) batchSize() int {
+	return len(lp.state.known) + len(lp.state.failed)
+}
+
+// isWinner tells if the given request is the one which has to acquire the lease (the batch being eligible). With the
+// FreezeWinner option, the winner is selected once, and kept until it acquires the lease (or leaves the queue).
+func (lp *leaseProviderImpl) isWinner(ctx context.Context, req *Request) bool {
+	// the lease has been explicitly handed off (unless the target is gone in the meantime)
+	if _, ok := lp.state.known[lp.state.handoffTarget]; ok {
+		return req.HeadSHA == lp.state.handoffTarget
+	}
+	if !lp.opts.FreezeWinner {
+		return req.Priority == lp.winningPriority()
+	}
+	if _, ok := lp.state.known[lp.state.frozenWinner]; !ok {
+		lp.state.frozenWinner = lp.winnerSHA()
+		lp.logger(ctx).
+			Info().
+			Str("frozen_winner_sha", lp.state.frozenWinner).
+			Msg("Winner selection frozen")
+	}
+	return req.HeadSHA == lp.state.frozenWinner
+}
+
+// winnerSHA returns the head SHA of a request with the winning priority (the lowest SHA on ties, to be deterministic)
+func (lp *leaseProviderImpl) winnerSHA() string {
+	winningPriority := lp.winningPriority()
+	winner := ""
+	for sha, known := range lp.state.known {
+		if known.Priority == winningPriority && (winner == "" || sha < winner) {
+			winner = sha
+		}
+	}
+	return winner
+}
+
+// stabilizeStartedAt returns the time the stabilize duration is counted from: the last state update by default, or the
+// first time the oldest pending request was seen (falling back to the last state update if there is none)
+func (lp *leaseProviderImpl) stabilizeStartedAt() time.Time {
+	if lp.opts.StabilizeFrom != StabilizeFromFirstRequest {
+		return lp.state.lastUpdatedAt
+	}
+	startedAt := lp.oldestPendingFirstSeenAt()
+	if startedAt == nil {
+		return lp.state.lastUpdatedAt
+	}
+	return *startedAt
+}
+
+// oldestPendingFirstSeenAt returns the first time the oldest pending request was seen (nil if there is none)
+func (lp *leaseProviderImpl) oldestPendingFirstSeenAt() *time.Time {
+	var oldest *time.Time
+	for _, known := range lp.state.known {
+		if pointer.StringDeref(known.Status, StatusPending) != StatusPending {
+			continue
+		}
+		// the requests stored before the first seen time was tracked fall back to their last seen time
+		firstSeenAt := known.firstSeenAt
+		if firstSeenAt == nil {
+			firstSeenAt = known.lastSeenAt
+		}
+		if firstSeenAt != nil && (oldest == nil || firstSeenAt.Before(*oldest)) {
+			oldest = firstSeenAt
+		}
+	}
+	return oldest
+}
+
+// maxWaitReached tells if the oldest pending request has waited for the max wait duration (if configured)
+func (lp *leaseProviderImpl) maxWaitReached() bool {
+	if lp.opts.MaxWait <= 0 {
+		return false
+	}
+	oldest := lp.oldestPendingFirstSeenAt()
+	return oldest != nil && lp.clock.Since(*oldest) >= lp.opts.MaxWait
+}
+
+// winningPriority returns the priority winning the lease among the known requests (max or min, depending on the
+// winner selection mode)
+func (lp *leaseProviderImpl) winningPriority() int {
+	first := true
+	winningPriority := 0
+	for _, known := range lp.state.known {
+		if first || lp.outranks(known.Priority, winningPriority) {
+			winningPriority = known.Priority
+			first = false
+		}
+	}
+	return winningPriority
+}
+
+// outranks tells if priority a wins over priority b, according to the configured winner selection mode
+func (lp *leaseProviderImpl) outranks(a int, b int) bool {
+	if lp.opts.WinnerSelection == WinnerSelectionLowest {
+		return a < b
+	}
+	return a > b
+}
+
+// syncOwnerLeases reports to the owner leases accounting whether the provider is holding a lease, i.e. whether its
+// lease has been acquired and not released yet (the lock has to be held)
+func (lp *leaseProviderImpl) syncOwnerLeases() {
+	if lp.opts.OwnerLeases != nil {
+		held := lp.state.acquired != nil && pointer.StringDeref(lp.state.acquired.Status, StatusPending) == StatusAcquired
+		lp.opts.OwnerLeases.Sync(lp.opts.Owner, lp.opts.ID, held)
+	}
 }
 
 func (lp *leaseProviderImpl) updateMetrics() {
@@ -551,36 +1405,108 @@ func (lp *leaseProviderImpl) updateMetrics() {
 }
 
 func (lp *leaseProviderImpl) Acquire(ctx context.Context, leaseRequest *Request) (*Request, error) {
+	req, err := lp.acquire(ctx, leaseRequest)
+	lp.countOutcome(outcomeEndpointAcquire, req, err)
+	return req, err
+}
+
+func (lp *leaseProviderImpl) acquire(ctx context.Context, leaseRequest *Request) (*Request, error) {
+	if lp.frozen.Load() {
+		return nil, ErrFrozen
+	}
+
 	// Ensure we don't have any collisions
 	lp.mutex.Lock()
 	defer lp.mutex.Unlock()
+	defer lp.useEventTime(ctx)()
+	defer lp.syncOwnerLeases()
 	defer lp.updateMetrics()
 
 	// Save the state to storage
 	defer lp.saveState(ctx)
 
+	// Cleanup a potential completed lease first, its batch requests are then known as completed
+	lp.cleanup(ctx)
+	// Free the lease of a holder which stopped showing signs of life
+	lp.expireLease(ctx)
+
+	// The request has been completed by the success of the lease holder, let the client know it can die.
+	if _, ok := lp.state.completed[leaseRequest.HeadSHA]; ok {
+		delete(lp.state.completed, leaseRequest.HeadSHA)
+		req := leaseRequest.copy()
+		req.Status = pointer.String(StatusCompleted)
+		lp.logger(ctx).Info().EmbedObject(req).Msg("Lock holder succeeded. Current lease request completed")
+		return req, nil
+	}
+
+	// The request has been released by the failure of the lease holder of its batch, let the client know
+	if _, ok := lp.state.released[leaseRequest.HeadSHA]; ok {
+		delete(lp.state.released, leaseRequest.HeadSHA)
+		req := leaseRequest.copy()
+		req.Status = pointer.String(StatusReleased)
+		lp.logger(ctx).Info().EmbedObject(req).Msg("Lock holder failed. Current lease request released")
+		return req, nil
+	}
+
+	if err := lp.derivePriority(leaseRequest); err != nil {
+		return nil, err
+	}
+
 	// Insert or get the correct one
 	req, err := lp.insert(ctx, leaseRequest)
 	if err != nil {
 		return nil, err
 	}
-	log.Ctx(ctx).Debug().EmbedObject(req).Msg("Lease request has been inserted")
+	lp.logger(ctx).Debug().EmbedObject(req).Msg("Lease request has been inserted")
 
-	// Check if the lease was released successful, let the client know it can die.
-	if lp.state.acquired != nil && pointer.StringDeref(lp.state.acquired.Status, StatusPending) == StatusCompleted {
-		req.Status = pointer.String(StatusCompleted)
-		delete(lp.state.known, req.HeadSHA)
-		log.Ctx(ctx).Info().EmbedObject(req).Msg("Lock holder succeeded. Current lease request completed")
-		return req, nil
+	// Return the request object with the correct status (a copy, the state one can't be read outside the lock)
+	return lp.evaluateRequest(ctx, req).copy(), nil
+}
+
+// Heartbeat bumps the last seen time of the lease holder: acquired leases aren't polling, this is the way for a long
+// build to prove it's still alive (deferring the lease timeout). The acquisition time is left untouched.
+func (lp *leaseProviderImpl) Heartbeat(ctx context.Context, headSHA string) (*Request, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	acquired := lp.state.acquired
+	if acquired == nil || pointer.StringDeref(acquired.Status, StatusPending) != StatusAcquired {
+		return nil, errors.New("no lease acquired")
+	}
+	if acquired.HeadSHA != headSHA {
+		return nil, fmt.Errorf("commit %s does not hold the lease", headSHA)
 	}
 
-	// Return the request object with the correct status
-	return lp.evaluateRequest(ctx, req), nil
+	lp.updateRequestLastSeenAt(acquired)
+	lp.saveState(ctx)
+	lp.logger(ctx).Debug().EmbedObject(acquired).Msg("Lease holder heartbeat")
+
+	return acquired.copy(), nil
 }
 
 func (lp *leaseProviderImpl) Release(ctx context.Context, leaseRequest *Request) (*Request, error) {
+	req, err := lp.release(ctx, leaseRequest)
+	lp.countOutcome(outcomeEndpointRelease, req, err)
+	return req, err
+}
+
+func (lp *leaseProviderImpl) release(ctx context.Context, leaseRequest *Request) (*Request, error) {
+	// The status is validated by the API too, but the provider must not rely on it
+	if status := pointer.StringDeref(leaseRequest.Status, ""); !isReleaseStatus(status) {
+		return nil, fmt.Errorf("%w %q for commit %s, expected one of: %s, %s, %s", ErrInvalidReleaseStatus, status, leaseRequest.HeadSHA, StatusSuccess, StatusFailure, StatusCancelled)
+	}
+
 	lp.mutex.Lock()
 	defer lp.mutex.Unlock()
+
+	// A retried release (e.g. after a timeout) finds the lease already released, and possibly cleaned up: it's a no-op
+	if released := lp.alreadyReleased(leaseRequest); released != nil {
+		lp.logger(ctx).Info().EmbedObject(released).Msg("Lease already released, ignoring the retried release")
+		return released, nil
+	}
+
+	defer lp.useEventTime(ctx)()
+	defer lp.syncOwnerLeases()
 	defer lp.updateMetrics()
 
 	// Save the state to storage
@@ -596,6 +1522,15 @@ func (lp *leaseProviderImpl) Release(ctx context.Context, leaseRequest *Request)
 		return nil, fmt.Errorf("commit %s does not hold the lease", leaseRequest.HeadSHA)
 	}
 
+	// 3. Handing off to a request which can't take the lease
+	if err := lp.validateHandoff(leaseRequest); err != nil {
+		return nil, err
+	}
+
+	if err := lp.derivePriority(leaseRequest); err != nil {
+		return nil, err
+	}
+
 	// At this point in time, we can ingest the lease
 	req, err := lp.insert(ctx, leaseRequest)
 	if err != nil {
@@ -604,44 +1539,353 @@ func (lp *leaseProviderImpl) Release(ctx context.Context, leaseRequest *Request)
 	status := pointer.StringDeref(req.Status, StatusAcquired)
 
 	if status == StatusSuccess {
+		// keep track of the merged pull requests (computed before the status change, which is impacting the stack)
+		stackedPulls, err := lp.computeStackedPullRequests(req)
+		if err != nil {
+			lp.logger(ctx).Warn().EmbedObject(req).Err(err).Msg("Failed to compute the merged pull requests for the history")
+		}
 		// On success, set status to completed so all remaining ones can be removed
-		req.Status = pointer.String(StatusCompleted)
+		req.setStatus(StatusCompleted, lp.clock.Now())
+		lp.recordHistory(req, StatusSuccess, stackedPulls)
+		lp.countRelease(StatusSuccess)
 
 		if lp.metrics != nil {
 			// compute merged batch size to report in the metrics
 			mergedBatchSize := 1
 			for _, known := range lp.state.known {
-				if known.Priority < req.Priority {
+				if lp.outranks(req.Priority, known.Priority) {
 					mergedBatchSize++
 				}
 			}
 			lp.metrics.mergedBatchSize.WithLabelValues(lp.opts.ID).Observe(float64(mergedBatchSize))
 		}
 
-		return req, nil
+		if lp.opts.AutoCompleteOnSuccess {
+			lp.autoComplete(ctx)
+		}
+
+		return req.copy(), nil
 	}
 
-	if status == StatusFailure {
-		// On failure, drop it. This way the next one can acquire the lease
+	if isReleasedWithoutSuccess(status) {
+		lp.recordHistory(req, status, nil)
+		lp.countRelease(status)
+		lp.logger(ctx).Info().EmbedObject(req).Str("release_status", status).Msg("Lease released without success, passing it on")
+
+		// On failure (or cancellation), drop it. This way the next one can acquire the lease
 		delete(lp.state.known, req.HeadSHA)
+		if lp.opts.ExcludeFailedRequests {
+			lp.markFailed(req.HeadSHA, lp.clock.Now())
+		}
+		if leaseRequest.NextHeadSHA != "" {
+			lp.handoff(ctx, leaseRequest.NextHeadSHA)
+		}
+		if status == StatusFailure && lp.opts.CompletedResponse == CompletedResponseOutcome {
+			lp.releaseBatch(ctx, req)
+		}
 		// when it is the last one, we can reset the state
 		if len(lp.state.known) == 0 {
 			lp.state.acquired = nil
 		}
-		return req, nil
+		return req.copy(), nil
+	}
+
+	return req.copy(), fmt.Errorf("unknown condition for commit %s", leaseRequest.HeadSHA)
+}
+
+// releaseBatch drops the requests of the batch of the given failed lease holder (the ones it outranks, but the
+// hand-off target), remembered as released until they poll in: the newer requests compete for the next lease
+func (lp *leaseProviderImpl) releaseBatch(ctx context.Context, failed *Request) {
+	now := lp.clock.Now()
+	releasedCount := 0
+	for sha, req := range lp.state.known {
+		if sha == lp.state.handoffTarget || lp.outranks(req.Priority, failed.Priority) {
+			continue
+		}
+		lp.markReleased(sha, now)
+		delete(lp.state.known, sha)
+		releasedCount++
+	}
+	lp.logger(ctx).
+		Info().
+		EmbedObject(failed).
+		Int("released_count", releasedCount).
+		Msg("Lock holder failed. Lease requests of its batch released")
+}
+
+// validateHandoff checks that the hand-off target of the release (if any) is a known pending request, and that the
+// release is passing the lease on
+func (lp *leaseProviderImpl) validateHandoff(leaseRequest *Request) error {
+	if leaseRequest.NextHeadSHA == "" {
+		return nil
+	}
+	if !isReleasedWithoutSuccess(pointer.StringDeref(leaseRequest.Status, StatusPending)) {
+		return fmt.Errorf("the lease can only be handed off on a failed or cancelled release (given: `%s`)", pointer.StringDeref(leaseRequest.Status, ""))
+	}
+	target, ok := lp.state.known[leaseRequest.NextHeadSHA]
+	if !ok || target.HeadSHA == leaseRequest.HeadSHA {
+		return fmt.Errorf("unknown hand-off target %s", leaseRequest.NextHeadSHA)
+	}
+	if status := pointer.StringDeref(target.Status, StatusPending); status != StatusPending {
+		return fmt.Errorf("hand-off target %s is not pending (status: `%s`)", leaseRequest.NextHeadSHA, status)
+	}
+	return nil
+}
+
+// handoff makes the given request the winner of the lease, whatever its priority: it acquires it on its next poll
+func (lp *leaseProviderImpl) handoff(ctx context.Context, sha string) {
+	lp.state.handoffTarget = sha
+	lp.logger(ctx).
+		Info().
+		EmbedObject(lp.state.known[sha]).
+		Msg("Lock handed off, the target acquires it on its next poll")
+}
+
+// autoComplete completes all the remaining known requests (remembered until they poll again), and clears the state
+// so that the next batch can start right away
+func (lp *leaseProviderImpl) autoComplete(ctx context.Context) {
+	now := lp.clock.Now()
+	for sha := range lp.state.known {
+		if sha == lp.state.acquired.HeadSHA {
+			continue
+		}
+		lp.markCompleted(sha, now)
+	}
+	lp.logger(ctx).
+		Info().
+		EmbedObject(lp.state.acquired).
+		Int("completed_count", len(lp.state.known)-1).
+		Msg("Lock holder succeeded. Remaining lease requests auto-completed")
+	lp.state.known = make(map[string]*Request)
+	lp.state.acquired = nil
+	lp.state.failed = nil
+	lp.state.lastUpdatedAt = now
+}
+
+// countEviction reports a request evicted after its TTL in the metrics
+func (lp *leaseProviderImpl) countEviction() {
+	if lp.metrics == nil || lp.metrics.evictions == nil {
+		return
+	}
+	lp.metrics.evictions.WithLabelValues(lp.opts.ID).Inc()
+}
+
+// countOutcome reports the logical result of an acquire/release call in the metrics: the status of the returned
+// request (the releases without success all being reported as a failure), or `rejected` on error
+func (lp *leaseProviderImpl) countOutcome(endpoint string, req *Request, err error) {
+	if lp.metrics == nil || lp.metrics.outcomes == nil {
+		return
+	}
+	result := outcomeRejected
+	if err == nil && req != nil {
+		result = pointer.StringDeref(req.Status, StatusPending)
+		if isReleasedWithoutSuccess(result) {
+			result = StatusFailure
+		}
+	}
+	lp.metrics.outcomes.WithLabelValues(lp.opts.ID, endpoint, result).Inc()
+}
+
+// countHydration reports the outcome of the first hydration from the storage in the metrics (the lock has to be held)
+func (lp *leaseProviderImpl) countHydration(result string) {
+	if lp.hydrated {
+		return
+	}
+	lp.hydrated = true
+	if lp.metrics == nil || lp.metrics.hydrations == nil {
+		return
+	}
+	lp.metrics.hydrations.WithLabelValues(lp.opts.ID, result).Inc()
+}
+
+// countRelease reports a release (by outcome) in the metrics
+func (lp *leaseProviderImpl) countRelease(status string) {
+	if lp.metrics == nil || lp.metrics.releases == nil {
+		return
+	}
+	lp.metrics.releases.WithLabelValues(lp.opts.ID, status).Inc()
+}
+
+// alreadyReleased returns the request as it was released (completed on success) if the given release is a retry of a
+// release kept in the history, nil otherwise (the lock has to be held). The history is only looked up when the commit
+// isn't known anymore: its current state prevails.
+func (lp *leaseProviderImpl) alreadyReleased(leaseRequest *Request) *Request {
+	// the commit may have been re-queued, or even acquired the lease again, since (a completed lease holder is kept
+	// until the next cleanup)
+	if known, ok := lp.state.known[leaseRequest.HeadSHA]; ok && pointer.StringDeref(known.Status, StatusPending) != StatusCompleted {
+		return nil
+	}
+	status := pointer.StringDeref(leaseRequest.Status, "")
+	for _, entry := range lp.history.list() {
+		if entry.HeadSHA != leaseRequest.HeadSHA {
+			continue
+		}
+		// only the last release of the commit is considered, it has to be the one retried
+		if entry.Status != status {
+			return nil
+		}
+		if status == StatusSuccess {
+			status = StatusCompleted
+		}
+		return &Request{
+			HeadSHA:  entry.HeadSHA,
+			HeadRef:  entry.HeadRef,
+			Priority: entry.Priority,
+			Status:   pointer.String(status),
+		}
+	}
+	return nil
+}
+
+func (lp *leaseProviderImpl) recordHistory(req *Request, status string, stackedPulls []*StackedPullRequest) {
+	lp.history.add(&HistoryEntry{
+		HeadSHA:             req.HeadSHA,
+		HeadRef:             req.HeadRef,
+		Priority:            req.Priority,
+		Status:              status,
+		ReleasedAt:          lp.clock.Now(),
+		StackedPullRequests: stackedPulls,
+		timeline:            req.Timeline(),
+	})
+}
+
+func (lp *leaseProviderImpl) ExportState() ([]byte, error) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return lp.state.ExportJSON()
+}
+
+func (lp *leaseProviderImpl) History() []*HistoryEntry {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return lp.history.list()
+}
+
+func (lp *leaseProviderImpl) Statuses() []*RequestStatus {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	statuses := make([]*RequestStatus, 0, len(lp.state.known))
+	for _, r := range lp.state.known {
+		statuses = append(statuses, &RequestStatus{
+			HeadSHA:  r.HeadSHA,
+			Status:   pointer.StringDeref(r.Status, StatusPending),
+			Priority: r.Priority,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Priority != statuses[j].Priority {
+			return statuses[i].Priority < statuses[j].Priority
+		}
+		return statuses[i].HeadSHA < statuses[j].HeadSHA
+	})
+	return statuses
+}
+
+func (lp *leaseProviderImpl) PeekWinner(ctx context.Context) (*RequestContext, error) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	if !lp.eligible() {
+		return nil, nil
+	}
+	winner, ok := lp.state.known[lp.peekWinnerSHA()]
+	if !ok {
+		return nil, nil
+	}
+
+	// the winner is still pending: its stacked pull requests are the ones it would get on acquisition
+	stackedPulls, err := lp.computeStackedPullRequests(winner)
+	if err != nil {
+		lp.logger(ctx).Error().EmbedObject(winner).Err(err).Msg("Failed to build the winner request context")
+		return nil, err
+	}
+	return &RequestContext{Request: winner.copy(), StackedPullRequests: stackedPulls}, nil
+}
+
+// eligible tells if the lease can be granted as of now, based on the same conditions as evaluateRequest (no lease
+// held, stabilize duration elapsed or expected request count reached, min batch size...), without any side effect (the
+// lock has to be held)
+func (lp *leaseProviderImpl) eligible() bool {
+	if len(lp.state.known) == 0 {
+		return false
+	}
+	if lp.state.acquired != nil && !isReleasedWithoutSuccess(pointer.StringDeref(lp.state.acquired.Status, StatusAcquired)) {
+		return false
+	}
+	// after a failure (or cancellation), the next winner doesn't wait for the batch to resolve again
+	if lp.state.acquired != nil || lp.maxWaitReached() {
+		return true
+	}
+
+	stabilizeStartedAt := lp.stabilizeStartedAt()
+	passedStabilizeDuration := lp.clock.Since(stabilizeStartedAt) >= lp.opts.StabilizeDuration
+	reachedExpectedRequestCount := lp.batchSize() >= lp.opts.ExpectedRequestCount
+	if reachedExpectedRequestCount {
+		return true
+	}
+	if !passedStabilizeDuration {
+		return false
 	}
+	if len(lp.state.known) < lp.opts.MinBatchSize {
+		minBatchMaxWait := lp.opts.MinBatchMaxWait
+		if minBatchMaxWait <= 0 {
+			minBatchMaxWait = lp.opts.StabilizeDuration
+		}
+		return lp.clock.Since(stabilizeStartedAt) >= lp.opts.StabilizeDuration+minBatchMaxWait
+	}
+	return true
+}
 
-	return req, fmt.Errorf("unknown condition for commit %s", leaseRequest.HeadSHA)
+// peekWinnerSHA returns the head SHA of the request which would win the lease, like isWinner but without freezing the
+// winner selection (the lock has to be held). Without a frozen winner, the requests with the winning priority are all
+// winners (the first one polling acquires the lease): the lowest SHA is reported.
+func (lp *leaseProviderImpl) peekWinnerSHA() string {
+	if _, ok := lp.state.known[lp.state.handoffTarget]; ok {
+		return lp.state.handoffTarget
+	}
+	if lp.opts.FreezeWinner {
+		if _, ok := lp.state.known[lp.state.frozenWinner]; ok {
+			return lp.state.frozenWinner
+		}
+	}
+	return lp.winnerSHA()
+}
+
+func (lp *leaseProviderImpl) Timeline(headSHA string) ([]StatusTransition, bool) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	if req, ok := lp.state.known[headSHA]; ok {
+		return req.Timeline(), true
+	}
+	for _, entry := range lp.history.list() {
+		if entry.HeadSHA == headSHA {
+			return slices.Clone(entry.timeline), true
+		}
+	}
+	return nil, false
 }
 
 func (lp *leaseProviderImpl) BuildRequestContext(ctx context.Context, leaseRequest *Request) (*RequestContext, error) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return lp.buildRequestContext(ctx, leaseRequest)
+}
+
+// buildRequestContext is the lock-free version of BuildRequestContext (the caller must hold the lock)
+func (lp *leaseProviderImpl) buildRequestContext(ctx context.Context, leaseRequest *Request) (*RequestContext, error) {
 	// a request context is a combination of a request object and its stacked pull requests info
 	if nil == leaseRequest {
 		return nil, nil
 	}
 
 	requestContext := &RequestContext{
-		Request: leaseRequest,
+		// the context is serialized outside the lock, it must not point to the state request
+		Request: leaseRequest.copy(),
 	}
 
 	if pointer.StringDeref(leaseRequest.Status, StatusPending) != StatusAcquired {
@@ -650,7 +1894,7 @@ func (lp *leaseProviderImpl) BuildRequestContext(ctx context.Context, leaseReque
 
 	stackedPulls, err := lp.computeStackedPullRequests(leaseRequest)
 	if err != nil {
-		log.Ctx(ctx).
+		lp.logger(ctx).
 			Error().
 			EmbedObject(leaseRequest).
 			Err(err).
@@ -665,16 +1909,242 @@ func (lp *leaseProviderImpl) BuildRequestContext(ctx context.Context, leaseReque
 func (lp *leaseProviderImpl) Clear(ctx context.Context) {
 	lp.mutex.Lock()
 	defer lp.mutex.Unlock()
+
+	lp.clear(ctx)
+}
+
+func (lp *leaseProviderImpl) ClearIfNotAcquired(ctx context.Context) error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if lp.state.acquired != nil {
+		acquired, err := lp.buildRequestContext(ctx, lp.state.acquired)
+		if err != nil {
+			acquired = &RequestContext{Request: lp.state.acquired.copy()}
+		}
+		return &AcquiredError{Acquired: acquired}
+	}
+	lp.clear(ctx)
+	return nil
+}
+
+// clear resets the state (the lock has to be held)
+func (lp *leaseProviderImpl) clear(ctx context.Context) {
+	defer lp.syncOwnerLeases()
 	defer lp.updateMetrics()
 
 	lp.state = NewProviderState(NewProviderStateOpts{
 		ID:            lp.state.id,
 		LastUpdatedAt: lp.clock.Now(),
+		Encoding:      lp.opts.StorageEncoding,
 	})
 
 	lp.saveState(ctx)
 }
 
+func (lp *leaseProviderImpl) ImportState(ctx context.Context, state *ProviderState) error {
+	if state.id != lp.opts.ID {
+		return fmt.Errorf("state %s doesn't belong to the provider %s", state.id, lp.opts.ID)
+	}
+
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	defer lp.syncOwnerLeases()
+	defer lp.updateMetrics()
+
+	// the state is written with the encoding of the provider, whatever the encoding of the backup is
+	state.encoding = lp.opts.StorageEncoding
+	if err := lp.storage.Save(context.Background(), state); err != nil {
+		return fmt.Errorf("failed to save the imported state: %w", err)
+	}
+	lp.state = state
+
+	lp.logger(ctx).Info().Int("known_count", len(state.known)).Msg("Provider state imported")
+	return nil
+}
+
+func (lp *leaseProviderImpl) SetDraining(draining bool) {
+	lp.draining.Store(draining)
+}
+
+func (lp *leaseProviderImpl) SetFrozen(frozen bool) {
+	lp.frozen.Store(frozen)
+}
+
+func (lp *leaseProviderImpl) Frozen() bool {
+	return lp.frozen.Load()
+}
+
+func (lp *leaseProviderImpl) UpdateConfig(ctx context.Context, update ConfigUpdate) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if update.StabilizeDuration != nil {
+		lp.opts.StabilizeDuration = *update.StabilizeDuration
+		// the end of the new stabilize duration is worth logging again
+		lp.state.stabilizeElapsedLogged = false
+	}
+	if update.TTL != nil {
+		lp.opts.TTL = *update.TTL
+	}
+	if update.ExpectedRequestCount != nil {
+		lp.opts.ExpectedRequestCount = *update.ExpectedRequestCount
+	}
+	if update.DelayAssignmentCount != nil {
+		lp.opts.DelayAssignmentCount = *update.DelayAssignmentCount
+	}
+	lp.logger(ctx).
+		Warn().
+		Dur("stabilize_duration", lp.opts.StabilizeDuration).
+		Dur("ttl", lp.opts.TTL).
+		Int("expected_request_count", lp.opts.ExpectedRequestCount).
+		Int("delay_assignment_count", lp.opts.DelayAssignmentCount).
+		Msg("Provider config updated at runtime")
+}
+
+func (lp *leaseProviderImpl) DetailsETag() string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%d|%d|%t|%d|%d|%d|%d",
+		lp.state.lastUpdatedAt.UnixNano(),
+		len(lp.state.known),
+		lp.frozen.Load(),
+		lp.opts.StabilizeDuration,
+		lp.opts.TTL,
+		lp.opts.ExpectedRequestCount,
+		lp.opts.DelayAssignmentCount,
+	)
+	if lp.state.acquired != nil {
+		_, _ = fmt.Fprintf(h, "|%s|%s", lp.state.acquired.HeadSHA, pointer.StringDeref(lp.state.acquired.Status, StatusPending))
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+func (lp *leaseProviderImpl) AcquiredSHA() string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	if held := lp.heldRequest(); held != nil {
+		return held.HeadSHA
+	}
+	return ""
+}
+
+func (lp *leaseProviderImpl) AcquiredLease(ctx context.Context) (*AcquiredLease, error) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	held := lp.heldRequest()
+	if held == nil {
+		return &AcquiredLease{}, nil
+	}
+	reqContext, err := lp.buildRequestContext(ctx, held)
+	if err != nil {
+		return nil, err
+	}
+	return &AcquiredLease{Acquired: reqContext, AcquiredAt: held.acquiredAt}, nil
+}
+
+// heldRequest returns the request currently holding the lease, if any (the caller must hold the lock)
+func (lp *leaseProviderImpl) heldRequest() *Request {
+	// a failed (or cancelled) lease is kept as acquired until the next request acquires it, but it's not held anymore
+	if lp.state.acquired == nil || isReleasedWithoutSuccess(pointer.StringDeref(lp.state.acquired.Status, StatusAcquired)) {
+		return nil
+	}
+	return lp.state.acquired
+}
+
+// SuggestedPollInterval returns the time a pending request should wait before polling again: the remaining stabilize
+// duration (nothing can happen before it elapses), with some jitter to spread the polling of the different requests,
+// bounded by the configured min/max.
+func (lp *leaseProviderImpl) SuggestedPollInterval() time.Duration {
+	lp.mutex.RLock()
+	remaining := lp.opts.StabilizeDuration - lp.clock.Since(lp.stabilizeStartedAt())
+	lp.mutex.RUnlock()
+
+	minInterval := lp.opts.PollIntervalMin
+	if minInterval <= 0 {
+		minInterval = defaultPollIntervalMin
+	}
+	maxInterval := lp.opts.PollIntervalMax
+	if maxInterval <= 0 {
+		maxInterval = defaultPollIntervalMax
+	}
+	maxInterval = max(maxInterval, minInterval)
+
+	interval := min(max(remaining, minInterval), maxInterval)
+	jitter := 1 + pollIntervalJitter*(2*rand.Float64()-1) //nolint:gosec // no need for a secure random here
+	return min(max(time.Duration(float64(interval)*jitter), minInterval), maxInterval)
+}
+
+func (lp *leaseProviderImpl) Decision(leaseRequest *Request) *Decision {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return &Decision{
+		StabilizePassed:      lp.clock.Since(lp.stabilizeStartedAt()) >= lp.opts.StabilizeDuration,
+		ExpectedCountReached: lp.batchSize() >= lp.opts.ExpectedRequestCount,
+		KnownCount:           len(lp.state.known),
+		MaxPriority:          lp.winningPriority(),
+		YourPriority:         leaseRequest.Priority,
+	}
+}
+
+func (lp *leaseProviderImpl) GenericMode() bool {
+	return lp.opts.GenericMode
+}
+
+func (lp *leaseProviderImpl) DerivesPriority() bool {
+	return lp.opts.PriorityFromRef != "" && !lp.opts.GenericMode
+}
+
+func (lp *leaseProviderImpl) MaxPriority() int {
+	// the client priorities are ignored when derived from the refs, there's nothing to bound
+	if lp.DerivesPriority() {
+		return 0
+	}
+	return lp.opts.MaxPriority
+}
+
+func (lp *leaseProviderImpl) DefaultPriority() int {
+	return lp.opts.DefaultPriority
+}
+
+func (lp *leaseProviderImpl) PendingAccepted() bool {
+	return lp.opts.PendingAccepted
+}
+
+func (lp *leaseProviderImpl) Stats() *Stats {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	stats := &Stats{
+		KnownCount: len(lp.state.known),
+		Acquired:   lp.state.acquired != nil,
+	}
+
+	if remaining := lp.opts.StabilizeDuration - lp.clock.Since(lp.stabilizeStartedAt()); remaining > 0 {
+		stats.StabilizeRemainingSeconds = int(remaining.Seconds())
+	}
+
+	var oldestLastSeenAt *time.Time
+	for _, r := range lp.state.known {
+		if pointer.StringDeref(r.Status, StatusPending) == StatusPending {
+			stats.PendingCount++
+		}
+		if r.lastSeenAt != nil && (oldestLastSeenAt == nil || r.lastSeenAt.Before(*oldestLastSeenAt)) {
+			oldestLastSeenAt = r.lastSeenAt
+		}
+	}
+	if oldestLastSeenAt != nil {
+		stats.OldestRequestAgeSeconds = int(lp.clock.Since(*oldestLastSeenAt).Seconds())
+	}
+
+	return stats
+}
+
 // getPRNumberFromRef extract pull request number from a GH read-only branch ref name
 func getPRNumberFromRef(ref string) (int, error) {
 	matches := refRegex.FindStringSubmatch(ref)
@@ -684,12 +2154,19 @@ func getPRNumberFromRef(ref string) (int, error) {
 	}
 
 	prNumber, err := strconv.Atoi(matches[2])
-	if err != nil {
+	if errors.Is(err, strconv.ErrRange) {
+		// the regex only bounds the format, a huge number doesn't fit in an int
+		return 0, fmt.Errorf("could not extract PR number from ref: PR number out of range (given: `%s`, ref: `%s`)", matches[2], ref)
+	}
+	if err != nil || prNumber <= 0 {
 		return 0, fmt.Errorf("could not extract PR number from ref: invalid PR integer (given: `%s`, ref: `%s`)", matches[2], ref)
 	}
 	return prNumber, nil
 }
 
+// ValidateGHTempRef checks the ref is a merge queue temporary branch ref, with a PR number the priority can be derived
+// from (a positive one, fitting in an int)
 func ValidateGHTempRef(ref string) bool {
-	return refRegex.MatchString(ref)
+	_, err := getPRNumberFromRef(ref)
+	return err == nil
 }
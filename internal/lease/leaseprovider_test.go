@@ -1,10 +1,22 @@
 package lease
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
+	"github.com/ankorstore/mq-lease-service/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	clocktesting "k8s.io/utils/clock/testing"
 	"k8s.io/utils/pointer" //nolint
@@ -62,6 +74,7 @@ func Test_ProviderState_Marshall(t *testing.T) {
 	expectedState := &ProviderState{
 		id:            "some-key",
 		lastUpdatedAt: expectedLastUpdatedAt,
+		restored:      true,
 		known: map[string]*Request{
 			"fghij": {
 				HeadSHA:    "fghij",
@@ -113,6 +126,7 @@ func Test_ProviderState_Unmarshal(t *testing.T) {
 	providerState.acquired = providerState.known["abcde"]
 
 	expectedStoredStateRaw := `{
+		"schema_version": 1,
 		"id": "some-key",
 		"last_updated_at": "2023-02-17T16:00:00+01:00",
 		"acquired_sha": "abcde",
@@ -542,7 +556,14 @@ func Test_leaseProviderImpl__FullLoop_ReleaseSuccess(t *testing.T) {
 
 	// The reqNext will now be rejected, since the lease acquiring is locked, and we're awaiting all other leases to return
 	_, err = lp.Acquire(context.Background(), reqNext)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrLeaseAcquired)
+	// the error is carrying the lease holder
+	var acquiredErr *AcquiredError
+	if assert.ErrorAs(t, err, &acquiredErr) {
+		assert.Equal(t, "sha3", acquiredErr.Acquired.Request.HeadSHA)
+		assert.Equal(t, 3, acquiredErr.Acquired.Request.Priority)
+		assert.Equal(t, StatusAcquired, *acquiredErr.Acquired.Request.Status)
+	}
 
 	// Report success status for req3
 	req3, err = lp.Release(context.Background(), req3success)
@@ -554,18 +575,14 @@ func Test_leaseProviderImpl__FullLoop_ReleaseSuccess(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, StatusCompleted, *req1.Status)
 
-	// The reqNext should still fail as confirmation or timeout of req2 is awaited
+	// The completed lease has been cleaned up, the next distributed lease can start without waiting for req2
 	_, err = lp.Acquire(context.Background(), reqNext)
-	assert.Error(t, err)
+	assert.NoError(t, err)
 
-	// Last remaining request, send COMPLETE and afterwards the next distributed lease can start
+	// Last remaining request is still told it's COMPLETED, and can die
 	req2, err = lp.Acquire(context.Background(), req2)
 	assert.NoError(t, err)
 	assert.Equal(t, StatusCompleted, *req2.Status)
-
-	// Now, all leases are marked as successful / released. the reqNew should now be accepted
-	_, err = lp.Acquire(context.Background(), reqNext)
-	assert.NoError(t, err)
 }
 
 func Test_leaseProviderImpl__FullLoop_ReleaseFailedNoNewRequest(t *testing.T) {
@@ -773,3 +790,2094 @@ func Test_leaseProviderImpl__FullLoop_DelayedAcquisition(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, StatusAcquired, *req2.Status)
 }
+
+func Test_leaseProviderImpl__DelayedAcquisitionMetric(t *testing.T) {
+	assignmentsDelayed := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "provider_lease_assignment_delayed_total"}, []string{"provider_id"})
+	lp := NewLeaseProvider(ProviderOpts{
+		ID:                   "provider-id",
+		TTL:                  1 * time.Hour,
+		StabilizeDuration:    time.Minute,
+		ExpectedRequestCount: 2,
+		DelayAssignmentCount: 2,
+		Metrics: &providerMetrics{
+			queueSize:          prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "provider_lease_requests_total"}, []string{"provider_id"}),
+			mergedBatchSize:    prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "provider_merged_batch_size"}, []string{"provider_id"}),
+			assignmentsDelayed: assignmentsDelayed,
+		},
+	})
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	// sha1 is not the winner, it must not count as a delayed assignment
+	assert.Equal(t, float64(0), testutil.ToFloat64(assignmentsDelayed.WithLabelValues("provider-id")))
+
+	req2 := &Request{HeadSHA: "sha2", Priority: 2}
+	for i := 1; i <= 2; i++ {
+		req, err := lp.Acquire(context.Background(), req2)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req.Status)
+		assert.Equal(t, float64(i), testutil.ToFloat64(assignmentsDelayed.WithLabelValues("provider-id")))
+	}
+
+	req, err := lp.Acquire(context.Background(), req2)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	assert.Equal(t, float64(2), testutil.ToFloat64(assignmentsDelayed.WithLabelValues("provider-id")))
+}
+
+func Test_leaseProviderImpl__WinnerSelection(t *testing.T) {
+	for _, tc := range []struct {
+		winnerSelection        WinnerSelection
+		expectedWinner         string
+		expectedStackedNumbers []int
+	}{
+		{winnerSelection: "", expectedWinner: "sha3", expectedStackedNumbers: []int{1, 2, 3}},
+		{winnerSelection: WinnerSelectionHighest, expectedWinner: "sha3", expectedStackedNumbers: []int{1, 2, 3}},
+		{winnerSelection: WinnerSelectionLowest, expectedWinner: "sha1", expectedStackedNumbers: []int{3, 2, 1}},
+	} {
+		t.Run(string(tc.winnerSelection), func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: 1 * time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 3, WinnerSelection: tc.winnerSelection})
+
+			requests := map[string]*Request{}
+			for i := 1; i <= 3; i++ {
+				sha := "sha" + strconv.Itoa(i)
+				req, err := lp.Acquire(context.Background(), &Request{
+					HeadSHA:  sha,
+					HeadRef:  "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc",
+					Priority: i,
+				})
+				assert.NoError(t, err)
+				requests[sha] = req
+			}
+
+			// poll again with everyone, only the expected winner should acquire the lease
+			for sha, req := range requests {
+				req, err := lp.Acquire(context.Background(), req)
+				assert.NoError(t, err)
+				requests[sha] = req
+				if sha == tc.expectedWinner {
+					assert.Equal(t, StatusAcquired, *req.Status)
+				} else {
+					assert.Equal(t, StatusPending, *req.Status)
+				}
+			}
+
+			reqContext, err := lp.BuildRequestContext(context.Background(), requests[tc.expectedWinner])
+			assert.NoError(t, err)
+			stackedNumbers := make([]int, 0, len(reqContext.StackedPullRequests))
+			for _, pr := range reqContext.StackedPullRequests {
+				stackedNumbers = append(stackedNumbers, pr.Number)
+			}
+			assert.Equal(t, tc.expectedStackedNumbers, stackedNumbers)
+		})
+	}
+}
+
+func Test_leaseProviderImpl_BuildRequestContext_StackedOrdering(t *testing.T) {
+	for _, tc := range []struct {
+		winnerSelection        WinnerSelection
+		winnerPriority         int
+		expectedStackedNumbers []int
+	}{
+		// sorted by priority (the most outranked first), then by PR number, the winner being always last
+		{winnerSelection: WinnerSelectionHighest, winnerPriority: 3, expectedStackedNumbers: []int{3, 12, 5, 7, 9}},
+		{winnerSelection: WinnerSelectionLowest, winnerPriority: 0, expectedStackedNumbers: []int{5, 7, 3, 12, 9}},
+	} {
+		t.Run(string(tc.winnerSelection), func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: 1 * time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 5, WinnerSelection: tc.winnerSelection})
+
+			for _, r := range []struct {
+				number   int
+				priority int
+			}{{12, 1}, {7, 2}, {3, 1}, {5, 2}} {
+				_, err := lp.Acquire(context.Background(), &Request{
+					HeadSHA:  "sha" + strconv.Itoa(r.number),
+					HeadRef:  "gh-readonly-queue/main/pr-" + strconv.Itoa(r.number) + "-abc",
+					Priority: r.priority,
+				})
+				assert.NoError(t, err)
+			}
+			winner, err := lp.Acquire(context.Background(), &Request{
+				HeadSHA:  "sha9",
+				HeadRef:  "gh-readonly-queue/main/pr-9-abc",
+				Priority: tc.winnerPriority,
+			})
+			assert.NoError(t, err)
+
+			// the equal-priority entries must come out in the same order, whatever the map iteration order
+			for i := 0; i < 20; i++ {
+				reqContext, err := lp.BuildRequestContext(context.Background(), winner)
+				assert.NoError(t, err)
+				stackedNumbers := make([]int, 0, len(reqContext.StackedPullRequests))
+				for _, pr := range reqContext.StackedPullRequests {
+					stackedNumbers = append(stackedNumbers, pr.Number)
+				}
+				assert.Equal(t, tc.expectedStackedNumbers, stackedNumbers)
+			}
+		})
+	}
+}
+
+type hydrateTestFakeStorage struct {
+	clearTestFakeStorage
+	raw string
+}
+
+func (s *hydrateTestFakeStorage) Hydrate(_ context.Context, obj *ProviderState) error {
+	return obj.Unmarshal([]byte(s.raw))
+}
+
+func Test_leaseProviderImpl_HydrateFromState_ClampFutureLastUpdatedAt(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2023-02-17T16:00:00+01:00")
+	clk := clocktesting.NewFakePassiveClock(now)
+
+	for _, tc := range []struct {
+		name                  string
+		storedLastUpdatedAt   string
+		expectedLastUpdatedAt time.Time
+	}{
+		{name: "past", storedLastUpdatedAt: "2023-02-17T15:59:00+01:00", expectedLastUpdatedAt: now.Add(-time.Minute)},
+		{name: "slightly in the future", storedLastUpdatedAt: "2023-02-17T16:00:01+01:00", expectedLastUpdatedAt: now},
+		{name: "far in the future", storedLastUpdatedAt: "2023-02-17T17:00:00+01:00", expectedLastUpdatedAt: now},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := &hydrateTestFakeStorage{raw: `{"id": "provider-id", "last_updated_at": "` + tc.storedLastUpdatedAt + `", "known": {}}`}
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ID: "provider-id", Clock: clk, Storage: storage})
+			lpImpl, ok := lp.(*leaseProviderImpl)
+			assert.True(t, ok)
+
+			assert.NoError(t, lp.HydrateFromState(context.Background()))
+			assert.True(t, tc.expectedLastUpdatedAt.Equal(lpImpl.state.lastUpdatedAt), "expected %s, got %s", tc.expectedLastUpdatedAt, lpImpl.state.lastUpdatedAt)
+		})
+	}
+}
+
+func Test_leaseProviderImpl_HydrateFromState_DelayedAcquisition(t *testing.T) {
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+	opts := ProviderOpts{TTL: 1 * time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, DelayAssignmentCount: 2, ID: "provider-id", Clock: clk}
+
+	savingStorage := &clearTestFakeStorage{}
+	opts.Storage = savingStorage
+	lp := NewLeaseProvider(opts)
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	// first delayed evaluation, one remaining before acquiring the lease
+	req2, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req2.Status)
+
+	raw, err := savingStorage.state.Marshal()
+	assert.NoError(t, err)
+
+	// simulate a restart: the delay progress must be restored from the stored state
+	opts.Storage = &hydrateTestFakeStorage{raw: string(raw)}
+	lp = NewLeaseProvider(opts)
+	assert.NoError(t, lp.HydrateFromState(context.Background()))
+
+	req2, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req2.Status)
+	req2, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req2.Status)
+}
+
+func Test_leaseProviderImpl_HydrateFromState_Metrics(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		storage        storage.Storage[*ProviderState]
+		expectedResult string
+		expectedErr    bool
+	}{
+		{name: "prefilled storage", storage: &hydrateTestFakeStorage{raw: `{"id": "provider-id", "last_updated_at": "2023-02-17T16:00:00+01:00", "known": {}}`}, expectedResult: hydrationResultRestored},
+		{name: "empty storage", storage: &clearTestFakeStorage{}, expectedResult: hydrationResultEmpty},
+		{name: "unreadable state", storage: &hydrateTestFakeStorage{raw: `{`}, expectedResult: hydrationResultError, expectedErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hydrations := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "provider_hydration_total"}, []string{"provider_id", "result"})
+			lp := NewLeaseProvider(ProviderOpts{
+				ID:                "provider-id",
+				TTL:               time.Hour,
+				StabilizeDuration: time.Minute,
+				Clock:             clocktesting.NewFakePassiveClock(time.Now()),
+				Storage:           tc.storage,
+				Metrics: &providerMetrics{
+					queueSize:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "provider_lease_requests_total"}, []string{"provider_id"}),
+					mergedBatchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "provider_merged_batch_size"}, []string{"provider_id"}),
+					hydrations:      hydrations,
+				},
+			})
+
+			err := lp.HydrateFromState(context.Background())
+			if tc.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			// the re-hydrations (follower refreshes) aren't counted
+			_ = lp.HydrateFromState(context.Background())
+			for _, result := range []string{hydrationResultRestored, hydrationResultEmpty, hydrationResultError} {
+				expected := float64(0)
+				if result == tc.expectedResult {
+					expected = 1
+				}
+				assert.Equal(t, expected, testutil.ToFloat64(hydrations.WithLabelValues("provider-id", result)), result)
+			}
+		})
+	}
+}
+
+func Test_leaseProviderImpl_evaluateRequest_logStabilizeElapsedOnce(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: 1 * time.Hour, StabilizeDuration: 1 * time.Minute, ExpectedRequestCount: 4, DelayAssignmentCount: 10, Clock: clk})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	logs := &bytes.Buffer{}
+	ctx := zerolog.New(logs).WithContext(context.Background())
+	countLogs := func() int {
+		return strings.Count(logs.String(), "Stabilize duration elapsed")
+	}
+
+	req := &Request{
+		HeadSHA:  "sha1",
+		Priority: 1,
+	}
+	_, err := lpImpl.insert(ctx, req)
+	assert.NoError(t, err)
+
+	// still in the stabilize window
+	_ = lpImpl.evaluateRequest(ctx, req)
+	assert.Equal(t, 0, countLogs())
+
+	// once the window has passed, the log is only emitted once, no matter the number of evaluations
+	clk.SetTime(now.Add(2 * time.Minute))
+	for i := 0; i < 3; i++ {
+		_ = lpImpl.evaluateRequest(ctx, req)
+	}
+	assert.Equal(t, 1, countLogs())
+
+	// a new request opens a new stabilize window, which is logged again once elapsed
+	_, err = lpImpl.insert(ctx, &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	_ = lpImpl.evaluateRequest(ctx, req)
+	assert.Equal(t, 1, countLogs())
+	clk.SetTime(now.Add(4 * time.Minute))
+	_ = lpImpl.evaluateRequest(ctx, req)
+	_ = lpImpl.evaluateRequest(ctx, req)
+	assert.Equal(t, 2, countLogs())
+}
+
+func Test_leaseProviderImpl_evaluateRequest_minBatchSize(t *testing.T) {
+	now := time.Now()
+
+	t.Run("lone request waits until the min batch size is reached", func(t *testing.T) {
+		clk := clocktesting.NewFakePassiveClock(now)
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 4, MinBatchSize: 2, MinBatchMaxWait: 10 * time.Minute, Clock: clk})
+
+		req1, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req1.Status)
+
+		// stabilize duration elapsed, but the batch is too small
+		clk.SetTime(now.Add(2 * time.Minute))
+		req1, err = lp.Acquire(context.Background(), req1)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req1.Status)
+
+		// a 2nd request registers, once the stabilize duration elapsed again, the lease is granted
+		req2, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req2.Status)
+		clk.SetTime(now.Add(4 * time.Minute))
+		req2, err = lp.Acquire(context.Background(), req2)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *req2.Status)
+	})
+
+	t.Run("lone request waits until the cap", func(t *testing.T) {
+		clk := clocktesting.NewFakePassiveClock(now)
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 4, MinBatchSize: 2, MinBatchMaxWait: 10 * time.Minute, Clock: clk})
+
+		req1, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+		assert.NoError(t, err)
+
+		clk.SetTime(now.Add(10 * time.Minute))
+		req1, err = lp.Acquire(context.Background(), req1)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req1.Status)
+
+		// stabilize duration + max wait elapsed
+		clk.SetTime(now.Add(11 * time.Minute))
+		req1, err = lp.Acquire(context.Background(), req1)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *req1.Status)
+	})
+
+	t.Run("default min batch size does not delay the lease", func(t *testing.T) {
+		clk := clocktesting.NewFakePassiveClock(now)
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 4, Clock: clk})
+
+		req1, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+		assert.NoError(t, err)
+
+		clk.SetTime(now.Add(2 * time.Minute))
+		req1, err = lp.Acquire(context.Background(), req1)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *req1.Status)
+	})
+}
+
+func Test_leaseProviderImpl_SuggestedPollInterval(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+
+	for _, tc := range []struct {
+		name        string
+		elapsed     time.Duration
+		minInterval time.Duration
+		maxInterval time.Duration
+		expectedMin time.Duration
+		expectedMax time.Duration
+	}{
+		{name: "default bounds, long remaining stabilize duration", elapsed: 0, expectedMin: 24 * time.Second, expectedMax: 30 * time.Second},
+		{name: "configured bounds, capped by the max", elapsed: 0, minInterval: 2 * time.Second, maxInterval: 10 * time.Second, expectedMin: 8 * time.Second, expectedMax: 10 * time.Second},
+		{name: "jittered remaining stabilize duration", elapsed: 55 * time.Second, minInterval: time.Second, maxInterval: 10 * time.Second, expectedMin: 4 * time.Second, expectedMax: 6 * time.Second},
+		{name: "stabilize duration elapsed, floored by the min", elapsed: 2 * time.Minute, minInterval: 2 * time.Second, maxInterval: 10 * time.Second, expectedMin: 2 * time.Second, expectedMax: 2400 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clk.SetTime(now)
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 4, PollIntervalMin: tc.minInterval, PollIntervalMax: tc.maxInterval, Clock: clk})
+			clk.SetTime(now.Add(tc.elapsed))
+
+			for i := 0; i < 20; i++ {
+				interval := lp.SuggestedPollInterval()
+				assert.GreaterOrEqual(t, interval, tc.expectedMin)
+				assert.LessOrEqual(t, interval, tc.expectedMax)
+			}
+		})
+	}
+}
+
+func Test_leaseProviderImpl_BuildRequestContext_GenericMode(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, GenericMode: true})
+	assert.True(t, lp.GenericMode())
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "deploy-staging", Priority: 1})
+	assert.NoError(t, err)
+	req2, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "deploy-production", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req2.Status)
+
+	reqContext, err := lp.BuildRequestContext(context.Background(), req2)
+	assert.NoError(t, err)
+	assert.Empty(t, reqContext.StackedPullRequests)
+}
+
+func Test_leaseProviderImpl_History(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 1, HistorySize: 3, Clock: clk})
+	assert.Empty(t, lp.History())
+
+	// release 5 leases one after the other, alternating successes & failures
+	for i := 1; i <= 5; i++ {
+		clk.SetTime(now.Add(time.Duration(i) * time.Minute))
+		req := &Request{HeadSHA: "sha" + strconv.Itoa(i), HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc", Priority: i}
+		req, err := lp.Acquire(context.Background(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *req.Status)
+
+		status := StatusSuccess
+		if i%2 == 0 {
+			status = StatusFailure
+		}
+		_, err = lp.Release(context.Background(), &Request{HeadSHA: req.HeadSHA, HeadRef: req.HeadRef, Priority: req.Priority, Status: pointer.String(status)})
+		assert.NoError(t, err)
+	}
+
+	// capped to the last 3 entries, newest first
+	history := lp.History()
+	assert.Len(t, history, 3)
+	for i, expected := range []struct {
+		sha    string
+		status string
+	}{{"sha5", StatusSuccess}, {"sha4", StatusFailure}, {"sha3", StatusSuccess}} {
+		assert.Equal(t, expected.sha, history[i].HeadSHA)
+		assert.Equal(t, expected.status, history[i].Status)
+	}
+	assert.True(t, now.Add(5*time.Minute).Equal(history[0].ReleasedAt))
+	assert.Equal(t, []*StackedPullRequest{{Number: 5}}, history[0].StackedPullRequests)
+	assert.Empty(t, history[1].StackedPullRequests)
+}
+
+// Test_leaseProviderImpl_ConcurrentAccess is hammering the provider from concurrent writers & readers, it's meant to
+// be run with the race detector (go test -race)
+func Test_leaseProviderImpl_ConcurrentAccess(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Millisecond, ExpectedRequestCount: 4})
+
+	const workers = 8
+	const iterations = 200
+	wg := sync.WaitGroup{}
+
+	// writers: each one is polling with its own request, and releasing the lease when acquired
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				req := &Request{
+					HeadSHA:  "sha" + strconv.Itoa(w) + "-" + strconv.Itoa(i/10),
+					HeadRef:  "gh-readonly-queue/main/pr-" + strconv.Itoa(w) + "-abc",
+					Priority: w,
+				}
+				res, err := lp.Acquire(context.Background(), req)
+				if err != nil || pointer.StringDeref(res.Status, StatusPending) != StatusAcquired {
+					continue
+				}
+				_, _ = lp.BuildRequestContext(context.Background(), res)
+				res.Status = pointer.String(StatusSuccess)
+				_, _ = lp.Release(context.Background(), res)
+			}
+		}(w)
+	}
+
+	// readers: all the read-only paths used by the API handlers
+	for r := 0; r < workers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				_, err := json.Marshal(lp)
+				assert.NoError(t, err)
+				_ = lp.Stats()
+				_ = lp.AcquiredSHA()
+				_ = lp.History()
+				_ = lp.SuggestedPollInterval()
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestProviderState_MarshalUnmarshal(t *testing.T) {
+	lastUpdatedAt, _ := time.Parse(time.RFC3339, "2023-02-17T16:00:00Z")
+	lastSeenAt := lastUpdatedAt.Add(-time.Second)
+	firstSeenAt := lastUpdatedAt.Add(-time.Minute)
+	newState := func(encoding StorageEncoding) *ProviderState {
+		known := map[string]*Request{
+			"sha1": {HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(StatusPending), lastSeenAt: &lastSeenAt, firstSeenAt: &firstSeenAt},
+			"sha2": {HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2, Status: pointer.String(StatusAcquired), acquireCountdown: pointer.Int(0)},
+		}
+		return NewProviderState(NewProviderStateOpts{ID: "provider-id", LastUpdatedAt: lastUpdatedAt, Known: known, Acquired: known["sha2"], Encoding: encoding})
+	}
+
+	for _, tc := range []struct {
+		encoding     StorageEncoding
+		isJSONOutput bool
+	}{
+		{encoding: "", isJSONOutput: true},
+		{encoding: StorageEncodingJSON, isJSONOutput: true},
+		{encoding: StorageEncodingMsgpack, isJSONOutput: false},
+	} {
+		t.Run(string(tc.encoding), func(t *testing.T) {
+			b, err := newState(tc.encoding).Marshal()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.isJSONOutput, json.Valid(b))
+
+			// the payload can be read whatever the encoding of the reader is
+			for _, readerEncoding := range []StorageEncoding{StorageEncodingJSON, StorageEncodingMsgpack} {
+				state := NewProviderState(NewProviderStateOpts{Encoding: readerEncoding})
+				assert.NoError(t, state.Unmarshal(b))
+				assert.Equal(t, "provider-id", state.id)
+				assert.True(t, lastUpdatedAt.Equal(state.lastUpdatedAt))
+				assert.Len(t, state.known, 2)
+				assert.Same(t, state.known["sha2"], state.acquired)
+				assert.Equal(t, StatusPending, *state.known["sha1"].Status)
+				assert.True(t, lastSeenAt.Equal(*state.known["sha1"].lastSeenAt))
+				assert.True(t, firstSeenAt.Equal(*state.known["sha1"].firstSeenAt))
+				assert.Nil(t, state.known["sha1"].acquireCountdown)
+				assert.Equal(t, "gh-readonly-queue/main/pr-2-abc", state.known["sha2"].HeadRef)
+				assert.Equal(t, 0, *state.known["sha2"].acquireCountdown)
+				assert.Nil(t, state.known["sha2"].lastSeenAt)
+			}
+		})
+	}
+}
+
+func TestProviderState_ExportJSON(t *testing.T) {
+	lastUpdatedAt, _ := time.Parse(time.RFC3339, "2023-02-17T16:00:00Z")
+	lastSeenAt := lastUpdatedAt.Add(-time.Second)
+	known := map[string]*Request{
+		"sha1": {HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(StatusPending), lastSeenAt: &lastSeenAt},
+		"sha2": {HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2, Status: pointer.String(StatusAcquired), lastSeenAt: &lastSeenAt},
+	}
+	state := NewProviderState(NewProviderStateOpts{ID: "provider-id", LastUpdatedAt: lastUpdatedAt, Known: known, Acquired: known["sha2"], Encoding: StorageEncodingMsgpack})
+
+	// exported as JSON, whatever the storage encoding is
+	exported, err := state.ExportJSON()
+	assert.NoError(t, err)
+	assert.True(t, json.Valid(exported))
+	assert.NotContains(t, string(exported), "\n")
+
+	// and restored to an equivalent state
+	restored := NewProviderState(NewProviderStateOpts{Encoding: StorageEncodingMsgpack})
+	assert.NoError(t, restored.Unmarshal(exported))
+	reExported, err := restored.ExportJSON()
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(exported), string(reExported))
+	assert.Equal(t, "provider-id", restored.id)
+	assert.Len(t, restored.known, 2)
+	assert.Same(t, restored.known["sha2"], restored.acquired)
+}
+
+func TestProviderState_Unmarshal_SchemaMigration(t *testing.T) {
+	t.Run("version 0", func(t *testing.T) {
+		// payload written before the schema versioning, with an empty known entry and a dangling acquired SHA
+		v0 := `{
+			"id": "provider-id",
+			"last_updated_at": "2023-02-17T16:00:00Z",
+			"acquired_sha": "sha3",
+			"known": {
+				"sha1": {"head_sha": "sha1", "head_ref": "gh-readonly-queue/main/pr-1-abc", "priority": 1, "status": "pending", "last_seen_at": null},
+				"sha2": null
+			}
+		}`
+		state := NewProviderState(NewProviderStateOpts{})
+		assert.NoError(t, state.Unmarshal([]byte(v0)))
+		assert.Equal(t, "provider-id", state.id)
+		assert.Len(t, state.known, 1)
+		assert.Equal(t, "sha1", state.known["sha1"].HeadSHA)
+		assert.Nil(t, state.acquired)
+
+		b, err := state.Marshal()
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), `"schema_version":1`)
+	})
+
+	t.Run("future version", func(t *testing.T) {
+		state := NewProviderState(NewProviderStateOpts{})
+		err := state.Unmarshal([]byte(`{"schema_version": 2, "id": "provider-id", "known": {}}`))
+		assert.ErrorContains(t, err, "unsupported state schema version 2")
+	})
+}
+
+func Test_leaseProviderImpl_EventTime(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 4, Clock: clk})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	eventTime := now.Add(-24 * time.Hour)
+	_, err := lp.Acquire(WithEventTime(context.Background(), eventTime), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.True(t, eventTime.Equal(lpImpl.state.lastUpdatedAt))
+	assert.True(t, eventTime.Equal(*lpImpl.state.known["sha1"].lastSeenAt))
+	// the provider clock is restored after the call
+	assert.Same(t, clk, lpImpl.clock)
+
+	// the stabilize duration is computed from the event times as well
+	req, err := lp.Acquire(WithEventTime(context.Background(), eventTime.Add(2*time.Minute)), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	assert.True(t, eventTime.Add(2*time.Minute).Equal(*lpImpl.state.known["sha1"].lastSeenAt))
+
+	releasedAt := eventTime.Add(5 * time.Minute)
+	_, err = lp.Release(WithEventTime(context.Background(), releasedAt), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+	assert.True(t, releasedAt.Equal(lp.History()[0].ReleasedAt))
+}
+
+func Test_leaseProviderImpl_AutoCompleteOnSuccess(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 3, Clock: clk, AutoCompleteOnSuccess: true})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	var req3 *Request
+	var err error
+	for i := 1; i <= 3; i++ {
+		req3, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), Priority: i})
+		assert.NoError(t, err)
+	}
+	// the expected request count is reached, the last (highest) one wins
+	assert.Equal(t, StatusAcquired, *req3.Status)
+
+	req3, err = lp.Release(context.Background(), &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCompleted, *req3.Status)
+
+	// the state is emptied right away, without waiting for the remaining requests to poll in
+	assert.Nil(t, lpImpl.state.acquired)
+	assert.Empty(t, lpImpl.state.known)
+	assert.Len(t, lpImpl.state.completed, 2)
+	assert.Equal(t, "", lp.AcquiredSHA())
+
+	// a new request can register straight away
+	next, err := lp.Acquire(context.Background(), &Request{HeadSHA: "next", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *next.Status)
+
+	// the remaining requests are still told they are completed when polling in
+	req1, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCompleted, *req1.Status)
+	assert.NotContains(t, lpImpl.state.known, "sha1")
+	assert.NotContains(t, lpImpl.state.completed, "sha1")
+
+	// the ones never polling in are forgotten after the TTL
+	clk.SetTime(now.Add(2 * time.Hour))
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "next", Priority: 1})
+	assert.NoError(t, err)
+	assert.Empty(t, lpImpl.state.completed)
+}
+
+func Test_leaseProviderImpl_AutoCompleteOnSuccess_Disabled(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	for i := 1; i <= 2; i++ {
+		_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), Priority: i})
+		assert.NoError(t, err)
+	}
+	_, err := lp.Release(context.Background(), &Request{HeadSHA: "sha2", Priority: 2, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+
+	// the remaining request is kept until it polls in
+	assert.NotNil(t, lpImpl.state.acquired)
+	assert.Len(t, lpImpl.state.known, 2)
+	assert.Empty(t, lpImpl.state.completed)
+}
+
+func Test_leaseProviderImpl_ExcludeFailedRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		excludeFailedRequests bool
+		expectedStatus        string
+	}{
+		{name: "enabled", excludeFailedRequests: true, expectedStatus: StatusAcquired},
+		{name: "disabled", excludeFailedRequests: false, expectedStatus: StatusPending},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := clocktesting.NewFakePassiveClock(now)
+			lp := NewLeaseProvider(ProviderOpts{
+				TTL:                   10 * time.Second,
+				StabilizeDuration:     time.Minute,
+				ExpectedRequestCount:  3,
+				Clock:                 clk,
+				ExcludeFailedRequests: tc.excludeFailedRequests,
+			})
+
+			// a full batch, sha3 acquires the lease
+			var req *Request
+			var err error
+			for i := 1; i <= 3; i++ {
+				req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), Priority: i})
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, StatusAcquired, *req.Status)
+
+			// the other builds of the batch are cancelled (their requests expire), then sha3 fails
+			clk.SetTime(now.Add(20 * time.Second))
+			_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(StatusFailure)})
+			assert.NoError(t, err)
+			assert.Empty(t, lp.AcquiredSHA())
+
+			// the batch is rebuilt without the failed pull request: only 2 requests are coming
+			clk.SetTime(now.Add(25 * time.Second))
+			_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha4", Priority: 1})
+			assert.NoError(t, err)
+			req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha5", Priority: 2})
+			assert.NoError(t, err)
+			// the failed request still counts as part of the batch: no need to wait for the stabilize duration
+			assert.Equal(t, tc.expectedStatus, *req.Status)
+		})
+	}
+}
+
+func Test_leaseProviderImpl_ExcludeFailedRequests_ForgottenOnSuccess(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, ExcludeFailedRequests: true})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	var req *Request
+	var err error
+	for i := 1; i <= 2; i++ {
+		req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), Priority: i})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, StatusAcquired, *req.Status)
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha2", Priority: 2, Status: pointer.String(StatusFailure)})
+	assert.NoError(t, err)
+	assert.Contains(t, lpImpl.state.failed, "sha2")
+
+	// the lease is passed on to sha1, which succeeds: the next batch starts from scratch
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha3", Priority: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+	assert.Empty(t, lpImpl.state.failed)
+}
+
+func Test_leaseProviderImpl_Heartbeat(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, Clock: clk})
+
+	// no lease acquired yet
+	_, err := lp.Heartbeat(context.Background(), "sha1")
+	assert.Error(t, err)
+
+	var req *Request
+	for i := 1; i <= 2; i++ {
+		req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc", Priority: i})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, StatusAcquired, *req.Status)
+
+	// sha1 is still polling, the lease holder isn't: it looks like the oldest (stuck) request
+	clk.SetTime(now.Add(10 * time.Minute))
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 600, lp.Stats().OldestRequestAgeSeconds)
+
+	// only the lease holder can send heartbeats
+	_, err = lp.Heartbeat(context.Background(), "sha1")
+	assert.EqualError(t, err, "commit sha1 does not hold the lease")
+
+	clk.SetTime(now.Add(11 * time.Minute))
+	req, err = lp.Heartbeat(context.Background(), "sha2")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	assert.Equal(t, 60, lp.Stats().OldestRequestAgeSeconds)
+
+	// the acquisition time is left untouched
+	acquired, err := lp.AcquiredLease(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, now.Equal(*acquired.AcquiredAt))
+}
+
+func Test_leaseProviderImpl_LeaseTimeout(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, LeaseTimeout: 10 * time.Minute, Clock: clk})
+
+	acquire := func(i int) *Request {
+		req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc", Priority: i})
+		assert.NoError(t, err)
+		return req
+	}
+	acquire(1)
+	assert.Equal(t, StatusAcquired, *acquire(2).Status)
+
+	// the heartbeats are deferring the lease timeout
+	clk.SetTime(now.Add(8 * time.Minute))
+	_, err := lp.Heartbeat(context.Background(), "sha2")
+	assert.NoError(t, err)
+	clk.SetTime(now.Add(16 * time.Minute))
+	assert.Equal(t, StatusPending, *acquire(1).Status)
+	assert.Equal(t, "sha2", lp.AcquiredSHA())
+
+	// without any sign of life, the lease is released as failed and passed on
+	clk.SetTime(now.Add(27 * time.Minute))
+	assert.Equal(t, StatusAcquired, *acquire(1).Status)
+	assert.Equal(t, "sha1", lp.AcquiredSHA())
+	history := lp.History()
+	assert.Len(t, history, 1)
+	assert.Equal(t, "sha2", history[0].HeadSHA)
+	assert.Equal(t, StatusFailure, history[0].Status)
+}
+
+func Test_leaseProviderImpl_cleanup_completedWithNewRequest(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 1, Clock: clk})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	// a completed lease, a batch request (outranked by the lease holder) which didn't poll in yet, and a fresh request
+	completed := &Request{HeadSHA: "sha2", Priority: 2, Status: pointer.String(StatusCompleted)}
+	completed.UpdateLastSeenAt(now)
+	batch := &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusPending)}
+	batch.UpdateLastSeenAt(now)
+	fresh := &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(StatusPending)}
+	fresh.UpdateLastSeenAt(now)
+	lpImpl.state = NewProviderState(NewProviderStateOpts{
+		ID:            "provider-id",
+		LastUpdatedAt: now.Add(-time.Hour),
+		Acquired:      completed,
+		Known:         map[string]*Request{"sha1": batch, "sha2": completed, "sha3": fresh},
+	})
+
+	// the fresh request makes progress: the completed lease is cleaned up, and it wins the next one
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha3", Priority: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	assert.Equal(t, "sha3", lp.AcquiredSHA())
+	assert.NotContains(t, lpImpl.state.known, "sha2")
+	assert.NotContains(t, lpImpl.state.known, "sha1")
+
+	// the batch request is still told it's completed when it polls in
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCompleted, *req.Status)
+}
+
+func Test_leaseProviderImpl__FullLoop_ReleaseCancelled(t *testing.T) {
+	releases := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "provider_lease_releases_total"}, []string{"provider_id", "status"})
+	lp := NewLeaseProvider(ProviderOpts{
+		ID:                   "provider-id",
+		TTL:                  time.Hour,
+		StabilizeDuration:    time.Minute,
+		ExpectedRequestCount: 2,
+		Metrics: &providerMetrics{
+			queueSize:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "provider_lease_requests_total"}, []string{"provider_id"}),
+			mergedBatchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "provider_merged_batch_size"}, []string{"provider_id"}),
+			releases:        releases,
+		},
+	})
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	req2, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req2.Status)
+
+	// Report a cancellation for req2
+	req2, err = lp.Release(context.Background(), &Request{HeadSHA: "sha2", Priority: 2, Status: pointer.String(StatusCancelled)})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCancelled, *req2.Status)
+	assert.Equal(t, "", lp.AcquiredSHA())
+
+	// The lease is freed and passed on to the next one, like on a failure
+	req1, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req1.Status)
+
+	// ... but the cancellation is counted (and recorded) separately
+	assert.Equal(t, float64(1), testutil.ToFloat64(releases.WithLabelValues("provider-id", StatusCancelled)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(releases.WithLabelValues("provider-id", StatusFailure)))
+	assert.Equal(t, StatusCancelled, lp.History()[0].Status)
+
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusFailure)})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(releases.WithLabelValues("provider-id", StatusCancelled)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(releases.WithLabelValues("provider-id", StatusFailure)))
+}
+
+func Test_leaseProviderImpl_Outcomes(t *testing.T) {
+	outcomes := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lease_outcomes_total"}, []string{"provider_id", "endpoint", "result"})
+	lp := NewLeaseProvider(ProviderOpts{
+		ID:                   "provider-id",
+		TTL:                  time.Hour,
+		StabilizeDuration:    time.Minute,
+		ExpectedRequestCount: 3,
+		Metrics: &providerMetrics{
+			queueSize:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "provider_lease_requests_total"}, []string{"provider_id"}),
+			mergedBatchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "provider_merged_batch_size"}, []string{"provider_id"}),
+			outcomes:        outcomes,
+		},
+	})
+	outcome := func(endpoint string, result string) float64 {
+		return testutil.ToFloat64(outcomes.WithLabelValues("provider-id", endpoint, result))
+	}
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), outcome("acquire", StatusPending))
+
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha3", Priority: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), outcome("acquire", StatusAcquired))
+
+	// a new request while the lease is held is rejected, so is a release by a commit not holding the lease
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha4", Priority: 4})
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), outcome("acquire", outcomeRejected))
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), outcome("release", outcomeRejected))
+
+	// the cancellations are reported as failures
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(StatusCancelled)})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), outcome("release", StatusFailure))
+
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), outcome("acquire", StatusAcquired))
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha2", Priority: 2, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), outcome("release", StatusCompleted))
+
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), outcome("acquire", StatusCompleted))
+}
+
+func Test_leaseProviderImpl_Frozen(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 1})
+
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+
+	lp.SetFrozen(true)
+	assert.True(t, lp.Frozen())
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.ErrorIs(t, err, ErrFrozen)
+	// the lease holder can still release it
+	req, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusFailure)})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusFailure, *req.Status)
+
+	lp.SetFrozen(false)
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+}
+
+func Test_leaseProviderImpl_ReleaseInvalidStatus(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 1})
+
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+
+	for _, status := range []*string{nil, pointer.String(""), pointer.String(StatusPending), pointer.String(StatusAcquired), pointer.String(StatusCompleted), pointer.String("unknown")} {
+		req, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: status})
+		assert.ErrorIs(t, err, ErrInvalidReleaseStatus)
+		assert.Nil(t, req)
+	}
+
+	// the lease is left untouched
+	assert.True(t, lp.Stats().Acquired)
+	req, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusCompleted, *req.Status)
+}
+
+func Test_leaseProviderImpl_ReleaseHandoff(t *testing.T) {
+	setup := func() Provider {
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 3})
+		for _, req := range []*Request{{HeadSHA: "sha1", Priority: 1}, {HeadSHA: "sha2", Priority: 2}, {HeadSHA: "sha3", Priority: 3}} {
+			_, err := lp.Acquire(context.Background(), req)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, "sha3", lp.AcquiredSHA())
+		return lp
+	}
+
+	t.Run("valid target", func(t *testing.T) {
+		lp := setup()
+		req, err := lp.Release(context.Background(), &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(StatusFailure), NextHeadSHA: "sha1"})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusFailure, *req.Status)
+		// the target acquires the lease on its next poll, even though it's not the winner
+		req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *req.Status)
+		req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *req.Status)
+		assert.Equal(t, "sha1", lp.AcquiredSHA())
+	})
+
+	for _, tc := range []struct {
+		name    string
+		status  string
+		nextSHA string
+	}{
+		{name: "unknown target", status: StatusFailure, nextSHA: "unknown"},
+		{name: "releasing request as target", status: StatusFailure, nextSHA: "sha3"},
+		{name: "successful release", status: StatusSuccess, nextSHA: "sha1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp := setup()
+			_, err := lp.Release(context.Background(), &Request{HeadSHA: "sha3", Priority: 3, Status: pointer.String(tc.status), NextHeadSHA: tc.nextSHA})
+			assert.Error(t, err)
+			// the release is rejected as a whole
+			assert.Equal(t, "sha3", lp.AcquiredSHA())
+		})
+	}
+}
+
+func Test_leaseProviderImpl_FreezeWinner(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		freezeWinner   bool
+		expectedWinner string
+	}{
+		{name: "enabled", freezeWinner: true, expectedWinner: "sha2"},
+		{name: "disabled", freezeWinner: false, expectedWinner: "sha1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2, FreezeWinner: tc.freezeWinner})
+
+			req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+			assert.NoError(t, err)
+			assert.Equal(t, StatusPending, *req.Status)
+			// the expected request count is reached: the batch is eligible, sha2 is the winner
+			req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, StatusPending, *req.Status)
+
+			// a late priority bump, before the winner polls again
+			req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 3})
+			assert.NoError(t, err)
+			if tc.freezeWinner {
+				assert.Equal(t, StatusPending, *req.Status)
+				req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+				assert.NoError(t, err)
+				assert.Equal(t, StatusAcquired, *req.Status)
+			} else {
+				assert.Equal(t, StatusAcquired, *req.Status)
+			}
+			assert.Equal(t, tc.expectedWinner, lp.AcquiredSHA())
+		})
+	}
+}
+
+func Test_leaseProviderImpl_FreezeWinner_WinnerLeaving(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: 90 * time.Second, StabilizeDuration: time.Hour, ExpectedRequestCount: 2, FreezeWinner: true, Clock: clk})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "sha2", lpImpl.state.frozenWinner)
+	clk.SetTime(now.Add(time.Minute))
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+
+	// the frozen winner is abandoned (evicted): the winner is selected again among the remaining requests
+	clk.SetTime(now.Add(2 * time.Minute))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha3", Priority: 3})
+	assert.NoError(t, err)
+	assert.NotContains(t, lpImpl.state.known, "sha2")
+	assert.Equal(t, StatusAcquired, *req.Status)
+	// the winner is unfrozen once it acquired the lease
+	assert.Empty(t, lpImpl.state.frozenWinner)
+}
+
+func Test_leaseProviderImpl_EvictionMetric(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	evictions := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "provider_evictions_total"}, []string{"provider_id"})
+	lp := NewLeaseProvider(ProviderOpts{
+		ID:                   "provider-id",
+		TTL:                  time.Minute,
+		StabilizeDuration:    time.Hour,
+		ExpectedRequestCount: 3,
+		Clock:                clk,
+		Metrics: &providerMetrics{
+			queueSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "provider_lease_requests_total"}, []string{"provider_id"}),
+			evictions: evictions,
+		},
+	})
+
+	for i := 1; i <= 2; i++ {
+		_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha" + strconv.Itoa(i), Priority: i})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, float64(0), testutil.ToFloat64(evictions.WithLabelValues("provider-id")))
+
+	// both requests are abandoned, the eviction runs when a new one comes in
+	clk.SetTime(now.Add(2 * time.Minute))
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha3", Priority: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lp.Stats().KnownCount)
+	assert.Equal(t, float64(2), testutil.ToFloat64(evictions.WithLabelValues("provider-id")))
+}
+
+func Test_leaseProviderImpl_AcquiredLease(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 1, Clock: clk, GenericMode: true})
+
+	acquiredLease, err := lp.AcquiredLease(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, acquiredLease.Acquired)
+	assert.Nil(t, acquiredLease.AcquiredAt)
+
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "ref", Priority: 1})
+	assert.NoError(t, err)
+	clk.SetTime(now.Add(time.Minute))
+
+	acquiredLease, err = lp.AcquiredLease(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "sha1", acquiredLease.Acquired.Request.HeadSHA)
+	assert.True(t, now.Equal(*acquiredLease.AcquiredAt))
+
+	// a failed lease is not held anymore
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "ref", Priority: 1, Status: pointer.String(StatusFailure)})
+	assert.NoError(t, err)
+	acquiredLease, err = lp.AcquiredLease(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, acquiredLease.Acquired)
+}
+
+func Test_leaseProviderImpl_LogsProviderID(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{ID: "owner:repo:main", TTL: time.Minute, StabilizeDuration: time.Hour, ExpectedRequestCount: 2})
+
+	logs := &bytes.Buffer{}
+	ctx := zerolog.New(logs).WithContext(context.Background())
+	_, err := lp.Acquire(ctx, &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.NotEmpty(t, lines)
+	for _, line := range lines {
+		entry := map[string]any{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, "owner:repo:main", entry["provider_id"], line)
+	}
+}
+
+func Test_leaseProviderImpl_StabilizeFrom(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		stabilizeFrom      StabilizeFrom
+		expectedAcquiredAt *time.Duration
+	}{
+		// every new request starts the stabilize duration over: the trickle delays the lease assignment
+		{name: "last update", stabilizeFrom: StabilizeFromLastUpdate, expectedAcquiredAt: nil},
+		{name: "default", stabilizeFrom: "", expectedAcquiredAt: nil},
+		// the stabilize duration is anchored to the first request: the lease is granted on schedule
+		{name: "first request", stabilizeFrom: StabilizeFromFirstRequest, expectedAcquiredAt: pointer.Duration(6 * time.Minute)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := clocktesting.NewFakePassiveClock(now)
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: 5 * time.Minute, ExpectedRequestCount: 10, StabilizeFrom: tc.stabilizeFrom, Clock: clk})
+
+			// a new request every 2 minutes (the newest one having the highest priority)
+			var acquiredAt *time.Duration
+			for i := 0; i < 6; i++ {
+				elapsed := time.Duration(i) * 2 * time.Minute
+				clk.SetTime(now.Add(elapsed))
+				req, err := lp.Acquire(context.Background(), &Request{
+					HeadSHA:  "sha" + strconv.Itoa(i),
+					HeadRef:  "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc",
+					Priority: i + 1,
+				})
+				assert.NoError(t, err)
+				if *req.Status == StatusAcquired {
+					acquiredAt = &elapsed
+					break
+				}
+			}
+			assert.Equal(t, tc.expectedAcquiredAt, acquiredAt)
+		})
+	}
+}
+
+func Test_leaseProviderImpl_StabilizeFrom_FirstRequestSeen(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: 5 * time.Minute, ExpectedRequestCount: 10, StabilizeFrom: StabilizeFromFirstRequest, Clock: clk})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	clk.SetTime(now.Add(time.Minute))
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	// polling again doesn't move the first seen time
+	clk.SetTime(now.Add(2 * time.Minute))
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+
+	assert.True(t, now.Equal(lpImpl.stabilizeStartedAt()))
+	assert.Equal(t, 180, lp.Stats().StabilizeRemainingSeconds)
+}
+
+func Test_leaseProviderImpl_MaxWait(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		maxWait          time.Duration
+		expectedAcquired bool
+	}{
+		{name: "reached", maxWait: 2 * time.Minute, expectedAcquired: true},
+		{name: "disabled", maxWait: 0, expectedAcquired: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			clk := clocktesting.NewFakePassiveClock(now)
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 10, MinBatchSize: 5, MaxWait: tc.maxWait, Clock: clk})
+
+			req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, StatusPending, *req.Status)
+
+			// still waiting for the stabilize duration and the expected request count
+			clk.SetTime(now.Add(time.Minute))
+			req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+			assert.NoError(t, err)
+			assert.Equal(t, StatusPending, *req.Status)
+
+			clk.SetTime(now.Add(2 * time.Minute))
+			req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+			assert.NoError(t, err)
+			if tc.expectedAcquired {
+				assert.Equal(t, StatusAcquired, *req.Status)
+			} else {
+				assert.Equal(t, StatusPending, *req.Status)
+			}
+		})
+	}
+}
+
+func Test_leaseProviderImpl_MaxWait_GrantsWinner(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 10, MaxWait: 2 * time.Minute, Clock: clk})
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	clk.SetTime(now.Add(time.Minute))
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+
+	// the max wait is counted from the oldest pending request, but only the winner acquires the lease
+	clk.SetTime(now.Add(2 * time.Minute))
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", Priority: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+}
+
+func Test_leaseProviderImpl_DedupeByHeadRef(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		dedupe        bool
+		expectedKnown []string
+	}{
+		{name: "enabled", dedupe: true, expectedKnown: []string{"sha1-new", "sha2"}},
+		{name: "disabled", dedupe: false, expectedKnown: []string{"sha1", "sha1-new", "sha2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 3, DedupeByHeadRef: tc.dedupe})
+			lpImpl, ok := lp.(*leaseProviderImpl)
+			assert.True(t, ok)
+
+			_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+			assert.NoError(t, err)
+			_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+			assert.NoError(t, err)
+			// force-push: same head ref, new head SHA
+			_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1-new", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+			assert.NoError(t, err)
+
+			known := make([]string, 0, len(lpImpl.state.known))
+			for sha := range lpImpl.state.known {
+				known = append(known, sha)
+			}
+			assert.ElementsMatch(t, tc.expectedKnown, known)
+			// the old commit doesn't count toward the expected request count anymore
+			req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+			assert.NoError(t, err)
+			if tc.dedupe {
+				assert.Equal(t, StatusPending, *req.Status)
+			} else {
+				assert.Equal(t, StatusAcquired, *req.Status)
+			}
+		})
+	}
+}
+
+func Test_leaseProviderImpl_PriorityFromRef(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		priorityFromRef  PriorityFromRef
+		expectedWinner   string
+		expectedPriority int
+	}{
+		{name: "ascending", priorityFromRef: PriorityFromRefAscending, expectedWinner: "sha2", expectedPriority: 20},
+		{name: "descending", priorityFromRef: PriorityFromRefDescending, expectedWinner: "sha1", expectedPriority: -10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2, PriorityFromRef: tc.priorityFromRef})
+
+			// the client priorities are contradicting the ref-derived ordering, and ignored
+			_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-10-abc", Priority: 5})
+			assert.NoError(t, err)
+			_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-20-abc", Priority: 1})
+			assert.NoError(t, err)
+
+			refs := map[string]string{"sha1": "gh-readonly-queue/main/pr-10-abc", "sha2": "gh-readonly-queue/main/pr-20-abc"}
+			if lp.AcquiredSHA() == "" {
+				// the winner has to poll again to get the lease
+				_, err = lp.Acquire(context.Background(), &Request{HeadSHA: tc.expectedWinner, HeadRef: refs[tc.expectedWinner], Priority: 3})
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedWinner, lp.AcquiredSHA())
+
+			// the release priority is ignored as well
+			req, err := lp.Release(context.Background(), &Request{HeadSHA: tc.expectedWinner, HeadRef: refs[tc.expectedWinner], Priority: 1, Status: pointer.String(StatusSuccess)})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedPriority, req.Priority)
+		})
+	}
+
+	t.Run("invalid ref", func(t *testing.T) {
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, PriorityFromRef: PriorityFromRefAscending})
+		_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "feature/branch", Priority: 1})
+		assert.Error(t, err)
+	})
+
+	t.Run("generic mode", func(t *testing.T) {
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 1, GenericMode: true, PriorityFromRef: PriorityFromRefAscending})
+		req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "feature/branch", Priority: 7})
+		assert.NoError(t, err)
+		assert.Equal(t, 7, req.Priority)
+	})
+}
+
+func Test_leaseProviderImpl_MaxPriority(t *testing.T) {
+	assert.Equal(t, 10, NewLeaseProvider(ProviderOpts{MaxPriority: 10}).MaxPriority())
+	// the client priorities are ignored when derived from the refs
+	assert.Equal(t, 0, NewLeaseProvider(ProviderOpts{MaxPriority: 10, PriorityFromRef: PriorityFromRefAscending}).MaxPriority())
+	// ... unless in generic mode, where there are no pull request numbers to derive them from
+	assert.Equal(t, 10, NewLeaseProvider(ProviderOpts{MaxPriority: 10, PriorityFromRef: PriorityFromRefAscending, GenericMode: true}).MaxPriority())
+}
+
+func Test_leaseProviderImpl_ImportState(t *testing.T) {
+	storage := &clearTestFakeStorage{}
+	lp := NewLeaseProvider(ProviderOpts{ID: "provider-id", TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2, StorageEncoding: StorageEncodingMsgpack, Storage: storage})
+	lpImpl, ok := lp.(*leaseProviderImpl)
+	assert.True(t, ok)
+
+	// a state of another provider is rejected
+	assert.Error(t, lp.ImportState(context.Background(), NewProviderState(NewProviderStateOpts{ID: "other-id"})))
+	assert.Nil(t, storage.state)
+
+	known := map[string]*Request{
+		"sha1": {HeadSHA: "sha1", Priority: 1, Status: pointer.String(StatusAcquired)},
+	}
+	state := NewProviderState(NewProviderStateOpts{ID: "provider-id", Known: known, Acquired: known["sha1"]})
+	assert.NoError(t, lp.ImportState(context.Background(), state))
+	// saved (with the provider encoding) and used in memory
+	assert.Same(t, state, storage.state)
+	assert.Same(t, state, lpImpl.state)
+	assert.Equal(t, StorageEncodingMsgpack, state.encoding)
+	assert.Equal(t, "sha1", lp.AcquiredSHA())
+}
+
+func Test_getPRNumberFromRef(t *testing.T) {
+	for _, tc := range []struct {
+		ref           string
+		expected      int
+		expectedError string
+	}{
+		{ref: "gh-readonly-queue/main/pr-31132-d107b89c095dd85ba6c62b8a4503100ee33a04bb", expected: 31132},
+		{ref: "gh-readonly-queue/main/pr-007-abc", expected: 7},
+		{ref: "feature/branch", expectedError: "invalid ref format"},
+		{ref: "gh-readonly-queue/main/pr-0-abc", expectedError: "invalid PR integer"},
+		{ref: "gh-readonly-queue/main/pr-99999999999999999999999-abc", expectedError: "PR number out of range"},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			prNumber, err := getPRNumberFromRef(tc.ref)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				assert.Equal(t, 0, prNumber)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, prNumber)
+		})
+	}
+}
+
+func FuzzGetPRNumberFromRef(f *testing.F) {
+	for _, seed := range []string{
+		"gh-readonly-queue/main/pr-31132-d107b89c095dd85ba6c62b8a4503100ee33a04bb",
+		"gh-readonly-queue/main/pr-99999999999999999999999-abc",
+		"gh-readonly-queue/main/pr-0-abc",
+		"gh-readonly-queue//pr-1-",
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, ref string) {
+		prNumber, err := getPRNumberFromRef(ref)
+		// the refs accepted by the request validation are exactly the ones a number can be extracted from
+		assert.Equal(t, err == nil, ValidateGHTempRef(ref))
+		if err != nil {
+			assert.Equal(t, 0, prNumber)
+			assert.Contains(t, err.Error(), "could not extract PR number from ref")
+			return
+		}
+		// a successfully extracted number is always a positive one, matching the ref
+		assert.Positive(t, prNumber)
+		assert.Contains(t, ref, "pr-")
+	})
+}
+
+func Test_leaseProviderImpl_TimeScale(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{
+		ID:                   "provider-id",
+		TTL:                  time.Hour,
+		StabilizeDuration:    10 * time.Minute,
+		ExpectedRequestCount: 3,
+		TimeScale:            10,
+		Clock:                clk,
+	})
+
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+
+	// the 10 minutes stabilize window is shortened to 1 minute
+	clk.SetTime(now.Add(59 * time.Second))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+
+	clk.SetTime(now.Add(time.Minute))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+	// the dates are left untouched
+	assert.True(t, req.acquiredAt.Equal(now.Add(time.Minute)))
+}
+
+func Test_leaseProviderImpl_Timeline(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, Clock: clk})
+
+	_, ok := lp.Timeline("sha1")
+	assert.False(t, ok)
+
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+
+	clk.SetTime(now.Add(2 * time.Minute))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+
+	clk.SetTime(now.Add(3 * time.Minute))
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+
+	expected := []StatusTransition{
+		{Status: StatusPending, At: now},
+		{Status: StatusAcquired, At: now.Add(2 * time.Minute)},
+		{Status: StatusSuccess, At: now.Add(3 * time.Minute)},
+		{Status: StatusCompleted, At: now.Add(3 * time.Minute)},
+	}
+	timeline, ok := lp.Timeline("sha1")
+	assert.True(t, ok)
+	assert.Equal(t, expected, timeline)
+
+	// the timeline is persisted along with the request
+	state := &ProviderState{}
+	raw, err := lp.(*leaseProviderImpl).state.Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, state.Unmarshal(raw))
+	assert.Len(t, state.known["sha1"].timeline, len(expected))
+	for i, transition := range state.known["sha1"].timeline {
+		assert.Equal(t, expected[i].Status, transition.Status)
+		assert.True(t, expected[i].At.Equal(transition.At))
+	}
+
+	// once cleaned up, the request timeline is still served from the history
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+	assert.NoError(t, err)
+	timeline, ok = lp.Timeline("sha1")
+	assert.True(t, ok)
+	assert.Equal(t, expected, timeline)
+}
+
+func Test_leaseProviderImpl_Metadata(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2})
+
+	metadata := map[string]string{"build_url": "https://ci.example.com/builds/1", "actor": "octocat"}
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Metadata: metadata})
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, req.Metadata)
+
+	// polling without metadata leaves it untouched
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, req.Metadata)
+
+	// polling with other metadata replaces it
+	metadata = map[string]string{"build_url": "https://ci.example.com/builds/2"}
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", Priority: 1, Metadata: metadata})
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, req.Metadata)
+
+	// the metadata is persisted along with the request
+	state := &ProviderState{}
+	raw, err := lp.(*leaseProviderImpl).state.Marshal()
+	assert.NoError(t, err)
+	assert.NoError(t, state.Unmarshal(raw))
+	assert.Equal(t, metadata, state.known["sha1"].Metadata)
+}
+
+func Test_leaseProviderImpl_UpdateConfig(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 4, Clock: clk})
+
+	req, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+
+	// shortening the stabilize duration applies to the current batch
+	stabilizeDuration := time.Minute
+	lp.UpdateConfig(context.Background(), ConfigUpdate{StabilizeDuration: &stabilizeDuration})
+	clk.SetTime(now.Add(59 * time.Second))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *req.Status)
+	clk.SetTime(now.Add(time.Minute))
+	req, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *req.Status)
+
+	// the other settings are left untouched, and reported in the details
+	raw, err := json.Marshal(lp)
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), `"stabilize_duration":60,"ttl":3600,"expected_request_count":4`)
+}
+
+// orchestratorHydrateTestFakeStorage hydrates the states from their raw form (by provider ID), failing for the IDs
+// without any. It tracks the max number of concurrent hydrations.
+type orchestratorHydrateTestFakeStorage struct {
+	clearTestFakeStorage
+	raw         map[string]string
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (s *orchestratorHydrateTestFakeStorage) Hydrate(_ context.Context, obj *ProviderState) error {
+	inFlight := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		maxInFlight := s.maxInFlight.Load()
+		if inFlight <= maxInFlight || s.maxInFlight.CompareAndSwap(maxInFlight, inFlight) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	raw, ok := s.raw[obj.GetIdentifier()]
+	if !ok {
+		return errors.New("storage failure")
+	}
+	return obj.Unmarshal([]byte(raw))
+}
+
+func Test_leaseProviderOrchestratorImpl_HydrateFromState(t *testing.T) {
+	now := time.Now()
+	raw := func(id string) string {
+		return `{"id": "` + id + `", "last_updated_at": "` + now.Format(time.RFC3339) + `", "known": {"sha1": {"head_sha": "sha1", "head_ref": "gh-readonly-queue/main/pr-1-aaabbb", "priority": 1, "status": "pending"}}}`
+	}
+	st := &orchestratorHydrateTestFakeStorage{raw: map[string]string{}}
+	var repositories []*latest.GithubRepositoryConfig
+	for i := 0; i < 10; i++ {
+		repository := &latest.GithubRepositoryConfig{Owner: "owner", Name: "repo", BaseRef: "base-" + strconv.Itoa(i), StabilizeDuration: 60, TTL: 3600}
+		repositories = append(repositories, repository)
+		// the base-3 provider fails to be hydrated
+		if i != 3 {
+			id := getKey(repository.Owner, repository.Name, repository.BaseRef, "")
+			st.raw[id] = raw(id)
+		}
+	}
+
+	orchestrator := NewProviderOrchestrator(NewProviderOrchestratorOpts{
+		Repositories:         repositories,
+		Clock:                clocktesting.NewFakePassiveClock(now),
+		Storage:              st,
+		HydrationConcurrency: 3,
+	})
+	err := orchestrator.HydrateFromState(context.Background())
+	assert.ErrorContains(t, err, "failed to hydrate provider owner:repo:base-3: storage failure")
+
+	// the other providers are hydrated anyway
+	for key, status := range orchestrator.HydrationStatuses() {
+		if key == "owner:repo:base-3" {
+			assert.Equal(t, pointer.String("storage failure"), status.Error)
+			assert.Equal(t, 0, status.KnownCount)
+			continue
+		}
+		assert.Nil(t, status.Error, key)
+		assert.Equal(t, 1, status.KnownCount, key)
+	}
+	// with a bounded parallelism
+	assert.LessOrEqual(t, st.maxInFlight.Load(), int32(3))
+	assert.Greater(t, st.maxInFlight.Load(), int32(1))
+}
+
+// newLargeQueueProvider returns a provider holding count known requests, the highest priority one having acquired the
+// lease
+func newLargeQueueProvider(tb testing.TB, count int) *leaseProviderImpl {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: count})
+	for i := 1; i <= count; i++ {
+		req := &Request{HeadSHA: "sha" + strconv.Itoa(i), HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(i) + "-abc", Priority: i}
+		_, err := lp.Acquire(context.Background(), req)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return lp.(*leaseProviderImpl)
+}
+
+// Test_leaseProviderImpl_MarshalJSON_RequestContexts checks the request contexts of the details are the ones built
+// one by one for each request
+func Test_leaseProviderImpl_MarshalJSON_RequestContexts(t *testing.T) {
+	const count = 50
+	lp := newLargeQueueProvider(t, count)
+
+	expectedAcquired, err := lp.BuildRequestContext(context.Background(), lp.state.acquired)
+	assert.NoError(t, err)
+	assert.Len(t, expectedAcquired.StackedPullRequests, count)
+	expectedKnown := make([]*RequestContext, 0, count)
+	for i := 1; i <= count; i++ {
+		reqContext, err := lp.BuildRequestContext(context.Background(), lp.state.known["sha"+strconv.Itoa(i)])
+		assert.NoError(t, err)
+		expectedKnown = append(expectedKnown, reqContext)
+	}
+
+	raw, err := json.Marshal(lp)
+	assert.NoError(t, err)
+	details := map[string]json.RawMessage{}
+	assert.NoError(t, json.Unmarshal(raw, &details))
+
+	expected, err := json.Marshal(expectedAcquired)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(details["acquired"]))
+	expected, err = json.Marshal(expectedKnown)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(details["known"]))
+}
+
+func Benchmark_leaseProviderImpl_MarshalJSON(b *testing.B) {
+	lp := newLargeQueueProvider(b, 1000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(lp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Test_leaseProviderOrchestratorImpl_OwnerLeases(t *testing.T) {
+	var repositories []*latest.GithubRepositoryConfig
+	for _, ownerRepo := range [][2]string{{"small", "repo-1"}, {"small", "repo-2"}, {"big", "repo-1"}, {"big", "repo-2"}, {"big", "repo-3"}} {
+		repositories = append(repositories, &latest.GithubRepositoryConfig{Owner: ownerRepo[0], Name: ownerRepo[1], BaseRef: "main", StabilizeDuration: 60, TTL: 3600, ExpectedRequestCount: 1})
+	}
+	orchestrator := NewProviderOrchestrator(NewProviderOrchestratorOpts{
+		Repositories: repositories,
+		// each owner can hold a single lease at a time, but the big one which weights 2
+		OwnerLeases: &latest.OwnerLeasesConfig{MaxConcurrent: 1, Owners: map[string]int{"big": 2}},
+	})
+	acquire := func(owner string, repo string, sha string) *Request {
+		lp, err := orchestrator.Get(owner, repo, "main", "")
+		assert.NoError(t, err)
+		req, err := lp.Acquire(context.Background(), &Request{HeadSHA: sha, HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+		assert.NoError(t, err)
+		return req
+	}
+	release := func(owner string, repo string, sha string, status string) {
+		lp, err := orchestrator.Get(owner, repo, "main", "")
+		assert.NoError(t, err)
+		_, err = lp.Release(context.Background(), &Request{HeadSHA: sha, HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(status)})
+		assert.NoError(t, err)
+	}
+
+	// the owners get leases up to their cap, the other repositories wait
+	assert.Equal(t, StatusAcquired, *acquire("small", "repo-1", "small-1").Status)
+	assert.Equal(t, StatusPending, *acquire("small", "repo-2", "small-2").Status)
+	assert.Equal(t, StatusAcquired, *acquire("big", "repo-1", "big-1").Status)
+	assert.Equal(t, StatusAcquired, *acquire("big", "repo-2", "big-2").Status)
+	assert.Equal(t, StatusPending, *acquire("big", "repo-3", "big-3").Status)
+	// polling again doesn't change anything, and the owners don't take from each other's capacity
+	assert.Equal(t, StatusPending, *acquire("small", "repo-2", "small-2").Status)
+	assert.Equal(t, StatusPending, *acquire("big", "repo-3", "big-3").Status)
+
+	// a failed lease isn't held anymore: the next repository of the owner gets the lease
+	release("small", "repo-1", "small-1", StatusFailure)
+	assert.Equal(t, StatusAcquired, *acquire("small", "repo-2", "small-2").Status)
+
+	// so is a successful one
+	release("big", "repo-1", "big-1", StatusSuccess)
+	assert.Equal(t, StatusAcquired, *acquire("big", "repo-3", "big-3").Status)
+	assert.Equal(t, StatusPending, *acquire("big", "repo-1", "big-4").Status)
+}
+
+func Test_leaseProviderImpl_DetailsETag(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2})
+	etag := lp.DetailsETag()
+	assert.Regexp(t, `^"[0-9a-f]+"$`, etag)
+	assert.Equal(t, etag, lp.DetailsETag())
+
+	// every change of the details gives a new ETag
+	seen := map[string]bool{etag: true}
+	assertChanged := func(msg string) {
+		etag := lp.DetailsETag()
+		assert.False(t, seen[etag], msg)
+		seen[etag] = true
+	}
+
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1})
+	assert.NoError(t, err)
+	assertChanged("new request")
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+	assert.NoError(t, err)
+	assertChanged("lease acquired")
+	lp.SetFrozen(true)
+	assertChanged("freeze")
+	ttl := 2 * time.Hour
+	lp.UpdateConfig(context.Background(), ConfigUpdate{TTL: &ttl})
+	assertChanged("config update")
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+	assertChanged("lease released")
+}
+
+func Test_leaseProviderImpl_ReleaseRetried(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 1})
+	ref := "gh-readonly-queue/main/pr-1-abc"
+	acquired, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *acquired.Status)
+
+	// a failed release can be retried, the lease isn't held anymore
+	failure := &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1, Status: pointer.String(StatusFailure)}
+	for i := 0; i < 2; i++ {
+		released, err := lp.Release(context.Background(), failure)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusFailure, *released.Status)
+	}
+	assert.Len(t, lp.History(), 1)
+
+	// the same commit acquires the lease again: its release is processed as a new one
+	acquired, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *acquired.Status)
+	success := &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1, Status: pointer.String(StatusSuccess)}
+	for i := 0; i < 2; i++ {
+		released, err := lp.Release(context.Background(), success)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusCompleted, *released.Status)
+	}
+	assert.Len(t, lp.History(), 2)
+	assert.Equal(t, StatusSuccess, lp.History()[0].Status)
+
+	// only the last release of the commit can be retried
+	_, err = lp.Release(context.Background(), failure)
+	assert.Error(t, err)
+}
+
+func Test_leaseProviderImpl_ReleaseRetried_Requeued(t *testing.T) {
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2})
+	acquire := func(sha string, priority int) *Request {
+		req, err := lp.Acquire(context.Background(), &Request{HeadSHA: sha, HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(priority) + "-abc", Priority: priority})
+		assert.NoError(t, err)
+		return req
+	}
+	acquire("sha1", 1)
+	assert.Equal(t, StatusAcquired, *acquire("sha2", 2).Status)
+
+	failure := &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2, Status: pointer.String(StatusFailure)}
+	_, err := lp.Release(context.Background(), failure)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *acquire("sha1", 1).Status)
+	_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Status: pointer.String(StatusSuccess)})
+	assert.NoError(t, err)
+
+	// the failed commit is re-queued in the next batch: its state prevails over its release history
+	assert.Equal(t, StatusPending, *acquire("sha2", 2).Status)
+	_, err = lp.Release(context.Background(), failure)
+	assert.EqualError(t, err, "no lease acquired")
+	assert.Len(t, lp.History(), 2)
+}
+
+func Test_leaseProviderImpl_MarshalJSON_ProviderStateView(t *testing.T) {
+	now := time.Now().Truncate(time.Second).UTC()
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 2, MaxPriority: 10, Clock: clocktesting.NewFakePassiveClock(now)})
+	_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: "gh-readonly-queue/main/pr-1-abc", Priority: 1, Metadata: map[string]string{"actor": "bot"}})
+	assert.NoError(t, err)
+	_, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+	assert.NoError(t, err)
+	lp.SetFrozen(true)
+
+	raw, err := json.Marshal(lp)
+	assert.NoError(t, err)
+	view := &ProviderStateView{}
+	assert.NoError(t, json.Unmarshal(raw, view))
+
+	assert.True(t, now.Equal(view.LastUpdatedAt))
+	assert.True(t, view.Frozen)
+	assert.Equal(t, ProviderConfigView{StabilizeDuration: 60, TTL: 3600, ExpectedRequestCount: 2, MaxPriority: 10}, view.Config)
+	if assert.NotNil(t, view.Acquired) {
+		assert.Equal(t, "sha2", view.Acquired.Request.HeadSHA)
+		assert.Equal(t, StatusAcquired, *view.Acquired.Request.Status)
+		assert.Equal(t, []*StackedPullRequest{{Number: 1}, {Number: 2}}, view.Acquired.StackedPullRequests)
+	}
+	if assert.Len(t, view.Known, 2) {
+		assert.Equal(t, "sha1", view.Known[0].Request.HeadSHA)
+		assert.Equal(t, StatusPending, *view.Known[0].Request.Status)
+		assert.Equal(t, map[string]string{"actor": "bot"}, view.Known[0].Request.Metadata)
+		assert.Equal(t, "sha2", view.Known[1].Request.HeadSHA)
+	}
+
+	// the view is the exact representation of the provider
+	reencoded, err := json.Marshal(view)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(raw), string(reencoded))
+}
+
+func Test_leaseProviderImpl_PeekWinner(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Minute, ExpectedRequestCount: 3, Clock: clock})
+	newRequest := func(sha string, priority int) *Request {
+		return &Request{HeadSHA: sha, HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(priority) + "-abc", Priority: priority}
+	}
+
+	winner, err := lp.PeekWinner(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, winner)
+
+	for priority, sha := range []string{"sha1", "sha2"} {
+		_, err := lp.Acquire(context.Background(), newRequest(sha, priority+1))
+		assert.NoError(t, err)
+	}
+
+	// the batch is still stabilizing
+	winner, err = lp.PeekWinner(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, winner)
+
+	clock.Step(2 * time.Minute)
+	before, err := json.Marshal(lp)
+	assert.NoError(t, err)
+	winner, err = lp.PeekWinner(context.Background())
+	assert.NoError(t, err)
+	assert.NotNil(t, winner)
+	assert.Equal(t, "sha2", winner.Request.HeadSHA)
+	assert.Equal(t, StatusPending, *winner.Request.Status)
+	assert.Len(t, winner.StackedPullRequests, 2)
+
+	// peeking doesn't change the state
+	after, err := json.Marshal(lp)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(before), string(after))
+
+	// the peeked winner is the one acquiring the lease on the next polls
+	pending, err := lp.Acquire(context.Background(), newRequest("sha1", 1))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusPending, *pending.Status)
+	acquired, err := lp.Acquire(context.Background(), newRequest("sha2", 2))
+	assert.NoError(t, err)
+	assert.Equal(t, StatusAcquired, *acquired.Status)
+	assert.Equal(t, winner.Request.HeadSHA, acquired.HeadSHA)
+
+	// the lease is held: no winner anymore
+	winner, err = lp.PeekWinner(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, winner)
+}
+
+func Test_leaseProviderImpl_CompletedResponse(t *testing.T) {
+	tests := []struct {
+		name              string
+		completedResponse CompletedResponse
+		releaseStatus     string
+		// expected statuses of the requests of the batch (priority 2 polling first) when they poll after the release
+		expected []string
+	}{
+		{name: "success", releaseStatus: StatusSuccess, expected: []string{StatusCompleted, StatusCompleted}},
+		{name: "failure", releaseStatus: StatusFailure, expected: []string{StatusAcquired, StatusPending}},
+		{name: "outcome success", completedResponse: CompletedResponseOutcome, releaseStatus: StatusSuccess, expected: []string{StatusCompleted, StatusCompleted}},
+		{name: "outcome failure", completedResponse: CompletedResponseOutcome, releaseStatus: StatusFailure, expected: []string{StatusReleased, StatusReleased}},
+		{name: "outcome cancelled", completedResponse: CompletedResponseOutcome, releaseStatus: StatusCancelled, expected: []string{StatusAcquired, StatusPending}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 3, CompletedResponse: tt.completedResponse})
+			newRequest := func(priority int) *Request {
+				return &Request{HeadSHA: "sha" + strconv.Itoa(priority), HeadRef: "gh-readonly-queue/main/pr-" + strconv.Itoa(priority) + "-abc", Priority: priority}
+			}
+			for priority := 1; priority <= 2; priority++ {
+				_, err := lp.Acquire(context.Background(), newRequest(priority))
+				assert.NoError(t, err)
+			}
+			acquired, err := lp.Acquire(context.Background(), newRequest(3))
+			assert.NoError(t, err)
+			assert.Equal(t, StatusAcquired, *acquired.Status)
+
+			release := newRequest(3)
+			release.Status = pointer.String(tt.releaseStatus)
+			_, err = lp.Release(context.Background(), release)
+			assert.NoError(t, err)
+
+			for i, priority := range []int{2, 1} {
+				res, err := lp.Acquire(context.Background(), newRequest(priority))
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected[i], *res.Status, "priority %d", priority)
+			}
+		})
+	}
+
+	t.Run("released request polling again", func(t *testing.T) {
+		lp := NewLeaseProvider(ProviderOpts{TTL: time.Hour, StabilizeDuration: time.Hour, ExpectedRequestCount: 2, CompletedResponse: CompletedResponseOutcome})
+		ref := "gh-readonly-queue/main/pr-1-abc"
+		_, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1})
+		assert.NoError(t, err)
+		acquired, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusAcquired, *acquired.Status)
+		_, err = lp.Release(context.Background(), &Request{HeadSHA: "sha2", HeadRef: "gh-readonly-queue/main/pr-2-abc", Priority: 2, Status: pointer.String(StatusFailure)})
+		assert.NoError(t, err)
+
+		// the released request is told once, then registered anew
+		res, err := lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusReleased, *res.Status)
+		res, err = lp.Acquire(context.Background(), &Request{HeadSHA: "sha1", HeadRef: ref, Priority: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, StatusPending, *res.Status)
+	})
+}
+
+func Test_leaseProviderOrchestratorImpl_GetOrCreate(t *testing.T) {
+	orchestrator := NewProviderOrchestrator(NewProviderOrchestratorOpts{
+		Repositories: []*latest.GithubRepositoryConfig{
+			{Owner: "acme", Name: "configured", BaseRef: "main", StabilizeDuration: 60, TTL: 3600, ExpectedRequestCount: 1},
+		},
+		DynamicProviders: &latest.DynamicProvidersConfig{
+			Allow:    []string{"acme", "other/svc-*"},
+			Defaults: &latest.GithubRepositoryConfig{StabilizeDuration: 120, TTL: 600, ExpectedRequestCount: 2},
+		},
+		MaxProviders: 3,
+	})
+	ctx := context.Background()
+	expectedRequestCount := func(provider Provider) int {
+		raw, err := json.Marshal(provider)
+		assert.NoError(t, err)
+		view := &ProviderStateView{}
+		assert.NoError(t, json.Unmarshal(raw, view))
+		return view.Config.ExpectedRequestCount
+	}
+
+	// the configured providers are returned as is
+	configured, err := orchestrator.GetOrCreate(ctx, "acme", "configured", "main", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, expectedRequestCount(configured))
+
+	// the allowlisted ones are created with the default settings, once
+	created, err := orchestrator.GetOrCreate(ctx, "acme", "dynamic", "main", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, expectedRequestCount(created))
+	again, err := orchestrator.GetOrCreate(ctx, "acme", "dynamic", "main", "", nil)
+	assert.NoError(t, err)
+	assert.Same(t, created, again)
+	got, err := orchestrator.Get("acme", "dynamic", "main", "")
+	assert.NoError(t, err)
+	assert.Same(t, created, got)
+	assert.Len(t, orchestrator.GetAll(), 2)
+
+	// the check errors are returned as is, and no provider is created when it rejects it
+	errRejected := errors.New("rejected")
+	reject := func(Provider) error { return errRejected }
+	_, err = orchestrator.GetOrCreate(ctx, "acme", "dynamic", "main", "", reject)
+	assert.ErrorIs(t, err, errRejected)
+	_, err = orchestrator.GetOrCreate(ctx, "acme", "rejected", "main", "", reject)
+	assert.ErrorIs(t, err, errRejected)
+	assert.Len(t, orchestrator.GetAll(), 2)
+
+	// the patterns can restrict the repositories of an owner
+	_, err = orchestrator.GetOrCreate(ctx, "other", "svc-api", "main", "", nil)
+	assert.NoError(t, err)
+	_, err = orchestrator.GetOrCreate(ctx, "other", "web", "main", "", nil)
+	assert.Error(t, err)
+
+	// no provider is created outside the allowlist, for a queue, or past the max providers
+	for _, key := range [][4]string{{"unknown", "repo", "main", ""}, {"acme", "queued", "main", "shard-1"}, {"acme", "one-too-many", "main", ""}} {
+		_, err := orchestrator.GetOrCreate(ctx, key[0], key[1], key[2], key[3], nil)
+		assert.Error(t, err, key)
+	}
+	assert.Len(t, orchestrator.GetAll(), 3)
+}
+
+func Test_leaseProviderOrchestratorImpl_KeyCollision(t *testing.T) {
+	orchestrator := NewProviderOrchestrator(NewProviderOrchestratorOpts{
+		Repositories: []*latest.GithubRepositoryConfig{
+			{Owner: "acme", Name: "repo", BaseRef: "main", Queue: "q1", StabilizeDuration: 60, TTL: 3600, ExpectedRequestCount: 1},
+		},
+		DynamicProviders: &latest.DynamicProvidersConfig{Allow: []string{"acme"}},
+	})
+
+	queued, err := orchestrator.Get("acme", "repo", "main", "q1")
+	assert.NoError(t, err)
+	assert.NotNil(t, queued)
+
+	// a base ref holding the key separator doesn't resolve to the queue of another base ref, nor is created
+	_, err = orchestrator.Get("acme", "repo", "main:q1", "")
+	assert.Error(t, err)
+	_, err = orchestrator.GetOrCreate(context.Background(), "acme", "repo", "main:q1", "", nil)
+	assert.Error(t, err)
+	assert.Len(t, orchestrator.GetAll(), 1)
+
+	assert.Error(t, ValidateKeyParts("acme", "repo", "main:q1", ""))
+	assert.NoError(t, ValidateKeyParts("acme", "repo", "main", "q1"))
+}
+
+func Test_leaseProviderOrchestratorImpl_GetOrCreate_Concurrent(t *testing.T) {
+	orchestrator := NewProviderOrchestrator(NewProviderOrchestratorOpts{
+		DynamicProviders: &latest.DynamicProvidersConfig{Allow: []string{"acme"}},
+	})
+
+	// the concurrent creations of the same provider are all ending up with the registered one
+	providers := make([]Provider, 8)
+	var wg sync.WaitGroup
+	for i := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			provider, err := orchestrator.GetOrCreate(context.Background(), "acme", "dynamic", "main", "", nil)
+			assert.NoError(t, err)
+			providers[i] = provider
+		}()
+	}
+	wg.Wait()
+
+	registered, err := orchestrator.Get("acme", "dynamic", "main", "")
+	assert.NoError(t, err)
+	for _, provider := range providers {
+		assert.Same(t, registered, provider)
+	}
+}
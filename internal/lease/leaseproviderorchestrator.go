@@ -4,13 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
 	"github.com/ankorstore/mq-lease-service/internal/metrics"
 	"github.com/ankorstore/mq-lease-service/internal/storage"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
 	"k8s.io/utils/clock"
+	"k8s.io/utils/pointer" //nolint
 )
 
 type NewProviderOrchestratorOpts struct {
@@ -18,11 +26,34 @@ type NewProviderOrchestratorOpts struct {
 	Clock        clock.PassiveClock
 	Storage      storage.Storage[*ProviderState]
 	Metrics      metrics.Metrics
+	// StorageEncoding is the format the provider states are written with in the storage (defaults to JSON)
+	StorageEncoding StorageEncoding
+	// HydrationConcurrency is the max number of providers hydrated at the same time (defaults to
+	// defaultHydrationConcurrency)
+	HydrationConcurrency int
+	// OwnerLeases caps the leases held concurrently by the repositories of a same owner (no cap if nil)
+	OwnerLeases *latest.OwnerLeasesConfig
+	// DynamicProviders allows GetOrCreate to create the providers of the allowlisted repositories which aren't
+	// configured (disabled if nil)
+	DynamicProviders *latest.DynamicProvidersConfig
+	// MaxProviders caps the number of providers, the dynamically created ones included (unlimited if zero)
+	MaxProviders int
 }
 
+// errUnknownProvider is returned when the requested provider isn't managed by the orchestrator
+var errUnknownProvider = errors.New("unknown provider")
+
+// defaultHydrationConcurrency is the max number of providers hydrated at the same time, when none is provided
+const defaultHydrationConcurrency = 8
+
 type providerMetrics struct {
-	queueSize       *prometheus.GaugeVec
-	mergedBatchSize *prometheus.HistogramVec
+	queueSize          *prometheus.GaugeVec
+	mergedBatchSize    *prometheus.HistogramVec
+	assignmentsDelayed *prometheus.CounterVec
+	releases           *prometheus.CounterVec
+	evictions          *prometheus.CounterVec
+	outcomes           *prometheus.CounterVec
+	hydrations         *prometheus.CounterVec
 }
 
 func NewProviderOrchestrator(opts NewProviderOrchestratorOpts) ProviderOrchestrator {
@@ -44,69 +75,330 @@ func NewProviderOrchestrator(opts NewProviderOrchestratorOpts) ProviderOrchestra
 				},
 				[]string{"provider_id"},
 			),
+			assignmentsDelayed: opts.Metrics.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "provider_lease_assignment_delayed_total",
+					Help: "Number of lease assignments delayed because of the delay_lease_assignment_by setting",
+				},
+				[]string{"provider_id"},
+			),
+			releases: opts.Metrics.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "provider_lease_releases_total",
+					Help: "Number of lease releases by outcome (success, failure or cancelled)",
+				},
+				[]string{"provider_id", "status"},
+			),
+			evictions: opts.Metrics.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "provider_evictions_total",
+					Help: "Number of lease requests evicted after their TTL (abandoned by their client)",
+				},
+				[]string{"provider_id"},
+			),
+			outcomes: opts.Metrics.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "lease_outcomes_total",
+					Help: "Number of acquire/release calls by logical result (pending, acquired, completed, failure or rejected)",
+				},
+				[]string{"provider_id", "endpoint", "result"},
+			),
+			hydrations: opts.Metrics.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: "provider_hydration_total",
+					Help: "Number of provider state hydrations from the storage by result (restored, empty or error)",
+				},
+				[]string{"provider_id", "result"},
+			),
 		}
 	}
 
+	// the owner leases accounting is shared by all the providers
+	var ownerLeases *OwnerLeaseLimiter
+	if opts.OwnerLeases.IsEnabled() {
+		ownerLeases = NewOwnerLeaseLimiter(opts.OwnerLeases.MaxConcurrent, opts.OwnerLeases.Owners)
+	}
+
+	newProvider := func(key string, repository *latest.GithubRepositoryConfig) Provider {
+		return NewLeaseProvider(ProviderOpts{
+			StabilizeDuration:     time.Second * time.Duration(repository.StabilizeDuration),
+			TTL:                   time.Second * time.Duration(repository.TTL),
+			ExpectedRequestCount:  repository.ExpectedRequestCount,
+			DelayAssignmentCount:  repository.DelayLeaseAssignmentBy,
+			WinnerSelection:       WinnerSelection(repository.WinnerSelection),
+			MinBatchSize:          repository.MinBatchSize,
+			MinBatchMaxWait:       time.Second * time.Duration(repository.MinBatchMaxWait),
+			PollIntervalMin:       time.Second * time.Duration(repository.PollIntervalMin),
+			PollIntervalMax:       time.Second * time.Duration(repository.PollIntervalMax),
+			GenericMode:           repository.GenericMode,
+			HistorySize:           repository.HistorySize,
+			AutoCompleteOnSuccess: repository.AutoCompleteOnSuccess,
+			ExcludeFailedRequests: repository.ExcludeFailedRequests,
+			FreezeWinner:          repository.FreezeWinner,
+			StabilizeFrom:         StabilizeFrom(repository.StabilizeFrom),
+			MaxWait:               time.Second * time.Duration(repository.MaxWait),
+			LeaseTimeout:          time.Second * time.Duration(repository.LeaseTimeout),
+			DedupeByHeadRef:       repository.DedupeByHeadRef,
+			PriorityFromRef:       PriorityFromRef(repository.PriorityFromRef),
+			MaxPriority:           repository.MaxPriority,
+			DefaultPriority:       repository.DefaultPriority,
+			TimeScale:             repository.TimeScale,
+			PendingAccepted:       repository.PendingAccepted,
+			CompletedResponse:     CompletedResponse(repository.CompletedResponse),
+			Owner:                 repository.Owner,
+			OwnerLeases:           ownerLeases,
+			StorageEncoding:       opts.StorageEncoding,
+			ID:                    key,
+			Clock:                 opts.Clock,
+			Storage:               opts.Storage,
+			Metrics:               pMetrics,
+		})
+	}
 	leaseProviders := make(map[string]Provider)
 	for _, repository := range opts.Repositories {
-		key := getKey(repository.Owner, repository.Name, repository.BaseRef)
-		leaseProviders[key] = NewLeaseProvider(ProviderOpts{
-			StabilizeDuration:    time.Second * time.Duration(repository.StabilizeDuration),
-			TTL:                  time.Second * time.Duration(repository.TTL),
-			ExpectedRequestCount: repository.ExpectedRequestCount,
-			DelayAssignmentCount: repository.DelayLeaseAssignmentBy,
-			ID:                   key,
-			Clock:                opts.Clock,
-			Storage:              opts.Storage,
-			Metrics:              pMetrics,
-		})
+		key := getKey(repository.Owner, repository.Name, repository.BaseRef, repository.Queue)
+		leaseProviders[key] = newProvider(key, repository)
+	}
+	cl := opts.Clock
+	if cl == nil {
+		cl = clock.RealClock{}
+	}
+	hydrationConcurrency := opts.HydrationConcurrency
+	if hydrationConcurrency <= 0 {
+		hydrationConcurrency = defaultHydrationConcurrency
 	}
 	return &leaseProviderOrchestratorImpl{
-		leaseProviders: leaseProviders,
+		leaseProviders:       leaseProviders,
+		newProvider:          newProvider,
+		dynamicProviders:     opts.DynamicProviders,
+		maxProviders:         opts.MaxProviders,
+		clock:                cl,
+		hydration:            make(map[string]*HydrationStatus),
+		hydrationConcurrency: hydrationConcurrency,
 	}
 }
 
+// HydrationStatus is the outcome of the last hydration of a provider state from the storage
+type HydrationStatus struct {
+	HydratedAt time.Time `json:"hydrated_at"`
+	// Error is the reason the hydration failed (null on success)
+	Error *string `json:"error"`
+	// KnownCount is the number of known requests after the hydration (0 when no state was found)
+	KnownCount int `json:"known_count"`
+}
+
 // ProviderOrchestrator the orchestrator is a registry of lease Providers.
 // it allows the system to be able to handle multiple repositories (and or multiple merge queues per repos, which
 // are not targeting the same base ref)
 type ProviderOrchestrator interface {
-	// Get returns a specific lease provider
-	Get(owner string, repo string, baseRef string) (Provider, error)
+	// Get returns a specific lease provider (the queue is empty for the providers without a queue name)
+	Get(owner string, repo string, baseRef string, queue string) (Provider, error)
+	// GetOrCreate returns a specific lease provider like Get, creating it (with its state hydrated from the storage) if
+	// it's not configured but allowed by the dynamic providers allowlist. Only the providers without a queue name can
+	// be created. The check (optional) is called with the provider before it's returned: its error is returned as is,
+	// and a provider rejected by the check isn't created.
+	GetOrCreate(ctx context.Context, owner string, repo string, baseRef string, queue string, check func(Provider) error) (Provider, error)
 	// GetAll returns all managed lease providers
 	GetAll() map[string]Provider
 	// HydrateFromState will recursively hydrate all the states of managed providers
 	HydrateFromState(ctx context.Context) error
+	// SetDraining toggles the drain mode on all managed providers
+	SetDraining(draining bool)
+	// IsDraining tells if the drain mode is on
+	IsDraining() bool
+	// HydrationStatuses returns the outcome of the last hydration of all managed providers (null if never hydrated)
+	HydrationStatuses() map[string]*HydrationStatus
 }
 
 type leaseProviderOrchestratorImpl struct {
+	// mutex guards the providers, which can be created on the fly (see GetOrCreate)
+	mutex          sync.RWMutex
 	leaseProviders map[string]Provider
+	// newProvider builds the provider of the given repository
+	newProvider      func(key string, repository *latest.GithubRepositoryConfig) Provider
+	dynamicProviders *latest.DynamicProvidersConfig
+	maxProviders     int
+	draining         atomic.Bool
+	clock            clock.PassiveClock
+	// hydrationMutex guards the hydration statuses, updated by the (follower mode) re-hydrations
+	hydrationMutex sync.RWMutex
+	hydration      map[string]*HydrationStatus
+	// hydrationConcurrency is the max number of providers hydrated at the same time
+	hydrationConcurrency int
 }
 
-// HydrateFromState will recursively hydrate all the states of managed providers
-func (o *leaseProviderOrchestratorImpl) HydrateFromState(ctx context.Context) error {
+// SetDraining toggles the drain mode on all managed providers
+func (o *leaseProviderOrchestratorImpl) SetDraining(draining bool) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	o.draining.Store(draining)
 	for _, provider := range o.leaseProviders {
-		if err := provider.HydrateFromState(ctx); err != nil {
-			return err
-		}
+		provider.SetDraining(draining)
+	}
+}
+
+// IsDraining tells if the drain mode is on
+func (o *leaseProviderOrchestratorImpl) IsDraining() bool {
+	return o.draining.Load()
+}
+
+// HydrateFromState will recursively hydrate all the states of managed providers, hydrationConcurrency of them at the
+// same time. All the providers are hydrated, even if some of them fail (the returned error is joining their errors,
+// sorted by provider).
+func (o *leaseProviderOrchestratorImpl) HydrateFromState(ctx context.Context) error {
+	providers := o.GetAll()
+	keys := make([]string, 0, len(providers))
+	for key := range providers {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	errs := make([]error, len(keys))
+	grp := errgroup.Group{}
+	grp.SetLimit(o.hydrationConcurrency)
+	for i, key := range keys {
+		grp.Go(func() error {
+			errs[i] = o.hydrateProvider(ctx, key, providers[key])
+			return nil
+		})
 	}
+	_ = grp.Wait()
+	return errors.Join(errs...)
+}
+
+// hydrateProvider hydrates the state of the given provider, and records the outcome in its hydration status
+func (o *leaseProviderOrchestratorImpl) hydrateProvider(ctx context.Context, key string, provider Provider) error {
+	status := &HydrationStatus{HydratedAt: o.clock.Now()}
+	defer func() {
+		o.hydrationMutex.Lock()
+		o.hydration[key] = status
+		o.hydrationMutex.Unlock()
+	}()
+
+	if err := provider.HydrateFromState(ctx); err != nil {
+		log.Ctx(ctx).Error().Err(err).Str("provider_id", key).Msg("Failed to hydrate the provider state")
+		status.Error = pointer.String(err.Error())
+		return fmt.Errorf("failed to hydrate provider %s: %w", key, err)
+	}
+	status.KnownCount = provider.Stats().KnownCount
 	return nil
 }
 
-// GetAll returns all managed lease providers
+// HydrationStatuses returns the outcome of the last hydration of all managed providers (null if never hydrated)
+func (o *leaseProviderOrchestratorImpl) HydrationStatuses() map[string]*HydrationStatus {
+	providers := o.GetAll()
+	o.hydrationMutex.RLock()
+	defer o.hydrationMutex.RUnlock()
+
+	statuses := make(map[string]*HydrationStatus, len(providers))
+	for key := range providers {
+		statuses[key] = o.hydration[key]
+	}
+	return statuses
+}
+
+// GetAll returns all managed lease providers (a snapshot, the providers created afterwards aren't part of it)
 func (o *leaseProviderOrchestratorImpl) GetAll() map[string]Provider {
-	return o.leaseProviders
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return maps.Clone(o.leaseProviders)
 }
 
-// Get returns a specific lease provider
-func (o *leaseProviderOrchestratorImpl) Get(owner string, repo string, baseRef string) (Provider, error) {
-	key := getKey(owner, repo, baseRef)
+// Get returns a specific lease provider (the queue is empty for the providers without a queue name)
+func (o *leaseProviderOrchestratorImpl) Get(owner string, repo string, baseRef string, queue string) (Provider, error) {
+	// the key of another provider could be built from parts holding the separator
+	if ValidateKeyParts(owner, repo, baseRef, queue) != nil {
+		return nil, errUnknownProvider
+	}
+	key := getKey(owner, repo, baseRef, queue)
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
 	if provider, ok := o.leaseProviders[key]; ok {
 		return provider, nil
 	}
 
-	return nil, errors.New("unknown provider")
+	return nil, errUnknownProvider
+}
+
+// GetOrCreate returns a specific lease provider like Get, creating it (with its state hydrated from the storage) if
+// it's not configured but allowed by the dynamic providers allowlist. A provider rejected by the check isn't created.
+func (o *leaseProviderOrchestratorImpl) GetOrCreate(ctx context.Context, owner string, repo string, baseRef string, queue string, check func(Provider) error) (Provider, error) {
+	if check == nil {
+		check = func(Provider) error { return nil }
+	}
+	provider, err := o.Get(owner, repo, baseRef, queue)
+	if err == nil {
+		if err := check(provider); err != nil {
+			return nil, err
+		}
+		return provider, nil
+	}
+	if queue != "" || !o.dynamicProviders.Allows(owner, repo) || ValidateKeyParts(owner, repo, baseRef, queue) != nil {
+		return nil, err
+	}
+
+	key := getKey(owner, repo, baseRef, queue)
+	maxProvidersReached := func() (Provider, error) {
+		log.Ctx(ctx).Warn().Str("provider_id", key).Int("max_providers", o.maxProviders).Msg("Max providers reached, the dynamic provider can't be created")
+		return nil, errUnknownProvider
+	}
+	o.mutex.RLock()
+	full := o.full()
+	o.mutex.RUnlock()
+	if full {
+		return maxProvidersReached()
+	}
+
+	// a provider created before a restart has its state in the storage: it's hydrated before being registered, outside
+	// of the lock (not to block the other providers lookups on the storage)
+	provider = o.newProvider(key, o.dynamicProviders.GetRepository(owner, repo, baseRef))
+	if err := check(provider); err != nil {
+		return nil, err
+	}
+	if err := o.hydrateProvider(ctx, key, provider); err != nil {
+		return nil, err
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	// it may have been created in the meantime
+	if existing, ok := o.leaseProviders[key]; ok {
+		return existing, nil
+	}
+	if o.full() {
+		return maxProvidersReached()
+	}
+	provider.SetDraining(o.draining.Load())
+	o.leaseProviders[key] = provider
+	log.Ctx(ctx).Info().Str("provider_id", key).Msg("Dynamic lease provider created")
+	return provider, nil
 }
 
-func getKey(owner string, repo string, baseRef string) string {
-	return fmt.Sprintf("%s:%s:%s", owner, repo, baseRef)
+// full tells if the max number of providers is reached, no more of them can be created (the lock has to be held)
+func (o *leaseProviderOrchestratorImpl) full() bool {
+	return o.maxProviders > 0 && len(o.leaseProviders) >= o.maxProviders
+}
+
+// keySeparator separates the parts of the provider keys
+const keySeparator = ":"
+
+// ValidateKeyParts checks the parts of a provider key (owner, repository name, base ref and queue name) don't hold the
+// key separator, which would make the key ambiguous (e.g. the `main:q1` base ref & the `q1` queue of the `main` one)
+func ValidateKeyParts(parts ...string) error {
+	for _, part := range parts {
+		if strings.Contains(part, keySeparator) {
+			return fmt.Errorf("invalid provider key part %q (%q isn't allowed)", part, keySeparator)
+		}
+	}
+	return nil
+}
+
+// getKey returns the key of a provider, also used as its state identifier in the storage (the providers without a
+// queue name are keeping the key they had before the queues were introduced)
+func getKey(owner string, repo string, baseRef string, queue string) string {
+	parts := []string{owner, repo, baseRef}
+	if queue != "" {
+		parts = append(parts, queue)
+	}
+	return strings.Join(parts, keySeparator)
 }
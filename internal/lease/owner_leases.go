@@ -0,0 +1,82 @@
+package lease
+
+import "sync"
+
+// OwnerLeaseLimiter is the cross-provider accounting of the leases held by each owner, capping how many of them an
+// owner can hold concurrently across all its repositories (so that a busy owner can't monopolize a shared capacity).
+// It's shared by all the providers of the orchestrator, and only guarded by its own mutex: the providers are calling it
+// while holding their lock, it must never call them back.
+type OwnerLeaseLimiter struct {
+	mutex sync.Mutex
+	// maxConcurrent is the default cap of the owners (unlimited if zero)
+	maxConcurrent int
+	// owners overrides the cap of some owners (their weight in the shared capacity)
+	owners map[string]int
+	// holders are the IDs of the providers holding a lease, by owner
+	holders map[string]map[string]struct{}
+}
+
+// NewOwnerLeaseLimiter returns a limiter capping the leases held by each owner to maxConcurrent, or to its own cap
+// when listed in owners (unlimited if zero)
+func NewOwnerLeaseLimiter(maxConcurrent int, owners map[string]int) *OwnerLeaseLimiter {
+	return &OwnerLeaseLimiter{
+		maxConcurrent: maxConcurrent,
+		owners:        owners,
+		holders:       make(map[string]map[string]struct{}),
+	}
+}
+
+// Max returns the max number of leases the owner can hold concurrently (0 if unlimited)
+func (l *OwnerLeaseLimiter) Max(owner string) int {
+	if limit, ok := l.owners[owner]; ok {
+		return limit
+	}
+	return l.maxConcurrent
+}
+
+// Held returns the number of leases currently held by the owner
+func (l *OwnerLeaseLimiter) Held(owner string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.holders[owner])
+}
+
+// TryGrant records the lease of the provider as held, unless the owner already holds as many leases as allowed. It
+// returns false when the lease can't be granted (yet).
+func (l *OwnerLeaseLimiter) TryGrant(owner string, providerID string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.holders[owner][providerID]; ok {
+		return true
+	}
+	if limit := l.Max(owner); limit > 0 && len(l.holders[owner]) >= limit {
+		return false
+	}
+	l.hold(owner, providerID)
+	return true
+}
+
+// Sync records whether the provider is holding a lease, whatever the cap (e.g. a lease restored from the storage)
+func (l *OwnerLeaseLimiter) Sync(owner string, providerID string, held bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if held {
+		l.hold(owner, providerID)
+		return
+	}
+	delete(l.holders[owner], providerID)
+	if len(l.holders[owner]) == 0 {
+		delete(l.holders, owner)
+	}
+}
+
+// hold records the lease of the provider as held (the lock has to be held)
+func (l *OwnerLeaseLimiter) hold(owner string, providerID string) {
+	if l.holders[owner] == nil {
+		l.holders[owner] = make(map[string]struct{})
+	}
+	l.holders[owner][providerID] = struct{}{}
+}
@@ -0,0 +1,34 @@
+package lease
+
+import (
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// scaledClock is a passive clock compressing the elapsed durations by a factor (used to run accelerated soak tests
+// against the real code paths). The current time is left untouched, so the stored dates remain accurate: only the
+// stabilize duration, TTL and wait windows pass faster.
+type scaledClock struct {
+	clock clock.PassiveClock
+	scale float64
+}
+
+var _ clock.PassiveClock = scaledClock{}
+
+// newScaledClock wraps the given clock, scaling its elapsed durations by the given factor (returned as is when the
+// factor is not set, or 1)
+func newScaledClock(cl clock.PassiveClock, scale float64) clock.PassiveClock {
+	if scale <= 0 || scale == 1 {
+		return cl
+	}
+	return scaledClock{clock: cl, scale: scale}
+}
+
+func (c scaledClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+func (c scaledClock) Since(t time.Time) time.Duration {
+	return time.Duration(float64(c.clock.Since(t)) * c.scale)
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -25,6 +26,9 @@ type Metrics interface {
 	NewSummaryVec(opts prometheus.SummaryOpts, labelNames []string) *prometheus.SummaryVec
 	NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram
 	NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec
+	// Reset deletes all the series of the metric vectors created by the service (the counters then read zero). The
+	// default collectors are left untouched.
+	Reset()
 }
 
 type NewOpts struct {
@@ -58,6 +62,15 @@ type metricsImpl struct {
 	promGatherer   prometheus.Gatherer
 	appName        string
 	constLabels    map[string]string
+
+	// vecsMutex guards vecs, the metric vectors created by the service (reset by Reset)
+	vecsMutex sync.Mutex
+	vecs      []resettable
+}
+
+// resettable is a metric vector, which series can be deleted
+type resettable interface {
+	Reset()
 }
 
 func (m *metricsImpl) GetFactory() promauto.Factory {
@@ -89,7 +102,9 @@ func (m *metricsImpl) NewCounter(opts prometheus.CounterOpts) prometheus.Counter
 func (m *metricsImpl) NewCounterVec(opts prometheus.CounterOpts, labelNames []string) *prometheus.CounterVec {
 	opts.Namespace = metricNamespace
 	opts.ConstLabels = m.mergeLabels(opts.ConstLabels)
-	return m.GetFactory().NewCounterVec(opts, m.mergeLabelsNames(labelNames))
+	vec := m.GetFactory().NewCounterVec(opts, m.mergeLabelsNames(labelNames))
+	m.track(vec)
+	return vec
 }
 
 func (m *metricsImpl) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
@@ -101,7 +116,9 @@ func (m *metricsImpl) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
 func (m *metricsImpl) NewGaugeVec(opts prometheus.GaugeOpts, labelNames []string) *prometheus.GaugeVec {
 	opts.Namespace = metricNamespace
 	opts.ConstLabels = m.mergeLabels(opts.ConstLabels)
-	return m.GetFactory().NewGaugeVec(opts, m.mergeLabelsNames(labelNames))
+	vec := m.GetFactory().NewGaugeVec(opts, m.mergeLabelsNames(labelNames))
+	m.track(vec)
+	return vec
 }
 
 func (m *metricsImpl) NewSummary(opts prometheus.SummaryOpts) prometheus.Summary {
@@ -113,7 +130,9 @@ func (m *metricsImpl) NewSummary(opts prometheus.SummaryOpts) prometheus.Summary
 func (m *metricsImpl) NewSummaryVec(opts prometheus.SummaryOpts, labelNames []string) *prometheus.SummaryVec {
 	opts.Namespace = metricNamespace
 	opts.ConstLabels = m.mergeLabels(opts.ConstLabels)
-	return m.GetFactory().NewSummaryVec(opts, m.mergeLabelsNames(labelNames))
+	vec := m.GetFactory().NewSummaryVec(opts, m.mergeLabelsNames(labelNames))
+	m.track(vec)
+	return vec
 }
 
 func (m *metricsImpl) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
@@ -125,7 +144,23 @@ func (m *metricsImpl) NewHistogram(opts prometheus.HistogramOpts) prometheus.His
 func (m *metricsImpl) NewHistogramVec(opts prometheus.HistogramOpts, labelNames []string) *prometheus.HistogramVec {
 	opts.Namespace = metricNamespace
 	opts.ConstLabels = m.mergeLabels(opts.ConstLabels)
-	return m.GetFactory().NewHistogramVec(opts, m.mergeLabelsNames(labelNames))
+	vec := m.GetFactory().NewHistogramVec(opts, m.mergeLabelsNames(labelNames))
+	m.track(vec)
+	return vec
+}
+
+func (m *metricsImpl) Reset() {
+	m.vecsMutex.Lock()
+	defer m.vecsMutex.Unlock()
+	for _, vec := range m.vecs {
+		vec.Reset()
+	}
+}
+
+func (m *metricsImpl) track(vec resettable) {
+	m.vecsMutex.Lock()
+	defer m.vecsMutex.Unlock()
+	m.vecs = append(m.vecs, vec)
 }
 
 func GetDefaultDurationBuckets() []float64 {
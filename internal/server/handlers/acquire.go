@@ -1,32 +1,54 @@
 package handlers
 
 import (
+	"errors"
+	"strconv"
+	"time"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 )
 
-func Acquire(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+// PollIntervalHeaderName is the header suggesting to the pending requests when to poll again (in milliseconds)
+const PollIntervalHeaderName = "Poll-Interval-Ms"
+
+// Acquire handles the lease requests. If allowEventTime is set, the requests can carry the time they happened at, used
+// instead of the current time (to replay historical events). With `?debug=true`, the response exposes the factors the
+// lease assignment is based on.
+func Acquire(orchestrator lease.ProviderOrchestrator, allowEventTime bool) func(c *fiber.Ctx) error {
 	type acquireRequest struct {
-		HeadSHA  string `json:"head_sha" validate:"required,min=1"`
-		HeadRef  string `json:"head_ref" validate:"required,min=1,ghTempBranchRef"`
-		Priority int    `json:"priority" validate:"required,number,min=1"`
+		HeadSHA   string     `json:"head_sha" validate:"required,min=1"`
+		HeadRef   string     `json:"head_ref" validate:"required,min=1,ghTempBranchRef"`
+		Priority  int        `json:"priority" validate:"required,number,min=1,maxPriority"`
+		EventTime *time.Time `json:"event_time"`
+		// Metadata is echoed in the request contexts, size-limited to keep the states small
+		Metadata map[string]string `json:"metadata" validate:"max=16,dive,keys,min=1,max=64,endkeys,max=256"`
 	}
 
 	validate := validator.New()
 	registerGhTempBranchRefValidationRuleOrFail(validate)
+	registerMaxPriorityValidationRuleOrFail(validate)
 
 	return func(c *fiber.Ctx) error {
-		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
-		if provider == nil {
-			return fiberErr
-		}
-
 		input := new(acquireRequest)
 		if ok, err := parseBodyOrFail(c, input); !ok {
 			return err
 		}
-		if ok, err := validateInputOrFail(c, validate, input); !ok {
+		// the head ref & priority rules depend on the provider config, the request is validated once the provider is
+		// retrieved (but before it's created)
+		provider, fiberErr := getOrCreateLeaseProviderOrFail(c, orchestrator, func(provider lease.Provider) []*inputValidationError {
+			// the priority can be omitted when the provider has a default one, or derives it (still required otherwise)
+			if input.Priority == 0 {
+				input.Priority = provider.DefaultPriority()
+			}
+			return validateInput(validationContext(c, provider), validate, input, providerIgnoredFields(provider)...)
+		})
+		if provider == nil {
+			return fiberErr
+		}
+		ctx, err := eventTimeContextOrFail(c, input.EventTime, allowEventTime)
+		if ctx == nil {
 			return err
 		}
 
@@ -34,9 +56,21 @@ func Acquire(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 			HeadSHA:  input.HeadSHA,
 			HeadRef:  input.HeadRef,
 			Priority: input.Priority,
+			Metadata: input.Metadata,
 		}
 
-		leaseRequestResponse, err := provider.Acquire(c.UserContext(), leaseRequest)
+		leaseRequestResponse, err := provider.Acquire(ctx, leaseRequest)
+		if errors.Is(err, lease.ErrDraining) || errors.Is(err, lease.ErrFrozen) {
+			return apiError(c, fiber.StatusServiceUnavailable, "Couldn't acquire the lock", err.Error())
+		}
+		var acquiredErr *lease.AcquiredError
+		if errors.As(err, &acquiredErr) {
+			// expose the lease holder, so that the client doesn't have to fetch it with a second call
+			return apiError(c, fiber.StatusConflict, "Couldn't acquire the lock", fiber.Map{
+				"reason":   acquiredErr.Error(),
+				"acquired": acquiredErr.Acquired,
+			})
+		}
 		if err != nil {
 			return apiError(c, fiber.StatusConflict, "Couldn't acquire the lock", err.Error())
 		}
@@ -45,6 +79,16 @@ func Acquire(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 		if err != nil {
 			return apiError(c, fiber.StatusInternalServerError, "Couldn't build request context", err.Error())
 		}
-		return c.Status(fiber.StatusOK).JSON(reqContext)
+		if c.QueryBool("debug") {
+			reqContext.Decision = provider.Decision(leaseRequestResponse)
+		}
+		status := fiber.StatusOK
+		if leaseRequestResponse.Status != nil && *leaseRequestResponse.Status == lease.StatusPending {
+			c.Set(PollIntervalHeaderName, strconv.FormatInt(provider.SuggestedPollInterval().Milliseconds(), 10))
+			if provider.PendingAccepted() {
+				status = fiber.StatusAccepted
+			}
+		}
+		return sendRequestContext(c, status, reqContext)
 	}
 }
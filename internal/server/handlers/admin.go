@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/ankorstore/mq-lease-service/internal/metrics"
+	"github.com/ankorstore/mq-lease-service/internal/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+type drainResponse struct {
+	Draining bool `json:"draining"`
+}
+
+// Drain turns the drain mode on: new lease requests are rejected, while the known ones can still be processed (so the
+// in-flight leases can be released). The readiness probe fails while draining.
+func Drain(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		orchestrator.SetDraining(true)
+		log.Ctx(c.UserContext()).Warn().Msg("Drain mode enabled")
+		return c.Status(fiber.StatusOK).JSON(drainResponse{Draining: true})
+	}
+}
+
+// Undrain turns the drain mode off
+func Undrain(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		orchestrator.SetDraining(false)
+		log.Ctx(c.UserContext()).Warn().Msg("Drain mode disabled")
+		return c.Status(fiber.StatusOK).JSON(drainResponse{Draining: false})
+	}
+}
+
+// ResetMetrics deletes all the series of the application metrics (the counters then read zero), to isolate the test
+// cases asserting on them without restarting the server
+func ResetMetrics(metricsService metrics.Metrics) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		metricsService.Reset()
+		log.Ctx(c.UserContext()).Warn().Msg("Metrics reset")
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// AcquiredLeases lists the leases currently held, for all the managed providers (with a null acquired request for the
+// ones without any)
+func AcquiredLeases(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		leases := make(map[string]*lease.AcquiredLease)
+		for key, provider := range orchestrator.GetAll() {
+			acquiredLease, err := provider.AcquiredLease(c.UserContext())
+			if err != nil {
+				return apiError(c, fiber.StatusInternalServerError, "Couldn't build request context", err.Error())
+			}
+			leases[key] = acquiredLease
+		}
+		return c.Status(fiber.StatusOK).JSON(leases)
+	}
+}
+
+// HydrationStatuses reports the outcome of the last hydration of all the managed providers states from the storage
+// (to confirm the states were restored after a restart)
+func HydrationStatuses(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusOK).JSON(orchestrator.HydrationStatuses())
+	}
+}
+
+// Export dumps the states of all the managed providers as NDJSON (one JSON marshalled state per line, sorted by
+// provider), for backups. Each line can be restored with lease.ProviderState.Unmarshal.
+func Export(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		providers := orchestrator.GetAll()
+		keys := make([]string, 0, len(providers))
+		for key := range providers {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		c.Status(fiber.StatusOK)
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		for _, key := range keys {
+			state, err := providers[key].ExportState()
+			if err != nil {
+				c.Response().ResetBody()
+				return apiError(c, fiber.StatusInternalServerError, "Couldn't export the provider state", fiber.Map{
+					"provider": key,
+					"reason":   err.Error(),
+				})
+			}
+			if _, err := c.Write(append(state, '\n')); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ClearAll clears the states of all the managed providers (in memory and in the storage), then compacts the storage to
+// reclaim their disk space (for the full environment resets). As it drops all the known requests and the held leases,
+// it has to be confirmed with `?confirm=true`.
+func ClearAll(orchestrator lease.ProviderOrchestrator, st storage.Storage[*lease.ProviderState]) func(c *fiber.Ctx) error {
+	type clearAllResponse struct {
+		Cleared []string `json:"cleared"`
+		// CompactedFiles is the number of storage files rewritten by the compaction
+		CompactedFiles int `json:"compacted_files"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		if !c.QueryBool("confirm") {
+			return apiError(c, fiber.StatusBadRequest, "Clearing all the provider states has to be confirmed with ?confirm=true", nil)
+		}
+
+		providers := orchestrator.GetAll()
+		resp := clearAllResponse{Cleared: make([]string, 0, len(providers))}
+		for key := range providers {
+			resp.Cleared = append(resp.Cleared, key)
+		}
+		slices.Sort(resp.Cleared)
+		for _, key := range resp.Cleared {
+			providers[key].Clear(c.UserContext())
+		}
+		log.Ctx(c.UserContext()).Warn().Strs("providers", resp.Cleared).Msg("All the provider states cleared")
+
+		if compactor, ok := st.(storage.Compactor); ok {
+			compacted, err := compactor.Compact()
+			if err != nil {
+				return apiError(c, fiber.StatusInternalServerError, "The provider states were cleared, but the storage couldn't be compacted", err.Error())
+			}
+			resp.CompactedFiles = compacted
+		}
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+}
+
+// maxImportLineSize is the max size of an imported provider state (a single NDJSON line)
+const maxImportLineSize = 16 * 1024 * 1024
+
+// Import restores the provider states exported as NDJSON (see Export): each state is saved in the storage, and replaces
+// the in-memory one. The states of the providers which aren't configured are skipped. As it overwrites the current
+// states, the import has to be confirmed with `?confirm=true`.
+func Import(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	type importResponse struct {
+		Imported []string `json:"imported"`
+		Skipped  []string `json:"skipped"`
+	}
+
+	return func(c *fiber.Ctx) error {
+		if !c.QueryBool("confirm") {
+			return apiError(c, fiber.StatusBadRequest, "The import overwrites the current provider states, it has to be confirmed with ?confirm=true", nil)
+		}
+
+		// parse all the states first, so that nothing is imported if the payload is invalid
+		var states []*lease.ProviderState
+		scanner := bufio.NewScanner(bytes.NewReader(c.Body()))
+		scanner.Buffer(nil, maxImportLineSize)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			state := lease.NewProviderState(lease.NewProviderStateOpts{})
+			if err := state.Unmarshal(scanner.Bytes()); err != nil {
+				return apiError(c, fiber.StatusBadRequest, "Couldn't parse the provider state", fiber.Map{
+					"line":   line,
+					"reason": err.Error(),
+				})
+			}
+			states = append(states, state)
+		}
+		if err := scanner.Err(); err != nil {
+			return apiError(c, fiber.StatusBadRequest, "Couldn't read the provider states", err.Error())
+		}
+
+		providers := orchestrator.GetAll()
+		resp := importResponse{Imported: []string{}, Skipped: []string{}}
+		for _, state := range states {
+			key := state.GetIdentifier()
+			provider, ok := providers[key]
+			if !ok {
+				log.Ctx(c.UserContext()).Warn().Str("provider", key).Msg("Skipping the import of an unknown provider state")
+				resp.Skipped = append(resp.Skipped, key)
+				continue
+			}
+			if err := provider.ImportState(c.UserContext(), state); err != nil {
+				return apiError(c, fiber.StatusInternalServerError, "Couldn't import the provider state", fiber.Map{
+					"provider": key,
+					"reason":   err.Error(),
+				})
+			}
+			resp.Imported = append(resp.Imported, key)
+		}
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+}
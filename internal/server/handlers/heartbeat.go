@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Heartbeat handles the liveness signals of the builds holding a lease
+func Heartbeat(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	type heartbeatRequest struct {
+		HeadSHA string `json:"head_sha" validate:"required,min=1"`
+	}
+
+	validate := validator.New()
+
+	return func(c *fiber.Ctx) error {
+		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
+		if provider == nil {
+			return fiberErr
+		}
+
+		input := new(heartbeatRequest)
+		if ok, err := parseBodyOrFail(c, input); !ok {
+			return err
+		}
+		if ok, err := validateInputOrFail(validationContext(c, provider), c, validate, input); !ok {
+			return err
+		}
+
+		leaseRequestResponse, err := provider.Heartbeat(c.UserContext(), input.HeadSHA)
+		if err != nil {
+			log.Ctx(c.UserContext()).Warn().Err(err).Msg("Couldn't record the lease heartbeat")
+			return apiError(c, fiber.StatusConflict, "Couldn't record the lease heartbeat", err.Error())
+		}
+
+		reqContext, err := provider.BuildRequestContext(c.UserContext(), leaseRequestResponse)
+		if err != nil {
+			return apiError(c, fiber.StatusInternalServerError, "Couldn't build request context", err.Error())
+		}
+		return sendRequestContext(c, fiber.StatusOK, reqContext)
+	}
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/ankorstore/mq-lease-service/internal/storage"
 	"github.com/gofiber/fiber/v2"
@@ -12,15 +14,54 @@ func Liveness() func(c *fiber.Ctx) error {
 	}
 }
 
-func Readiness(storage storage.Storage[*lease.ProviderState]) func(c *fiber.Ctx) error {
+func Readiness(storage storage.Storage[*lease.ProviderState], orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		status, _ := readiness(c.UserContext(), storage, orchestrator)
+		return c.SendStatus(status)
+	}
+}
+
+// Health aggregates the liveness and readiness checks (for the monitoring tools expecting a single endpoint): a 200 is
+// returned only if both are passing, a 503 otherwise.
+func Health(storage storage.Storage[*lease.ProviderState], orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	type healthCheck struct {
+		Healthy bool   `json:"healthy"`
+		Reason  string `json:"reason,omitempty"`
+	}
+	type healthResponse struct {
+		Healthy   bool        `json:"healthy"`
+		Liveness  healthCheck `json:"liveness"`
+		Readiness healthCheck `json:"readiness"`
+	}
+
 	return func(c *fiber.Ctx) error {
-		if passed := storage.HealthCheck(c.UserContext(), func() *lease.ProviderState {
-			return lease.NewProviderState(lease.NewProviderStateOpts{
-				ID: "test-healthcheck",
-			})
-		}); !passed {
-			return c.SendStatus(fiber.StatusInternalServerError)
+		status, reason := readiness(c.UserContext(), storage, orchestrator)
+		resp := healthResponse{
+			// the liveness probe is passing as soon as the server is answering
+			Liveness:  healthCheck{Healthy: true},
+			Readiness: healthCheck{Healthy: status == fiber.StatusOK, Reason: reason},
 		}
-		return c.SendStatus(fiber.StatusOK)
+		resp.Healthy = resp.Liveness.Healthy && resp.Readiness.Healthy
+		if !resp.Healthy {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(resp)
+		}
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+}
+
+// readiness checks if the instance is able to serve traffic, and returns the status the readiness probe should answer
+// with (along with the reason, if not ready)
+func readiness(ctx context.Context, storage storage.Storage[*lease.ProviderState], orchestrator lease.ProviderOrchestrator) (int, string) {
+	// stop receiving traffic while draining
+	if orchestrator.IsDraining() {
+		return fiber.StatusServiceUnavailable, "draining"
+	}
+	if passed := storage.HealthCheck(ctx, func() *lease.ProviderState {
+		return lease.NewProviderState(lease.NewProviderStateOpts{
+			ID: "test-healthcheck",
+		})
+	}); !passed {
+		return fiber.StatusInternalServerError, "storage healthcheck failed"
 	}
+	return fiber.StatusOK, ""
 }
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	_ "embed"
+
+	"github.com/ankorstore/mq-lease-service/internal/version"
+	"github.com/gofiber/fiber/v2"
+)
+
+// openAPISpec is the (hand-maintained) OpenAPI 3 document describing the API, keep it in sync with the routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func Version() func(c *fiber.Ctx) error {
+	type versionResponse struct {
+		App       string `json:"app"`
+		Commit    string `json:"commit"`
+		Tag       string `json:"tag"`
+		BuildDate string `json:"build_date"`
+	}
+
+	v := version.Version{}
+	return func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusOK).JSON(versionResponse{
+			App:       v.GetAppName(),
+			Commit:    v.GetCommit(),
+			Tag:       v.GetTag(),
+			BuildDate: v.GetBuildDate(),
+		})
+	}
+}
+
+// OpenAPI serves the OpenAPI spec of the API
+func OpenAPI() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(fiber.StatusOK).Send(openAPISpec)
+	}
+}
@@ -1,17 +1,36 @@
 package handlers
 
 import (
+	"errors"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/gofiber/fiber/v2"
 )
 
+// ProviderClear wipes the provider state. With `?safe=true`, the state is only cleared if no request is holding the
+// lease (so that an in-progress merge isn't aborted by accident).
 func ProviderClear(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
 		if provider == nil {
 			return fiberErr
 		}
-		provider.Clear(c.UserContext())
+		if !c.QueryBool("safe") {
+			provider.Clear(c.UserContext())
+			return c.Status(fiber.StatusOK).JSON(provider)
+		}
+
+		err := provider.ClearIfNotAcquired(c.UserContext())
+		var acquiredErr *lease.AcquiredError
+		if errors.As(err, &acquiredErr) {
+			return apiError(c, fiber.StatusConflict, "Couldn't clear the provider", fiber.Map{
+				"reason":   acquiredErr.Error(),
+				"acquired": acquiredErr.Acquired,
+			})
+		}
+		if err != nil {
+			return apiError(c, fiber.StatusInternalServerError, "Couldn't clear the provider", err.Error())
+		}
 		return c.Status(fiber.StatusOK).JSON(provider)
 	}
 }
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ProviderConfigUpdate overrides some settings of a provider at runtime (e.g. the stabilize duration of a misbehaving
+// queue), until restart. The omitted settings are left untouched. The stabilize duration is capped to
+// maxStabilizeDuration, like in the configuration.
+func ProviderConfigUpdate(orchestrator lease.ProviderOrchestrator, maxStabilizeDuration time.Duration) func(c *fiber.Ctx) error {
+	type configUpdateRequest struct {
+		StabilizeDuration    *int `json:"stabilize_duration" validate:"omitempty,min=0"`
+		TTL                  *int `json:"ttl" validate:"omitempty,min=1"`
+		ExpectedRequestCount *int `json:"expected_request_count" validate:"omitempty,min=1"`
+		DelayAssignmentCount *int `json:"delay_assignment_count" validate:"omitempty,min=0"`
+	}
+
+	validate := validator.New()
+
+	return func(c *fiber.Ctx) error {
+		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
+		if provider == nil {
+			return fiberErr
+		}
+
+		input := new(configUpdateRequest)
+		if ok, err := parseBodyOrFail(c, input); !ok {
+			return err
+		}
+		if ok, err := validateInputOrFail(c.UserContext(), c, validate, input); !ok {
+			return err
+		}
+
+		update := lease.ConfigUpdate{
+			ExpectedRequestCount: input.ExpectedRequestCount,
+			DelayAssignmentCount: input.DelayAssignmentCount,
+		}
+		if input.StabilizeDuration != nil {
+			stabilizeDuration := time.Duration(*input.StabilizeDuration) * time.Second
+			if stabilizeDuration > maxStabilizeDuration {
+				return apiError(c, fiber.StatusBadRequest, "Invalid request", "stabilize_duration is over the limit (see max_stabilize_duration_seconds)")
+			}
+			update.StabilizeDuration = &stabilizeDuration
+		}
+		if input.TTL != nil {
+			ttl := time.Duration(*input.TTL) * time.Second
+			update.TTL = &ttl
+		}
+		provider.UpdateConfig(c.UserContext(), update)
+
+		return c.Status(fiber.StatusOK).JSON(provider)
+	}
+}
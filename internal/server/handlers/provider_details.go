@@ -5,12 +5,18 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// ProviderDetails serves the details of a provider, honoring the conditional requests (If-None-Match) so that the
+// frequent pollers don't fetch them again while unchanged
 func ProviderDetails(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
 		if provider == nil {
 			return fiberErr
 		}
+		c.Set(fiber.HeaderETag, provider.DetailsETag())
+		if c.Fresh() {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
 		return c.Status(fiber.StatusOK).JSON(provider)
 	}
 }
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+type freezeResponse struct {
+	Frozen bool `json:"frozen"`
+}
+
+// ProviderFreeze toggles the freeze of a provider (maintenance window of its repository): while frozen, the acquire
+// requests are rejected, while the releases and the read-only routes are still served.
+func ProviderFreeze(orchestrator lease.ProviderOrchestrator, frozen bool) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
+		if provider == nil {
+			return fiberErr
+		}
+		provider.SetFrozen(frozen)
+		log.Ctx(c.UserContext()).Warn().Bool("frozen", frozen).Msg("Provider freeze toggled")
+		return c.Status(fiber.StatusOK).JSON(freezeResponse{Frozen: frozen})
+	}
+}
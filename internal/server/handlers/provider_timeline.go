@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/gofiber/fiber/v2"
+)
+
+type providerTimelineResponse struct {
+	HeadSHA  string                   `json:"head_sha"`
+	Timeline []lease.StatusTransition `json:"timeline"`
+}
+
+func ProviderTimeline(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
+		if provider == nil {
+			return fiberErr
+		}
+		headSHA := c.Params("headSha")
+		timeline, ok := provider.Timeline(headSHA)
+		if !ok {
+			return apiError(c, fiber.StatusNotFound, fmt.Sprintf("unknown lease request %s", headSHA), nil)
+		}
+		if timeline == nil {
+			timeline = []lease.StatusTransition{}
+		}
+		return c.Status(fiber.StatusOK).JSON(providerTimelineResponse{HeadSHA: headSHA, Timeline: timeline})
+	}
+}
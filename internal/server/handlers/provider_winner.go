@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/gofiber/fiber/v2"
+)
+
+type providerWinnerResponse struct {
+	Winner *lease.RequestContext `json:"winner"`
+}
+
+func ProviderWinner(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
+		if provider == nil {
+			return fiberErr
+		}
+		winner, err := provider.PeekWinner(c.UserContext())
+		if err != nil {
+			return apiError(c, fiber.StatusInternalServerError, "Couldn't build request context", err.Error())
+		}
+		return c.Status(fiber.StatusOK).JSON(providerWinnerResponse{Winner: winner})
+	}
+}
@@ -1,22 +1,30 @@
 package handlers
 
 import (
+	"time"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
 )
 
-func Release(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
+// Release handles the lease releases. If allowEventTime is set, the requests can carry the time they happened at, used
+// instead of the current time (to replay historical events).
+func Release(orchestrator lease.ProviderOrchestrator, allowEventTime bool) func(c *fiber.Ctx) error {
 	type releaseRequest struct {
-		HeadSHA  string `json:"head_sha" validate:"required,min=1"`
-		HeadRef  string `json:"head_ref" validate:"required,min=1,ghTempBranchRef"`
-		Priority int    `json:"priority" validate:"required,number,min=1"`
-		Status   string `json:"status" validate:"required,oneof=success failure"`
+		HeadSHA   string     `json:"head_sha" validate:"required,min=1"`
+		HeadRef   string     `json:"head_ref" validate:"required,min=1,ghTempBranchRef"`
+		Priority  int        `json:"priority" validate:"required,number,min=1,maxPriority"`
+		Status    string     `json:"status" validate:"required,oneof=success failure cancelled"`
+		EventTime *time.Time `json:"event_time"`
+		// NextHeadSHA hands the lease off to the given pending request (failed or cancelled releases only)
+		NextHeadSHA string `json:"next_head_sha"`
 	}
 
 	validate := validator.New()
 	registerGhTempBranchRefValidationRuleOrFail(validate)
+	registerMaxPriorityValidationRuleOrFail(validate)
 
 	return func(c *fiber.Ctx) error {
 		provider, fiberErr := getLeaseProviderOrFail(c, orchestrator)
@@ -28,17 +36,26 @@ func Release(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 		if ok, err := parseBodyOrFail(c, input); !ok {
 			return err
 		}
-		if ok, err := validateInputOrFail(c, validate, input); !ok {
+		// the priority can be omitted when the provider has a default one, or derives it (still required otherwise)
+		if input.Priority == 0 {
+			input.Priority = provider.DefaultPriority()
+		}
+		if ok, err := validateInputOrFail(validationContext(c, provider), c, validate, input, providerIgnoredFields(provider)...); !ok {
+			return err
+		}
+		ctx, err := eventTimeContextOrFail(c, input.EventTime, allowEventTime)
+		if ctx == nil {
 			return err
 		}
 		leaseRequest := &lease.Request{
-			HeadSHA:  input.HeadSHA,
-			HeadRef:  input.HeadRef,
-			Priority: input.Priority,
-			Status:   &input.Status,
+			HeadSHA:     input.HeadSHA,
+			HeadRef:     input.HeadRef,
+			Priority:    input.Priority,
+			Status:      &input.Status,
+			NextHeadSHA: input.NextHeadSHA,
 		}
 
-		leaseRequestResponse, err := provider.Release(c.UserContext(), leaseRequest)
+		leaseRequestResponse, err := provider.Release(ctx, leaseRequest)
 		if err != nil {
 			log.Ctx(c.UserContext()).Error().Err(err).Msg("Couldn't release the lock")
 			return apiError(c, fiber.StatusBadRequest, "Couldn't release the lock", err.Error())
@@ -48,6 +65,6 @@ func Release(orchestrator lease.ProviderOrchestrator) func(c *fiber.Ctx) error {
 		if err != nil {
 			return apiError(c, fiber.StatusInternalServerError, "Couldn't build request context", err.Error())
 		}
-		return c.Status(fiber.StatusOK).JSON(reqContext)
+		return sendRequestContext(c, fiber.StatusOK, reqContext)
 	}
 }
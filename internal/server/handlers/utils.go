@@ -1,7 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/ankorstore/mq-lease-service/internal/server/middlewares"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog"
@@ -11,21 +18,79 @@ import (
 type apiErrorResponse struct {
 	Error        string `json:"error"`
 	ErrorContext any    `json:"error_context,omitempty"`
+	// RequestID is the ID of the request, to find it in the server logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// versionedRequestContext is the request context, enveloped with the API version explicitly selected by the client
+type versionedRequestContext struct {
+	*lease.RequestContext
+	APIVersion int `json:"api_version"`
+}
+
+// sendRequestContext responds with the request context: enveloped with the API version (and with its media type) when
+// the client selected one, in its default shape otherwise
+func sendRequestContext(c *fiber.Ctx, status int, reqContext *lease.RequestContext) error {
+	version, ok := middlewares.APIVersion(c)
+	if !ok {
+		return c.Status(status).JSON(reqContext)
+	}
+	return c.Status(status).JSON(versionedRequestContext{RequestContext: reqContext, APIVersion: version}, middlewares.APIVersionMediaType(version))
 }
 
+// errInvalidRequest rejects the creation of a provider by an invalid request
+var errInvalidRequest = errors.New("invalid request")
+
 func getLeaseProviderOrFail(c *fiber.Ctx, orchestrator lease.ProviderOrchestrator) (lease.Provider, error) {
+	return leaseProviderOrFail(c, orchestrator, false, nil)
+}
+
+// getOrCreateLeaseProviderOrFail is getLeaseProviderOrFail, creating the provider when it's not configured but allowed
+// to be created dynamically. The request is validated against the provider (see validate) before it's created, so that
+// an invalid request doesn't create any.
+func getOrCreateLeaseProviderOrFail(c *fiber.Ctx, orchestrator lease.ProviderOrchestrator, validate func(provider lease.Provider) []*inputValidationError) (lease.Provider, error) {
+	return leaseProviderOrFail(c, orchestrator, true, validate)
+}
+
+func leaseProviderOrFail(c *fiber.Ctx, orchestrator lease.ProviderOrchestrator, create bool, validate func(provider lease.Provider) []*inputValidationError) (lease.Provider, error) {
 	owner := c.Params("owner")
 	repo := c.Params("repo")
 	baseRef := c.Params("baseRef")
+	queue := c.Params("queue")
 
 	log.Ctx(c.UserContext()).UpdateContext(func(c zerolog.Context) zerolog.Context {
-		return c.
+		c = c.
 			Str("repo_owner", owner).
 			Str("repo_name", repo).
 			Str("repo_baseRef", baseRef)
+		if queue != "" {
+			c = c.Str("repo_queue", queue)
+		}
+		return c
 	})
 
-	provider, err := orchestrator.Get(owner, repo, baseRef)
+	// if the caller is restricted to some repositories, make sure the target one is part of them
+	if scopes, ok := c.Locals(middlewares.AuthScopesLocalKey).([]string); ok && !slices.Contains(scopes, owner+"/"+repo) {
+		log.Ctx(c.UserContext()).Warn().Strs("auth_scopes", scopes).Msg("Caller is not authorized to access the provider")
+		return nil, apiError(c, fiber.StatusForbidden, "not authorized to access this repository", nil)
+	}
+
+	var provider lease.Provider
+	var err error
+	var validationErrs []*inputValidationError
+	if create {
+		provider, err = orchestrator.GetOrCreate(c.UserContext(), owner, repo, baseRef, queue, func(provider lease.Provider) error {
+			if validationErrs = validate(provider); len(validationErrs) > 0 {
+				return errInvalidRequest
+			}
+			return nil
+		})
+	} else {
+		provider, err = orchestrator.Get(owner, repo, baseRef, queue)
+	}
+	if errors.Is(err, errInvalidRequest) {
+		return nil, apiError(c, fiber.StatusBadRequest, "Invalid request", validationErrs)
+	}
 	if err != nil {
 		log.Ctx(c.UserContext()).Error().Err(err).Msg("Error when retrieving provider")
 		return nil, apiError(c, fiber.StatusNotFound, err.Error(), nil)
@@ -34,6 +99,18 @@ func getLeaseProviderOrFail(c *fiber.Ctx, orchestrator lease.ProviderOrchestrato
 	return provider, nil
 }
 
+// eventTimeContextOrFail returns the context the provider has to be called with: if an event time is provided (and
+// allowed), the provider is using it as the current time.
+func eventTimeContextOrFail(c *fiber.Ctx, eventTime *time.Time, allowEventTime bool) (context.Context, error) {
+	if eventTime == nil {
+		return c.UserContext(), nil
+	}
+	if !allowEventTime {
+		return nil, apiError(c, fiber.StatusBadRequest, "Invalid request", "event_time is not allowed on this server")
+	}
+	return lease.WithEventTime(c.UserContext(), *eventTime), nil
+}
+
 func parseBodyOrFail(c *fiber.Ctx, out interface{}) (bool, error) {
 	if err := c.BodyParser(out); err != nil {
 		log.Ctx(c.UserContext()).Error().Err(err).Msg("Error when parsing request body")
@@ -46,41 +123,122 @@ type inputValidationError struct {
 	FailedField string `json:"failed_field"`
 	Tag         string `json:"tag"`
 	Value       string `json:"value"`
+	// Expected is a hint about the expected format (only for the rules listed in validationRuleHints)
+	Expected string `json:"expected,omitempty"`
+	// Actual is the offending value (only for the rules listed in validationRuleHints)
+	Actual string `json:"actual,omitempty"`
+}
+
+// validationRuleHints are the expected formats of the custom validation rules, which don't carry any parameter
+// explaining what they're expecting (computed from the validation context)
+var validationRuleHints = map[string]func(ctx context.Context) string{
+	"ghTempBranchRef": func(context.Context) string { return lease.GHTempRefPattern },
+	"maxPriority": func(ctx context.Context) string {
+		maxPriority, _ := ctx.Value(maxPriorityCtxKey{}).(int)
+		return fmt.Sprintf("<= %d", maxPriority)
+	},
 }
 
-func ghTempBranchRefNameValidation(fl validator.FieldLevel) bool {
+// providerIgnoredFields returns the input fields which don't have to be validated for the given provider: the
+// priority is ignored when derived from the head ref
+func providerIgnoredFields(provider lease.Provider) []string {
+	if provider.DerivesPriority() {
+		return []string{"Priority"}
+	}
+	return nil
+}
+
+// genericModeCtxKey flags the validation context of the requests targeting a provider in generic mode
+type genericModeCtxKey struct{}
+
+// maxPriorityCtxKey carries the max priority accepted by the provider in the validation context
+type maxPriorityCtxKey struct{}
+
+// validationContext returns the context the request inputs targeting the given provider have to be validated with
+func validationContext(c *fiber.Ctx, provider lease.Provider) context.Context {
+	ctx := context.WithValue(c.UserContext(), genericModeCtxKey{}, provider.GenericMode())
+	return context.WithValue(ctx, maxPriorityCtxKey{}, provider.MaxPriority())
+}
+
+func ghTempBranchRefNameValidation(ctx context.Context, fl validator.FieldLevel) bool {
+	// providers in generic mode are accepting any ref
+	if genericMode, _ := ctx.Value(genericModeCtxKey{}).(bool); genericMode {
+		return true
+	}
 	return lease.ValidateGHTempRef(fl.Field().String())
 }
 
 func registerGhTempBranchRefValidationRuleOrFail(validate *validator.Validate) {
-	if err := validate.RegisterValidation("ghTempBranchRef", ghTempBranchRefNameValidation); err != nil {
+	if err := validate.RegisterValidationCtx("ghTempBranchRef", ghTempBranchRefNameValidation); err != nil {
 		panic("Error when trying to register GH branch ref validation rule in validator: " + err.Error())
 	}
 }
 
-func validateInputOrFail(c *fiber.Ctx, validate *validator.Validate, subject any) (bool, error) {
-	errs := validateInput(validate, subject)
+func maxPriorityValidation(ctx context.Context, fl validator.FieldLevel) bool {
+	maxPriority, _ := ctx.Value(maxPriorityCtxKey{}).(int)
+	// unbounded
+	if maxPriority <= 0 {
+		return true
+	}
+	return fl.Field().Int() <= int64(maxPriority)
+}
+
+func registerMaxPriorityValidationRuleOrFail(validate *validator.Validate) {
+	if err := validate.RegisterValidationCtx("maxPriority", maxPriorityValidation); err != nil {
+		panic("Error when trying to register max priority validation rule in validator: " + err.Error())
+	}
+}
+
+// validateInputOrFail validates the subject, but the given fields (e.g. the ones depending on the provider, when it
+// isn't known yet)
+func validateInputOrFail(ctx context.Context, c *fiber.Ctx, validate *validator.Validate, subject any, except ...string) (bool, error) {
+	errs := validateInput(ctx, validate, subject, except...)
 	if len(errs) > 0 {
 		return false, apiError(c, fiber.StatusBadRequest, "Invalid request", errs)
 	}
 	return true, nil
 }
 
-func validateInput(validate *validator.Validate, subject any) []*inputValidationError {
+func validateInput(ctx context.Context, validate *validator.Validate, subject any, except ...string) []*inputValidationError {
 	var errs []*inputValidationError
-	err := validate.Struct(subject)
+	var err error
+	if len(except) > 0 {
+		err = validate.StructExceptCtx(ctx, subject, except...)
+	} else {
+		err = validate.StructCtx(ctx, subject)
+	}
 	if err != nil {
 		for _, err := range err.(validator.ValidationErrors) {
-			errs = append(errs, &inputValidationError{
+			validationErr := &inputValidationError{
 				FailedField: err.StructNamespace(),
 				Tag:         err.Tag(),
 				Value:       err.Param(),
-			})
+			}
+			if hint, ok := validationRuleHints[err.Tag()]; ok {
+				validationErr.Expected = hint(ctx)
+				validationErr.Actual = fmt.Sprint(err.Value())
+			}
+			errs = append(errs, validationErr)
 		}
 	}
 	return errs
 }
 
 func apiError(c *fiber.Ctx, status int, err string, errCtx any) error {
-	return c.Status(status).JSON(apiErrorResponse{Error: err, ErrorContext: errCtx})
+	return c.Status(status).JSON(apiErrorResponse{Error: err, ErrorContext: errCtx, RequestID: middlewares.RequestID(c)})
+}
+
+// ErrorHandler is the fiber error handler, used for the errors returned outside the handlers (for example, when the
+// request is rejected at the server level because the body is too large). It makes sure the errors we know about are
+// following the same format as the ones returned by the API handlers.
+func ErrorHandler(bodyLimit int) fiber.ErrorHandler {
+	return func(c *fiber.Ctx, err error) error {
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusRequestEntityTooLarge {
+			return apiError(c, fiber.StatusRequestEntityTooLarge, "Request body too large", fiber.Map{
+				"max_body_size": bodyLimit,
+			})
+		}
+		return fiber.DefaultErrorHandler(c, err)
+	}
 }
@@ -0,0 +1,31 @@
+package middlewares
+
+import (
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	AcquiredSHAHeaderName = "X-Lease-Acquired-SHA"
+)
+
+// AcquiredSHAHeaderMiddleware adds the head SHA currently holding the lease of the requested provider in the responses
+// headers (empty if the lease is not acquired). It's computed once the request is handled, so it reflects the state
+// after a potential acquisition/release. It's meant to be used on provider-scoped routes (/:owner/:repo/:baseRef, and
+// /:owner/:repo/:baseRef/queues/:queue).
+func AcquiredSHAHeaderMiddleware(orchestrator lease.ProviderOrchestrator) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+
+		// don't leak anything to callers which are not allowed to access the provider
+		if status := c.Response().StatusCode(); status == fiber.StatusUnauthorized || status == fiber.StatusForbidden {
+			return err
+		}
+
+		provider, getErr := orchestrator.Get(c.Params("owner"), c.Params("repo"), c.Params("baseRef"), c.Params("queue"))
+		if getErr == nil {
+			c.Set(AcquiredSHAHeaderName, provider.AcquiredSHA())
+		}
+		return err
+	}
+}
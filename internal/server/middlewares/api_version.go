@@ -0,0 +1,57 @@
+package middlewares
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	APIVersionHeaderName = "API-Version"
+	// APIVersionLocalKey is the fiber local key holding the API version explicitly selected by the client (unset if none)
+	APIVersionLocalKey = "api_version"
+	// CurrentAPIVersion is the latest version of the API, served when the client doesn't select any
+	CurrentAPIVersion = 1
+)
+
+// apiVersionMediaTypePattern matches the versioned media types (application/vnd.mqlease.v<N>+json)
+var apiVersionMediaTypePattern = regexp.MustCompile(`application/vnd\.mqlease\.v(\d+)\+json`)
+
+// APIVersionMediaType returns the media type of the given API version
+func APIVersionMediaType(version int) string {
+	return "application/vnd.mqlease.v" + strconv.Itoa(version) + "+json"
+}
+
+// APIVersionMiddleware negotiates the version of the API responses: a client can select one with the
+// `Accept: application/vnd.mqlease.v<N>+json` header, the current one is served otherwise (in its default shape). The
+// unsupported versions are rejected with a 406. The served version is echoed in the API-Version header.
+func APIVersionMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		version := CurrentAPIVersion
+		if match := apiVersionMediaTypePattern.FindStringSubmatch(c.Get(fiber.HeaderAccept)); match != nil {
+			requested, err := strconv.Atoi(match[1])
+			if err != nil || requested != CurrentAPIVersion {
+				return c.Status(fiber.StatusNotAcceptable).JSON(fiber.Map{
+					"error": "Unsupported API version",
+					"error_context": fiber.Map{
+						"requested":          match[0],
+						"supported_versions": []int{CurrentAPIVersion},
+					},
+					"request_id": RequestID(c),
+				})
+			}
+			version = requested
+			c.Locals(APIVersionLocalKey, version)
+		}
+		c.Set(APIVersionHeaderName, strconv.Itoa(version))
+		return c.Next()
+	}
+}
+
+// APIVersion returns the API version explicitly selected by the client (false if none, the current version is then
+// served in its default shape)
+func APIVersion(c *fiber.Ctx) (int, bool) {
+	version, ok := c.Locals(APIVersionLocalKey).(int)
+	return version, ok
+}
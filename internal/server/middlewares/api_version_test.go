@@ -0,0 +1,49 @@
+package middlewares
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIVersionMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(APIVersionMiddleware())
+	app.Get("/", func(c *fiber.Ctx) error {
+		version, ok := APIVersion(c)
+		return c.SendString(strconv.Itoa(version) + "|" + strconv.FormatBool(ok))
+	})
+
+	tests := []struct {
+		accept          string
+		expectedStatus  int
+		expectedVersion string
+		expectedBody    string
+	}{
+		{accept: "", expectedStatus: fiber.StatusOK, expectedVersion: "1", expectedBody: "0|false"},
+		{accept: "application/json", expectedStatus: fiber.StatusOK, expectedVersion: "1", expectedBody: "0|false"},
+		{accept: "application/vnd.mqlease.v1+json", expectedStatus: fiber.StatusOK, expectedVersion: "1", expectedBody: "1|true"},
+		{accept: "text/html, application/vnd.mqlease.v1+json;q=0.9", expectedStatus: fiber.StatusOK, expectedVersion: "1", expectedBody: "1|true"},
+		{accept: "application/vnd.mqlease.v2+json", expectedStatus: fiber.StatusNotAcceptable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			req.Header.Set(fiber.HeaderAccept, tt.accept)
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != fiber.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.expectedVersion, resp.Header.Get(APIVersionHeaderName))
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedBody, string(body))
+		})
+	}
+}
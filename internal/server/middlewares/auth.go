@@ -0,0 +1,105 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// AuthIdentityLocalKey is the fiber local key holding the identity of the authenticated caller
+	// (the basic auth username, or the API key)
+	AuthIdentityLocalKey = "auth_identity"
+	// AuthScopesLocalKey is the fiber local key holding the repositories (`owner/repo`) the authenticated caller is
+	// restricted to (not set if the caller is not restricted)
+	AuthScopesLocalKey = "auth_scopes"
+)
+
+// AuthMiddleware authenticates the requests either with basic auth (`Authorization: Basic <credentials>`), validated
+// against the given users, or with a bearer token (`Authorization: Bearer <token>`), validated against the given API keys.
+// The identity of the authenticated caller is stored in the AuthIdentityLocalKey local, and its scopes (if any) in the
+// AuthScopesLocalKey local.
+func AuthMiddleware(users map[string]string, apiKeys []string, scopes map[string][]string) fiber.Handler {
+	unauthorized := func(c *fiber.Ctx) error {
+		if len(users) > 0 {
+			c.Set(fiber.HeaderWWWAuthenticate, `Basic realm="Restricted"`)
+		}
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	return func(c *fiber.Ctx) error {
+		auth := c.Get(fiber.HeaderAuthorization)
+		scheme, credentials, found := strings.Cut(auth, " ")
+		if !found {
+			return unauthorized(c)
+		}
+
+		var identity string
+		switch {
+		case utils.EqualFold(scheme, "basic") && len(users) > 0:
+			identity = authenticateBasic(users, credentials)
+		case utils.EqualFold(scheme, "bearer") && len(apiKeys) > 0:
+			identity = authenticateBearer(apiKeys, credentials)
+		}
+		if identity == "" {
+			return unauthorized(c)
+		}
+
+		c.Locals(AuthIdentityLocalKey, identity)
+		if identityScopes, ok := scopes[identity]; ok {
+			c.Locals(AuthScopesLocalKey, identityScopes)
+		}
+		return c.Next()
+	}
+}
+
+// authenticateBasic returns the username if the basic auth credentials are valid (empty string otherwise)
+func authenticateBasic(users map[string]string, credentials string) string {
+	raw, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return ""
+	}
+	username, password, found := strings.Cut(string(raw), ":")
+	if !found {
+		return ""
+	}
+	expectedPassword, ok := users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword)) != 1 {
+		return ""
+	}
+	return username
+}
+
+// authenticateBearer returns the token if it matches one of the API keys (empty string otherwise)
+func authenticateBearer(apiKeys []string, token string) string {
+	matched := false
+	// go through all the keys, no matter if one already matched, to keep a constant time
+	for _, key := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			matched = true
+		}
+	}
+	if !matched {
+		return ""
+	}
+	return token
+}
+
+// UnscopedOnlyMiddleware forbids the callers restricted to some repositories (see AuthScopesLocalKey), guarding the
+// routes spanning all the providers. It has to run after the AuthMiddleware.
+func UnscopedOnlyMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if scopes, ok := c.Locals(AuthScopesLocalKey).([]string); ok {
+			log.Ctx(c.UserContext()).Warn().Strs("auth_scopes", scopes).Msg("Scoped caller is not authorized to access the route")
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":      "not authorized to access this route",
+				"request_id": RequestID(c),
+			})
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const redactedValue = "[REDACTED]"
+
+// sensitiveFieldMarkers are the (lowercase) substrings identifying the auth-related body fields, whose values are
+// redacted before being logged
+var sensitiveFieldMarkers = []string{"auth", "token", "password", "secret", "api_key", "apikey", "credential"}
+
+// BodyLoggerMiddleware logs (at debug level) the request body along with the response status, to help diagnosing the
+// client issues. JSON bodies are logged with their auth-related fields redacted, other bodies are never logged.
+func BodyLoggerMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var body json.RawMessage
+		if raw := c.Body(); len(raw) > 0 {
+			body = redactBody(raw)
+		}
+
+		err := c.Next()
+
+		event := log.Ctx(c.UserContext()).Debug().
+			Str("req_method", c.Method()).
+			Str("req_path", c.Path()).
+			Int("req_status", c.Response().StatusCode())
+		if body != nil {
+			event = event.RawJSON("req_body", body)
+		} else if len(c.Body()) > 0 {
+			event = event.Bool("req_body_unparsable", true)
+		}
+		event.Msg("Request body")
+
+		return err
+	}
+}
+
+// redactBody returns the given JSON body with the auth-related fields redacted (nil if the body isn't valid JSON)
+func redactBody(raw []byte) json.RawMessage {
+	var payload any
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(payload))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			if isSensitiveField(key) {
+				v[key] = redactedValue
+				continue
+			}
+			v[key] = redactValue(nested)
+		}
+	case []any:
+		for i, nested := range v {
+			v[i] = redactValue(nested)
+		}
+	}
+	return value
+}
+
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, marker := range sensitiveFieldMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+	return false
+}
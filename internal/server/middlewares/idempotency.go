@@ -0,0 +1,125 @@
+package middlewares
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"k8s.io/utils/clock"
+)
+
+const (
+	IdempotencyKeyHeaderName = "Idempotency-Key"
+	// idempotencyMaxEntries caps the number of cached responses, the ones expiring first being evicted to make room
+	idempotencyMaxEntries = 10000
+)
+
+type idempotencyCachedResponse struct {
+	cacheKey    string
+	status      int
+	contentType []byte
+	body        []byte
+	expiresAt   time.Time
+}
+
+// IdempotencyMiddleware replays the previous response when a request is received again by the same caller with the same
+// idempotency key (provided in the Idempotency-Key header) and the same body, during the given lifetime. Requests
+// without key are processed as usual. The callers are identified by their credential (it has to run after the auth
+// middleware), or by their IP if anonymous. A duplicate received while the first request is still processed waits for
+// its response.
+func IdempotencyMiddleware(lifetime time.Duration, clk clock.PassiveClock) fiber.Handler {
+	return newIdempotencyMiddleware(lifetime, idempotencyMaxEntries, clk)
+}
+
+func newIdempotencyMiddleware(lifetime time.Duration, maxEntries int, clk clock.PassiveClock) fiber.Handler {
+	// if no Clock service is provided, fallback to a Real clock
+	if clk == nil {
+		clk = clock.RealClock{}
+	}
+	var mutex sync.Mutex
+	cache := map[string]*list.Element{}
+	// the lifetime being the same for all the responses, the insertion order is the expiry order
+	expiries := list.New()
+	// closed once the request being processed for a cache key is done
+	inFlight := map[string]chan struct{}{}
+
+	remove := func(element *list.Element) {
+		delete(cache, expiries.Remove(element).(*idempotencyCachedResponse).cacheKey)
+	}
+
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeaderName, "")
+		if key == "" {
+			return c.Next()
+		}
+
+		caller := "ip:" + c.IP()
+		if identity, ok := c.Locals(AuthIdentityLocalKey).(string); ok && identity != "" {
+			caller = "credential:" + identity
+		}
+		bodyHash := sha256.Sum256(c.Body())
+		// the response shape depends on the negotiated API version
+		cacheKey := caller + "|" + c.Path() + "|" + key + "|" + c.Get(fiber.HeaderAccept) + "|" + hex.EncodeToString(bodyHash[:])
+
+		for {
+			mutex.Lock()
+			if element, ok := cache[cacheKey]; ok {
+				cached := element.Value.(*idempotencyCachedResponse)
+				if !clk.Now().After(cached.expiresAt) {
+					mutex.Unlock()
+					log.Ctx(c.UserContext()).Debug().Str("idempotency_key", key).Msg("Replaying response of a previous request with the same idempotency key")
+					c.Response().Header.SetContentTypeBytes(cached.contentType)
+					return c.Status(cached.status).Send(cached.body)
+				}
+				remove(element)
+			}
+			done, processing := inFlight[cacheKey]
+			if !processing {
+				inFlight[cacheKey] = make(chan struct{})
+				mutex.Unlock()
+				break
+			}
+			mutex.Unlock()
+			// wait for the response of the duplicate (or to take over if it wasn't cached)
+			<-done
+		}
+
+		defer func() {
+			mutex.Lock()
+			close(inFlight[cacheKey])
+			delete(inFlight, cacheKey)
+			mutex.Unlock()
+		}()
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+
+		// only cache the responses which are not server errors, so the client can retry those
+		if status := c.Response().StatusCode(); status < fiber.StatusInternalServerError {
+			mutex.Lock()
+			now := clk.Now()
+			// drop the expired responses, then the ones expiring first to make room
+			for front := expiries.Front(); front != nil && now.After(front.Value.(*idempotencyCachedResponse).expiresAt); front = expiries.Front() {
+				remove(front)
+			}
+			for expiries.Len() >= maxEntries {
+				remove(expiries.Front())
+			}
+			cache[cacheKey] = expiries.PushBack(&idempotencyCachedResponse{
+				cacheKey:    cacheKey,
+				status:      status,
+				contentType: append([]byte(nil), c.Response().Header.ContentType()...),
+				body:        append([]byte(nil), c.Response().Body()...),
+				expiresAt:   now.Add(lifetime),
+			})
+			mutex.Unlock()
+		}
+
+		return nil
+	}
+}
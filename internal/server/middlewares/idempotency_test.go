@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+	calls := 0
+	app := fiber.New()
+	app.Use(AuthMiddleware(nil, []string{"token-a", "token-b"}, nil))
+	app.Use(newIdempotencyMiddleware(time.Minute, 2, clk))
+	app.Post("/", func(c *fiber.Ctx) error {
+		calls++
+		return c.SendString(strconv.Itoa(calls))
+	})
+	call := func(token string, key string) string {
+		req := httptest.NewRequest(fiber.MethodPost, "/", nil)
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+		req.Header.Set(IdempotencyKeyHeaderName, key)
+		resp, err := app.Test(req, -1)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "1", call("token-a", "key-1"))
+	assert.Equal(t, "1", call("token-a", "key-1"))
+	// the responses aren't shared between the callers
+	assert.Equal(t, "2", call("token-b", "key-1"))
+	assert.Equal(t, "2", call("token-b", "key-1"))
+
+	// past the max entries, the responses expiring first are evicted
+	assert.Equal(t, "3", call("token-a", "key-2"))
+	assert.Equal(t, "4", call("token-a", "key-1"))
+	assert.Equal(t, "3", call("token-a", "key-2"))
+
+	// the responses are replayed during their lifetime only
+	clk.SetTime(clk.Now().Add(time.Minute))
+	assert.Equal(t, "3", call("token-a", "key-2"))
+	clk.SetTime(clk.Now().Add(time.Second))
+	assert.Equal(t, "5", call("token-a", "key-2"))
+}
+
+func TestIdempotencyMiddlewareConcurrentDuplicates(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app := fiber.New()
+	app.Use(newIdempotencyMiddleware(time.Minute, 2, clocktesting.NewFakePassiveClock(time.Now())))
+	app.Post("/", func(c *fiber.Ctx) error {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return c.SendString(strconv.Itoa(int(calls.Load())))
+	})
+	call := func() string {
+		req := httptest.NewRequest(fiber.MethodPost, "/", nil)
+		req.Header.Set(IdempotencyKeyHeaderName, "key-1")
+		resp, err := app.Test(req, -1)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return string(body)
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bodies[0] = call()
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bodies[1] = call()
+	}()
+	// give the duplicate the time to reach the middleware while the first request is processed
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, []string{"1", "1"}, bodies)
+}
@@ -20,6 +20,10 @@ func LoggerMiddleware(logger *zerolog.Logger) fiber.Handler {
 		if traceparent := c.Get(TraceparentHeaderName, ""); traceparent != "" {
 			log = logger.With().Str("req_trace_parent", traceparent).Logger()
 		}
+		// if the request has been stamped with an ID, add it to the log (it's echoed in the response too)
+		if requestID := RequestID(c); requestID != "" {
+			log = log.With().Str("req_id", requestID).Logger()
+		}
 		ctx := log.WithContext(c.UserContext())
 		c.SetUserContext(ctx)
 
@@ -10,7 +10,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func PrometheusMiddleware(app *fiber.App, metricsService metrics.Metrics, url string) fiber.Handler {
+// PrometheusMiddleware instruments the HTTP requests, and registers the metrics scrapping endpoint (guarded by the
+// provided auth handler) on the given url.
+func PrometheusMiddleware(app *fiber.App, metricsService metrics.Metrics, url string, authHandler fiber.Handler) fiber.Handler {
 	requestsTotal := metricsService.NewCounterVec(prometheus.CounterOpts{
 		Name: "http_requests_total",
 		Help: "Count all http requests by status code, method and route name.",
@@ -27,7 +29,7 @@ func PrometheusMiddleware(app *fiber.App, metricsService metrics.Metrics, url st
 		Help: "All the requests in progress",
 	}, []string{"method"})
 
-	app.Get(url, adaptor.HTTPHandler(metricsService.GetHTTPHandler())).Name("metrics")
+	app.Get(url, authHandler, adaptor.HTTPHandler(metricsService.GetHTTPHandler())).Name("metrics")
 
 	return func(c *fiber.Ctx) error {
 		start := time.Now()
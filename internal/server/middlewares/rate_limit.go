@@ -0,0 +1,34 @@
+package middlewares
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+// RateLimitMiddleware limits the requests of each client to max requests per window. The clients are identified by
+// their IP, or by their credential (basic auth username or API key, the anonymous ones still being identified by their
+// IP) if perCredential is set: the middleware then has to run after the auth one. The requests over the limit are
+// rejected with a 429, whose Retry-After header tells when the window resets.
+func RateLimitMiddleware(max int, window time.Duration, perCredential bool) fiber.Handler {
+	return limiter.New(limiter.Config{
+		Max:        max,
+		Expiration: window,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			if perCredential {
+				if identity, ok := c.Locals(AuthIdentityLocalKey).(string); ok && identity != "" {
+					return "credential:" + identity
+				}
+			}
+			return "ip:" + c.IP()
+		},
+		LimitReached: func(c *fiber.Ctx) error {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":         "Too many requests",
+				"error_context": "retry after " + c.GetRespHeader(fiber.HeaderRetryAfter) + "s",
+				"request_id":    RequestID(c),
+			})
+		},
+	})
+}
@@ -0,0 +1,28 @@
+package middlewares
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+)
+
+const (
+	RequestIDHeaderName = fiber.HeaderXRequestID
+	// RequestIDLocalKey is the fiber local key holding the ID of the request
+	RequestIDLocalKey = "request_id"
+)
+
+// RequestIDMiddleware stamps each request with a unique ID (the inbound X-Request-ID header is honored if present),
+// stored in the RequestIDLocalKey local and echoed in the response headers, to correlate the client-side errors with
+// the server logs.
+func RequestIDMiddleware() fiber.Handler {
+	return requestid.New(requestid.Config{
+		Header:     RequestIDHeaderName,
+		ContextKey: RequestIDLocalKey,
+	})
+}
+
+// RequestID returns the ID of the request (empty if it hasn't been stamped by the RequestIDMiddleware)
+func RequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(RequestIDLocalKey).(string)
+	return id
+}
@@ -0,0 +1,37 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// TimeoutMiddleware bounds the time spent handling a request through its user context, cancelled once the timeout is
+// reached: the handlers are expected to honor it to give up early (the middleware can't interrupt them). Only the
+// handlers which gave up (returning the context error) are answered with a 503, the response of the ones which
+// completed anyway is kept (e.g. a mutation which went through).
+func TimeoutMiddleware(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+
+		log.Ctx(ctx).Warn().Err(err).Dur("timeout", timeout).Msg("Request timed out")
+		c.Response().Reset()
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Request timed out",
+			"error_context": fiber.Map{
+				"timeout": timeout.String(),
+			},
+			"request_id": RequestID(c),
+		})
+	}
+}
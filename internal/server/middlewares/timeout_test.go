@@ -0,0 +1,58 @@
+package middlewares
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(RequestIDMiddleware())
+	app.Use(TimeoutMiddleware(50 * time.Millisecond))
+	app.Get("/fast", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	// the handlers not honoring the context are keeping their response
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		time.Sleep(100 * time.Millisecond)
+		return c.SendStatus(fiber.StatusCreated)
+	})
+	app.Get("/cancelled", func(c *fiber.Ctx) error {
+		select {
+		case <-c.UserContext().Done():
+			return c.UserContext().Err()
+		case <-time.After(time.Second):
+			return c.SendStatus(fiber.StatusOK)
+		}
+	})
+
+	tests := map[string]int{
+		"/fast":      fiber.StatusOK,
+		"/slow":      fiber.StatusCreated,
+		"/cancelled": fiber.StatusServiceUnavailable,
+	}
+	for path, expectedStatus := range tests {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, path, nil)
+			req.Header.Set(RequestIDHeaderName, "request-id")
+			resp, err := app.Test(req, -1)
+			assert.NoError(t, err)
+			assert.Equal(t, expectedStatus, resp.StatusCode)
+		})
+	}
+
+	t.Run("error body", func(t *testing.T) {
+		req := httptest.NewRequest(fiber.MethodGet, "/cancelled", nil)
+		req.Header.Set(RequestIDHeaderName, "request-id")
+		resp, err := app.Test(req, -1)
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"error": "Request timed out", "error_context": {"timeout": "50ms"}, "request_id": "request-id"}`, string(body))
+	})
+}
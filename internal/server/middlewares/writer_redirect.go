@@ -0,0 +1,19 @@
+package middlewares
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// WriterRedirectMiddleware redirects the requests to the writer instance (used to handle the mutating routes on the
+// followers). A 307 status code is used, so the clients are replaying the same method & body against the writer.
+func WriterRedirectMiddleware(writerURL string) fiber.Handler {
+	writerURL = strings.TrimSuffix(writerURL, "/")
+	return func(c *fiber.Ctx) error {
+		location := writerURL + c.OriginalURL()
+		log.Ctx(c.UserContext()).Debug().Str("location", location).Msg("Follower instance, redirecting the request to the writer")
+		return c.Redirect(location, fiber.StatusTemporaryRedirect)
+	}
+}
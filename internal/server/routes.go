@@ -1,23 +1,93 @@
 package server
 
 import (
+	"slices"
+	"time"
+
 	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/ankorstore/mq-lease-service/internal/metrics"
 	"github.com/ankorstore/mq-lease-service/internal/server/handlers"
+	"github.com/ankorstore/mq-lease-service/internal/server/middlewares"
 	"github.com/ankorstore/mq-lease-service/internal/storage"
 	"github.com/gofiber/fiber/v2"
+	"k8s.io/utils/clock"
 )
 
-func RegisterRoutes(app *fiber.App, orchestrator lease.ProviderOrchestrator) {
-	app.Get("/", handlers.ProviderList(orchestrator)).Name("providers.list")
+// idempotencyKeyLifetime is the duration during which a response is replayed for the same idempotency key & body
+const idempotencyKeyLifetime = time.Minute
+
+// RegisterRoutes registers the API routes. The readAuth & writeAuth handlers are respectively guarding the read-only
+// and the mutating routes, the latter being rate limited by the writeRateLimit handler. allowEventTime allows the
+// acquire/release requests to carry their own event time. logBodies enables the (debug level) logging of the provider
+// routes request bodies. maxStabilizeDuration caps the stabilize duration set at runtime. clk is expiring the replayed
+// responses of the idempotent routes.
+func RegisterRoutes(app *fiber.App, orchestrator lease.ProviderOrchestrator, readAuth fiber.Handler, writeAuth fiber.Handler, writeRateLimit fiber.Handler, allowEventTime bool, logBodies bool, maxStabilizeDuration time.Duration, clk clock.PassiveClock) {
+	app.Get("/", readAuth, handlers.ProviderList(orchestrator)).Name("providers.list")
+
+	// the providers with a queue name are served under their base ref (same routes, same names)
+	for _, prefix := range []string{"/:owner/:repo/:baseRef", "/:owner/:repo/:baseRef/queues/:queue"} {
+		registerProviderRoutes(app.Group(prefix).Name("provider."), orchestrator, readAuth, writeAuth, writeRateLimit, allowEventTime, logBodies, maxStabilizeDuration, clk)
+	}
+}
+
+// registerProviderRoutes registers the provider-scoped routes. Their middlewares are part of each route (instead of
+// being used on the group), as the group prefixes are overlapping. The rate limit of the mutating routes runs after
+// their auth, which identifies the caller.
+func registerProviderRoutes(providerRoutes fiber.Router, orchestrator lease.ProviderOrchestrator, readAuth fiber.Handler, writeAuth fiber.Handler, writeRateLimit fiber.Handler, allowEventTime bool, logBodies bool, maxStabilizeDuration time.Duration, clk clock.PassiveClock) {
+	var providerMiddlewares []fiber.Handler
+	if logBodies {
+		providerMiddlewares = append(providerMiddlewares, middlewares.BodyLoggerMiddleware())
+	}
+	providerMiddlewares = append(providerMiddlewares, middlewares.AcquiredSHAHeaderMiddleware(orchestrator), middlewares.APIVersionMiddleware())
+	withMiddlewares := func(routeHandlers ...fiber.Handler) []fiber.Handler {
+		return append(slices.Clone(providerMiddlewares), routeHandlers...)
+	}
 
-	providerRoutes := app.Group("/:owner/:repo/:baseRef").Name("provider.")
-	providerRoutes.Post("/acquire", handlers.Acquire(orchestrator)).Name("acquire")
-	providerRoutes.Post("/release", handlers.Release(orchestrator)).Name("release")
-	providerRoutes.Get("/", handlers.ProviderDetails(orchestrator)).Name("show")
-	providerRoutes.Delete("/", handlers.ProviderClear(orchestrator)).Name("clear")
+	providerRoutes.Post("/acquire", withMiddlewares(writeAuth, writeRateLimit, middlewares.IdempotencyMiddleware(idempotencyKeyLifetime, clk), handlers.Acquire(orchestrator, allowEventTime))...).Name("acquire")
+	providerRoutes.Post("/release", withMiddlewares(writeAuth, writeRateLimit, handlers.Release(orchestrator, allowEventTime))...).Name("release")
+	providerRoutes.Post("/heartbeat", withMiddlewares(writeAuth, writeRateLimit, handlers.Heartbeat(orchestrator))...).Name("heartbeat")
+	providerRoutes.Get("/", withMiddlewares(readAuth, handlers.ProviderDetails(orchestrator))...).Name("show")
+	providerRoutes.Get("/stats", withMiddlewares(readAuth, handlers.ProviderStats(orchestrator))...).Name("stats")
+	providerRoutes.Get("/history", withMiddlewares(readAuth, handlers.ProviderHistory(orchestrator))...).Name("history")
+	providerRoutes.Get("/statuses", withMiddlewares(readAuth, handlers.ProviderStatuses(orchestrator))...).Name("statuses")
+	providerRoutes.Get("/requests/:headSha/timeline", withMiddlewares(readAuth, handlers.ProviderTimeline(orchestrator))...).Name("request.timeline")
+	providerRoutes.Get("/winner", withMiddlewares(readAuth, handlers.ProviderWinner(orchestrator))...).Name("winner")
+	providerRoutes.Delete("/", withMiddlewares(writeAuth, writeRateLimit, handlers.ProviderClear(orchestrator))...).Name("clear")
+	providerRoutes.Post("/freeze", withMiddlewares(writeAuth, writeRateLimit, handlers.ProviderFreeze(orchestrator, true))...).Name("freeze")
+	providerRoutes.Post("/unfreeze", withMiddlewares(writeAuth, writeRateLimit, handlers.ProviderFreeze(orchestrator, false))...).Name("unfreeze")
+	providerRoutes.Patch("/config", withMiddlewares(writeAuth, writeRateLimit, handlers.ProviderConfigUpdate(orchestrator, maxStabilizeDuration))...).Name("config.update")
 }
 
-func RegisterK8sProbesRoutes(app *fiber.App, storage storage.Storage[*lease.ProviderState]) {
+func RegisterK8sProbesRoutes(app *fiber.App, storage storage.Storage[*lease.ProviderState], orchestrator lease.ProviderOrchestrator) {
 	app.Get("/k8s/liveness", handlers.Liveness()).Name("k8s.liveness")
-	app.Get("/k8s/readiness", handlers.Readiness(storage)).Name("k8s.readiness")
+	app.Get("/k8s/readiness", handlers.Readiness(storage, orchestrator)).Name("k8s.readiness")
+	// both probes at once, for the monitoring tools expecting a single health endpoint
+	app.Get(healthPath, handlers.Health(storage, orchestrator)).Name("healthz")
+}
+
+func RegisterMetaRoutes(app *fiber.App) {
+	app.Get("/_meta/version", handlers.Version()).Name("meta.version")
+	app.Get("/_meta/openapi.json", handlers.OpenAPI()).Name("meta.openapi")
+}
+
+// RegisterAdminRoutes registers the administration routes, guarded by the given auth handler (the callers restricted to
+// some repositories being forbidden). The mutating ones are guarded by the given write handler instead (redirecting
+// them to the writer in follower mode).
+func RegisterAdminRoutes(app *fiber.App, orchestrator lease.ProviderOrchestrator, storage storage.Storage[*lease.ProviderState], auth fiber.Handler, write fiber.Handler) {
+	// the callers restricted to some repositories can't act on the whole instance
+	unscoped := middlewares.UnscopedOnlyMiddleware()
+	adminRoutes := app.Group("/_admin").Name("admin.")
+	adminRoutes.Post("/drain", write, unscoped, handlers.Drain(orchestrator)).Name("drain")
+	adminRoutes.Delete("/drain", write, unscoped, handlers.Undrain(orchestrator)).Name("undrain")
+	adminRoutes.Get("/acquired", auth, unscoped, handlers.AcquiredLeases(orchestrator)).Name("acquired")
+	adminRoutes.Get("/hydration", auth, unscoped, handlers.HydrationStatuses(orchestrator)).Name("hydration")
+	adminRoutes.Get("/export", auth, unscoped, handlers.Export(orchestrator)).Name("export")
+	adminRoutes.Post("/import", write, unscoped, handlers.Import(orchestrator)).Name("import")
+	adminRoutes.Delete("/state", write, unscoped, handlers.ClearAll(orchestrator, storage)).Name("state.clear")
+}
+
+// RegisterMetricsResetRoute registers the metrics reset administration route (meant for the test environments only),
+// guarded by the given auth handler
+func RegisterMetricsResetRoute(app *fiber.App, metricsService metrics.Metrics, auth fiber.Handler) {
+	app.Post("/_admin/metrics/reset", auth, middlewares.UnscopedOnlyMiddleware(), handlers.ResetMetrics(metricsService)).Name("admin.metrics.reset")
 }
@@ -5,18 +5,23 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ankorstore/mq-lease-service/internal/config"
+	"github.com/ankorstore/mq-lease-service/internal/config/server/latest"
 	"github.com/ankorstore/mq-lease-service/internal/lease"
 	"github.com/ankorstore/mq-lease-service/internal/metrics"
+	"github.com/ankorstore/mq-lease-service/internal/server/handlers"
 	"github.com/ankorstore/mq-lease-service/internal/server/middlewares"
 	"github.com/ankorstore/mq-lease-service/internal/storage"
 	"github.com/ankorstore/mq-lease-service/internal/version"
 	"github.com/gofiber/fiber/v2"
-	fiberbasicauth "github.com/gofiber/fiber/v2/middleware/basicauth"
+	fibercompress "github.com/gofiber/fiber/v2/middleware/compress"
+	fibercors "github.com/gofiber/fiber/v2/middleware/cors"
 	fiberrecover "github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
@@ -24,6 +29,26 @@ import (
 	"k8s.io/utils/clock"
 )
 
+const (
+	metricsPath = "/metrics"
+	healthPath  = "/healthz"
+	// defaultBodyLimit is the max request body size (in bytes) used when none is provided
+	defaultBodyLimit = 1024 * 1024
+	// defaultFollowerRefreshInterval is the interval between 2 state re-hydrations in follower mode, when none is provided
+	defaultFollowerRefreshInterval = 5 * time.Second
+)
+
+// Mode defines the role of the server instance
+type Mode string
+
+const (
+	// ModeWriter is the default mode: the instance handles all the requests
+	ModeWriter Mode = "writer"
+	// ModeFollower serves the read-only routes from its (periodically re-hydrated) read-only storage, and redirects the
+	// mutating ones to the writer instance
+	ModeFollower Mode = "follower"
+)
+
 type Server interface {
 	// Run the server
 	Run(ctx context.Context) error
@@ -43,16 +68,83 @@ type NewOpts struct {
 	ConfigPath         string
 	PersistentStateDir string
 	Clock              clock.PassiveClock
+	// Compression enables gzip/deflate/brotli compression of the API responses (based on the Accept-Encoding header)
+	Compression bool
+	// BodyLimit is the max request body size (in bytes). Bigger requests are rejected with a 413 status code.
+	BodyLimit int
+	// Mode is the role of the instance (defaults to ModeWriter)
+	Mode Mode
+	// WriterURL is the base URL of the writer instance, the mutating requests are redirected to (follower mode only)
+	WriterURL string
+	// FollowerRefreshInterval is the interval between 2 state re-hydrations (follower mode only)
+	FollowerRefreshInterval time.Duration
+	// StorageEncoding is the format the provider states are written with in the storage (defaults to JSON)
+	StorageEncoding lease.StorageEncoding
+	// AllowEventTime allows the acquire/release requests to carry an `event_time`, used instead of the current time
+	// (to replay historical events, should not be enabled on a production instance)
+	AllowEventTime bool
+	// StorageGCInterval is the interval between 2 storage value log GC runs (disabled if not positive)
+	StorageGCInterval time.Duration
+	// StorageOpenRetries is the number of extra attempts to open the storage on startup, StorageOpenRetryInterval the
+	// delay before the first one (doubled for each of the next ones)
+	StorageOpenRetries       int
+	StorageOpenRetryInterval time.Duration
+	// LogBodies logs (at debug level) the bodies of the requests made to the provider routes, along with the response
+	// status (the auth-related fields are redacted)
+	LogBodies bool
+	// TLSCertFile and TLSKeyFile are the paths of the certificate and private key used to serve HTTPS (plain HTTP is
+	// served when unset)
+	TLSCertFile string
+	TLSKeyFile  string
+	// RequestTimeout bounds the time spent handling a request, a 503 is returned once exceeded (disabled if not positive)
+	RequestTimeout time.Duration
+	// InMemoryStorage keeps the states in an in-memory storage (PersistentStateDir is then ignored): they are lost on
+	// shutdown, for the tests and the ephemeral runs (writer mode only)
+	InMemoryStorage bool
+	// StorageKeyPrefix namespaces the keys of the states in the storage, so that several instances can share it
+	StorageKeyPrefix string
+	// StorageBackupDir is the directory a backup of the storage is written to when it's closed (disabled if empty, not
+	// supported in follower mode)
+	StorageBackupDir string
+	// AllowMetricsReset exposes the `POST /_admin/metrics/reset` route, resetting the application metrics (to isolate
+	// the test cases asserting on them, should not be enabled on a production instance)
+	AllowMetricsReset bool
 }
 
 // New returns a server instance
 func New(opts NewOpts) Server {
+	if opts.BodyLimit <= 0 {
+		opts.BodyLimit = defaultBodyLimit
+	}
+	if opts.Mode == "" {
+		opts.Mode = ModeWriter
+	}
+	if opts.FollowerRefreshInterval <= 0 {
+		opts.FollowerRefreshInterval = defaultFollowerRefreshInterval
+	}
 	return &serverImpl{
 		waitReady:          make(chan struct{}, 1),
 		port:               opts.Port,
 		configPath:         opts.ConfigPath,
 		persistentStateDir: opts.PersistentStateDir,
 		clock:              opts.Clock,
+		compression:        opts.Compression,
+		bodyLimit:          opts.BodyLimit,
+		mode:               opts.Mode,
+		writerURL:          opts.WriterURL,
+		refreshInterval:    opts.FollowerRefreshInterval,
+		storageEncoding:    opts.StorageEncoding,
+		allowEventTime:     opts.AllowEventTime,
+		logBodies:          opts.LogBodies,
+		allowMetricsReset:  opts.AllowMetricsReset,
+		storageGCInterval:  opts.StorageGCInterval,
+		inMemoryStorage:    opts.InMemoryStorage,
+		storageOpenRetry:   storage.WithOpenRetry(opts.StorageOpenRetries, opts.StorageOpenRetryInterval),
+		storageKeyPrefix:   opts.StorageKeyPrefix,
+		storageBackup:      storage.WithBackupOnClose(opts.StorageBackupDir),
+		tlsCertFile:        opts.TLSCertFile,
+		tlsKeyFile:         opts.TLSKeyFile,
+		requestTimeout:     opts.RequestTimeout,
 	}
 }
 
@@ -65,6 +157,23 @@ type serverImpl struct {
 	app                *fiber.App
 	clock              clock.PassiveClock
 	orchestrator       lease.ProviderOrchestrator
+	compression        bool
+	bodyLimit          int
+	mode               Mode
+	writerURL          string
+	refreshInterval    time.Duration
+	storageEncoding    lease.StorageEncoding
+	allowEventTime     bool
+	logBodies          bool
+	allowMetricsReset  bool
+	storageGCInterval  time.Duration
+	inMemoryStorage    bool
+	storageOpenRetry   storage.Option
+	storageKeyPrefix   string
+	storageBackup      storage.Option
+	tlsCertFile        string
+	tlsKeyFile         string
+	requestTimeout     time.Duration
 }
 
 func (s *serverImpl) WaitReady(ctx context.Context) bool {
@@ -80,8 +189,56 @@ func (s *serverImpl) setup(ctx context.Context) error {
 	// Make sure we mark the server as ready before returning (this does not cover errors, in the setup process, they need to be checked separately)
 	defer close(s.waitReady)
 
-	// Setup state storage
-	s.storage = storage.New[*lease.ProviderState](ctx, s.persistentStateDir)
+	switch s.mode {
+	case ModeWriter:
+	case ModeFollower:
+		if s.writerURL == "" {
+			return errors.New("a writer URL is required in follower mode")
+		}
+		if s.inMemoryStorage {
+			return errors.New("the in-memory storage can't be used in follower mode (there is no writer storage to follow)")
+		}
+	default:
+		return fmt.Errorf("unknown server mode %q", s.mode)
+	}
+	if (s.tlsCertFile == "") != (s.tlsKeyFile == "") {
+		return errors.New("both a TLS certificate and a TLS key are required to serve HTTPS")
+	}
+	if err := storage.ValidateKeyPrefix(s.storageKeyPrefix); err != nil {
+		return err
+	}
+
+	// Load config
+	cfg, err := config.LoadServerConfig(s.configPath)
+	if err != nil {
+		return fmt.Errorf("failed loading configuration: %w", err)
+	}
+	if maxProviders := cfg.GetMaxProviders(); len(cfg.Repositories) > maxProviders {
+		return fmt.Errorf("too many repositories configured: %d, the limit is %d (see max_providers)", len(cfg.Repositories), maxProviders)
+	}
+	maxStabilizeDuration := cfg.GetMaxStabilizeDuration()
+	for _, repository := range cfg.Repositories {
+		if repository.StabilizeDuration > maxStabilizeDuration {
+			return fmt.Errorf("stabilize duration of %s/%s@%s is too long: %ds, the limit is %ds (see max_stabilize_duration_seconds)", repository.Owner, repository.Name, repository.BaseRef, repository.StabilizeDuration, maxStabilizeDuration)
+		}
+		if err := validateRepository(repository); err != nil {
+			return fmt.Errorf("%s/%s@%s: %w", repository.Owner, repository.Name, repository.BaseRef, err)
+		}
+	}
+	if err := validateDynamicProviders(cfg.DynamicProviders, maxStabilizeDuration); err != nil {
+		return err
+	}
+
+	// Setup state storage (followers are never writing in it)
+	switch {
+	case s.mode == ModeFollower:
+		s.storage = storage.NewReadOnly[*lease.ProviderState](ctx, s.persistentStateDir, s.storageOpenRetry, storage.WithKeyPrefix(s.storageKeyPrefix))
+	case s.inMemoryStorage:
+		log.Ctx(ctx).Warn().Msg("Using an in-memory storage, the states will be lost on shutdown")
+		s.storage = storage.NewInMemory[*lease.ProviderState](ctx, storage.WithKeyPrefix(s.storageKeyPrefix), s.storageBackup)
+	default:
+		s.storage = storage.New[*lease.ProviderState](ctx, s.persistentStateDir, storage.WithGCInterval(s.storageGCInterval), s.storageOpenRetry, storage.WithKeyPrefix(s.storageKeyPrefix), s.storageBackup)
+	}
 	if err := s.storage.Init(); err != nil {
 		return fmt.Errorf("failed to init storage: %w", err)
 	}
@@ -97,12 +254,6 @@ func (s *serverImpl) setup(ctx context.Context) error {
 		}
 	}()
 
-	// Load config
-	cfg, err := config.LoadServerConfig(s.configPath)
-	if err != nil {
-		return fmt.Errorf("failed loading configuration: %w", err)
-	}
-
 	// Metrics
 	promRegistry := prometheus.NewRegistry()
 	metricsServ := metrics.New(metrics.NewOpts{
@@ -111,26 +262,46 @@ func (s *serverImpl) setup(ctx context.Context) error {
 		PromGatherer:   promRegistry,
 	})
 	metricsServ.AddDefaultCollectors()
+	s.storage = storage.WithMetrics(s.storage, metricsServ)
 
 	// Lease provider orchestrator (handling all repos merge queue leases)
 	s.orchestrator = lease.NewProviderOrchestrator(lease.NewProviderOrchestratorOpts{
-		Repositories: cfg.Repositories,
-		Clock:        s.clock,
-		Storage:      s.storage,
-		Metrics:      metricsServ,
+		Repositories:     cfg.Repositories,
+		Clock:            s.clock,
+		Storage:          s.storage,
+		Metrics:          metricsServ,
+		StorageEncoding:  s.storageEncoding,
+		OwnerLeases:      cfg.OwnerLeases,
+		DynamicProviders: cfg.DynamicProviders,
+		MaxProviders:     cfg.GetMaxProviders(),
 	})
+	// a single line listing the active providers, to confirm the configuration on boot
+	log.Ctx(ctx).Info().
+		Int("provider_count", len(cfg.Repositories)).
+		Array("providers", latest.RepositoriesSummary(cfg.Repositories)).
+		Msg("Lease providers loaded")
 	// tries to hydrate the states of managed providers from the storage
 	if err := s.orchestrator.HydrateFromState(ctx); err != nil {
 		return fmt.Errorf("failed to hydrate orchestrator providers from state: %w", err)
 	}
 
 	// Fiber app configuration
-	s.app = fiber.New(fiber.Config{DisableStartupMessage: true})
+	s.app = fiber.New(fiber.Config{
+		DisableStartupMessage: true,
+		BodyLimit:             s.bodyLimit,
+		ErrorHandler:          handlers.ErrorHandler(s.bodyLimit),
+	})
+	metricsAuth, err := metricsAuthMiddleware(ctx, cfg.AuthConfig)
+	if err != nil {
+		return err
+	}
 	s.app.Use(middlewares.PrometheusMiddleware(
 		s.app,
 		metricsServ,
-		"/metrics",
+		metricsPath,
+		metricsAuth,
 	))
+	s.app.Use(middlewares.RequestIDMiddleware())
 	s.app.Use(middlewares.LoggerMiddleware(log.Ctx(ctx)))
 	// recover middleware allow us to avoid a panic (happening in middlewares or http handlers) to stop the server
 	// this will result in a 500, but the server will continue to accept requests.
@@ -141,29 +312,237 @@ func (s *serverImpl) setup(ctx context.Context) error {
 		},
 	}))
 
-	// Configure basic auth if needed
-	if cfg.AuthConfig != nil && cfg.AuthConfig.BasicAuth != nil {
-		log.Ctx(ctx).Info().Msg("Basic auth enabled")
-		s.app.Use(fiberbasicauth.New(fiberbasicauth.Config{
-			Users: cfg.AuthConfig.BasicAuth.Users,
+	// Bound the time spent handling a request, if enabled
+	if s.requestTimeout > 0 {
+		log.Ctx(ctx).Info().Dur("request_timeout", s.requestTimeout).Msg("Request timeout enabled")
+		s.app.Use(middlewares.TimeoutMiddleware(s.requestTimeout))
+	}
+
+	// Compress responses if enabled (the metrics endpoint is left untouched, the prometheus handler negotiates its own encoding)
+	if s.compression {
+		log.Ctx(ctx).Info().Msg("Response compression enabled")
+		s.app.Use(fibercompress.New(fibercompress.Config{
+			Next: func(c *fiber.Ctx) bool {
+				return c.Path() == metricsPath
+			},
 		}))
 	}
 
+	// CORS headers on the API routes, if enabled (the internal routes are never meant to be called from a browser)
+	if cfg.CORSConfig.IsEnabled() {
+		log.Ctx(ctx).Info().Strs("allowed_origins", cfg.CORSConfig.AllowedOrigins).Msg("CORS enabled")
+		s.app.Use(fibercors.New(fibercors.Config{
+			Next: func(c *fiber.Ctx) bool {
+				return isInternalPath(c.Path())
+			},
+			AllowOrigins:  strings.Join(cfg.CORSConfig.AllowedOrigins, ","),
+			AllowMethods:  strings.Join(cfg.CORSConfig.GetAllowedMethods(), ","),
+			ExposeHeaders: strings.Join([]string{handlers.PollIntervalHeaderName, middlewares.AcquiredSHAHeaderName, middlewares.RequestIDHeaderName, middlewares.APIVersionHeaderName, fiber.HeaderETag}, ","),
+		}))
+	}
+
+	readAuth := authMiddleware(ctx, cfg.AuthConfig, latest.AuthProtectRead)
+	writeAuth := authMiddleware(ctx, cfg.AuthConfig, latest.AuthProtectWrite)
+	// followers are not handling the mutating routes at all, the writer is in charge of them (and of their auth)
+	writeHandler := writeAuth
+	if s.mode == ModeFollower {
+		log.Ctx(ctx).Info().Str("writer_url", s.writerURL).Msg("Follower mode enabled, mutating requests are redirected to the writer")
+		writeHandler = middlewares.WriterRedirectMiddleware(s.writerURL)
+	}
+
+	writeRateLimit, err := rateLimitMiddleware(ctx, cfg.RateLimitConfig)
+	if err != nil {
+		return err
+	}
+
 	// register k8s probes handlers
-	RegisterK8sProbesRoutes(s.app, s.storage)
-	// register API routes on the fiber app
-	RegisterRoutes(s.app, s.orchestrator)
+	RegisterK8sProbesRoutes(s.app, s.storage, s.orchestrator)
+	// register meta routes (build info...)
+	RegisterMetaRoutes(s.app)
+	// register admin routes (guarded by the auth of the mutating routes, if configured)
+	RegisterAdminRoutes(s.app, s.orchestrator, s.storage, writeAuth, writeHandler)
+	if s.allowMetricsReset {
+		log.Ctx(ctx).Warn().Msg("Metrics reset route enabled")
+		RegisterMetricsResetRoute(s.app, metricsServ, writeAuth)
+	}
+	// register API routes on the fiber app (guarded by the auth, if configured)
+	if s.allowEventTime {
+		log.Ctx(ctx).Warn().Msg("Event times are allowed on the acquire/release requests")
+	}
+	if s.logBodies {
+		log.Ctx(ctx).Info().Msg("Request bodies logging enabled (debug level)")
+	}
+	RegisterRoutes(s.app, s.orchestrator, readAuth, writeHandler, writeRateLimit, s.allowEventTime, s.logBodies, time.Duration(maxStabilizeDuration)*time.Second, s.clock)
+
+	return nil
+}
+
+// runFollowerRefresh periodically reloads the read-only storage and re-hydrates the providers states from it, until
+// the context is cancelled (follower mode only)
+func (s *serverImpl) runFollowerRefresh(ctx context.Context) {
+	reloader, ok := s.storage.(storage.Reloader)
+	if s.mode != ModeFollower || !ok {
+		return
+	}
+
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := reloader.Reload(); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to reload the storage")
+				continue
+			}
+			if err := s.orchestrator.HydrateFromState(ctx); err != nil {
+				log.Ctx(ctx).Error().Err(err).Msg("Failed to re-hydrate orchestrator providers from state")
+			}
+		}
+	}
+}
 
+// authMiddleware returns the middleware guarding the given route group. If the group isn't protected (or no auth is
+// configured), it's letting all the requests through.
+func authMiddleware(ctx context.Context, cfg *latest.AuthConfig, group string) fiber.Handler {
+	passThrough := func(c *fiber.Ctx) error {
+		return c.Next()
+	}
+	if cfg == nil || !cfg.IsProtected(group) {
+		return passThrough
+	}
+	var users map[string]string
+	if cfg.BasicAuth != nil {
+		users = cfg.BasicAuth.Users
+	}
+	if len(users) == 0 && len(cfg.APIKeys) == 0 {
+		return passThrough
+	}
+
+	log.Ctx(ctx).
+		Info().
+		Str("route_group", group).
+		Bool("basic_auth", len(users) > 0).
+		Bool("api_keys_auth", len(cfg.APIKeys) > 0).
+		Msg("Auth enabled")
+	return middlewares.AuthMiddleware(users, cfg.APIKeys, cfg.Scopes)
+}
+
+// validateDynamicProviders checks the allowlist patterns and the settings of the dynamically created providers (if
+// enabled)
+func validateDynamicProviders(cfg *latest.DynamicProvidersConfig, maxStabilizeDuration int) error {
+	if !cfg.IsEnabled() {
+		return nil
+	}
+	for _, pattern := range cfg.Allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid dynamic providers allowlist pattern %q: %w", pattern, err)
+		}
+	}
+	defaults := cfg.GetRepository("", "", "")
+	if defaults.StabilizeDuration > maxStabilizeDuration {
+		return fmt.Errorf("stabilize duration of the dynamic providers is too long: %ds, the limit is %ds (see max_stabilize_duration_seconds)", defaults.StabilizeDuration, maxStabilizeDuration)
+	}
+	if err := validateRepository(defaults); err != nil {
+		return fmt.Errorf("dynamic providers: %w", err)
+	}
 	return nil
 }
 
+// validateRepository checks the provider key parts of a repository are unambiguous, and its modes are known ones (an
+// unknown value would otherwise silently fall back to the default)
+func validateRepository(repository *latest.GithubRepositoryConfig) error {
+	if err := lease.ValidateKeyParts(repository.Owner, repository.Name, repository.BaseRef, repository.Queue); err != nil {
+		return err
+	}
+	if err := lease.WinnerSelection(repository.WinnerSelection).Validate(); err != nil {
+		return err
+	}
+	if err := lease.PriorityFromRef(repository.PriorityFromRef).Validate(); err != nil {
+		return err
+	}
+	if err := lease.StabilizeFrom(repository.StabilizeFrom).Validate(); err != nil {
+		return err
+	}
+	return lease.CompletedResponse(repository.CompletedResponse).Validate()
+}
+
+// rateLimitMiddleware returns the middleware limiting the requests of each client to the mutating provider routes. If
+// no rate limit is configured, it's letting all the requests through.
+func rateLimitMiddleware(ctx context.Context, cfg *latest.RateLimitConfig) (fiber.Handler, error) {
+	if !cfg.IsEnabled() {
+		return func(c *fiber.Ctx) error {
+			return c.Next()
+		}, nil
+	}
+	key := cfg.GetKey()
+	if key != latest.RateLimitKeyIP && key != latest.RateLimitKeyCredential {
+		return nil, fmt.Errorf("invalid rate limit key %q (expected %s or %s)", key, latest.RateLimitKeyIP, latest.RateLimitKeyCredential)
+	}
+
+	log.Ctx(ctx).
+		Info().
+		Int("max", cfg.Max).
+		Int("window_seconds", cfg.GetWindow()).
+		Str("key", key).
+		Msg("Rate limit enabled")
+	return middlewares.RateLimitMiddleware(cfg.Max, time.Duration(cfg.GetWindow())*time.Second, key == latest.RateLimitKeyCredential), nil
+}
+
+// isInternalPath tells if the path belongs to the internal routes (metrics, k8s probes, meta and admin routes), as
+// opposed to the API routes
+func isInternalPath(path string) bool {
+	if path == metricsPath || path == healthPath {
+		return true
+	}
+	for _, prefix := range []string{"/k8s/", "/_meta/", "/_admin/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsAuthMiddleware returns the middleware guarding the metrics endpoint, depending on the configured metrics auth
+// mode (independent of the API routes protection).
+func metricsAuthMiddleware(ctx context.Context, cfg *latest.AuthConfig) (fiber.Handler, error) {
+	mode := cfg.GetMetricsAuth()
+	switch mode {
+	case latest.MetricsAuthNone:
+		return func(c *fiber.Ctx) error {
+			return c.Next()
+		}, nil
+	case latest.MetricsAuthBasic:
+		if cfg.BasicAuth == nil || len(cfg.BasicAuth.Users) == 0 {
+			return nil, fmt.Errorf("metrics auth %q requires some basic auth users", mode)
+		}
+		log.Ctx(ctx).Info().Str("metrics_auth", mode).Msg("Metrics auth enabled")
+		return middlewares.AuthMiddleware(cfg.BasicAuth.Users, nil, nil), nil
+	case latest.MetricsAuthToken:
+		if len(cfg.APIKeys) == 0 {
+			return nil, fmt.Errorf("metrics auth %q requires some API keys", mode)
+		}
+		log.Ctx(ctx).Info().Str("metrics_auth", mode).Msg("Metrics auth enabled")
+		return middlewares.AuthMiddleware(nil, cfg.APIKeys, nil), nil
+	default:
+		return nil, fmt.Errorf("invalid metrics auth %q (expected %s, %s or %s)", mode, latest.MetricsAuthNone, latest.MetricsAuthBasic, latest.MetricsAuthToken)
+	}
+}
+
 // RunTest runs the server in test mode (actually does not listen)
 func (s *serverImpl) RunTest(ctx context.Context) error {
 	err := s.setup(ctx)
 	if err != nil {
 		return err
 	}
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		s.runFollowerRefresh(ctx)
+	}()
 	<-ctx.Done()
+	<-refreshDone
 	return s.storage.Close()
 }
 
@@ -177,11 +556,16 @@ func (s *serverImpl) Run(ctx context.Context) error {
 	// Run Server and shtudown on context cancel
 	grp, runCtx := errgroup.WithContext(ctx)
 	grp.Go(func() error {
-		log.Ctx(ctx).Info().Int("port", s.port).Msg("Starting server")
-		return s.app.Listen(":" + strconv.Itoa(s.port))
+		return s.listen(ctx)
 	})
+	refreshDone := make(chan struct{})
+	go func() {
+		defer close(refreshDone)
+		s.runFollowerRefresh(runCtx)
+	}()
 	grp.Go(func() error {
 		<-runCtx.Done()
+		<-refreshDone
 
 		log.Ctx(ctx).Warn().Msg("Shutting down fiber app")
 		shutDownErr := s.app.ShutdownWithTimeout(10 * time.Second)
@@ -195,6 +579,17 @@ func (s *serverImpl) Run(ctx context.Context) error {
 	return grp.Wait()
 }
 
+// listen starts serving the fiber app, over HTTPS when a TLS certificate and key are configured
+func (s *serverImpl) listen(ctx context.Context) error {
+	addr := ":" + strconv.Itoa(s.port)
+	if s.tlsCertFile != "" {
+		log.Ctx(ctx).Info().Int("port", s.port).Str("tls_cert", s.tlsCertFile).Msg("Starting server (TLS)")
+		return s.app.ListenTLS(addr, s.tlsCertFile, s.tlsKeyFile)
+	}
+	log.Ctx(ctx).Info().Int("port", s.port).Msg("Starting server")
+	return s.app.Listen(addr)
+}
+
 // Test should be called to test an API endpoint. This will relay the call to fiber app.Test() method. (TESTING)
 func (s *serverImpl) Test(req *http.Request, msTimeout ...int) (*http.Response, error) {
 	return s.app.Test(req, msTimeout...)
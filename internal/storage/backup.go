@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/rs/zerolog/log"
+)
+
+// backupTimeFormat is the format of the time the backup files are named after (sorting them chronologically)
+const backupTimeFormat = "20060102T150405Z"
+
+// restoreMaxPendingWrites is the max number of pending writes while loading a backup
+const restoreMaxPendingWrites = 256
+
+// backup writes a full backup of the DB to a new timestamped file of the backup directory (the lock has to be held).
+// The backup is written to a temporary file first, so that a partial backup is never mistaken for a complete one.
+func (s *storageImpl[T]) backup() error {
+	if err := os.MkdirAll(s.backupDir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.backupDir, ".backup-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op once renamed
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := s.db.Backup(tmp, 0); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.backupDir, fmt.Sprintf("backup-%s.bak", time.Now().UTC().Format(backupTimeFormat)))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Ctx(s.ctx).Info().Str("path", path).Msg("Storage backed up")
+	return nil
+}
+
+// ErrNotEmpty is returned when restoring a backup into a DB which already holds some objects, without overwriting it
+var ErrNotEmpty = errors.New("storage is not empty")
+
+// Restore loads a backup written on close (see WithBackupOnClose) into the DB of the given directory (created if
+// needed). A DB holding some objects is only overwritten (all its objects being dropped first) when asked to, ErrNotEmpty
+// is returned otherwise.
+func Restore(ctx context.Context, persistentStateDir string, backup io.Reader, overwrite bool) (err error) {
+	options := badger.DefaultOptions(persistentStateDir)
+	options.Logger = newBadgerLogger(ctx)
+	db, err := badger.Open(options)
+	if err != nil {
+		return fmt.Errorf("failed to open badger connection: %w", err)
+	}
+	defer func() {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close badger connection: %w", closeErr)
+		}
+	}()
+
+	empty, err := isEmpty(db)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		if !overwrite {
+			return ErrNotEmpty
+		}
+		if err := db.DropAll(); err != nil {
+			return fmt.Errorf("failed to drop the existing objects: %w", err)
+		}
+	}
+	if err := load(db, backup); err != nil {
+		return fmt.Errorf("failed to load the backup: %w", err)
+	}
+	return nil
+}
+
+// load loads the backup into the DB, badger panicking on some malformed backups
+func load(db *badger.DB, backup io.Reader) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed backup: %v", r)
+		}
+	}()
+	return db.Load(backup, restoreMaxPendingWrites)
+}
+
+// isEmpty tells if the DB doesn't hold any object (whatever its namespace)
+func isEmpty(db *badger.DB) (bool, error) {
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
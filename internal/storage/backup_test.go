@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage_BackupOnClose(t *testing.T) {
+	ctx := context.Background()
+	backupDir := filepath.Join(t.TempDir(), "backups")
+	s := New[*testObject](ctx, t.TempDir(), WithBackupOnClose(backupDir))
+	assert.NoError(t, s.Init())
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, s.Save(ctx, &testObject{id: "key-" + strconv.Itoa(i), value: "value-" + strconv.Itoa(i)}))
+	}
+	assert.NoError(t, s.Close())
+
+	// a single complete backup is left behind
+	entries, err := os.ReadDir(backupDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	backups, err := filepath.Glob(filepath.Join(backupDir, "backup-*.bak"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	// restore it into a fresh DB
+	restoredDir := t.TempDir()
+	f, err := os.Open(backups[0])
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, Restore(ctx, restoredDir, f, false))
+
+	restored := New[*testObject](ctx, restoredDir)
+	assert.NoError(t, restored.Init())
+	defer func() {
+		assert.NoError(t, restored.Close())
+	}()
+	for i := 0; i < 10; i++ {
+		obj := &testObject{id: "key-" + strconv.Itoa(i)}
+		assert.NoError(t, restored.Hydrate(ctx, obj))
+		assert.Equal(t, "value-"+strconv.Itoa(i), obj.value)
+	}
+}
+
+func TestStorage_BackupOnClose_ReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// the DB has to exist to be opened read-only
+	writer := New[*testObject](ctx, dir)
+	assert.NoError(t, writer.Init())
+	assert.NoError(t, writer.Close())
+
+	backupDir := filepath.Join(t.TempDir(), "backups")
+	s := NewReadOnly[*testObject](ctx, dir, WithBackupOnClose(backupDir))
+	assert.NoError(t, s.Init())
+	assert.NoError(t, s.Close())
+	_, err := os.Stat(backupDir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRestore_NotEmpty(t *testing.T) {
+	ctx := context.Background()
+	backupDir := t.TempDir()
+	source := New[*testObject](ctx, t.TempDir(), WithBackupOnClose(backupDir))
+	assert.NoError(t, source.Init())
+	assert.NoError(t, source.Save(ctx, &testObject{id: "restored", value: "value"}))
+	assert.NoError(t, source.Close())
+	backups, err := filepath.Glob(filepath.Join(backupDir, "backup-*.bak"))
+	assert.NoError(t, err)
+	assert.Len(t, backups, 1)
+	restore := func(dir string, overwrite bool) error {
+		f, err := os.Open(backups[0])
+		assert.NoError(t, err)
+		defer f.Close()
+		return Restore(ctx, dir, f, overwrite)
+	}
+	keys := func(dir string) []string {
+		s := New[*testObject](ctx, dir)
+		assert.NoError(t, s.Init())
+		defer func() {
+			assert.NoError(t, s.Close())
+		}()
+		var keys []string
+		assert.NoError(t, s.(Iterator).Iterate(func(key string, _ []byte) error {
+			keys = append(keys, key)
+			return nil
+		}))
+		return keys
+	}
+
+	targetDir := t.TempDir()
+	target := New[*testObject](ctx, targetDir)
+	assert.NoError(t, target.Init())
+	assert.NoError(t, target.Save(ctx, &testObject{id: "existing", value: "value"}))
+	assert.NoError(t, target.Close())
+
+	// the existing objects are left untouched
+	assert.ErrorIs(t, restore(targetDir, false), ErrNotEmpty)
+	assert.Equal(t, []string{"existing"}, keys(targetDir))
+
+	// unless overwritten
+	assert.NoError(t, restore(targetDir, true))
+	assert.Equal(t, []string{"restored"}, keys(targetDir))
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ankorstore/mq-lease-service/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	operationSave    = "save"
+	operationHydrate = "hydrate"
+
+	resultOk    = "ok"
+	resultError = "error"
+)
+
+type storageWithMetrics[T object] struct {
+	Storage[T]
+	operationDuration *prometheus.HistogramVec
+}
+
+// WithMetrics decorates the provided storage, observing the duration of its Save and Hydrate operations
+func WithMetrics[T object](s Storage[T], metricsService metrics.Metrics) Storage[T] {
+	return &storageWithMetrics[T]{
+		Storage: s,
+		operationDuration: metricsService.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "storage_operation_duration_seconds",
+			Help:    "Duration of the storage operations by operation and result.",
+			Buckets: metrics.GetDefaultDurationBuckets(),
+		}, []string{"operation", "result"}),
+	}
+}
+
+// Hydrate hydrates the provided object with data coming from the decorated storage, and observes the operation duration
+func (s *storageWithMetrics[T]) Hydrate(ctx context.Context, defaultObj T) error {
+	start := time.Now()
+	err := s.Storage.Hydrate(ctx, defaultObj)
+	s.observe(operationHydrate, start, err)
+	return err
+}
+
+// Save store the provided object in the decorated storage, and observes the operation duration
+func (s *storageWithMetrics[T]) Save(ctx context.Context, obj T) error {
+	start := time.Now()
+	err := s.Storage.Save(ctx, obj)
+	s.observe(operationSave, start, err)
+	return err
+}
+
+// Reload reloads the decorated storage, if it supports it
+func (s *storageWithMetrics[T]) Reload() error {
+	reloader, ok := s.Storage.(Reloader)
+	if !ok {
+		return errors.New("decorated storage can't be reloaded")
+	}
+	return reloader.Reload()
+}
+
+// Compact compacts the decorated storage, if it supports it
+func (s *storageWithMetrics[T]) Compact() (int, error) {
+	compactor, ok := s.Storage.(Compactor)
+	if !ok {
+		return 0, errors.New("decorated storage can't be compacted")
+	}
+	return compactor.Compact()
+}
+
+func (s *storageWithMetrics[T]) observe(operation string, start time.Time, err error) {
+	result := resultOk
+	if err != nil {
+		result = resultError
+	}
+	s.operationDuration.With(prometheus.Labels{
+		"operation": operation,
+		"result":    result,
+	}).Observe(time.Since(start).Seconds())
+}
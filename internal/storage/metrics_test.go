@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ankorstore/mq-lease-service/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+type testObject struct {
+	id    string
+	value string
+}
+
+func (o *testObject) GetIdentifier() string {
+	return o.id
+}
+
+func (o *testObject) Marshal() ([]byte, error) {
+	return []byte(o.value), nil
+}
+
+func (o *testObject) Unmarshal(b []byte) error {
+	o.value = string(b)
+	return nil
+}
+
+type failingStorage[T object] struct {
+	NullStorage[T]
+}
+
+func (s failingStorage[T]) Save(context.Context, T) error {
+	return errors.New("save failed")
+}
+
+// operationSampleCount returns the number of observations recorded by the storage operation histogram for the given labels
+func operationSampleCount(t *testing.T, gatherer prometheus.Gatherer, operation, result string) uint64 {
+	t.Helper()
+	families, err := gatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "aks_mq_lease_service_storage_operation_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["operation"] == operation && labels["result"] == result {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func newTestMetrics() (metrics.Metrics, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	return metrics.New(metrics.NewOpts{
+		PromRegisterer: registry,
+		PromGatherer:   registry,
+	}), registry
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := context.Background()
+	metricsService, registry := newTestMetrics()
+
+	s := WithMetrics(New[*testObject](ctx, t.TempDir()), metricsService)
+	assert.NoError(t, s.Init())
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	assert.NoError(t, s.Save(ctx, &testObject{id: "key", value: "value"}))
+	assert.Equal(t, uint64(1), operationSampleCount(t, registry, operationSave, resultOk))
+
+	obj := &testObject{id: "key"}
+	assert.NoError(t, s.Hydrate(ctx, obj))
+	assert.Equal(t, "value", obj.value)
+	assert.Equal(t, uint64(1), operationSampleCount(t, registry, operationHydrate, resultOk))
+
+	// health checks aren't observed
+	assert.True(t, s.HealthCheck(ctx, func() *testObject { return &testObject{id: "key"} }))
+	assert.Equal(t, uint64(1), operationSampleCount(t, registry, operationHydrate, resultOk))
+}
+
+func TestWithMetrics_Error(t *testing.T) {
+	ctx := context.Background()
+	metricsService, registry := newTestMetrics()
+
+	s := WithMetrics[*testObject](failingStorage[*testObject]{}, metricsService)
+	assert.Error(t, s.Save(ctx, &testObject{id: "key"}))
+	assert.Equal(t, uint64(1), operationSampleCount(t, registry, operationSave, resultError))
+	assert.Equal(t, uint64(0), operationSampleCount(t, registry, operationSave, resultOk))
+
+	_, ok := s.(Reloader)
+	assert.True(t, ok)
+	assert.Error(t, s.(Reloader).Reload())
+	_, ok = s.(Compactor)
+	assert.True(t, ok)
+	_, err := s.(Compactor).Compact()
+	assert.Error(t, err)
+}
@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -15,6 +18,12 @@ import (
 // we can improve the code in the future!
 const maxAge = 7 * 24 * time.Hour
 
+// maxOpenRetryDelay caps the (exponential) delay between 2 attempts to open the DB
+const maxOpenRetryDelay = 30 * time.Second
+
+// gcDiscardRatio is the ratio of discardable data a value log file must reach to be rewritten by the GC
+const gcDiscardRatio = 0.5
+
 type object interface {
 	// GetIdentifier returns key used in the K/V storage
 	GetIdentifier() string
@@ -24,6 +33,9 @@ type object interface {
 	Unmarshal([]byte) error
 }
 
+// ErrReadOnly is returned when trying to write in a read-only storage
+var ErrReadOnly = errors.New("storage is read-only")
+
 type badgerLogger struct {
 	ctx context.Context
 }
@@ -66,39 +78,313 @@ type Storage[T object] interface {
 	HealthCheck(ctx context.Context, hydrationSample func() T) bool
 }
 
+// Iterator is implemented by the storages able to list all their stored objects (e.g. for backups)
+type Iterator interface {
+	// Iterate calls fn with the key and the raw (marshalled) value of each stored object, sorted by key
+	Iterate(fn func(key string, value []byte) error) error
+}
+
+// Reloader is implemented by the storages able to reopen their underlying DB, to pick up changes made by another
+// process (read-only storages)
+type Reloader interface {
+	// Reload closes and reopens the storage
+	Reload() error
+}
+
+// Compactor is implemented by the storages able to reclaim the disk space of their deleted/overwritten objects on
+// demand
+type Compactor interface {
+	// Compact reclaims the disk space it can, and returns the number of rewritten files
+	Compact() (int, error)
+}
+
 type storageImpl[T object] struct {
+	// ctx is only used for logging
+	ctx     context.Context
 	options badger.Options
-	db      *badger.DB
-	setup   sync.Once
+	// open opens the badger DB (swapped in tests)
+	open func(opt badger.Options) (*badger.DB, error)
+	// openRetries is the number of extra attempts to open the DB, openRetryInterval the delay before the first one
+	// (doubled for each of the next ones)
+	openRetries       int
+	openRetryInterval time.Duration
+	// keyPrefix namespaces the keys of the stored objects
+	keyPrefix string
+	// backupDir is the directory a backup of the DB is written to on close (disabled if empty)
+	backupDir string
+	// mutex guards the db connection, which can be swapped by Reload
+	mutex    sync.RWMutex
+	db       *badger.DB
+	setup    sync.Once
+	teardown sync.Once
+	closed   bool
+
+	// gcInterval is the interval between 2 value log GC runs (disabled if not positive)
+	gcInterval time.Duration
+	gcRunning  atomic.Bool
+	gcStop     chan struct{}
+	gcDone     chan struct{}
+}
+
+// Option allows to tweak the storage
+type Option func(s *storageSettings)
+
+type storageSettings struct {
+	gcInterval        time.Duration
+	openRetries       int
+	openRetryInterval time.Duration
+	keyPrefix         string
+	backupDir         string
+}
+
+// WithGCInterval runs the value log GC (reclaiming the disk space of the deleted/expired entries) on the given interval
+func WithGCInterval(interval time.Duration) Option {
+	return func(s *storageSettings) {
+		s.gcInterval = interval
+	}
+}
+
+// WithOpenRetry retries to open the DB (up to the given number of times) when it fails, for example because its volume
+// isn't mounted yet. The delay between 2 attempts starts at the given interval, and is doubled each time (up to 30s).
+func WithOpenRetry(retries int, interval time.Duration) Option {
+	return func(s *storageSettings) {
+		s.openRetries = retries
+		s.openRetryInterval = interval
+	}
+}
+
+// keyPrefixSeparator separates the key prefix from the identifier of the stored objects, so that a prefix can't match
+// the namespace of another one it is the beginning of (e.g. `team` and `team2`)
+const keyPrefixSeparator = "/"
+
+// WithKeyPrefix namespaces the keys of the stored objects with the given prefix (see ValidateKeyPrefix), so that
+// several instances can share the same storage without seeing each other's objects
+func WithKeyPrefix(prefix string) Option {
+	return func(s *storageSettings) {
+		if prefix != "" {
+			s.keyPrefix = prefix + keyPrefixSeparator
+		}
+	}
+}
+
+// ValidateKeyPrefix checks that the given key prefix can't overlap with another one: it can't contain the separator
+// (`team` would otherwise see the objects of `team/a`)
+func ValidateKeyPrefix(prefix string) error {
+	if strings.Contains(prefix, keyPrefixSeparator) {
+		return fmt.Errorf("the storage key prefix can't contain %q", keyPrefixSeparator)
+	}
+	return nil
+}
+
+// WithBackupOnClose writes a backup of the DB (see Restore) to a new timestamped file of the given directory when the
+// storage is closed, before closing the DB. Ignored by the read-only storages.
+func WithBackupOnClose(dir string) Option {
+	return func(s *storageSettings) {
+		s.backupDir = dir
+	}
+}
+
+func newSettings(options []Option) *storageSettings {
+	settings := &storageSettings{}
+	for _, option := range options {
+		option(settings)
+	}
+	return settings
 }
 
 // New returns an instance of the storage (it doesn't open it)
-func New[T object](ctx context.Context, persistentStateDir string) Storage[T] {
-	options := badger.DefaultOptions(persistentStateDir)
-	options.Logger = newBadgerLogger(ctx)
+func New[T object](ctx context.Context, persistentStateDir string, options ...Option) Storage[T] {
+	settings := newSettings(options)
+
+	badgerOptions := badger.DefaultOptions(persistentStateDir)
+	badgerOptions.Logger = newBadgerLogger(ctx)
+
+	return &storageImpl[T]{
+		ctx:               ctx,
+		options:           badgerOptions,
+		open:              badger.Open,
+		openRetries:       settings.openRetries,
+		openRetryInterval: settings.openRetryInterval,
+		keyPrefix:         settings.keyPrefix,
+		backupDir:         settings.backupDir,
+		gcInterval:        settings.gcInterval,
+	}
+}
+
+// NewReadOnly returns an instance of the storage opening the DB in read-only mode (it doesn't open it).
+// Badger is locking its directory, so the DB can't be opened while another process is writing in it: the directory is
+// expected to be a replica of the writer one. The GC interval option is ignored (the value log can't be rewritten).
+func NewReadOnly[T object](ctx context.Context, persistentStateDir string, options ...Option) Storage[T] {
+	settings := newSettings(options)
+
+	badgerOptions := badger.DefaultOptions(persistentStateDir).WithReadOnly(true)
+	badgerOptions.Logger = newBadgerLogger(ctx)
+
+	return &storageImpl[T]{
+		ctx:               ctx,
+		options:           badgerOptions,
+		open:              badger.Open,
+		openRetries:       settings.openRetries,
+		openRetryInterval: settings.openRetryInterval,
+		keyPrefix:         settings.keyPrefix,
+	}
+}
 
-	return &storageImpl[T]{options: options}
+// NewInMemory returns an instance of the storage keeping its DB in memory only (it doesn't open it): nothing is written
+// on disk, and the stored objects are lost on close. Meant for the tests and the ephemeral runs, the objects still go
+// through the real (de)serialization (unless backed up on close). The GC interval option is ignored (there is no value
+// log on disk).
+func NewInMemory[T object](ctx context.Context, options ...Option) Storage[T] {
+	settings := newSettings(options)
+
+	badgerOptions := badger.DefaultOptions("").WithInMemory(true)
+	badgerOptions.Logger = newBadgerLogger(ctx)
+
+	return &storageImpl[T]{
+		ctx:               ctx,
+		options:           badgerOptions,
+		open:              badger.Open,
+		openRetries:       settings.openRetries,
+		openRetryInterval: settings.openRetryInterval,
+		keyPrefix:         settings.keyPrefix,
+		backupDir:         settings.backupDir,
+	}
 }
 
 // Init initialises the storage (opens it)
 func (s *storageImpl[T]) Init() error {
 	var err error
 	s.setup.Do(func() {
-		s.db, err = badger.Open(s.options)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.db, err = s.openWithRetry()
 		if err != nil {
 			err = fmt.Errorf("failed to open badger connection: %w", err)
+			return
+		}
+		// the read-only storages can't rewrite their value log
+		if s.gcInterval > 0 && !s.options.ReadOnly {
+			s.gcStop = make(chan struct{})
+			s.gcDone = make(chan struct{})
+			go s.runGC()
 		}
 	})
 	return err
 }
 
-// Close gracefully terminates the storage.
-func (s *storageImpl[T]) Close() error {
-	err := s.db.Close()
-	if err != nil {
-		return fmt.Errorf("failed to close badger connection: %w", err)
+// openWithRetry opens the DB, retrying with an exponential backoff on failure (up to the configured number of retries)
+func (s *storageImpl[T]) openWithRetry() (*badger.DB, error) {
+	delay := s.openRetryInterval
+	for attempt := 0; ; attempt++ {
+		db, err := s.open(s.options)
+		if err == nil || attempt >= s.openRetries {
+			return db, err
+		}
+		log.Ctx(s.ctx).
+			Warn().
+			Err(err).
+			Int("attempt", attempt+1).
+			Dur("retry_in", delay).
+			Msg("Failed to open the storage, retrying")
+		time.Sleep(delay)
+		delay = min(2*delay, maxOpenRetryDelay)
+	}
+}
+
+// runGC periodically runs the value log GC, until the storage is closed
+func (s *storageImpl[T]) runGC() {
+	defer close(s.gcDone)
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.gcStop:
+			return
+		case <-ticker.C:
+			if _, err := s.collectGarbage(); err != nil {
+				log.Ctx(s.ctx).Warn().Err(err).Msg("Storage value log GC failed")
+			}
+		}
 	}
-	return nil
+}
+
+// collectGarbage rewrites the value log files as long as there is enough space to reclaim, and returns the number of
+// rewritten files. It's a no-op if a collection is already running.
+func (s *storageImpl[T]) collectGarbage() (int, error) {
+	if !s.gcRunning.CompareAndSwap(false, true) {
+		return 0, nil
+	}
+	defer s.gcRunning.Store(false)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed || s.db == nil {
+		return 0, nil
+	}
+
+	// badger only refreshes the sizes periodically, the reclaimed space is an estimation
+	_, vlogSizeBefore := s.db.Size()
+	rewritten := 0
+	for {
+		err := s.db.RunValueLogGC(gcDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			break
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	_, vlogSizeAfter := s.db.Size()
+
+	log.Ctx(s.ctx).
+		Info().
+		Int("rewritten_files", rewritten).
+		Int64("vlog_size_bytes", vlogSizeAfter).
+		Int64("reclaimed_bytes", max(vlogSizeBefore-vlogSizeAfter, 0)).
+		Msg("Storage value log GC completed")
+	return rewritten, nil
+}
+
+// Compact runs the value log GC right away (see collectGarbage). Not supported by the read-only storages, and a no-op
+// for the in-memory ones (no disk space to reclaim).
+func (s *storageImpl[T]) Compact() (int, error) {
+	if s.options.ReadOnly {
+		return 0, errors.New("read-only storages can't be compacted")
+	}
+	if s.options.InMemory {
+		return 0, nil
+	}
+	return s.collectGarbage()
+}
+
+// Close gracefully terminates the storage, writing a backup of the DB first when configured (a failed backup doesn't
+// prevent the DB from being closed).
+// It is idempotent (only the first call closes the DB) and can safely be called before Init.
+func (s *storageImpl[T]) Close() error {
+	var err error
+	s.teardown.Do(func() {
+		// stop the GC first, it's holding the read lock while running
+		if s.gcStop != nil {
+			close(s.gcStop)
+			<-s.gcDone
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.closed = true
+		if s.db == nil {
+			return
+		}
+		if s.backupDir != "" && !s.options.ReadOnly {
+			if backupErr := s.backup(); backupErr != nil {
+				err = fmt.Errorf("failed to back up the storage: %w", backupErr)
+			}
+		}
+		if closeErr := s.db.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close badger connection: %w", closeErr))
+		}
+	})
+	return err
 }
 
 // Hydrate hydrates the provided object with data coming from the storage
@@ -108,6 +394,8 @@ func (s *storageImpl[T]) Hydrate(ctx context.Context, defaultObj T) error {
 
 	id := defaultObj.GetIdentifier()
 
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	txn := s.db.NewTransaction(false)
 	defer func(ctx context.Context) {
 		nestedErr := txn.Commit()
@@ -116,7 +404,7 @@ func (s *storageImpl[T]) Hydrate(ctx context.Context, defaultObj T) error {
 		}
 	}(ctx)
 
-	res, err := txn.Get([]byte(id))
+	res, err := txn.Get(s.key(id))
 	if err == badger.ErrKeyNotFound {
 		log.Ctx(ctx).Debug().Msg("Not found, passing default object")
 		return nil
@@ -134,6 +422,9 @@ func (s *storageImpl[T]) Hydrate(ctx context.Context, defaultObj T) error {
 // Save store the provided object in the storage
 // the provided object should at least be able to return a non-null and unique Identifier (via the GetIdentifier() method)
 func (s *storageImpl[T]) Save(_ context.Context, obj T) error {
+	if s.options.ReadOnly {
+		return ErrReadOnly
+	}
 	var err error
 	id := obj.GetIdentifier()
 	b, err := obj.Marshal()
@@ -141,8 +432,10 @@ func (s *storageImpl[T]) Save(_ context.Context, obj T) error {
 		return err
 	}
 
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	txn := s.db.NewTransaction(true)
-	entry := badger.NewEntry([]byte(id), b).WithTTL(maxAge)
+	entry := badger.NewEntry(s.key(id), b).WithTTL(maxAge)
 	err = txn.SetEntry(entry)
 	if err != nil {
 		txn.Discard()
@@ -153,11 +446,14 @@ func (s *storageImpl[T]) Save(_ context.Context, obj T) error {
 
 // HealthCheck verifies if the storage is connected and usable
 func (s *storageImpl[T]) HealthCheck(ctx context.Context, hydrationSample func() T) bool {
-	if s.db == nil {
+	s.mutex.RLock()
+	db := s.db
+	s.mutex.RUnlock()
+	if db == nil {
 		log.Ctx(ctx).Error().Msg("Storage healthcheck failed: db is nil")
 		return false
 	}
-	if s.db.IsClosed() {
+	if db.IsClosed() {
 		log.Ctx(ctx).Error().Msg("Storage healthcheck failed: db is closed")
 		return false
 	}
@@ -169,6 +465,56 @@ func (s *storageImpl[T]) HealthCheck(ctx context.Context, hydrationSample func()
 	return true
 }
 
+// Iterate calls fn with the key and the raw (marshalled) value of each stored object, sorted by key. The value is only
+// valid during the call. Only the objects of the storage namespace (key prefix) are listed, with their unprefixed key.
+func (s *storageImpl[T]) Iterate(fn func(key string, value []byte) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(s.keyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := strings.TrimPrefix(string(item.Key()), s.keyPrefix)
+			if err := item.Value(func(val []byte) error {
+				return fn(key, val)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// key returns the storage key of the object with the given identifier
+func (s *storageImpl[T]) key(id string) []byte {
+	return []byte(s.keyPrefix + id)
+}
+
+// Reload closes and reopens the DB, to pick up the changes made to the underlying files since it was opened.
+// Only supported by the read-only storages.
+func (s *storageImpl[T]) Reload() error {
+	if !s.options.ReadOnly {
+		return errors.New("only read-only storages can be reloaded")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errors.New("storage is closed")
+	}
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("failed to close badger connection: %w", err)
+	}
+	db, err := s.open(s.options)
+	if err != nil {
+		return fmt.Errorf("failed to open badger connection: %w", err)
+	}
+	s.db = db
+	return nil
+}
+
 // NullStorage is a dummy object honoring the Storage interface, and can be used in unit tests
 // as a drop-in replacement in the dependencies if the test don't actually care about storage actions.
 type NullStorage[T object] struct{}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorage_CloseTwice(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir())
+	assert.NoError(t, s.Init())
+
+	assert.NoError(t, s.Close())
+	assert.NotPanics(t, func() {
+		assert.NoError(t, s.Close())
+	})
+	assert.False(t, s.HealthCheck(ctx, func() *testObject { return &testObject{id: "key"} }))
+}
+
+func TestStorage_CloseBeforeInit(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir())
+
+	assert.NotPanics(t, func() {
+		assert.NoError(t, s.Close())
+	})
+	assert.False(t, s.HealthCheck(ctx, func() *testObject { return &testObject{id: "key"} }))
+}
+
+func TestStorage_CollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir())
+	assert.NoError(t, s.Init())
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+
+	// populate the DB, overwriting the entries to leave some garbage behind
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, s.Save(ctx, &testObject{id: "key-" + strconv.Itoa(i), value: strings.Repeat("v", 1024)}))
+		}
+	}
+
+	impl, ok := s.(*storageImpl[*testObject])
+	assert.True(t, ok)
+	_, err := impl.collectGarbage()
+	assert.NoError(t, err)
+
+	obj := &testObject{id: "key-1"}
+	assert.NoError(t, s.Hydrate(ctx, obj))
+	assert.Equal(t, strings.Repeat("v", 1024), obj.value)
+}
+
+func TestStorage_GCLoop(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir(), WithGCInterval(time.Millisecond))
+	assert.NoError(t, s.Init())
+
+	impl, ok := s.(*storageImpl[*testObject])
+	assert.True(t, ok)
+	assert.NotNil(t, impl.gcStop)
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Save(ctx, &testObject{id: "key-" + strconv.Itoa(i), value: "value"}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// closing the storage stops the GC loop
+	assert.NoError(t, s.Close())
+	select {
+	case <-impl.gcDone:
+	default:
+		t.Error("GC loop still running after the storage has been closed")
+	}
+}
+
+func TestStorage_GCDisabledOnReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// a read-only storage can only be opened on an existing DB
+	writer := New[*testObject](ctx, dir)
+	assert.NoError(t, writer.Init())
+	assert.NoError(t, writer.Close())
+
+	s := NewReadOnly[*testObject](ctx, dir)
+	impl, ok := s.(*storageImpl[*testObject])
+	assert.True(t, ok)
+	impl.gcInterval = time.Millisecond
+	assert.NoError(t, s.Init())
+	assert.Nil(t, impl.gcStop)
+	_, err := s.(Compactor).Compact()
+	assert.Error(t, err)
+	assert.NoError(t, s.Close())
+}
+
+// failingOpener fails the first attempts to open the DB, then opens it
+func failingOpener(failures int, attempts *int) func(opt badger.Options) (*badger.DB, error) {
+	return func(opt badger.Options) (*badger.DB, error) {
+		*attempts++
+		if *attempts <= failures {
+			return nil, errors.New("volume not mounted")
+		}
+		return badger.Open(opt)
+	}
+}
+
+func TestStorage_InitRetry(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir(), WithOpenRetry(3, time.Millisecond))
+	impl, ok := s.(*storageImpl[*testObject])
+	assert.True(t, ok)
+	attempts := 0
+	impl.open = failingOpener(2, &attempts)
+
+	assert.NoError(t, s.Init())
+	defer func() {
+		assert.NoError(t, s.Close())
+	}()
+	assert.Equal(t, 3, attempts)
+	assert.True(t, s.HealthCheck(ctx, func() *testObject { return &testObject{id: "key"} }))
+}
+
+func TestStorage_InitRetryExhausted(t *testing.T) {
+	ctx := context.Background()
+	s := New[*testObject](ctx, t.TempDir(), WithOpenRetry(1, time.Millisecond))
+	impl, ok := s.(*storageImpl[*testObject])
+	assert.True(t, ok)
+	attempts := 0
+	impl.open = failingOpener(2, &attempts)
+
+	assert.ErrorContains(t, s.Init(), "volume not mounted")
+	assert.Equal(t, 2, attempts)
+	assert.NoError(t, s.Close())
+}
+
+func TestStorage_InMemory(t *testing.T) {
+	ctx := context.Background()
+	s := NewInMemory[*testObject](ctx, WithKeyPrefix("ns:"))
+	assert.NoError(t, s.Init())
+	assert.True(t, s.HealthCheck(ctx, func() *testObject { return &testObject{id: "key"} }))
+	assert.NoError(t, s.Save(ctx, &testObject{id: "key-1", value: "value-1"}))
+	obj := &testObject{id: "key-1"}
+	assert.NoError(t, s.Hydrate(ctx, obj))
+	assert.Equal(t, "value-1", obj.value)
+
+	var keys []string
+	assert.NoError(t, s.(Iterator).Iterate(func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"key-1"}, keys)
+
+	// there is nothing to reclaim on disk
+	compacted, err := s.(Compactor).Compact()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, compacted)
+	assert.NoError(t, s.Close())
+
+	// the objects are gone with the DB
+	s = NewInMemory[*testObject](ctx, WithKeyPrefix("ns:"))
+	assert.NoError(t, s.Init())
+	obj = &testObject{id: "key-1"}
+	assert.NoError(t, s.Hydrate(ctx, obj))
+	assert.Equal(t, "", obj.value)
+	assert.NoError(t, s.Close())
+}
+
+func TestStorage_KeyPrefix(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := New[*testObject](ctx, dir, WithKeyPrefix("ns-a:"))
+	assert.NoError(t, s.Init())
+	assert.NoError(t, s.Save(ctx, &testObject{id: "key-1", value: "value-a"}))
+	assert.NoError(t, s.Close())
+
+	// same directory, other namespace
+	s = New[*testObject](ctx, dir, WithKeyPrefix("ns-b:"))
+	assert.NoError(t, s.Init())
+	obj := &testObject{id: "key-1"}
+	assert.NoError(t, s.Hydrate(ctx, obj))
+	assert.Equal(t, "", obj.value)
+	assert.NoError(t, s.Save(ctx, &testObject{id: "key-1", value: "value-b"}))
+	var keys []string
+	assert.NoError(t, s.(Iterator).Iterate(func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"key-1"}, keys)
+	assert.NoError(t, s.Close())
+
+	// each namespace is seeing its own object
+	for prefix, expected := range map[string]string{"ns-a:": "value-a", "ns-b:": "value-b"} {
+		ro := NewReadOnly[*testObject](ctx, dir, WithKeyPrefix(prefix))
+		assert.NoError(t, ro.Init())
+		obj := &testObject{id: "key-1"}
+		assert.NoError(t, ro.Hydrate(ctx, obj))
+		assert.Equal(t, expected, obj.value)
+		assert.NoError(t, ro.Close())
+	}
+}
+
+func TestStorage_KeyPrefix_Overlap(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, prefix := range []string{"team", "team2"} {
+		s := New[*testObject](ctx, dir, WithKeyPrefix(prefix))
+		assert.NoError(t, s.Init())
+		assert.NoError(t, s.Save(ctx, &testObject{id: "key-1", value: prefix}))
+		assert.NoError(t, s.Close())
+	}
+
+	// a prefix isn't matching the namespace of the ones it is the beginning of
+	s := NewReadOnly[*testObject](ctx, dir, WithKeyPrefix("team"))
+	assert.NoError(t, s.Init())
+	values := map[string]string{}
+	assert.NoError(t, s.(Iterator).Iterate(func(key string, value []byte) error {
+		values[key] = string(value)
+		return nil
+	}))
+	assert.Len(t, values, 1)
+	assert.Contains(t, values, "key-1")
+	assert.NoError(t, s.Close())
+
+	assert.NoError(t, ValidateKeyPrefix("team"))
+	assert.Error(t, ValidateKeyPrefix("team/a"))
+}
+
+func TestStorage_Iterate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := New[*testObject](ctx, dir)
+	assert.NoError(t, s.Init())
+	for _, id := range []string{"key-2", "key-1", "key-3"} {
+		assert.NoError(t, s.Save(ctx, &testObject{id: id, value: "value-" + id}))
+	}
+	assert.NoError(t, s.Close())
+
+	// the objects can be listed from a read-only storage, sorted by key
+	ro := NewReadOnly[*testObject](ctx, dir)
+	assert.NoError(t, ro.Init())
+	defer func() {
+		assert.NoError(t, ro.Close())
+	}()
+	iterator, ok := ro.(Iterator)
+	assert.True(t, ok)
+
+	var keys, values []string
+	assert.NoError(t, iterator.Iterate(func(key string, value []byte) error {
+		keys = append(keys, key)
+		values = append(values, string(value))
+		return nil
+	}))
+	assert.Equal(t, []string{"key-1", "key-2", "key-3"}, keys)
+	assert.Equal(t, []string{"value-key-1", "value-key-2", "value-key-3"}, values)
+
+	// the callback errors are stopping the iteration
+	errStop := errors.New("stop")
+	calls := 0
+	assert.ErrorIs(t, iterator.Iterate(func(string, []byte) error {
+		calls++
+		return errStop
+	}), errStop)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,137 @@
+// Package sim replays a recorded sequence of acquire/release events against a real lease provider (driven by a fake
+// clock), so the impact of a configuration change (stabilize duration, expected request count...) can be evaluated
+// before rolling it out.
+package sim
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/pointer" //nolint
+)
+
+type EventType string
+
+const (
+	EventAcquire EventType = "acquire"
+	EventRelease EventType = "release"
+)
+
+// Event is a recorded call made to the lease provider
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     EventType `json:"type"`
+	HeadSHA  string    `json:"head_sha"`
+	HeadRef  string    `json:"head_ref"`
+	Priority int       `json:"priority"`
+	// Status is the reported status, only used by release events (success|failure)
+	Status string `json:"status,omitempty"`
+}
+
+// Batch describes a lease granted during the simulation
+type Batch struct {
+	Winner         string    `json:"winner"`
+	WinnerPriority int       `json:"winner_priority"`
+	StartedAt      time.Time `json:"started_at"`
+	AcquiredAt     time.Time `json:"acquired_at"`
+	// WaitTime is the time elapsed between the first event of the batch and the lease being granted
+	WaitTime time.Duration `json:"wait_time"`
+	// Outcome is the status reported when releasing the lease (empty if it was never released)
+	Outcome string `json:"outcome,omitempty"`
+}
+
+// Report is the outcome of a simulation
+type Report struct {
+	Batches []*Batch `json:"batches"`
+	// Rejected is the number of events the provider returned an error for
+	Rejected int `json:"rejected"`
+}
+
+// Run replays the events (sorted by time) against a lease provider configured with the given options.
+// The clock and storage options are overridden: the provider is driven by a fake clock following the events
+// timestamps, and its state is not persisted.
+func Run(ctx context.Context, opts lease.ProviderOpts, events []Event) (*Report, error) {
+	report := &Report{Batches: []*Batch{}}
+	if len(events) == 0 {
+		return report, nil
+	}
+
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+
+	clk := clocktesting.NewFakePassiveClock(sorted[0].Time)
+	opts.Clock = clk
+	opts.Storage = nil
+	provider := lease.NewLeaseProvider(opts)
+
+	var batchStartedAt *time.Time
+	var current *Batch
+	for _, event := range sorted {
+		eventTime := event.Time
+		clk.SetTime(eventTime)
+
+		req := &lease.Request{
+			HeadSHA:  event.HeadSHA,
+			HeadRef:  event.HeadRef,
+			Priority: event.Priority,
+		}
+
+		switch event.Type {
+		case EventAcquire:
+			res, err := provider.Acquire(ctx, req)
+			if err != nil {
+				report.Rejected++
+				continue
+			}
+			switch pointer.StringDeref(res.Status, lease.StatusPending) {
+			case lease.StatusPending:
+				// first request waiting for a lease: a new batch starts
+				if batchStartedAt == nil {
+					batchStartedAt = &eventTime
+				}
+			case lease.StatusAcquired:
+				if current != nil && current.Winner == res.HeadSHA {
+					continue
+				}
+				startedAt := eventTime
+				if batchStartedAt != nil {
+					startedAt = *batchStartedAt
+				}
+				current = &Batch{
+					Winner:         res.HeadSHA,
+					WinnerPriority: res.Priority,
+					StartedAt:      startedAt,
+					AcquiredAt:     eventTime,
+					WaitTime:       eventTime.Sub(startedAt),
+				}
+				report.Batches = append(report.Batches, current)
+				batchStartedAt = nil
+			}
+		case EventRelease:
+			req.Status = pointer.String(event.Status)
+			res, err := provider.Release(ctx, req)
+			if err != nil {
+				report.Rejected++
+				continue
+			}
+			if current != nil && current.Winner == res.HeadSHA {
+				current.Outcome = event.Status
+			}
+			// on failure, the remaining requests are waiting for the lease to be granted again
+			if event.Status == lease.StatusFailure {
+				batchStartedAt = &eventTime
+			}
+		default:
+			return nil, fmt.Errorf("unknown event type `%s` (head sha: %s)", event.Type, event.HeadSHA)
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package sim
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ankorstore/mq-lease-service/internal/lease"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	start, _ := time.Parse(time.RFC3339, "2023-01-01T10:00:00Z")
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	ref := "gh-readonly-queue/main/pr-1-abc"
+
+	events := []Event{
+		// 1st batch: only 2 of the 3 expected requests are coming, the lease is granted after the stabilize duration
+		{Time: at(0), Type: EventAcquire, HeadSHA: "sha1", HeadRef: ref, Priority: 1},
+		{Time: at(5), Type: EventAcquire, HeadSHA: "sha2", HeadRef: ref, Priority: 2},
+		{Time: at(20), Type: EventAcquire, HeadSHA: "sha1", HeadRef: ref, Priority: 1},
+		{Time: at(40), Type: EventAcquire, HeadSHA: "sha2", HeadRef: ref, Priority: 2},
+		// the winner fails, the remaining request gets the lease on its next poll
+		{Time: at(50), Type: EventRelease, HeadSHA: "sha2", HeadRef: ref, Priority: 2, Status: lease.StatusFailure},
+		{Time: at(60), Type: EventAcquire, HeadSHA: "sha1", HeadRef: ref, Priority: 1},
+		{Time: at(95), Type: EventRelease, HeadSHA: "sha1", HeadRef: ref, Priority: 1, Status: lease.StatusSuccess},
+		// 2nd batch: the expected request count is reached, the lease is granted right away
+		{Time: at(100), Type: EventAcquire, HeadSHA: "sha3", HeadRef: ref, Priority: 1},
+		{Time: at(101), Type: EventAcquire, HeadSHA: "sha4", HeadRef: ref, Priority: 2},
+		{Time: at(102), Type: EventAcquire, HeadSHA: "sha5", HeadRef: ref, Priority: 3},
+		// a new request is coming while the lease is held: it's rejected
+		{Time: at(103), Type: EventAcquire, HeadSHA: "sha6", HeadRef: ref, Priority: 4},
+	}
+
+	report, err := Run(context.Background(), lease.ProviderOpts{
+		StabilizeDuration:    30 * time.Second,
+		TTL:                  time.Hour,
+		ExpectedRequestCount: 3,
+	}, events)
+	assert.NoError(t, err)
+
+	assert.Equal(t, &Report{
+		Batches: []*Batch{
+			{Winner: "sha2", WinnerPriority: 2, StartedAt: at(0), AcquiredAt: at(40), WaitTime: 40 * time.Second, Outcome: lease.StatusFailure},
+			{Winner: "sha1", WinnerPriority: 1, StartedAt: at(50), AcquiredAt: at(60), WaitTime: 10 * time.Second, Outcome: lease.StatusSuccess},
+			{Winner: "sha5", WinnerPriority: 3, StartedAt: at(100), AcquiredAt: at(102), WaitTime: 2 * time.Second},
+		},
+		Rejected: 1,
+	}, report)
+}
+
+func TestRun_unknownEventType(t *testing.T) {
+	_, err := Run(context.Background(), lease.ProviderOpts{}, []Event{{Type: "unknown"}})
+	assert.Error(t, err)
+}
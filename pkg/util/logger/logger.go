@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -29,6 +30,12 @@ type NewOpts struct {
 	AppInfo AppInfo
 	Debug   bool
 	JSON    bool
+	// DebugSampleBurst & DebugSamplePeriod rate-limit the debug logs: only DebugSampleBurst of them are written per
+	// DebugSamplePeriod, the next ones being dropped (no sampling if DebugSampleBurst is zero)
+	DebugSampleBurst  uint32
+	DebugSamplePeriod time.Duration
+	// Output is where the logs are written (defaults to Stderr)
+	Output io.Writer
 }
 
 func New(opts NewOpts) zerolog.Logger {
@@ -36,8 +43,11 @@ func New(opts NewOpts) zerolog.Logger {
 	var logLevel zerolog.Level
 
 	logOutput = os.Stderr
+	if opts.Output != nil {
+		logOutput = opts.Output
+	}
 	if !opts.JSON {
-		logOutput = zerolog.ConsoleWriter{Out: os.Stderr}
+		logOutput = zerolog.ConsoleWriter{Out: logOutput}
 	}
 
 	logLevel = zerolog.InfoLevel
@@ -46,12 +56,20 @@ func New(opts NewOpts) zerolog.Logger {
 	}
 
 	// Default options that are overwritten by flags
-	return zerolog.New(logOutput). // Stderr by default (k8s compat)
-					Level(logLevel).      // info level by default
-					Hook(locationHook{}). // Add caller information
-					With().
-					Timestamp().                             // Add timestamp to log
-					Str("app", opts.AppInfo.GetAppName()).   // Pass app name to context
-					Str("build_tag", opts.AppInfo.GetTag()). // Pass tag to context
-					Logger()
+	logger := zerolog.New(logOutput). // Stderr by default (k8s compat)
+						Level(logLevel).      // info level by default
+						Hook(locationHook{}). // Add caller information
+						With().
+						Timestamp().                             // Add timestamp to log
+						Str("app", opts.AppInfo.GetAppName()).   // Pass app name to context
+						Str("build_tag", opts.AppInfo.GetTag()). // Pass tag to context
+						Logger()
+
+	// the sampler is shared by the child loggers (e.g. the provider ones): the burst applies to all of them
+	if opts.DebugSampleBurst > 0 {
+		logger = logger.Sample(zerolog.LevelSampler{
+			DebugSampler: &zerolog.BurstSampler{Burst: opts.DebugSampleBurst, Period: opts.DebugSamplePeriod},
+		})
+	}
+	return logger
 }
@@ -0,0 +1,63 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAppInfo struct{}
+
+func (testAppInfo) GetAppName() string { return "test" }
+func (testAppInfo) GetCommit() string  { return "commit" }
+func (testAppInfo) GetTag() string     { return "tag" }
+
+func TestNew_DebugSampling(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := New(NewOpts{
+		AppInfo:           testAppInfo{},
+		Debug:             true,
+		JSON:              true,
+		DebugSampleBurst:  3,
+		DebugSamplePeriod: time.Hour,
+		Output:            output,
+	})
+	// the child loggers are sharing the sampling
+	child := logger.With().Str("provider_id", "owner:repo:main").Logger()
+
+	for i := 0; i < 5; i++ {
+		logger.Debug().Msg("debug")
+		child.Debug().Msg("debug")
+	}
+	// the other levels are never dropped
+	for i := 0; i < 5; i++ {
+		child.Info().Msg("info")
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	debugCount := 0
+	infoCount := 0
+	for _, line := range lines {
+		switch {
+		case strings.Contains(line, `"level":"debug"`):
+			debugCount++
+		case strings.Contains(line, `"level":"info"`):
+			infoCount++
+		}
+	}
+	assert.Equal(t, 3, debugCount)
+	assert.Equal(t, 5, infoCount)
+}
+
+func TestNew_NoSampling(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := New(NewOpts{AppInfo: testAppInfo{}, Debug: true, JSON: true, Output: output})
+
+	for i := 0; i < 10; i++ {
+		logger.Debug().Msg("debug")
+	}
+	assert.Equal(t, 10, strings.Count(output.String(), `"level":"debug"`))
+}